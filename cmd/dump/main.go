@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/fs"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"strings"
+	"syscall"
 	"time"
 
 	imap_backup "github.com/Schidstorm/imap-mirror/pkg/imap-backup"
@@ -23,6 +25,10 @@ type Config struct {
 	ImapAddr     string `json:"imapAddr" yaml:"imapAddr"`
 	ImapUsername string `json:"imapUsername" yaml:"imapUsername"`
 	ImapPassword string `json:"imapPassword" yaml:"imapPassword"`
+
+	OAuth2    *imapclient.OAuth2Config   `json:"oauth2" yaml:"oauth2"`
+	Transport imapclient.TransportConfig `json:"transport" yaml:"transport"`
+	Retry     imapclient.RetryConfig     `json:"retry" yaml:"retry"`
 }
 
 type LocalFS struct{}
@@ -47,6 +53,10 @@ func (LocalFS) Rename(oldpath, newpath string) error {
 	return os.Rename(oldpath, newpath)
 }
 
+func (LocalFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
 func (LocalFS) WriteFile(name string, data []byte, perm os.FileMode) error {
 	return os.WriteFile(name, data, perm)
 }
@@ -77,13 +87,89 @@ func main() {
 				return err
 			}
 
-			return runDump(cfg, outputDir)
+			format, err := cmd.Flags().GetString("format")
+			if err != nil {
+				return err
+			}
+
+			compression, err := cmd.Flags().GetString("compression")
+			if err != nil {
+				return err
+			}
+
+			nameTemplate, err := cmd.Flags().GetString("name-template")
+			if err != nil {
+				return err
+			}
+
+			backupFS, err := backupFSOf(cmd)
+			if err != nil {
+				return err
+			}
+
+			return runDump(cmd.Context(), cfg, backupFS, outputDir, imap_backup.Config{Format: format, Compression: compression, NameTemplate: nameTemplate})
 		},
 	}
 
 	flags := root.PersistentFlags()
 	flags.String("config.file", "config.yml", "config file path")
-	flags.String("output-dir", "dump", "local output directory for dumped .eml files")
+	flags.String("output-dir", "dump", "local output directory for dumped messages")
+	flags.String("key-file", "", "file with the key to encrypt the dump with")
+	flags.String("passphrase-env", "", "environment variable with the passphrase to encrypt the dump with")
+	root.Flags().String("format", imap_backup.FormatEml, "format of the dump: eml, maildir, mbox or cas")
+	root.Flags().String("compression", imap_backup.CompressionNone, "compression of the dumped messages: none, gzip or zstd")
+	root.Flags().String("name-template", imap_backup.DefaultNameTemplate, "template of the names of .eml files")
+
+	root.AddCommand(&cobra.Command{
+		Use:   "eml2mbox <eml-dir> <mbox-dir>",
+		Short: "Convert a tree of .eml files into one mbox per mailbox",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			backupFS, err := backupFSOf(cmd)
+			if err != nil {
+				return err
+			}
+
+			return imap_backup.ConvertEmlToMbox(backupFS, filepath.Clean(args[0]), filepath.Clean(args[1]))
+		},
+	})
+
+	root.AddCommand(&cobra.Command{
+		Use:   "mbox2eml <mbox-dir> <eml-dir>",
+		Short: "Convert mbox files into a tree of .eml files",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			backupFS, err := backupFSOf(cmd)
+			if err != nil {
+				return err
+			}
+
+			return imap_backup.ConvertMboxToEml(backupFS, filepath.Clean(args[0]), filepath.Clean(args[1]))
+		},
+	})
+
+	root.AddCommand(&cobra.Command{
+		Use:   "decrypt <encrypted-dir> <output-dir>",
+		Short: "Decrypt an encrypted backup or dump into a plain copy",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			encryptionCfg, err := encryptionConfigOf(cmd)
+			if err != nil {
+				return err
+			} else if encryptionCfg == nil {
+				return fmt.Errorf("key-file or passphrase-env is required")
+			}
+
+			encryptedFS, err := imap_backup.WithEncryption(LocalFS{}, encryptionCfg)
+			if err != nil {
+				return err
+			}
+
+			copied, err := imap_backup.CopyTree(encryptedFS, filepath.Clean(args[0]), LocalFS{}, filepath.Clean(args[1]))
+			log.WithField("files", copied).Info("decrypted files")
+			return err
+		},
+	})
 
 	root.AddCommand(&cobra.Command{
 		Use:   "config-structure",
@@ -105,7 +191,10 @@ func main() {
 		},
 	})
 
-	if err := root.Execute(); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if err := root.ExecuteContext(ctx); err != nil {
 		log.Error(err)
 	}
 }
@@ -121,45 +210,84 @@ func loadConfig(configFilePath string) (Config, error) {
 		return Config{}, err
 	}
 
-	if cfg.ImapAddr == "" || cfg.ImapUsername == "" || cfg.ImapPassword == "" {
-		return Config{}, fmt.Errorf("imapAddr, imapUsername and imapPassword are required")
+	if cfg.ImapAddr == "" || cfg.ImapUsername == "" || (cfg.ImapPassword == "" && cfg.OAuth2 == nil) {
+		return Config{}, fmt.Errorf("imapAddr, imapUsername and imapPassword or oauth2 are required")
 	}
 
 	return cfg, nil
 }
 
-func runDump(cfg Config, outputDir string) error {
+// encryptionConfigOf returns the encryption config of the flags or nil if no
+// key is given
+func encryptionConfigOf(cmd *cobra.Command) (*imap_backup.EncryptionConfig, error) {
+	keyFile, err := cmd.Flags().GetString("key-file")
+	if err != nil {
+		return nil, err
+	}
+
+	passphraseEnv, err := cmd.Flags().GetString("passphrase-env")
+	if err != nil {
+		return nil, err
+	}
+	return imap_backup.EncryptionConfigFromFlags(keyFile, passphraseEnv)
+}
+
+// backupFSOf returns the local file system, encrypted if a key is given
+func backupFSOf(cmd *cobra.Command) (imap_backup.FS, error) {
+	encryptionCfg, err := encryptionConfigOf(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return imap_backup.WithEncryption(LocalFS{}, encryptionCfg)
+}
+
+func runDump(ctx context.Context, cfg Config, backupFS imap_backup.FS, outputDir string, backupCfg imap_backup.Config) error {
 	outputDir = filepath.Clean(outputDir)
 	if outputDir == "" || outputDir == "." {
 		return fmt.Errorf("output-dir is required")
 	}
 
-	backupFS := LocalFS{}
-	backupClient := imap_backup.NewImapBackup(backupFS, imap_backup.Config{BackupDir: outputDir})
+	backupCfg.BackupDir = outputDir
+	backupClient, err := imap_backup.NewImapBackup(backupFS, backupCfg)
+	if err != nil {
+		return err
+	}
 
-	conn := imapclient.NewConnection(imapclient.ConnectionParams{
+	connParams := imapclient.ConnectionParams{
 		ImapAddr:     cfg.ImapAddr,
 		ImapUsername: cfg.ImapUsername,
 		ImapPassword: cfg.ImapPassword,
-	})
+		Transport:    cfg.Transport,
+		Retry:        cfg.Retry,
+	}
+	if cfg.OAuth2 != nil {
+		// the token cache is kept in the working directory
+		connParams.TokenSource = imapclient.NewOAuth2TokenSource(LocalFS{}, "", *cfg.OAuth2)
+		connParams.OAuth2Mechanism = cfg.OAuth2.Mechanism
+	}
+
+	conn := imapclient.NewConnection(connParams)
 	if err := conn.Open(); err != nil {
 		return err
 	}
 	defer conn.Close()
 
-	mailboxes, err := conn.List("", "*")
+	mailboxes, err := conn.List(ctx, "", "*")
 	if err != nil {
 		return err
 	}
 
+	// the backup maps the mailbox names to directories
+	backupClient.HandleMailboxes(mailboxes)
+
 	for _, mailbox := range mailboxes {
 		if mailbox == nil {
 			continue
 		}
 
-		localMailboxPath := normalizeMailboxPath(mailbox.Name, mailbox.Delimiter)
-
-		if err := dumpMailbox(conn, backupClient, mailbox.Name, localMailboxPath); err != nil {
+		if err := dumpMailbox(ctx, conn, backupClient, mailbox.Name); ctx.Err() != nil {
+			return ctx.Err()
+		} else if err != nil {
 			log.WithError(err).WithField("mailbox", mailbox.Name).Error("failed to dump mailbox")
 			continue
 		}
@@ -168,8 +296,8 @@ func runDump(cfg Config, outputDir string) error {
 	return nil
 }
 
-func dumpMailbox(conn *imapclient.Connection, backupClient *imap_backup.ImapBackup, mailbox string, localMailboxPath string) error {
-	status, err := conn.Select(mailbox, true)
+func dumpMailbox(ctx context.Context, conn *imapclient.Connection, backupClient *imap_backup.ImapBackup, mailbox string) error {
+	status, err := conn.Select(ctx, mailbox, true)
 	if err != nil {
 		return err
 	}
@@ -180,6 +308,8 @@ func dumpMailbox(conn *imapclient.Connection, backupClient *imap_backup.ImapBack
 	}
 
 	log.WithFields(log.Fields{"mailbox": mailbox, "messages": status.Messages}).Info("dumping mailbox")
+	backupClient.HandleUidValidity(mailbox, status.UidValidity)
+	fetchItems := conn.WithLabels(imapclient.FetchItems)
 
 	for start := uint32(1); start <= status.Messages; start += fetchBatchSize {
 		end := start + fetchBatchSize - 1
@@ -190,7 +320,7 @@ func dumpMailbox(conn *imapclient.Connection, backupClient *imap_backup.ImapBack
 		seqSet := new(imap.SeqSet)
 		seqSet.AddRange(start, end)
 
-		messages, err := conn.Fetch(seqSet, imapclient.FetchItems)
+		messages, err := conn.Fetch(ctx, seqSet, fetchItems)
 		if err != nil {
 			return err
 		}
@@ -200,27 +330,9 @@ func dumpMailbox(conn *imapclient.Connection, backupClient *imap_backup.ImapBack
 				continue
 			}
 
-			backupClient.HandleMessage(localMailboxPath, msg)
+			backupClient.HandleMessage(mailbox, msg)
 		}
 	}
 
 	return nil
 }
-
-func normalizeMailboxPath(mailboxName string, delimiter string) string {
-	normalized := strings.TrimSpace(mailboxName)
-	if normalized == "" {
-		return "INBOX"
-	}
-
-	if delimiter != "" && delimiter != "/" {
-		normalized = strings.ReplaceAll(normalized, delimiter, "/")
-	}
-
-	normalized = strings.Trim(normalized, "/")
-	if normalized == "" {
-		return "INBOX"
-	}
-
-	return normalized
-}
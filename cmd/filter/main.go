@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"os"
+	"os/signal"
+	"syscall"
 
 	filterscripts "github.com/Schidstorm/imap-mirror"
 	"github.com/Schidstorm/imap-mirror/pkg/cifs"
 	imapclient "github.com/Schidstorm/imap-mirror/pkg/imap-client"
 	imap_filter "github.com/Schidstorm/imap-mirror/pkg/imap-filter"
 	logger "github.com/Schidstorm/imap-mirror/pkg/log"
+	"github.com/Schidstorm/imap-mirror/pkg/storage"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v2"
@@ -15,6 +20,7 @@ import (
 
 type Config struct {
 	ClientConfig imapclient.Config `json:",inline" yaml:",inline"`
+	Storage      storage.Config    `json:"storage" yaml:"storage"`
 	CifsConfig   cifs.Config       `json:",inline" yaml:",inline"`
 }
 
@@ -38,22 +44,17 @@ func main() {
 				return err
 			}
 
-			cifsShare, err := cifs.OpenCifsShare(cifs.Config{
-				CifsAddr:     cfg.CifsConfig.CifsAddr,
-				CifsUsername: cfg.CifsConfig.CifsUsername,
-				CifsPassword: cfg.CifsConfig.CifsPassword,
-				CifsShare:    cfg.CifsConfig.CifsShare,
-			})
+			storageFS, err := storage.OpenOrCifs(cmd.Context(), cfg.Storage, cfg.CifsConfig)
 			if err != nil {
 				return err
 			}
-			defer cifsShare.Close()
+			defer storageFS.Close()
 
 			filterClient := imap_filter.NewFilterClient(
 				imap_filter.NewLuaFilter(imap_filter.LuaFilterConfig{}, filterscripts.ListFiles, filterscripts.ReadFile),
 			)
 
-			client := imapclient.NewClient(cifsShare, cfg.ClientConfig, []imapclient.HandleMessagePlugin{filterClient})
+			client := imapclient.NewClient(storageFS, cfg.ClientConfig, []imapclient.HandleMessagePlugin{filterClient})
 			defer client.Close()
 			err = client.Open()
 			if err != nil {
@@ -62,8 +63,8 @@ func main() {
 
 			filterClient.SetConnection(client.GetConnection())
 
-			err = client.Run()
-			if err != nil {
+			err = client.Run(cmd.Context())
+			if err != nil && !errors.Is(err, context.Canceled) {
 				log.Error(err)
 			}
 
@@ -103,7 +104,10 @@ func main() {
 		},
 	})
 
-	err := root.Execute()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	err := root.ExecuteContext(ctx)
 	if err != nil {
 		log.Error(err)
 	}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/Schidstorm/imap-mirror/pkg/cifs"
 	imap_backup "github.com/Schidstorm/imap-mirror/pkg/imap-backup"
 	imapclient "github.com/Schidstorm/imap-mirror/pkg/imap-client"
 	logger "github.com/Schidstorm/imap-mirror/pkg/log"
+	"github.com/Schidstorm/imap-mirror/pkg/storage"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v2"
@@ -14,6 +19,7 @@ import (
 
 type Config struct {
 	ClientConfig imapclient.Config  `json:",inline" yaml:",inline"`
+	Storage      storage.Config     `json:"storage" yaml:"storage"`
 	CifsConfig   cifs.Config        `json:",inline" yaml:",inline"`
 	BackupConfig imap_backup.Config `json:",inline" yaml:",inline"`
 }
@@ -38,20 +44,35 @@ func main() {
 				return err
 			}
 
-			cifsShare, err := cifs.OpenCifsShare(cifs.Config{
-				CifsAddr:     cfg.CifsConfig.CifsAddr,
-				CifsUsername: cfg.CifsConfig.CifsUsername,
-				CifsPassword: cfg.CifsConfig.CifsPassword,
-				CifsShare:    cfg.CifsConfig.CifsShare,
-			})
+			if !storage.AllowsColons(cfg.Storage) {
+				cfg.BackupConfig, err = cfg.BackupConfig.WithoutColons()
+				if err != nil {
+					return err
+				}
+			}
+			if !storage.AppendsInPlace(cfg.Storage) {
+				cfg.BackupConfig, err = cfg.BackupConfig.WithoutAppends()
+				if err != nil {
+					return err
+				}
+			}
+
+			storageFS, err := storage.OpenOrCifs(cmd.Context(), cfg.Storage, cfg.CifsConfig)
 			if err != nil {
 				return err
 			}
-			defer cifsShare.Close()
+			defer storageFS.Close()
 
-			backupClient := imap_backup.NewImapBackup(cifsShare, cfg.BackupConfig)
+			backupFS, err := imap_backup.WithEncryption(storageFS, cfg.BackupConfig.Encryption)
+			if err != nil {
+				return err
+			}
+			backupClient, err := imap_backup.NewImapBackup(backupFS, cfg.BackupConfig)
+			if err != nil {
+				return err
+			}
 
-			client := imapclient.NewClient(cifsShare, cfg.ClientConfig, []imapclient.HandleMessagePlugin{backupClient})
+			client := imapclient.NewClient(storageFS, cfg.ClientConfig, []imapclient.HandleMessagePlugin{backupClient})
 			defer client.Close()
 
 			err = client.Open()
@@ -59,8 +80,8 @@ func main() {
 				return err
 			}
 
-			err = client.Run()
-			if err != nil {
+			err = client.Run(cmd.Context())
+			if err != nil && !errors.Is(err, context.Canceled) {
 				log.Error(err)
 			}
 
@@ -103,7 +124,10 @@ func main() {
 		},
 	})
 
-	err := root.Execute()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	err := root.ExecuteContext(ctx)
 	if err != nil {
 		log.Error(err)
 	}
@@ -2,8 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
 	"text/template"
 	"time"
 
@@ -13,11 +19,16 @@ import (
 	imapclient "github.com/Schidstorm/imap-mirror/pkg/imap-client"
 	imap_filter "github.com/Schidstorm/imap-mirror/pkg/imap-filter"
 	logger "github.com/Schidstorm/imap-mirror/pkg/log"
+	"github.com/Schidstorm/imap-mirror/pkg/storage"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v2"
 )
 
+// shutdownTimeout must be shorter than the grace period of the container
+// runtime (30 seconds by default)
+const shutdownTimeout = 25 * time.Second
+
 type Config struct {
 	RunPeriode *time.Duration `json:"runPeriode" yaml:"runPeriode"`
 
@@ -29,6 +40,21 @@ type Config struct {
 	BackupStateFile         string `json:"backupStateFile" yaml:"backupStateFile"`
 	FilterLastMessageOffset uint32 `json:"filterLastMessageOffset" yaml:"filterLastMessageOffset"`
 
+	WatchMailboxes   []string      `json:"watchMailboxes" yaml:"watchMailboxes"`
+	FullSyncInterval time.Duration `json:"fullSyncInterval" yaml:"fullSyncInterval"`
+
+	FetchBatchSize     int           `json:"fetchBatchSize" yaml:"fetchBatchSize"`
+	FetchBatchWaitTime time.Duration `json:"fetchBatchWaitTime" yaml:"fetchBatchWaitTime"`
+	MaxBatchBytes      int64         `json:"maxBatchBytes" yaml:"maxBatchBytes"`
+	MaxMessageBytes    int64         `json:"maxMessageBytes" yaml:"maxMessageBytes"`
+
+	OAuth2    *imapclient.OAuth2Config   `json:"oauth2" yaml:"oauth2"`
+	Transport imapclient.TransportConfig `json:"transport" yaml:"transport"`
+	Retry     imapclient.RetryConfig     `json:"retry" yaml:"retry"`
+
+	// Storage selects the backend of the backup and the state by URL, the
+	// CIFS share is used without one
+	Storage      storage.Config     `json:"storage" yaml:"storage"`
 	CifsConfig   cifs.Config        `json:",inline" yaml:",inline"`
 	BackupConfig imap_backup.Config `json:",inline" yaml:",inline"`
 }
@@ -37,16 +63,17 @@ func main() {
 	logger.Configure(log.DebugLevel)
 	root := &cobra.Command{
 		RunE: func(cmd *cobra.Command, args []string) error {
-			for {
+			ctx := cmd.Context()
+			for ctx.Err() == nil {
 				cfg, err := loadConfig(cmd.Flag("config.file").Value.String())
 				if err != nil {
 					log.WithError(err).Error("Failed to load config. Retrying in 5 seconds")
-					time.Sleep(5 * time.Second)
+					sleep(ctx, 5*time.Second)
 					continue
 				}
 
-				err = daemon(cfg)
-				if err != nil {
+				err = daemon(ctx, cfg)
+				if err != nil && !errors.Is(err, context.Canceled) {
 					log.Error(err)
 				}
 
@@ -54,9 +81,10 @@ func main() {
 					break
 				}
 
-				time.Sleep(*cfg.RunPeriode)
+				sleep(ctx, *cfg.RunPeriode)
 			}
 
+			log.Info("stopped")
 			return nil
 		},
 	}
@@ -74,6 +102,7 @@ func main() {
 				StateDir:        "state",
 				FilterStateFile: "filter_state.json",
 				BackupStateFile: "backup_state.json",
+				WatchMailboxes:  []string{"INBOX"},
 
 				CifsConfig: cifs.Config{
 					CifsAddr:     "cifs.example.com:445",
@@ -97,12 +126,174 @@ func main() {
 		},
 	})
 
-	err := root.Execute()
+	gcCommand := &cobra.Command{
+		Use:   "gc",
+		Short: "Remove blobs of the content-addressed backup that no manifest references",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dryRun, err := cmd.Flags().GetBool("dry-run")
+			if err != nil {
+				return err
+			}
+
+			return withBackupShare(cmd, func(cfg Config, backupFS imap_backup.FS) error {
+				result, err := imap_backup.CollectGarbage(backupFS, cfg.BackupConfig.BackupDir, dryRun)
+				if err != nil {
+					return err
+				}
+
+				log.WithFields(log.Fields{
+					"blobs":        result.Blobs,
+					"removedBlobs": result.RemovedBlobs,
+					"freedBytes":   result.FreedBytes,
+					"dryRun":       dryRun,
+				}).Info("collected garbage")
+				return nil
+			})
+		},
+	}
+	gcCommand.Flags().Bool("dry-run", false, "only log the blobs that would be removed")
+	root.AddCommand(gcCommand)
+
+	root.AddCommand(&cobra.Command{
+		Use:   "migrate-cas",
+		Short: "Convert the .eml backup into the content-addressed format in place",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withBackupShare(cmd, func(cfg Config, backupFS imap_backup.FS) error {
+				migrated, err := imap_backup.MigrateEmlToCas(backupFS, cfg.BackupConfig.BackupDir)
+				log.WithField("messages", migrated).Info("migrated messages")
+				if err != nil {
+					return err
+				}
+
+				if cfg.BackupConfig.Format != imap_backup.FormatCas {
+					log.Warnf("set backupFormat to %s before the next backup", imap_backup.FormatCas)
+				}
+				return nil
+			})
+		},
+	})
+
+	migrateNamesCommand := &cobra.Command{
+		Use:   "migrate-names",
+		Short: "Rename the .eml files of the backup to the configured naming scheme",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dryRun, err := cmd.Flags().GetBool("dry-run")
+			if err != nil {
+				return err
+			}
+
+			return withBackupShare(cmd, func(cfg Config, backupFS imap_backup.FS) error {
+				backup, err := imap_backup.NewImapBackup(backupFS, cfg.BackupConfig)
+				if err != nil {
+					return err
+				}
+
+				renamed, err := backup.RenameMessages(dryRun)
+				log.WithFields(log.Fields{"files": renamed, "dryRun": dryRun}).Info("renamed messages")
+				return err
+			})
+		},
+	}
+	migrateNamesCommand.Flags().Bool("dry-run", false, "only log the files that would be renamed")
+	root.AddCommand(migrateNamesCommand)
+
+	recompressCommand := &cobra.Command{
+		Use:   "recompress",
+		Short: "Rewrite the message files of the backup with the configured compression",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withBackupShare(cmd, func(cfg Config, backupFS imap_backup.FS) error {
+				compression := cfg.BackupConfig.Compression
+				if cmd.Flags().Changed("compression") {
+					compression = cmd.Flag("compression").Value.String()
+				}
+
+				backup, err := imap_backup.NewImapBackup(backupFS, cfg.BackupConfig)
+				if err != nil {
+					return err
+				}
+
+				recompressed, err := backup.Recompress(compression)
+				log.WithFields(log.Fields{"files": recompressed, "compression": compression}).Info("recompressed files")
+				return err
+			})
+		},
+	}
+	recompressCommand.Flags().String("compression", "", "compression instead of backupCompression of the config: none, gzip or zstd")
+	root.AddCommand(recompressCommand)
+
+	root.AddCommand(&cobra.Command{
+		Use:   "rekey",
+		Short: "Encrypt all backup files with the current encryption key",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withBackupShare(cmd, func(cfg Config, backupFS imap_backup.FS) error {
+				encryptedFS, ok := backupFS.(*imap_backup.EncryptedFS)
+				if !ok {
+					return fmt.Errorf("encryption is not configured")
+				}
+
+				// the state file is written by the client and stays unencrypted
+				statePath := path.Join(cfg.StateDir, cfg.BackupStateFile)
+				rekeyed, err := encryptedFS.Rekey(cfg.BackupConfig.BackupDir, func(filePath string) bool {
+					return strings.HasPrefix(filePath, statePath)
+				})
+				log.WithField("files", rekeyed).Info("rekeyed files")
+				return err
+			})
+		},
+	})
+
+	root.AddCommand(newVerifyCommand())
+
+	pruneCommand := &cobra.Command{
+		Use:   "prune",
+		Short: "Delete or archive the messages of the backup that are older than the retention allows",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dryRun, err := cmd.Flags().GetBool("dry-run")
+			if err != nil {
+				return err
+			}
+
+			return withBackupShare(cmd, func(cfg Config, backupFS imap_backup.FS) error {
+				if cfg.BackupConfig.Retention == nil {
+					return fmt.Errorf("retention is not configured")
+				}
+
+				backup, err := imap_backup.NewImapBackup(backupFS, cfg.BackupConfig)
+				if err != nil {
+					return err
+				}
+
+				result, err := backup.Prune(*cfg.BackupConfig.Retention, time.Now(), dryRun)
+				log.WithFields(log.Fields{"pruned": result.Pruned, "held": result.Held, "dryRun": dryRun}).Info("pruned messages")
+				if err != nil || result.Pruned == 0 {
+					return err
+				}
+
+				// blobs of pruned messages are no longer referenced
+				_, err = imap_backup.CollectGarbage(backupFS, cfg.BackupConfig.BackupDir, dryRun)
+				return err
+			})
+		},
+	}
+	pruneCommand.Flags().Bool("dry-run", false, "only log the messages that would be pruned")
+	root.AddCommand(pruneCommand)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	err := root.ExecuteContext(ctx)
 	if err != nil {
 		log.Error(err)
 	}
 }
 
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
 func loadConfig(configFilePath string) (Config, error) {
 	configFileBytes, err := os.ReadFile(configFilePath)
 	if err != nil {
@@ -129,10 +320,23 @@ func loadConfig(configFilePath string) (Config, error) {
 		return Config{}, err
 	}
 
+	if !storage.AllowsColons(cfg.Storage) {
+		cfg.BackupConfig, err = cfg.BackupConfig.WithoutColons()
+		if err != nil {
+			return Config{}, err
+		}
+	}
+	if !storage.AppendsInPlace(cfg.Storage) {
+		cfg.BackupConfig, err = cfg.BackupConfig.WithoutAppends()
+		if err != nil {
+			return Config{}, err
+		}
+	}
+
 	return cfg, nil
 }
 
-func daemon(cfg Config) (resultErr error) {
+func daemon(ctx context.Context, cfg Config) (resultErr error) {
 	defer func() {
 		if r := recover(); r != nil {
 			var err error
@@ -147,44 +351,114 @@ func daemon(cfg Config) (resultErr error) {
 		}
 	}()
 
-	cifsShare, err := cifs.OpenCifsShare(cifs.Config{
-		CifsAddr:     cfg.CifsConfig.CifsAddr,
-		CifsUsername: cfg.CifsConfig.CifsUsername,
-		CifsPassword: cfg.CifsConfig.CifsPassword,
-		CifsShare:    cfg.CifsConfig.CifsShare,
-	})
+	storageFS, err := openStorage(ctx, cfg)
 	if err != nil {
 		return err
 	}
-	defer cifsShare.Close()
+	defer storageFS.Close()
 
-	return runClient(cifsShare, cfg)
+	return runClient(ctx, storageFS, cfg)
 }
 
-func runClient(cifsShare cifs.CifsShare, cfg Config) error {
+func openStorage(ctx context.Context, cfg Config) (storage.FS, error) {
+	return storage.OpenOrCifs(ctx, cfg.Storage, cfg.CifsConfig)
+}
+
+// withBackupShare loads the config and runs f with the file system of the
+// backup on the storage
+func withBackupShare(cmd *cobra.Command, f func(cfg Config, backupFS imap_backup.FS) error) error {
+	cfg, err := loadConfig(cmd.Flag("config.file").Value.String())
+	if err != nil {
+		return err
+	}
+
+	storageFS, err := openStorage(cmd.Context(), cfg)
+	if err != nil {
+		return err
+	}
+	defer storageFS.Close()
+
+	backupFS, err := imap_backup.WithEncryption(storageFS, cfg.BackupConfig.Encryption)
+	if err != nil {
+		return err
+	}
+
+	return f(cfg, backupFS)
+}
+
+// openTokenCache returns the file system of the OAuth2 token cache. The cache
+// holds the refresh token, it is encrypted on the storage if the backup is
+// and kept in the working directory otherwise.
+func openTokenCache(cfg Config, storageFS storage.FS) (imapclient.FS, error) {
+	if cfg.BackupConfig.Encryption == nil {
+		return storage.NewLocalFS("."), nil
+	}
+
+	keyring, err := imap_backup.NewKeyring(cfg.BackupConfig.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	return imap_backup.NewEncryptedFS(storageFS, keyring), nil
+}
+
+func runClient(ctx context.Context, storageFS storage.FS, cfg Config) error {
 	log.Info("Running client")
 
 	filterClient := imap_filter.NewFilterClient(
 		imap_filter.NewLuaFilter(imap_filter.LuaFilterConfig{}, filterscripts.ListFiles, filterscripts.ReadFile),
 	)
 
-	backupClient := imap_backup.NewImapBackup(cifsShare, cfg.BackupConfig)
+	backupFS, err := imap_backup.WithEncryption(storageFS, cfg.BackupConfig.Encryption)
+	if err != nil {
+		return err
+	}
+	backupClient, err := imap_backup.NewImapBackup(backupFS, cfg.BackupConfig)
+	if err != nil {
+		return err
+	}
+
+	tokenCacheFS, err := openTokenCache(cfg, storageFS)
+	if err != nil {
+		return err
+	}
 
-	client := imapclient.NewClient(cifsShare, imapclient.Config{
+	client := imapclient.NewClient(storageFS, imapclient.Config{
 		ImapAddr:     cfg.ImapAddr,
 		ImapUsername: cfg.ImapUsername,
 		ImapPassword: cfg.ImapPassword,
 		StateDir:     cfg.StateDir,
 		StateFile:    &cfg.BackupStateFile,
+
+		WatchMailboxes:   cfg.WatchMailboxes,
+		FullSyncInterval: cfg.FullSyncInterval,
+		OAuth2:           cfg.OAuth2,
+		TokenCacheFS:     tokenCacheFS,
+		Transport:        cfg.Transport,
+		Retry:            cfg.Retry,
+
+		FetchBatchSize:     cfg.FetchBatchSize,
+		FetchBatchWaitTime: cfg.FetchBatchWaitTime,
+		MaxBatchBytes:      cfg.MaxBatchBytes,
+		MaxMessageBytes:    cfg.MaxMessageBytes,
 	}, []imapclient.HandleMessagePlugin{backupClient, filterClient})
-	defer client.Close()
+	defer func() {
+		// drain pending moves, write the state and log out even if ctx is done
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		log.Info("shutting down client")
+		err := client.Shutdown(shutdownCtx)
+		if err != nil {
+			log.WithError(err).Error("failed to shut down client")
+		}
+	}()
 
-	err := client.Open()
+	err = client.Open()
 	if err != nil {
 		return err
 	}
 
 	filterClient.SetConnection(client.GetConnection())
 
-	return client.Run()
+	return client.Run(ctx)
 }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	imap_backup "github.com/Schidstorm/imap-mirror/pkg/imap-backup"
+	imapclient "github.com/Schidstorm/imap-mirror/pkg/imap-client"
+	"github.com/Schidstorm/imap-mirror/pkg/storage"
+	"github.com/emersion/go-imap"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func newVerifyCommand() *cobra.Command {
+	verifyCommand := &cobra.Command{
+		Use:   "verify",
+		Short: "Check the checksums and messages of the backup and compare it with the server",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			offline, err := cmd.Flags().GetBool("offline")
+			if err != nil {
+				return err
+			}
+			reportPath, err := cmd.Flags().GetString("report")
+			if err != nil {
+				return err
+			}
+
+			cfg, err := loadConfig(cmd.Flag("config.file").Value.String())
+			if err != nil {
+				return err
+			}
+
+			storageFS, err := openStorage(cmd.Context(), cfg)
+			if err != nil {
+				return err
+			}
+			defer storageFS.Close()
+
+			report, err := verifyBackup(cmd.Context(), cfg, storageFS, offline)
+			if err != nil {
+				return err
+			}
+
+			err = writeVerifyReport(report, reportPath)
+			if err != nil {
+				return err
+			}
+
+			log.WithFields(log.Fields{
+				"messages":  report.Messages,
+				"missing":   len(report.Missing),
+				"extra":     len(report.Extra),
+				"corrupt":   len(report.Corrupt),
+				"duplicate": len(report.Duplicate),
+			}).Info("verified backup")
+			if !report.Ok() {
+				return fmt.Errorf("backup has problems")
+			}
+			return nil
+		},
+	}
+	verifyCommand.Flags().String("report", "", "file of the JSON report instead of stdout")
+	verifyCommand.Flags().Bool("offline", false, "do not compare the backup with the uids on the server")
+	return verifyCommand
+}
+
+// verifyBackup verifies the backup on the share and compares every mailbox of
+// the server with it unless offline is set
+func verifyBackup(ctx context.Context, cfg Config, storageFS storage.FS, offline bool) (*imap_backup.VerifyReport, error) {
+	backupFS, err := imap_backup.WithEncryption(storageFS, cfg.BackupConfig.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	report, err := imap_backup.Verify(backupFS, cfg.BackupConfig.BackupDir)
+	if err != nil {
+		return nil, err
+	}
+	if offline {
+		return report, nil
+	}
+
+	connParams := imapclient.ConnectionParams{
+		ImapAddr:     cfg.ImapAddr,
+		ImapUsername: cfg.ImapUsername,
+		ImapPassword: cfg.ImapPassword,
+		Transport:    cfg.Transport,
+		Retry:        cfg.Retry,
+	}
+	if cfg.OAuth2 != nil {
+		// the token cache of the daemon is shared
+		tokenCacheFS, err := openTokenCache(cfg, storageFS)
+		if err != nil {
+			return nil, err
+		}
+		connParams.TokenSource = imapclient.NewOAuth2TokenSource(tokenCacheFS, cfg.StateDir, *cfg.OAuth2)
+		connParams.OAuth2Mechanism = cfg.OAuth2.Mechanism
+	}
+
+	conn := imapclient.NewConnection(connParams)
+	if err := conn.Open(); err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return report, crossCheckServer(ctx, conn, report, cfg.BackupConfig.Format)
+}
+
+// crossCheckServer compares the uids of every mailbox on the server with the
+// backup. Mailboxes of the backup that are not on the server are compared
+// with an empty mailbox. format is the format of the backup.
+func crossCheckServer(ctx context.Context, conn *imapclient.Connection, report *imap_backup.VerifyReport, format string) error {
+	mailboxes, err := conn.List(ctx, "", "*")
+	if err != nil {
+		return err
+	}
+
+	checked := map[string]bool{}
+	for _, mailbox := range mailboxes {
+		if mailbox == nil || slices.Contains(mailbox.Attributes, imap.NoSelectAttr) {
+			continue
+		}
+
+		backupMailbox := imap_backup.MailboxPath(mailbox.Name, mailbox.Delimiter, format)
+
+		status, err := conn.Select(ctx, mailbox.Name, true)
+		if err != nil {
+			return fmt.Errorf("failed to select %s: %w", mailbox.Name, err)
+		}
+
+		uids := []uint32{}
+		if status.Messages > 0 {
+			criteria := imap.NewSearchCriteria()
+			uids, err = conn.UidSearch(ctx, criteria)
+			if err != nil {
+				return fmt.Errorf("failed to search %s: %w", mailbox.Name, err)
+			}
+		}
+
+		report.CrossCheck(backupMailbox, status.UidValidity, uids)
+		checked[backupMailbox] = true
+	}
+
+	for _, mailbox := range report.Mailboxes() {
+		if !checked[mailbox] {
+			report.CrossCheck(mailbox, 0, nil)
+		}
+	}
+	return nil
+}
+
+// writeVerifyReport writes the report as JSON to reportPath or stdout
+func writeVerifyReport(report *imap_backup.VerifyReport, reportPath string) error {
+	var w io.Writer = os.Stdout
+	if reportPath != "" {
+		file, err := os.Create(reportPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/mail"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Schidstorm/imap-mirror/pkg/cifs"
+	imap_backup "github.com/Schidstorm/imap-mirror/pkg/imap-backup"
+	imapclient "github.com/Schidstorm/imap-mirror/pkg/imap-client"
+	logger "github.com/Schidstorm/imap-mirror/pkg/log"
+	"github.com/Schidstorm/imap-mirror/pkg/storage"
+	"github.com/emersion/go-imap"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+// stateSaveInterval is the number of restored messages after which the state
+// file is written
+const stateSaveInterval = 20
+
+type Config struct {
+	ImapAddr     string `json:"imapAddr" yaml:"imapAddr"`
+	ImapUsername string `json:"imapUsername" yaml:"imapUsername"`
+	ImapPassword string `json:"imapPassword" yaml:"imapPassword"`
+
+	OAuth2    *imapclient.OAuth2Config   `json:"oauth2" yaml:"oauth2"`
+	Transport imapclient.TransportConfig `json:"transport" yaml:"transport"`
+	Retry     imapclient.RetryConfig     `json:"retry" yaml:"retry"`
+
+	// Storage selects the backend of the backup by URL, the CIFS share is
+	// used without one. The backup is read from local files if neither is
+	// configured.
+	Storage    storage.Config `json:"storage" yaml:"storage"`
+	CifsConfig cifs.Config    `json:",inline" yaml:",inline"`
+}
+
+// backupStorage is the file system the backup is read from
+type backupStorage interface {
+	imap_backup.FS
+	io.Closer
+}
+
+type LocalFS struct{}
+
+func (LocalFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+func (LocalFS) OpenFile(name string, flag int, perm os.FileMode) (fs.File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (LocalFS) MkdirAll(name string, perm os.FileMode) error {
+	return os.MkdirAll(name, perm)
+}
+
+func (LocalFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (LocalFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (LocalFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (LocalFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+
+func (LocalFS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (LocalFS) Close() error {
+	return nil
+}
+
+type restoreOptions struct {
+	backupDir string
+	statePath string
+	mailboxes []string
+	dryRun    bool
+	// encryption decrypts an encrypted backup, unencrypted backups are read
+	// without it
+	encryption *imap_backup.EncryptionConfig
+}
+
+func main() {
+	logger.Configure(log.InfoLevel)
+
+	root := &cobra.Command{
+		Use:   "restore",
+		Short: "Restores a backup or dump into an IMAP account",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configFilePath, err := cmd.Flags().GetString("config.file")
+			if err != nil {
+				return err
+			}
+
+			cfg, err := loadConfig(configFilePath)
+			if err != nil {
+				return err
+			}
+			if cmd.Flags().Changed("storage") {
+				if cfg.Storage.URL, err = cmd.Flags().GetString("storage"); err != nil {
+					return err
+				}
+			}
+
+			options := restoreOptions{}
+			if options.backupDir, err = cmd.Flags().GetString("backup-dir"); err != nil {
+				return err
+			}
+			if options.statePath, err = cmd.Flags().GetString("state-file"); err != nil {
+				return err
+			}
+			if options.mailboxes, err = cmd.Flags().GetStringSlice("mailbox"); err != nil {
+				return err
+			}
+			if options.dryRun, err = cmd.Flags().GetBool("dry-run"); err != nil {
+				return err
+			}
+			if options.encryption, err = encryptionConfigOf(cmd); err != nil {
+				return err
+			}
+
+			return runRestore(cmd.Context(), cfg, options)
+		},
+	}
+
+	flags := root.PersistentFlags()
+	flags.String("config.file", "config.yml", "config file path")
+	root.Flags().String("backup-dir", "dump", "directory of the backup or dump to restore on the storage")
+	root.Flags().String("storage", "", "URL of the storage of the backup, e.g. smb://user@nas/share or s3://bucket, instead of local files")
+	root.Flags().String("state-file", "restore-state.json", "file to remember restored messages in")
+	root.Flags().StringSlice("mailbox", nil, "only restore mailboxes matching these patterns, e.g. INBOX or Archive/*")
+	root.Flags().Bool("dry-run", false, "only log the messages that would be restored")
+	root.Flags().String("key-file", "", "file with the key of an encrypted backup")
+	root.Flags().String("passphrase-env", "", "environment variable with the passphrase of an encrypted backup")
+
+	root.AddCommand(&cobra.Command{
+		Use:   "config-structure",
+		Short: "Print an example config",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config := Config{
+				ImapAddr:     "imap.example.com:993",
+				ImapUsername: "user",
+				ImapPassword: "password",
+			}
+
+			configBytes, err := yaml.Marshal(config)
+			if err != nil {
+				return err
+			}
+
+			_, err = cmd.OutOrStdout().Write(configBytes)
+			return err
+		},
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if err := root.ExecuteContext(ctx); err != nil {
+		log.Error(err)
+	}
+}
+
+func loadConfig(configFilePath string) (Config, error) {
+	configFileBytes, err := os.ReadFile(configFilePath)
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg := Config{}
+	if err := yaml.Unmarshal(configFileBytes, &cfg); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.ImapAddr == "" || cfg.ImapUsername == "" || (cfg.ImapPassword == "" && cfg.OAuth2 == nil) {
+		return Config{}, fmt.Errorf("imapAddr, imapUsername and imapPassword or oauth2 are required")
+	}
+
+	return cfg, nil
+}
+
+func runRestore(ctx context.Context, cfg Config, options restoreOptions) error {
+	backupDir := filepath.Clean(options.backupDir)
+	if backupDir == "" || backupDir == "." {
+		return fmt.Errorf("backup-dir is required")
+	}
+
+	for _, pattern := range options.mailboxes {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid mailbox pattern %q: %w", pattern, err)
+		}
+	}
+
+	state, err := loadRestoreState(options.statePath)
+	if err != nil {
+		return fmt.Errorf("failed to load state file %s: %w", options.statePath, err)
+	}
+
+	keyring, err := imap_backup.NewKeyring(options.encryption)
+	if err != nil {
+		return err
+	}
+	storageFS, err := openBackupStorage(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer storageFS.Close()
+
+	// the backup is read through the encryption so that encrypted files are
+	// never appended as they are
+	backupFS := imap_backup.NewEncryptedFS(storageFS, keyring)
+
+	connParams := imapclient.ConnectionParams{
+		ImapAddr:     cfg.ImapAddr,
+		ImapUsername: cfg.ImapUsername,
+		ImapPassword: cfg.ImapPassword,
+		Transport:    cfg.Transport,
+		Retry:        cfg.Retry,
+	}
+	if cfg.OAuth2 != nil {
+		// the token cache is kept in the working directory
+		connParams.TokenSource = imapclient.NewOAuth2TokenSource(LocalFS{}, "", *cfg.OAuth2)
+		connParams.OAuth2Mechanism = cfg.OAuth2.Mechanism
+	}
+
+	conn := imapclient.NewConnection(connParams)
+	if err := conn.Open(); err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	restorer, err := newRestorer(ctx, conn, state, options.dryRun)
+	if err != nil {
+		return err
+	}
+
+	err = imap_backup.WalkBackup(backupFS, backupDir, func(message imap_backup.BackupMessage, body io.Reader) error {
+		if !matchesMailbox(options.mailboxes, message.Mailbox) {
+			return nil
+		}
+
+		err := restorer.restore(ctx, message, body)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		} else if err != nil {
+			log.WithError(err).WithFields(log.Fields{"mailbox": message.Mailbox, "key": message.Key}).Error("failed to restore message")
+			restorer.failed++
+		}
+		return nil
+	})
+	if err == nil && restorer.failed > 0 {
+		err = fmt.Errorf("failed to restore %d messages", restorer.failed)
+	}
+
+	if !options.dryRun {
+		if saveErr := state.save(); saveErr != nil {
+			log.WithError(saveErr).Error("failed to save state file")
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"restored": restorer.restored,
+		"skipped":  restorer.skipped,
+		"failed":   restorer.failed,
+		"dryRun":   options.dryRun,
+	}).Info("restore finished")
+	return err
+}
+
+// openBackupStorage opens the storage of the backup like mirror_filter does.
+// Configs without a storage URL or CIFS share read local files.
+func openBackupStorage(ctx context.Context, cfg Config) (backupStorage, error) {
+	if cfg.Storage.URL == "" && cfg.CifsConfig.CifsAddr == "" {
+		return LocalFS{}, nil
+	}
+	return storage.OpenOrCifs(ctx, cfg.Storage, cfg.CifsConfig)
+}
+
+// encryptionConfigOf returns the encryption config of the flags or nil if no
+// key is given
+func encryptionConfigOf(cmd *cobra.Command) (*imap_backup.EncryptionConfig, error) {
+	keyFile, err := cmd.Flags().GetString("key-file")
+	if err != nil {
+		return nil, err
+	}
+
+	passphraseEnv, err := cmd.Flags().GetString("passphrase-env")
+	if err != nil {
+		return nil, err
+	}
+	return imap_backup.EncryptionConfigFromFlags(keyFile, passphraseEnv)
+}
+
+func matchesMailbox(patterns []string, mailbox string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, mailbox); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// restorer appends backed up messages to the mailboxes of the server unless
+// they are already there
+type restorer struct {
+	conn      *imapclient.Connection
+	state     *restoreState
+	dryRun    bool
+	delimiter string
+	existing  map[string]bool
+	present   map[string]*presentMessages
+
+	restored int
+	skipped  int
+	failed   int
+}
+
+// presentMessages are the messages of a server mailbox
+type presentMessages struct {
+	messageIds map[string]bool
+	hashes     map[string]bool
+}
+
+func newRestorer(ctx context.Context, conn *imapclient.Connection, state *restoreState, dryRun bool) (*restorer, error) {
+	mailboxes, err := conn.List(ctx, "", "*")
+	if err != nil {
+		return nil, err
+	}
+
+	r := &restorer{
+		conn:      conn,
+		state:     state,
+		dryRun:    dryRun,
+		delimiter: "/",
+		existing:  map[string]bool{},
+		present:   map[string]*presentMessages{},
+	}
+	for _, mailbox := range mailboxes {
+		if mailbox == nil {
+			continue
+		}
+		r.existing[mailbox.Name] = true
+		if mailbox.Delimiter != "" {
+			r.delimiter = mailbox.Delimiter
+		}
+	}
+	return r, nil
+}
+
+func (r *restorer) restore(ctx context.Context, message imap_backup.BackupMessage, body io.Reader) error {
+	if r.state.restored(message.Mailbox, message.Key) {
+		r.skipped++
+		return nil
+	}
+
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	serverMailbox := r.serverMailboxOf(message.Mailbox)
+	present, err := r.presentMessagesOf(ctx, serverMailbox)
+	if err != nil {
+		return err
+	}
+
+	messageId := messageIdOf(content)
+	hash := hashOf(content)
+	logger := log.WithFields(log.Fields{"mailbox": serverMailbox, "key": message.Key, "messageId": messageId})
+	if (messageId != "" && present.messageIds[messageId]) || present.hashes[hash] {
+		logger.Debug("message is already present")
+		r.skipped++
+		return r.markRestored(message)
+	}
+
+	if r.dryRun {
+		logger.Info("would restore message")
+		r.restored++
+		return nil
+	}
+
+	if err := r.ensureMailbox(ctx, serverMailbox); err != nil {
+		return err
+	}
+
+	err = r.conn.Append(ctx, serverMailbox, appendableFlags(message.Flags), message.Date, content)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("restored message")
+	r.restored++
+	present.add(messageId, hash)
+	return r.markRestored(message)
+}
+
+func (r *restorer) markRestored(message imap_backup.BackupMessage) error {
+	if r.dryRun {
+		return nil
+	}
+	return r.state.markRestored(message.Mailbox, message.Key, stateSaveInterval)
+}
+
+// serverMailboxOf returns the server name of a backup mailbox
+func (r *restorer) serverMailboxOf(mailbox string) string {
+	return imap_backup.MailboxName(mailbox, r.delimiter)
+}
+
+func (r *restorer) ensureMailbox(ctx context.Context, mailbox string) error {
+	if r.existing[mailbox] {
+		return nil
+	}
+
+	if err := r.conn.Create(ctx, mailbox); err != nil {
+		return fmt.Errorf("failed to create mailbox %s: %w", mailbox, err)
+	}
+	r.existing[mailbox] = true
+	return nil
+}
+
+// presentMessagesOf returns the Message-IDs of the messages of mailbox and the
+// hashes of those without one
+func (r *restorer) presentMessagesOf(ctx context.Context, mailbox string) (*presentMessages, error) {
+	if present, ok := r.present[mailbox]; ok {
+		return present, nil
+	}
+
+	present := &presentMessages{messageIds: map[string]bool{}, hashes: map[string]bool{}}
+	r.present[mailbox] = present
+	if !r.existing[mailbox] {
+		return present, nil
+	}
+
+	status, err := r.conn.Select(ctx, mailbox, true)
+	if err != nil {
+		return nil, err
+	}
+	if status.Messages == 0 {
+		return present, nil
+	}
+
+	all := new(imap.SeqSet)
+	all.AddRange(1, 0)
+	messages, err := r.conn.UidFetch(ctx, all, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope})
+	if err != nil {
+		return nil, err
+	}
+
+	withoutMessageId := new(imap.SeqSet)
+	for _, message := range messages {
+		if message.Envelope != nil && message.Envelope.MessageId != "" {
+			present.messageIds[message.Envelope.MessageId] = true
+		} else {
+			withoutMessageId.AddNum(message.Uid)
+		}
+	}
+	if withoutMessageId.Empty() {
+		return present, nil
+	}
+
+	section := &imap.BodySectionName{Peek: true}
+	messages, err = r.conn.UidFetch(ctx, withoutMessageId, []imap.FetchItem{imap.FetchUid, section.FetchItem()})
+	if err != nil {
+		return nil, err
+	}
+	for _, message := range messages {
+		literal := message.GetBody(section)
+		if literal == nil {
+			continue
+		}
+		content, err := io.ReadAll(literal)
+		if err != nil {
+			return nil, err
+		}
+		present.hashes[hashOf(content)] = true
+	}
+
+	return present, nil
+}
+
+func (p *presentMessages) add(messageId string, hash string) {
+	if messageId != "" {
+		p.messageIds[messageId] = true
+	}
+	p.hashes[hash] = true
+}
+
+// appendableFlags returns flags without \Recent which cannot be set by clients
+func appendableFlags(flags []string) []string {
+	return slices.DeleteFunc(slices.Clone(flags), func(flag string) bool {
+		return flag == imap.RecentFlag
+	})
+}
+
+func messageIdOf(content []byte) string {
+	message, err := mail.ReadMessage(bytes.NewReader(content))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(message.Header.Get("Message-Id"))
+}
+
+func hashOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
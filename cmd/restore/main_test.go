@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	imap_backup "github.com/Schidstorm/imap-mirror/pkg/imap-backup"
+	imapclient "github.com/Schidstorm/imap-mirror/pkg/imap-client"
+	"github.com/Schidstorm/imap-mirror/pkg/storage"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTestServer starts an in-memory IMAP server with the user
+// username/password. Its INBOX has one message with the Message-ID
+// <0000000@localhost/>.
+func startTestServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	imapServer := server.New(memory.New())
+	imapServer.AllowInsecureAuth = true
+	go imapServer.Serve(listener)
+	t.Cleanup(func() { imapServer.Close() })
+
+	return listener.Addr().String()
+}
+
+func dialTestServer(t *testing.T, addr string) *client.Client {
+	c, err := client.Dial(addr)
+	require.NoError(t, err)
+	require.NoError(t, c.Login("username", "password"))
+	t.Cleanup(func() { c.Logout() })
+	return c
+}
+
+// serverMessages returns the bodies of the messages of mailbox by their
+// flags, nil if the mailbox does not exist
+func serverMessages(t *testing.T, addr string, mailbox string) map[string][]string {
+	c := dialTestServer(t, addr)
+	status, err := c.Select(mailbox, true)
+	if err != nil {
+		return nil
+	}
+
+	messages := map[string][]string{}
+	if status.Messages == 0 {
+		return messages
+	}
+
+	section := &imap.BodySectionName{Peek: true}
+	fetched := make(chan *imap.Message, status.Messages)
+	all := new(imap.SeqSet)
+	all.AddRange(1, status.Messages)
+	require.NoError(t, c.Fetch(all, []imap.FetchItem{imap.FetchFlags, section.FetchItem()}, fetched))
+	for message := range fetched {
+		body, err := io.ReadAll(message.GetBody(section))
+		require.NoError(t, err)
+		flags := strings.Join(message.Flags, " ")
+		messages[flags] = append(messages[flags], string(body))
+	}
+	return messages
+}
+
+// writeTestBackup writes a backup to backup below dir
+func writeTestBackup(t *testing.T, dir string, mailboxes map[string][]*imap.Message) {
+	fs := storage.NewLocalFS(dir)
+	backup, err := imap_backup.NewImapBackup(fs, imap_backup.Config{BackupDir: "backup"})
+	require.NoError(t, err)
+
+	for mailbox, messages := range mailboxes {
+		backup.HandleUidValidity(mailbox, 1)
+		for _, message := range messages {
+			require.NoError(t, backup.SaveMessage(mailbox, message, fs, "backup"))
+		}
+	}
+}
+
+func testMessage(uid uint32, flags []string, body string) *imap.Message {
+	return &imap.Message{
+		Uid:          uid,
+		Flags:        flags,
+		InternalDate: time.Date(2024, time.February, 18, 22, 47, 30, 0, time.UTC),
+		Envelope:     &imap.Envelope{Date: time.Date(2024, time.February, 18, 22, 47, 30, 0, time.UTC)},
+		Body: map[*imap.BodySectionName]imap.Literal{
+			&imap_backup.FetchBodySection: strings.NewReader(body),
+		},
+	}
+}
+
+func testConfig(addr string, dir string) Config {
+	return Config{
+		ImapAddr:     addr,
+		ImapUsername: "username",
+		ImapPassword: "password",
+		Transport:    imapclient.TransportConfig{Mode: imapclient.TransportPlain},
+		Storage:      storage.Config{URL: "file://" + filepath.ToSlash(dir)},
+	}
+}
+
+const (
+	duplicateId   = "Message-ID: <0000000@localhost/>\r\nSubject: same Message-ID\r\n\r\nother body\r\n"
+	withoutId     = "Subject: without Message-ID\r\n\r\nbody\r\n"
+	recentMessage = "Message-ID: <recent@example.com>\r\nSubject: recent\r\n\r\nrecent body\r\n"
+	archived      = "Message-ID: <archived@example.com>\r\nSubject: archived\r\n\r\narchived body\r\n"
+)
+
+func TestRunRestore(t *testing.T) {
+	addr := startTestServer(t)
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, "restore-state.json")
+
+	// the message without Message-ID is on the server already
+	c := dialTestServer(t, addr)
+	require.NoError(t, c.Append("INBOX", nil, time.Now(), bytes.NewBufferString(withoutId)))
+
+	writeTestBackup(t, dir, map[string][]*imap.Message{
+		"INBOX": {
+			testMessage(1, nil, duplicateId),
+			testMessage(2, []string{imap.SeenFlag}, withoutId),
+			testMessage(3, []string{imap.SeenFlag, imap.RecentFlag}, recentMessage),
+		},
+		"Archive": {testMessage(1, nil, archived)},
+	})
+	cfg := testConfig(addr, dir)
+	inbox := serverMessages(t, addr, "INBOX")
+
+	// a dry run changes neither the server nor the state
+	err := runRestore(context.Background(), cfg, restoreOptions{backupDir: "backup", statePath: statePath, dryRun: true})
+	assert.NoError(t, err)
+	assert.Equal(t, inbox, serverMessages(t, addr, "INBOX"))
+	assert.Nil(t, serverMessages(t, addr, "Archive"))
+	_, err = os.Stat(statePath)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// only INBOX, the duplicates by Message-ID and content are skipped and
+	// \Recent is not appended
+	err = runRestore(context.Background(), cfg, restoreOptions{backupDir: "backup", statePath: statePath, mailboxes: []string{"INBOX"}})
+	assert.NoError(t, err)
+	inbox[imap.SeenFlag] = append(inbox[imap.SeenFlag], recentMessage)
+	assert.Equal(t, inbox, serverMessages(t, addr, "INBOX"))
+	assert.Nil(t, serverMessages(t, addr, "Archive"))
+
+	state, err := loadRestoreState(statePath)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(state.mailboxes["INBOX"]))
+	assert.Empty(t, state.mailboxes["Archive"])
+
+	// the restored messages of the state are not restored again, even after
+	// they were removed from the server
+	c = dialTestServer(t, addr)
+	_, err = c.Select("INBOX", false)
+	require.NoError(t, err)
+	all := new(imap.SeqSet)
+	all.AddRange(1, 0)
+	require.NoError(t, c.Store(all, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil))
+	require.NoError(t, c.Expunge(nil))
+
+	err = runRestore(context.Background(), cfg, restoreOptions{backupDir: "backup", statePath: statePath})
+	assert.NoError(t, err)
+	assert.Empty(t, serverMessages(t, addr, "INBOX"))
+	assert.Equal(t, map[string][]string{"": {archived}}, serverMessages(t, addr, "Archive"))
+}
+
+func TestOpenBackupStorage(t *testing.T) {
+	fs, err := openBackupStorage(context.Background(), Config{})
+	assert.NoError(t, err)
+	assert.Equal(t, LocalFS{}, fs)
+
+	dir := t.TempDir()
+	fs, err = openBackupStorage(context.Background(), Config{Storage: storage.Config{URL: "file://" + filepath.ToSlash(dir)}})
+	assert.NoError(t, err)
+	defer fs.Close()
+	assert.NoError(t, fs.WriteFile("file", []byte("content"), os.ModePerm))
+
+	content, err := os.ReadFile(filepath.Join(dir, "file"))
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(content))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+)
+
+// restoreState is the progress of a restore. It is kept in a state file so
+// an interrupted restore continues where it stopped.
+type restoreState struct {
+	path      string
+	dirty     int
+	mailboxes map[string]map[string]bool
+}
+
+type restoreStateFile struct {
+	// Mailboxes are the keys of the restored messages per backup mailbox
+	Mailboxes map[string][]string `json:"mailboxes"`
+}
+
+func loadRestoreState(statePath string) (*restoreState, error) {
+	state := &restoreState{path: statePath, mailboxes: map[string]map[string]bool{}}
+
+	content, err := os.ReadFile(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	file := restoreStateFile{}
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, err
+	}
+
+	for mailbox, keys := range file.Mailboxes {
+		state.mailboxes[mailbox] = map[string]bool{}
+		for _, key := range keys {
+			state.mailboxes[mailbox][key] = true
+		}
+	}
+	return state, nil
+}
+
+func (s *restoreState) restored(mailbox string, key string) bool {
+	return s.mailboxes[mailbox][key]
+}
+
+// markRestored records a restored message and saves the state every
+// saveInterval messages
+func (s *restoreState) markRestored(mailbox string, key string, saveInterval int) error {
+	if s.mailboxes[mailbox] == nil {
+		s.mailboxes[mailbox] = map[string]bool{}
+	}
+	s.mailboxes[mailbox][key] = true
+
+	s.dirty++
+	if s.dirty < saveInterval {
+		return nil
+	}
+	return s.save()
+}
+
+// save writes the state next to the state file and renames it so an
+// interruption never leaves a truncated state file behind
+func (s *restoreState) save() error {
+	if s.dirty == 0 {
+		return nil
+	}
+
+	file := restoreStateFile{Mailboxes: map[string][]string{}}
+	for mailbox, keys := range s.mailboxes {
+		for key := range keys {
+			file.Mailboxes[mailbox] = append(file.Mailboxes[mailbox], key)
+		}
+		slices.Sort(file.Mailboxes[mailbox])
+	}
+
+	content, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return err
+	}
+
+	s.dirty = 0
+	return nil
+}
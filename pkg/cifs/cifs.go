@@ -1,87 +1,299 @@
 package cifs
 
 import (
+	"context"
+	"fmt"
 	"io/fs"
 	"net"
 	"os"
 	"path"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/hirochachacha/go-smb2"
 	log "github.com/sirupsen/logrus"
 )
 
-const operationTimeout = 30 * time.Second
-
+// CifsShare is the file system of a mounted SMB share. Operations that find
+// the session dead or time out close it, the next operation reconnects and
+// remounts the share. Operations that failed because of a dead session are
+// repeated once on the new session.
 type CifsShare struct {
-	Connection net.Conn
-	Session    *smb2.Session
-	Share      *smb2.Share
+	config Config
+
+	lock       sync.Mutex
+	connection net.Conn
+	session    *smb2.Session
+	// share is nil once the session was closed, files compare it with the
+	// share they were opened on
+	share  *smb2.Share
+	closed bool
 }
 
-func (c CifsShare) Close() error {
-	failOnTimeout(func() {
-		if c.Share != nil {
-			c.Share.Umount()
-		}
-		if c.Session != nil {
-			c.Session.Logoff()
-		}
-		if c.Connection != nil {
-			c.Connection.Close()
-		}
+func (c *CifsShare) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.closed = true
+	return c.disconnect()
+}
+
+// OpenCifsShare validates the config, connects and mounts the share. ctx
+// cancels connecting and mounting but not the operations on the returned
+// share.
+func OpenCifsShare(ctx context.Context, config Config) (*CifsShare, error) {
+	err := config.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid cifs config: %w", err)
+	}
+
+	c := &CifsShare{config: config}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	err = c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// connect dials the server, mounts the share and checks that the session is
+// as secure as configured. The caller holds the lock.
+func (c *CifsShare) connect(ctx context.Context) error {
+	timeout := c.config.Timeouts.connect()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	dialect, err := c.config.Security.dialect()
+	if err != nil {
+		return err
+	}
+
+	dialer := &net.Dialer{}
+	netConn, err := dialer.DialContext(ctx, "tcp", c.config.CifsAddr)
+	if err != nil {
+		return err
+	}
+	conn := &observedConn{Conn: netConn}
+
+	// the smb2 dialer does not stop on ctx once the connection is set up
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
 	})
+	defer stop()
+
+	d := &smb2.Dialer{
+		Negotiator: smb2.Negotiator{
+			RequireMessageSigning: c.config.Security.RequireSigning,
+			SpecifiedDialect:      dialect,
+		},
+		Initiator: &smb2.NTLMInitiator{
+			User:     c.config.CifsUsername,
+			Password: c.config.CifsPassword,
+			Domain:   c.config.CifsDomain,
+		},
+	}
+
+	log.Infof("dialing %s", c.config.CifsAddr)
+	session, err := d.DialContext(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return connectError(ctx, "dial", c.config.CifsAddr, timeout, err)
+	}
+	log.Infof("dialed %s", c.config.CifsAddr)
+
+	log.Infof("mounting %s", c.config.CifsShare)
+	share, err := session.WithContext(ctx).Mount(c.config.CifsShare)
+	if err != nil {
+		conn.Close()
+		return connectError(ctx, "mount", c.config.CifsShare, timeout, err)
+	}
+	log.Infof("mounted %s", c.config.CifsShare)
+
+	err = c.checkMount(share.WithContext(ctx), conn)
+	if err != nil {
+		conn.Close()
+		return connectError(ctx, "mount", c.config.CifsShare, timeout, err)
+	}
+
+	if !stop() {
+		// ctx was done right after mounting and closed the connection
+		return connectError(ctx, "mount", c.config.CifsShare, timeout, ctx.Err())
+	}
+
+	c.connection = conn
+	c.session = session
+	c.share = share
 	return nil
 }
 
-func OpenCifsShare(config Config) (CifsShare, error) {
-	shareBundle := CifsShare{}
-	var returnErr error
+// checkMount checks that the directory of the config exists and that the
+// session is encrypted unless unencrypted sessions are allowed. go-smb2
+// encrypts requests once the server asks for it, so the protocol id of a
+// request after mounting shows whether the session is encrypted.
+func (c *CifsShare) checkMount(share *smb2.Share, conn *observedConn) error {
+	dir := c.path(".")
+	info, err := share.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s on share %s: %w", dir, c.config.CifsShare, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s on share %s is not a directory", dir, c.config.CifsShare)
+	}
+
+	if conn.encrypted() {
+		return nil
+	}
+	if !c.config.Security.AllowUnencrypted {
+		return fmt.Errorf("refusing share %s on %s: %w, allow unencrypted sessions to use it anyway", c.config.CifsShare, c.config.CifsAddr, ErrUnencrypted)
+	}
+	log.Warnf("the session to %s is not encrypted", c.config.CifsAddr)
+	return nil
+}
+
+func connectError(ctx context.Context, op string, name string, timeout time.Duration, err error) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return &TimeoutError{Op: op, Path: name, Limit: timeout}
+	}
+	return err
+}
+
+// disconnect unmounts the share and logs off. The caller holds the lock.
+func (c *CifsShare) disconnect() error {
+	if c.connection == nil {
+		return nil
+	}
+
+	// unmounting and logging off must not block on a dead session
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.share.Umount()
+		// the session keeps the context it was dialed with
+		c.session.WithContext(context.Background()).Logoff()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(c.config.Timeouts.connect()):
+		log.Warn("cifs logoff timed out")
+	}
+
+	err := c.connection.Close()
+	c.connection, c.session, c.share = nil, nil, nil
+	return err
+}
+
+// mounted returns the share and reconnects if the session was closed
+func (c *CifsShare) mounted() (*smb2.Share, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return nil, fs.ErrClosed
+	}
 
-	failOnTimeout(func() {
-		conn, err := net.Dial("tcp", config.CifsAddr)
+	if c.share == nil {
+		log.Infof("reconnecting to %s", c.config.CifsAddr)
+		err := c.connect(context.Background())
 		if err != nil {
-			returnErr = err
-			return
+			return nil, fmt.Errorf("failed to reconnect to %s: %w", c.config.CifsAddr, err)
 		}
-		shareBundle.Connection = conn
+	}
+	return c.share, nil
+}
 
-		d := &smb2.Dialer{
-			Initiator: &smb2.NTLMInitiator{
-				User:     config.CifsUsername,
-				Password: config.CifsPassword,
-			},
-		}
+// invalidate closes the session of share unless it was replaced already.
+// Closing the connection cancels the operations still running on it.
+func (c *CifsShare) invalidate(share *smb2.Share) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-		log.Infof("dialing %s", config.CifsAddr)
-		s, err := d.Dial(conn)
+	if share != c.share || c.connection == nil {
+		return
+	}
+
+	c.connection.Close()
+	c.connection, c.session, c.share = nil, nil, nil
+}
+
+// do runs f on the mounted share. If the session turns out to be dead it is
+// closed and f runs once more on a new session.
+func (c *CifsShare) do(op string, name string, timeout time.Duration, f func(share *smb2.Share) error) error {
+	for attempt := 0; ; attempt++ {
+		share, err := c.mounted()
 		if err != nil {
-			returnErr = err
-			return
+			return err
 		}
-		log.Infof("dialed %s", config.CifsAddr)
-		shareBundle.Session = s
 
-		log.Infof("mounting %s", config.CifsShare)
-		fs, err := s.Mount(config.CifsShare)
-		if err != nil {
-			returnErr = err
-			return
+		err = c.run(op, name, timeout, share, func() error {
+			return f(share)
+		})
+		if attempt > 0 || !isSessionError(err) {
+			return err
 		}
-		shareBundle.Share = fs
-		log.Infof("mounted %s", config.CifsShare)
-	})
 
-	return shareBundle, returnErr
+		log.WithError(err).Warnf("cifs %s %s failed, reconnecting", op, name)
+		c.invalidate(share)
+	}
+}
+
+// run calls f and closes the session of share if f does not return within
+// timeout. It returns a TimeoutError then, but not before f returned: the
+// callers repeat f with the state it shares, so f must not outlive run.
+func (c *CifsShare) run(op string, name string, timeout time.Duration, share *smb2.Share, f func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+	}
+
+	c.invalidate(share)
+
+	// f fails once its connection is closed
+	timer.Reset(timeout)
+	for {
+		select {
+		case <-done:
+			return &TimeoutError{Op: op, Path: name, Limit: timeout}
+		case <-timer.C:
+			log.Warnf("cifs %s %s did not stop after closing its session, waiting for it", op, name)
+			timer.Reset(timeout)
+		}
+	}
+}
+
+// path returns the path of name on the share
+func (c *CifsShare) path(name string) string {
+	dir := c.config.dir()
+	if dir == "" {
+		return name
+	}
+	return path.Join(dir, name)
 }
 
 func (c *CifsShare) ReadFile(file string) (string, error) {
 	var fileContent []byte
-	var err error
-
-	failOnTimeout(func() {
-		fileContent, err = c.Share.ReadFile(file)
+	err := c.do("read", file, c.config.Timeouts.read(), func(share *smb2.Share) error {
+		var err error
+		fileContent, err = share.ReadFile(c.path(file))
+		return err
 	})
+	if isSessionError(err) {
+		return "", err
+	}
 
 	if err != nil {
 		log.WithError(err).Errorf("failed to read file %s", file)
@@ -93,12 +305,7 @@ func (c *CifsShare) ReadFile(file string) (string, error) {
 func (c *CifsShare) ListFiles(dir string) ([]string, error) {
 	var result []string
 
-	var fileInfos []fs.FileInfo
-	var err error
-
-	failOnTimeout(func() {
-		fileInfos, err = c.Share.ReadDir(dir)
-	})
+	fileInfos, err := c.readDir(dir)
 	if err != nil {
 		return nil, err
 	}
@@ -120,92 +327,103 @@ func (c *CifsShare) ListFiles(dir string) ([]string, error) {
 }
 
 // implement FS interface
-func (c CifsShare) Open(name string) (f fs.File, err error) {
-	failOnTimeout(func() {
-		f, err = c.Share.Open(name)
-	})
-	return
+func (c *CifsShare) Open(name string) (fs.File, error) {
+	return c.OpenFile(name, os.O_RDONLY, 0)
 }
 
-func (c CifsShare) OpenFile(name string, flag int, perm os.FileMode) (fs.File, error) {
-	var f fs.File
-	var err error
-	failOnTimeout(func() {
-		f, err = c.Share.OpenFile(name, flag, perm)
+func (c *CifsShare) OpenFile(name string, flag int, perm os.FileMode) (fs.File, error) {
+	file := &cifsFile{share: c, name: c.path(name), flag: flag, perm: perm}
+	err := file.open(flag)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (c *CifsShare) MkdirAll(name string, perm os.FileMode) error {
+	return c.do("mkdir", name, c.config.Timeouts.write(), func(share *smb2.Share) error {
+		return share.MkdirAll(c.path(name), perm)
 	})
-	return f, err
 }
 
-func (c CifsShare) MkdirAll(name string, perm os.FileMode) error {
-	var err error
-	failOnTimeout(func() {
-		err = c.Share.MkdirAll(name, perm)
+func (c *CifsShare) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return c.do("write", name, c.config.Timeouts.write(), func(share *smb2.Share) error {
+		return share.WriteFile(c.path(name), data, perm)
 	})
-	return err
 }
 
-func (c CifsShare) WriteFile(name string, data []byte, perm os.FileMode) error {
-	var err error
-	failOnTimeout(func() {
-		err = c.Share.WriteFile(name, data, perm)
+func (c *CifsShare) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return c.do("chtimes", name, c.config.Timeouts.write(), func(share *smb2.Share) error {
+		return share.Chtimes(c.path(name), atime, mtime)
 	})
-	return err
 }
 
-func (c CifsShare) Chtimes(name string, atime time.Time, mtime time.Time) error {
-	var err error
-	failOnTimeout(func() {
-		err = c.Share.Chtimes(name, atime, mtime)
+// Rename renames oldpath to newpath on the server and replaces newpath if it
+// exists, see renameReplacing
+func (c *CifsShare) Rename(oldpath, newpath string) error {
+	attempted := false
+	return c.do("rename", oldpath, c.config.Timeouts.write(), func(share *smb2.Share) error {
+		retried := attempted
+		attempted = true
+		err := renameReplacing(share, c.path(oldpath), c.path(newpath))
+		if retried && os.IsNotExist(err) {
+			if _, statErr := share.Stat(c.path(newpath)); statErr == nil {
+				// the first attempt renamed the file before the session died
+				return nil
+			}
+		}
+		return err
 	})
-	return err
 }
 
-func (c CifsShare) Rename(oldpath, newpath string) error {
-	// a file must be created before it can be renamed
-	var content []byte
-	var err error
-	failOnTimeout(func() {
-		content, err = c.Share.ReadFile(oldpath)
+func (c *CifsShare) Remove(name string) error {
+	attempted := false
+	return c.do("remove", name, c.config.Timeouts.write(), func(share *smb2.Share) error {
+		retried := attempted
+		attempted = true
+		err := share.Remove(c.path(name))
+		if retried && os.IsNotExist(err) {
+			// the first attempt removed the file before the session died
+			return nil
+		}
+		return err
 	})
+}
+
+func (c *CifsShare) ReadDir(name string) ([]fs.DirEntry, error) {
+	infos, err := c.readDir(name)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	entries := make([]fs.DirEntry, 0, len(infos))
+	for _, info := range infos {
+		entries = append(entries, fs.FileInfoToDirEntry(info))
 	}
 
-	failOnTimeout(func() {
-		err = c.Share.WriteFile(newpath, content, os.ModePerm)
+	// fs.ReadDirFS requires entries sorted by name
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
 	})
-	return err
+	return entries, nil
 }
 
-func (c CifsShare) Remove(name string) error {
-	var err error
-	failOnTimeout(func() {
-		err = c.Share.Remove(name)
+func (c *CifsShare) readDir(name string) ([]fs.FileInfo, error) {
+	var infos []fs.FileInfo
+	err := c.do("readdir", name, c.config.Timeouts.read(), func(share *smb2.Share) error {
+		var err error
+		infos, err = share.ReadDir(c.path(name))
+		return err
 	})
-	return err
+	return infos, err
 }
 
-func (c CifsShare) Stat(name string) (fs.FileInfo, error) {
+func (c *CifsShare) Stat(name string) (fs.FileInfo, error) {
 	var info fs.FileInfo
-	var err error
-	failOnTimeout(func() {
-		info, err = c.Share.Stat(name)
+	err := c.do("stat", name, c.config.Timeouts.read(), func(share *smb2.Share) error {
+		var err error
+		info, err = share.Stat(c.path(name))
+		return err
 	})
 	return info, err
 }
-
-func failOnTimeout(f func()) {
-	done := make(chan struct{})
-
-	go func() {
-		defer close(done)
-		f()
-	}()
-
-	select {
-	case <-done:
-		return
-	case <-time.After(operationTimeout):
-		panic("operation timed out")
-	}
-}
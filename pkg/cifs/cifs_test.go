@@ -0,0 +1,170 @@
+package cifs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	imapclient "github.com/Schidstorm/imap-mirror/pkg/imap-client"
+	"github.com/Schidstorm/imap-mirror/pkg/imap-client/fstest"
+	"github.com/hirochachacha/go-smb2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCifsShareContract runs against the share in CIFS_TEST_ADDR,
+// CIFS_TEST_SHARE, CIFS_TEST_USERNAME and CIFS_TEST_PASSWORD, e.g. a Samba
+// container. Unencrypted sessions are allowed unless CIFS_TEST_ENCRYPTED is
+// set.
+func TestCifsShareContract(t *testing.T) {
+	config := Config{
+		CifsAddr:     os.Getenv("CIFS_TEST_ADDR"),
+		CifsShare:    os.Getenv("CIFS_TEST_SHARE"),
+		CifsUsername: os.Getenv("CIFS_TEST_USERNAME"),
+		CifsPassword: os.Getenv("CIFS_TEST_PASSWORD"),
+		Security:     SecurityConfig{AllowUnencrypted: os.Getenv("CIFS_TEST_ENCRYPTED") == ""},
+	}
+	if config.CifsAddr == "" {
+		t.Skip("CIFS_TEST_ADDR is not set")
+	}
+
+	share, err := OpenCifsShare(context.Background(), config)
+	require.NoError(t, err)
+	defer share.Close()
+
+	fstest.Run(t, func(t *testing.T) (imapclient.FS, string) {
+		dir := fmt.Sprintf("imap-mirror-test-%x", rand.Uint64())
+		require.NoError(t, share.MkdirAll(dir, os.ModePerm))
+		t.Cleanup(func() {
+			removeAll(t, share, dir)
+		})
+		return share, dir
+	})
+
+	// the same contract on a share whose paths are relative to a directory
+	fstest.Run(t, func(t *testing.T) (imapclient.FS, string) {
+		dir := fmt.Sprintf("imap-mirror-test-%x", rand.Uint64())
+		require.NoError(t, share.MkdirAll(dir, os.ModePerm))
+
+		dirConfig := config
+		dirConfig.CifsDir = dir
+		dirShare, err := OpenCifsShare(context.Background(), dirConfig)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			dirShare.Close()
+			removeAll(t, share, dir)
+		})
+		return dirShare, ""
+	})
+}
+
+func removeAll(t *testing.T, share *CifsShare, dir string) {
+	entries, err := share.ReadDir(dir)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			removeAll(t, share, path.Join(dir, entry.Name()))
+		} else {
+			require.NoError(t, share.Remove(path.Join(dir, entry.Name())))
+		}
+	}
+	require.NoError(t, share.Remove(dir))
+}
+
+func TestRunClosesSessionOnTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	share := &smb2.Share{}
+	c := &CifsShare{connection: client, share: share}
+
+	stopped := make(chan struct{})
+	err := c.run("stat", "state.json", 50*time.Millisecond, share, func() error {
+		defer close(stopped)
+		// blocks until the connection is closed
+		_, err := client.Read(make([]byte, 1))
+		return err
+	})
+
+	var timeoutErr *TimeoutError
+	assert.ErrorAs(t, err, &timeoutErr)
+	assert.Equal(t, "stat", timeoutErr.Op)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.True(t, os.IsTimeout(err))
+	assert.True(t, isSessionError(err))
+
+	// the operation was cancelled and the next one reconnects
+	<-stopped
+	assert.Nil(t, c.share)
+	assert.Nil(t, c.connection)
+}
+
+func TestRunWaitsForAbandonedCall(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	share := &smb2.Share{}
+	c := &CifsShare{connection: client, share: share}
+
+	// the call ignores that its connection was closed
+	returned := false
+	err := c.run("write", "state.json", 20*time.Millisecond, share, func() error {
+		time.Sleep(100 * time.Millisecond)
+		returned = true
+		return nil
+	})
+
+	var timeoutErr *TimeoutError
+	assert.ErrorAs(t, err, &timeoutErr)
+	assert.True(t, returned)
+}
+
+func TestRunKeepsNewerSession(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	current := &smb2.Share{}
+	c := &CifsShare{connection: client, share: current}
+
+	c.invalidate(&smb2.Share{})
+	assert.Equal(t, current, c.share)
+
+	err := c.run("write", "state.json", time.Second, current, func() error {
+		return errors.New("failed")
+	})
+	assert.EqualError(t, err, "failed")
+	assert.Equal(t, current, c.share)
+}
+
+func TestIsSessionError(t *testing.T) {
+	assert.False(t, isSessionError(nil))
+	assert.False(t, isSessionError(io.EOF))
+	assert.False(t, isSessionError(&fs.PathError{Op: "open", Path: "a", Err: fs.ErrNotExist}))
+	assert.False(t, isSessionError(&smb2.ResponseError{Code: 0xC0000034}))
+
+	assert.True(t, isSessionError(&fs.PathError{Op: "write", Path: "a", Err: &smb2.TransportError{Err: io.EOF}}))
+	assert.True(t, isSessionError(&smb2.ResponseError{Code: statusNetworkSessionExpired}))
+	assert.True(t, isSessionError(net.ErrClosed))
+}
+
+func TestClosedShare(t *testing.T) {
+	c := &CifsShare{}
+	assert.NoError(t, c.Close())
+
+	_, err := c.Stat("state.json")
+	assert.ErrorIs(t, err, fs.ErrClosed)
+}
+
+func TestTimeoutDefaults(t *testing.T) {
+	timeouts := TimeoutConfig{Write: time.Minute}
+	assert.Equal(t, defaultTimeout, timeouts.read())
+	assert.Equal(t, time.Minute, timeouts.write())
+}
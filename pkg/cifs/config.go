@@ -1,8 +1,77 @@
 package cifs
 
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+const defaultTimeout = 30 * time.Second
+
 type Config struct {
 	CifsAddr     string `json:"cifsAddr" yaml:"cifsAddr"`
 	CifsUsername string `json:"cifsUsername" yaml:"cifsUsername"`
 	CifsPassword string `json:"cifsPassword" yaml:"cifsPassword"`
-	CifsShare    string `json:"cifsShare" yaml:"cifsShare"`
+	// CifsDomain is the NTLM domain of the user, empty for local users
+	CifsDomain string `json:"cifsDomain" yaml:"cifsDomain"`
+	CifsShare  string `json:"cifsShare" yaml:"cifsShare"`
+	// CifsDir is the directory on the share that all paths are relative to,
+	// the root of the share if empty
+	CifsDir string `json:"cifsDir" yaml:"cifsDir"`
+	// Timeouts limit the operations on the share
+	Timeouts TimeoutConfig `json:"cifsTimeouts" yaml:"cifsTimeouts"`
+	// Security requires signing and encryption of the session
+	Security SecurityConfig `json:"cifsSecurity" yaml:"cifsSecurity"`
+}
+
+// Validate checks the config before connecting
+func (c Config) Validate() error {
+	if c.CifsAddr == "" {
+		return errors.New("cifsAddr is empty")
+	}
+	if c.CifsShare == "" {
+		return errors.New("cifsShare is empty")
+	}
+	if c.CifsDir != "" && !fs.ValidPath(strings.Trim(c.CifsDir, "/")) {
+		return fmt.Errorf("cifsDir %q is not a relative path on the share", c.CifsDir)
+	}
+	return c.Security.validate()
+}
+
+// dir returns CifsDir as a path relative to the share
+func (c Config) dir() string {
+	return strings.Trim(c.CifsDir, "/")
+}
+
+// TimeoutConfig are the timeouts of the operations on the share. Zero values
+// use the default of 30 seconds. An operation that times out closes the
+// session, the next operation reconnects.
+type TimeoutConfig struct {
+	// Connect limits dialing, authenticating and mounting the share
+	Connect time.Duration `json:"connect" yaml:"connect"`
+	// Read limits opening, reading, listing and stat calls
+	Read time.Duration `json:"read" yaml:"read"`
+	// Write limits writing, renaming and removing files and directories
+	Write time.Duration `json:"write" yaml:"write"`
+}
+
+func (t TimeoutConfig) connect() time.Duration {
+	return timeoutOrDefault(t.Connect)
+}
+
+func (t TimeoutConfig) read() time.Duration {
+	return timeoutOrDefault(t.Read)
+}
+
+func (t TimeoutConfig) write() time.Duration {
+	return timeoutOrDefault(t.Write)
+}
+
+func timeoutOrDefault(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return defaultTimeout
+	}
+	return timeout
 }
@@ -0,0 +1,58 @@
+package cifs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/hirochachacha/go-smb2"
+)
+
+// NTSTATUS codes of sessions the server closed
+const (
+	statusNetworkNameDeleted     = 0xC00000C9
+	statusConnectionDisconnected = 0xC000020C
+	statusUserSessionDeleted     = 0xC0000203
+	statusNetworkSessionExpired  = 0xC000035C
+)
+
+// TimeoutError is returned by operations that did not finish within their
+// timeout. The session of the operation is closed.
+type TimeoutError struct {
+	Op    string
+	Path  string
+	Limit time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("cifs %s %s timed out after %s", e.Op, e.Path, e.Limit)
+}
+
+// Timeout makes os.IsTimeout report timeouts
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// isSessionError reports whether err means that the session is dead
+func isSessionError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var timeoutErr *TimeoutError
+	var transportErr *smb2.TransportError
+	switch {
+	case errors.As(err, &timeoutErr), errors.As(err, &transportErr):
+		return true
+	case errors.Is(err, net.ErrClosed), errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return true
+	}
+	return isStatus(err, statusNetworkNameDeleted, statusConnectionDisconnected, statusUserSessionDeleted, statusNetworkSessionExpired)
+}
@@ -0,0 +1,163 @@
+package cifs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hirochachacha/go-smb2"
+	log "github.com/sirupsen/logrus"
+)
+
+// cifsFile is a file on the share that survives reconnects. When its session
+// dies it is reopened on the new session at the same offset and the failed
+// operation is repeated there, so writes in flight are not lost.
+type cifsFile struct {
+	share *CifsShare
+	name  string
+	flag  int
+	perm  os.FileMode
+
+	lock sync.Mutex
+	file *smb2.File
+	// mount is the share the file was opened on
+	mount  *smb2.Share
+	offset int64
+	closed bool
+}
+
+// open opens the file on the mounted share and seeks to its offset
+func (f *cifsFile) open(flag int) error {
+	var file *smb2.File
+	var mount *smb2.Share
+	err := f.share.do("open", f.name, f.share.config.Timeouts.read(), func(share *smb2.Share) error {
+		opened, err := share.OpenFile(f.name, flag, f.perm)
+		if err != nil {
+			return err
+		}
+
+		// the offset is kept by the client, seeking does not reach the server
+		opened.Seek(f.offset, io.SeekStart)
+		file, mount = opened, share
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	f.file, f.mount = file, mount
+	return nil
+}
+
+// do runs fn on the open file. If the session died the file is reopened on a
+// new session and fn runs once more.
+func (f *cifsFile) do(op string, timeout time.Duration, fn func(file *smb2.File) error) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return fs.ErrClosed
+	}
+
+	for attempt := 0; ; attempt++ {
+		if f.file == nil {
+			// reopening must neither truncate nor fail on the file it created
+			err := f.open(f.flag &^ (os.O_TRUNC | os.O_EXCL))
+			if err != nil {
+				return err
+			}
+		}
+
+		file, mount := f.file, f.mount
+		err := f.share.run(op, f.name, timeout, mount, func() error {
+			return fn(file)
+		})
+		if offset, seekErr := file.Seek(0, io.SeekCurrent); seekErr == nil {
+			f.offset = offset
+		}
+		if attempt > 0 || !isSessionError(err) {
+			return err
+		}
+
+		log.WithError(err).Warnf("cifs %s %s failed, reopening the file", op, f.name)
+		f.share.invalidate(mount)
+		f.file = nil
+	}
+}
+
+func (f *cifsFile) Read(b []byte) (int, error) {
+	n := 0
+	err := f.do("read", f.share.config.Timeouts.read(), func(file *smb2.File) error {
+		m, err := file.Read(b[n:])
+		n += max(m, 0)
+		return err
+	})
+	return n, err
+}
+
+func (f *cifsFile) Write(b []byte) (int, error) {
+	n := 0
+	err := f.do("write", f.share.config.Timeouts.write(), func(file *smb2.File) error {
+		m, err := file.Write(b[n:])
+		n += max(m, 0)
+		return err
+	})
+	return n, err
+}
+
+func (f *cifsFile) Seek(offset int64, whence int) (int64, error) {
+	var ret int64
+	err := f.do("seek", f.share.config.Timeouts.read(), func(file *smb2.File) error {
+		var err error
+		ret, err = file.Seek(offset, whence)
+		return err
+	})
+	return ret, err
+}
+
+func (f *cifsFile) Stat() (fs.FileInfo, error) {
+	var info fs.FileInfo
+	err := f.do("stat", f.share.config.Timeouts.read(), func(file *smb2.File) error {
+		var err error
+		info, err = file.Stat()
+		return err
+	})
+	return info, err
+}
+
+func (f *cifsFile) Truncate(size int64) error {
+	return f.do("truncate", f.share.config.Timeouts.write(), func(file *smb2.File) error {
+		return file.Truncate(size)
+	})
+}
+
+func (f *cifsFile) Sync() error {
+	return f.do("sync", f.share.config.Timeouts.write(), func(file *smb2.File) error {
+		return file.Sync()
+	})
+}
+
+func (f *cifsFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+
+	if f.file == nil {
+		return nil
+	}
+
+	file := f.file
+	f.file = nil
+	err := f.share.run("close", f.name, f.share.config.Timeouts.write(), f.mount, file.Close)
+	if isSessionError(err) {
+		// the handle is gone with its session, the writes reached the server
+		return nil
+	}
+	return err
+}
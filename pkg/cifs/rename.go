@@ -0,0 +1,153 @@
+package cifs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+
+	"github.com/hirochachacha/go-smb2"
+	log "github.com/sirupsen/logrus"
+)
+
+// NTSTATUS codes of servers that cannot rename a file
+const (
+	statusNotSupported  = 0xC00000BB
+	statusNotSameDevice = 0xC00000D4
+)
+
+// NTSTATUS codes of servers that reject ReplaceIfExists
+const (
+	statusNotImplemented   = 0xC0000002
+	statusInvalidParameter = 0xC000000D
+)
+
+// renameReplacing renames oldpath to newpath with an SMB2 rename with
+// ReplaceIfExists, the server replaces an existing file at newpath
+// atomically. Servers that reject ReplaceIfExists get renameAside, servers
+// that cannot rename get a synced copy instead.
+func renameReplacing(share *smb2.Share, oldpath string, newpath string) error {
+	err := share.Replace(oldpath, newpath)
+	switch {
+	case err == nil:
+		return nil
+	case isStatus(err, statusNotSupported, statusNotSameDevice):
+		log.WithError(err).Debugf("copying %s to %s", oldpath, newpath)
+		return copyFile(share, oldpath, newpath)
+	case isStatus(err, statusNotImplemented, statusInvalidParameter),
+		errors.Is(err, os.ErrExist), errors.Is(err, os.ErrPermission):
+		log.WithError(err).Debugf("renaming %s to %s without ReplaceIfExists", oldpath, newpath)
+		return renameAside(share, oldpath, newpath)
+	}
+	return err
+}
+
+// renameAside renames oldpath to newpath without ReplaceIfExists. An
+// existing file at newpath is renamed aside first and removed once oldpath
+// took its place. newpath is never missing unless the session dies between
+// the two renames, it is restored from the file aside if the second rename
+// fails.
+func renameAside(share *smb2.Share, oldpath string, newpath string) error {
+	err := share.Rename(oldpath, newpath)
+	if errors.Is(err, os.ErrExist) {
+		return replaceFile(share, oldpath, newpath, err)
+	}
+	return err
+}
+
+// replaceFile renames oldpath over the existing file newpath. renameErr is
+// returned if newpath is a directory.
+func replaceFile(share *smb2.Share, oldpath string, newpath string, renameErr error) error {
+	info, err := share.Stat(newpath)
+	if err != nil {
+		return err
+	} else if info.IsDir() {
+		return renameErr
+	}
+
+	aside := path.Join(path.Dir(newpath), "."+path.Base(newpath)+".replaced")
+	err = share.Remove(aside)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	err = share.Rename(newpath, aside)
+	if err != nil {
+		return err
+	}
+
+	err = share.Rename(oldpath, newpath)
+	if err != nil {
+		if restoreErr := share.Rename(aside, newpath); restoreErr != nil {
+			log.WithError(restoreErr).Errorf("failed to restore %s from %s", newpath, aside)
+		}
+		return err
+	}
+
+	err = share.Remove(aside)
+	if err != nil {
+		// newpath is replaced, the next replace removes the leftover
+		log.WithError(err).Warnf("failed to remove %s", aside)
+	}
+	return nil
+}
+
+// copyFile copies oldpath to newpath, syncs the copy and removes oldpath
+func copyFile(share *smb2.Share, oldpath string, newpath string) error {
+	src, err := share.Open(oldpath)
+	if err != nil {
+		return err
+	}
+
+	info, err := src.Stat()
+	if err != nil {
+		src.Close()
+		return err
+	}
+
+	dst, err := share.OpenFile(newpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		src.Close()
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		src.Close()
+		share.Remove(newpath)
+		return err
+	}
+
+	err = share.Chtimes(newpath, info.ModTime(), info.ModTime())
+	if err != nil {
+		src.Close()
+		return err
+	}
+
+	// the open handle would keep oldpath from being removed
+	err = src.Close()
+	if err != nil {
+		return err
+	}
+	return share.Remove(oldpath)
+}
+
+// isStatus reports whether err is a response with one of the NTSTATUS codes
+func isStatus(err error, codes ...uint32) bool {
+	var responseErr *smb2.ResponseError
+	if !errors.As(err, &responseErr) {
+		return false
+	}
+	for _, code := range codes {
+		if responseErr.Code == code {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package cifs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// dialects are the SMB dialects the client can pin, see MS-SMB2 2.2.3
+var dialects = map[string]uint16{
+	"2.0.2": 0x0202,
+	"2.1":   0x0210,
+	"3.0":   0x0300,
+	"3.0.2": 0x0302,
+	"3.1.1": 0x0311,
+}
+
+// minEncryptionDialect is the first dialect that encrypts messages
+const minEncryptionDialect = 0x0300
+
+// protocolEncrypted is the protocol id of encrypted SMB3 messages, plain
+// ones start with 0xFE
+var protocolEncrypted = [4]byte{0xFD, 'S', 'M', 'B'}
+
+// ErrUnencrypted is returned when the server does not encrypt the session
+// and the config does not allow unencrypted sessions
+var ErrUnencrypted = errors.New("the smb session is not encrypted")
+
+// SecurityConfig are the security requirements of the session. The client
+// cannot request encryption, servers enable it for a session or a share.
+// Sessions the server does not encrypt are refused unless AllowUnencrypted
+// is set, because they carry mail in plain text.
+type SecurityConfig struct {
+	// RequireSigning makes the client sign all messages and verify the
+	// signatures of the server
+	RequireSigning bool `json:"requireSigning" yaml:"requireSigning"`
+	// AllowUnencrypted permits sessions the server does not encrypt
+	AllowUnencrypted bool `json:"allowUnencrypted" yaml:"allowUnencrypted"`
+	// Dialect pins the SMB dialect, one of 2.0.2, 2.1, 3.0, 3.0.2 and 3.1.1.
+	// The client negotiates the best dialect the server supports if empty.
+	Dialect string `json:"dialect" yaml:"dialect"`
+}
+
+func (s SecurityConfig) validate() error {
+	dialect, err := s.dialect()
+	if err != nil {
+		return err
+	}
+	if dialect != 0 && dialect < minEncryptionDialect && !s.AllowUnencrypted {
+		return fmt.Errorf("smb dialect %s cannot encrypt, pin 3.0 or newer or allow unencrypted sessions", s.Dialect)
+	}
+	return nil
+}
+
+// dialect returns the pinned dialect, 0 if none is pinned
+func (s SecurityConfig) dialect() (uint16, error) {
+	if s.Dialect == "" {
+		return 0, nil
+	}
+
+	dialect, ok := dialects[s.Dialect]
+	if !ok {
+		names := make([]string, 0, len(dialects))
+		for name := range dialects {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return 0, fmt.Errorf("unknown smb dialect %q, known are %s", s.Dialect, strings.Join(names, ", "))
+	}
+	return dialect, nil
+}
+
+// observedConn follows the SMB messages the client writes. go-smb2 does not
+// tell whether it encrypts a session, the protocol id of the messages does.
+type observedConn struct {
+	net.Conn
+
+	lock sync.Mutex
+	// header collects the length prefix and the protocol id of the message
+	// being written
+	header []byte
+	// remaining is the number of bytes of the message still to be written
+	remaining int
+	// protocol is the protocol id of the last message
+	protocol [4]byte
+}
+
+func (c *observedConn) Write(b []byte) (int, error) {
+	c.observe(b)
+	return c.Conn.Write(b)
+}
+
+func (c *observedConn) observe(b []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for len(b) > 0 {
+		if len(c.header) < 4 {
+			n := min(4-len(c.header), len(b))
+			c.header = append(c.header, b[:n]...)
+			b = b[n:]
+			if len(c.header) == 4 {
+				// direct TCP transport, a zero byte and a 24 bit length
+				c.remaining = int(binary.BigEndian.Uint32(c.header) & 0xFFFFFF)
+			}
+			continue
+		}
+
+		n := min(c.remaining, len(b))
+		if len(c.header) < 8 {
+			n = min(n, 8-len(c.header))
+			c.header = append(c.header, b[:n]...)
+			if len(c.header) == 8 {
+				copy(c.protocol[:], c.header[4:])
+			}
+		}
+		b = b[n:]
+		c.remaining -= n
+
+		if c.remaining == 0 {
+			c.header = c.header[:0]
+		}
+	}
+}
+
+// encrypted reports whether the last message was encrypted
+func (c *observedConn) encrypted() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.protocol == protocolEncrypted
+}
@@ -0,0 +1,102 @@
+package cifs
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigValidate(t *testing.T) {
+	valid := Config{CifsAddr: "nas:445", CifsShare: "backup"}
+
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		err    string
+	}{
+		{"valid", func(c *Config) {}, ""},
+		{"no address", func(c *Config) { c.CifsAddr = "" }, "cifsAddr is empty"},
+		{"no share", func(c *Config) { c.CifsShare = "" }, "cifsShare is empty"},
+		{"dir", func(c *Config) { c.CifsDir = "/mail/backup/" }, ""},
+		{"dir outside the share", func(c *Config) { c.CifsDir = "../other" }, "not a relative path"},
+		{"pinned dialect", func(c *Config) { c.Security.Dialect = "3.1.1" }, ""},
+		{"unknown dialect", func(c *Config) { c.Security.Dialect = "1.0" }, `unknown smb dialect "1.0"`},
+		{"dialect without encryption", func(c *Config) { c.Security.Dialect = "2.1" }, "cannot encrypt"},
+		{"dialect without encryption allowed", func(c *Config) {
+			c.Security.Dialect = "2.1"
+			c.Security.AllowUnencrypted = true
+		}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := valid
+			test.modify(&config)
+
+			err := config.Validate()
+			if test.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, test.err)
+			}
+		})
+	}
+}
+
+func TestConfigDir(t *testing.T) {
+	c := &CifsShare{config: Config{CifsDir: "/mail/backup/"}}
+	assert.Equal(t, "mail/backup/INBOX/1.eml", c.path("INBOX/1.eml"))
+	assert.Equal(t, "mail/backup", c.path("."))
+
+	c = &CifsShare{}
+	assert.Equal(t, "INBOX/1.eml", c.path("INBOX/1.eml"))
+}
+
+func TestObservedConnSeesEncryption(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go io.Copy(io.Discard, server)
+
+	conn := &observedConn{Conn: client}
+	assert.False(t, conn.encrypted())
+
+	// go-smb2 writes the length prefix and the message separately
+	writeMessage(t, conn, protocolEncrypted, 100, false)
+	assert.True(t, conn.encrypted())
+
+	writeMessage(t, conn, [4]byte{0xFE, 'S', 'M', 'B'}, 64, false)
+	assert.False(t, conn.encrypted())
+
+	// messages split at any byte are followed as well
+	writeMessage(t, conn, protocolEncrypted, 70, true)
+	assert.True(t, conn.encrypted())
+	writeMessage(t, conn, [4]byte{0xFE, 'S', 'M', 'B'}, 5, true)
+	assert.False(t, conn.encrypted())
+}
+
+// writeMessage writes a message of size bytes starting with protocol in the
+// direct TCP framing, byte by byte if split is set
+func writeMessage(t *testing.T, conn net.Conn, protocol [4]byte, size int, split bool) {
+	message := make([]byte, size)
+	copy(message, protocol[:])
+
+	prefix := make([]byte, 4)
+	binary.BigEndian.PutUint32(prefix, uint32(size))
+
+	if !split {
+		_, err := conn.Write(prefix)
+		require.NoError(t, err)
+		_, err = conn.Write(message)
+		require.NoError(t, err)
+		return
+	}
+
+	for _, b := range append(prefix, message...) {
+		_, err := conn.Write([]byte{b})
+		require.NoError(t, err)
+	}
+}
@@ -0,0 +1,553 @@
+package imap_backup
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/hack-pad/hackpadfs"
+	log "github.com/sirupsen/logrus"
+)
+
+const blobsDir = ".blobs"
+const blobsTmpDir = "tmp"
+const manifestsDir = ".manifests"
+const manifestExtension = ".jsonl"
+
+// staleTmpAge is the age of temporary blobs that are left over by an
+// interrupted write
+const staleTmpAge = time.Hour
+
+// CasStore writes every body once to .blobs/<xx>/<sha256>.eml, keyed by its
+// SHA-256 hash. Each mailbox has a manifest .manifests/<mailbox>.jsonl with
+// one ManifestEntry per message that references the blob.
+//
+// Blobs are hashed before they are compressed and keep their names.
+//
+// Expunged messages are moved to the manifest in the tombstone area, so their
+// blobs are kept. Blobs that no manifest references are removed by
+// CollectGarbage.
+type CasStore struct {
+	lock        *sync.Mutex
+	manifests   map[string]map[string]bool
+	compression string
+}
+
+// ManifestEntry is a message of a mailbox manifest
+type ManifestEntry struct {
+	Hash      string    `json:"hash"`
+	Size      int64     `json:"size"`
+	Uid       uint32    `json:"uid,omitempty"`
+	MessageId string    `json:"messageId,omitempty"`
+	Subject   string    `json:"subject,omitempty"`
+	Date      time.Time `json:"date"`
+}
+
+func NewCasStore(compression string) CasStore {
+	return CasStore{
+		lock:        &sync.Mutex{},
+		manifests:   map[string]map[string]bool{},
+		compression: compression,
+	}
+}
+
+// WriteMessage writes the blob of the message and adds it to the manifest of
+// the mailbox. It returns an empty path because blobs are shared between
+// mailboxes.
+func (s CasStore) WriteMessage(fs FS, backupDir string, mailbox string, message *imap.Message, body io.Reader) (string, error) {
+	entry := ManifestEntry{Uid: message.Uid, Date: message.InternalDate}
+	if message.Envelope != nil {
+		entry.MessageId = message.Envelope.MessageId
+		entry.Subject = message.Envelope.Subject
+		if entry.Date.IsZero() {
+			entry.Date = message.Envelope.Date
+		}
+	}
+
+	var err error
+	entry.Hash, entry.Size, err = writeBlob(fs, backupDir, body, entry.Date, s.compression)
+	if err != nil {
+		return "", err
+	}
+
+	return "", s.addToManifest(fs, GetManifestPath(backupDir, mailbox), entry)
+}
+
+// TombstoneMessage moves the manifest entries of uid into the manifest of the
+// mailbox in the tombstone area
+func (s CasStore) TombstoneMessage(fs FS, backupDir string, mailbox string, uid uint32) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	manifestPath := GetManifestPath(backupDir, mailbox)
+	entries, err := ReadManifest(fs, manifestPath)
+	if err != nil {
+		return err
+	}
+
+	var kept, expunged []ManifestEntry
+	for _, entry := range entries {
+		if entry.Uid == uid {
+			expunged = append(expunged, entry)
+		} else {
+			kept = append(kept, entry)
+		}
+	}
+
+	if len(expunged) == 0 {
+		log.WithFields(log.Fields{"mailbox": mailbox, "uid": uid}).Debug("expunged message was never backed up")
+		return nil
+	}
+
+	// add to the tombstone area first, the blob must stay referenced
+	deletedPath := GetManifestPath(path.Join(backupDir, deletedDir), mailbox)
+	for _, entry := range expunged {
+		err := s.appendToManifest(fs, deletedPath, entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = writeManifest(fs, manifestPath, kept)
+	if err != nil {
+		return err
+	}
+	delete(s.manifests, manifestPath)
+
+	log.WithFields(log.Fields{"mailbox": mailbox, "uid": uid, "path": deletedPath}).Info("moved expunged message to tombstone area")
+	return nil
+}
+
+func (s CasStore) addToManifest(fs FS, manifestPath string, entry ManifestEntry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.appendToManifest(fs, manifestPath, entry)
+}
+
+// appendToManifest appends entry unless the manifest already has it. The
+// caller must hold the lock.
+func (s CasStore) appendToManifest(fs FS, manifestPath string, entry ManifestEntry) error {
+	known, ok := s.manifests[manifestPath]
+	if !ok {
+		entries, err := ReadManifest(fs, manifestPath)
+		if err != nil {
+			return err
+		}
+
+		known = make(map[string]bool, len(entries))
+		for _, entry := range entries {
+			known[manifestKey(entry)] = true
+		}
+		s.manifests[manifestPath] = known
+	}
+
+	key := manifestKey(entry)
+	if known[key] {
+		return nil
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	err = fs.MkdirAll(path.Dir(manifestPath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	_, err = appendToFile(fs, manifestPath, func(w io.Writer) error {
+		_, err := w.Write(append(line, '\n'))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to append to %s: %w", manifestPath, err)
+	}
+
+	known[key] = true
+	return nil
+}
+
+func manifestKey(entry ManifestEntry) string {
+	return fmt.Sprintf("%d %s", entry.Uid, entry.Hash)
+}
+
+// GetManifestPath returns the path of the manifest of mailbox
+func GetManifestPath(backupDir string, mailbox string) string {
+	return path.Join(backupDir, manifestsDir, mailbox+manifestExtension)
+}
+
+// GetBlobPath returns the path of the blob with the SHA-256 hash
+func GetBlobPath(backupDir string, hash string) string {
+	return path.Join(backupDir, blobsDir, hash[:2], hash+emlExtension)
+}
+
+// ReadManifest returns the entries of the manifest at manifestPath. A
+// missing manifest is empty.
+func ReadManifest(fs FS, manifestPath string) ([]ManifestEntry, error) {
+	content, err := hackpadfs.ReadFile(fs, manifestPath)
+	if errors.Is(err, hackpadfs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var entries []ManifestEntry
+	for i, line := range strings.Split(string(content), "\n") {
+		if line == "" {
+			continue
+		}
+
+		entry := ManifestEntry{}
+		err := json.Unmarshal([]byte(line), &entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry in line %d of %s: %w", i+1, manifestPath, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// writeManifest replaces the manifest at manifestPath with entries
+func writeManifest(fs FS, manifestPath string, entries []ManifestEntry) error {
+	content := new(strings.Builder)
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		content.Write(line)
+		content.WriteByte('\n')
+	}
+
+	tmpPath := manifestPath + ".tmp"
+	err := fs.WriteFile(tmpPath, []byte(content.String()), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	return fs.Rename(tmpPath, manifestPath)
+}
+
+// OpenBlob opens the blob with the SHA-256 hash and decompresses it
+func OpenBlob(fileSystem FS, backupDir string, hash string) (io.ReadCloser, error) {
+	return OpenMessageFile(fileSystem, GetBlobPath(backupDir, hash))
+}
+
+// writeBlob writes body to a temporary file while hashing it and moves it to
+// its blob path unless the blob already exists
+func writeBlob(fs FS, backupDir string, body io.Reader, date time.Time, compression string) (string, int64, error) {
+	tmpDir := path.Join(backupDir, blobsDir, blobsTmpDir)
+	err := fs.MkdirAll(tmpDir, os.ModePerm)
+	if err != nil {
+		return "", 0, err
+	}
+
+	tmpPath := path.Join(tmpDir, randomName())
+	hasher := sha256.New()
+	counter := &countingWriter{writer: hasher}
+	err = writeMessageFile(fs, tmpPath, io.TeeReader(body, counter), compression)
+	if err != nil {
+		fs.Remove(tmpPath)
+		return "", 0, fmt.Errorf("failed to write %s: %w", tmpPath, err)
+	}
+
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	blobPath := GetBlobPath(backupDir, hash)
+
+	_, err = hackpadfs.Stat(fs, blobPath)
+	if err == nil {
+		// deduplicated
+		return hash, counter.written, fs.Remove(tmpPath)
+	} else if !errors.Is(err, hackpadfs.ErrNotExist) {
+		return "", 0, err
+	}
+
+	err = fs.MkdirAll(path.Dir(blobPath), os.ModePerm)
+	if err != nil {
+		return "", 0, err
+	}
+
+	err = fs.Rename(tmpPath, blobPath)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if !date.IsZero() {
+		err = fs.Chtimes(blobPath, time.Now(), date)
+	}
+	return hash, counter.written, err
+}
+
+func randomName() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// GarbageCollection is the result of CollectGarbage
+type GarbageCollection struct {
+	Blobs        int
+	RemovedBlobs int
+	FreedBytes   int64
+}
+
+// CollectGarbage removes the blobs that are referenced by no manifest,
+// including the manifests of the tombstone area, and temporary blobs of
+// interrupted writes. With dryRun nothing is removed.
+func CollectGarbage(fileSystem FS, backupDir string, dryRun bool) (GarbageCollection, error) {
+	result := GarbageCollection{}
+
+	// list the blobs before reading the manifests, so that blobs written in
+	// the meantime are never removed
+	blobs := map[string]fs.FileInfo{}
+	var staleTmp []string
+	tmpDir := path.Join(backupDir, blobsDir, blobsTmpDir)
+	err := walkIfExists(fileSystem, path.Join(backupDir, blobsDir), func(filePath string, d fs.DirEntry) error {
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if path.Dir(filePath) == tmpDir {
+			if time.Since(info.ModTime()) > staleTmpAge {
+				staleTmp = append(staleTmp, filePath)
+			}
+			return nil
+		}
+
+		blobs[strings.TrimSuffix(d.Name(), emlExtension)] = info
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	result.Blobs = len(blobs)
+
+	for _, dir := range []string{path.Join(backupDir, manifestsDir), path.Join(backupDir, deletedDir, manifestsDir)} {
+		err := walkIfExists(fileSystem, dir, func(filePath string, d fs.DirEntry) error {
+			if !strings.HasSuffix(d.Name(), manifestExtension) {
+				return nil
+			}
+
+			entries, err := ReadManifest(fileSystem, filePath)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				delete(blobs, entry.Hash)
+			}
+			return nil
+		})
+		if err != nil {
+			return result, err
+		}
+	}
+
+	for hash, info := range blobs {
+		blobPath := GetBlobPath(backupDir, hash)
+		log.WithFields(log.Fields{"path": blobPath, "dryRun": dryRun}).Info("removing unreferenced blob")
+		if !dryRun {
+			err := fileSystem.Remove(blobPath)
+			if err != nil {
+				return result, err
+			}
+		}
+
+		result.RemovedBlobs++
+		result.FreedBytes += info.Size()
+	}
+
+	for _, tmpPath := range staleTmp {
+		log.WithFields(log.Fields{"path": tmpPath, "dryRun": dryRun}).Info("removing stale temporary blob")
+		if !dryRun {
+			err := fileSystem.Remove(tmpPath)
+			if err != nil {
+				return result, err
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// walkIfExists calls fn for every file below root. A missing root has no
+// files.
+func walkIfExists(fileSystem FS, root string, fn func(filePath string, d fs.DirEntry) error) error {
+	_, err := hackpadfs.Stat(fileSystem, root)
+	if errors.Is(err, hackpadfs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return hackpadfs.WalkDir(fileSystem, root, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		return fn(filePath, d)
+	})
+}
+
+// MigrateEmlToCas converts the .eml files of the backup at backupDir, including
+// the tombstone area, into blobs and manifests in place. Every file is removed
+// only after its blob is referenced by a manifest, so the migration can be
+// interrupted and started again. It returns the number of migrated messages.
+func MigrateEmlToCas(fileSystem FS, backupDir string) (int, error) {
+	uids, err := readUidIndex(fileSystem, backupDir)
+	if err != nil {
+		return 0, err
+	}
+
+	var messagePaths []string
+	err = hackpadfs.WalkDir(fileSystem, backupDir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath := strings.TrimPrefix(strings.TrimPrefix(filePath, backupDir), "/")
+		if d.IsDir() {
+			switch relPath {
+			case uidIndexDir, blobsDir, manifestsDir, path.Join(deletedDir, manifestsDir):
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if isEmlFile(d.Name()) && path.Dir(relPath) != "." {
+			messagePaths = append(messagePaths, relPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	store := NewCasStore(CompressionNone)
+	for i, messagePath := range messagePaths {
+		err := store.migrateEml(fileSystem, backupDir, messagePath, uids[messagePath])
+		if err != nil {
+			return i, fmt.Errorf("failed to migrate %s: %w", messagePath, err)
+		}
+	}
+
+	return len(messagePaths), nil
+}
+
+func (s CasStore) migrateEml(fileSystem FS, backupDir string, messagePath string, entries []uidIndexEntry) error {
+	filePath := path.Join(backupDir, messagePath)
+	info, err := hackpadfs.Stat(fileSystem, filePath)
+	if err != nil {
+		return err
+	}
+
+	header, err := readEmlHeader(fileSystem, filePath)
+	if err != nil {
+		return err
+	}
+
+	// the modification time of .eml files is the date of the message
+	entry := ManifestEntry{
+		Uid:       uidOf(entries),
+		MessageId: strings.TrimSpace(header.Get("Message-Id")),
+		Subject:   header.Get("Subject"),
+		Date:      info.ModTime(),
+	}
+	if subject, err := headerDecoder.DecodeHeader(entry.Subject); err == nil {
+		entry.Subject = subject
+	}
+
+	file, err := OpenMessageFile(fileSystem, filePath)
+	if err != nil {
+		return err
+	}
+	entry.Hash, entry.Size, err = writeBlob(fileSystem, backupDir, file, entry.Date, s.compression)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	mailboxDir := backupDir
+	mailbox := path.Dir(messagePath)
+	if deleted, ok := strings.CutPrefix(mailbox, deletedDir+"/"); ok {
+		mailboxDir = path.Join(backupDir, deletedDir)
+		mailbox = deleted
+	}
+
+	err = s.addToManifest(fileSystem, GetManifestPath(mailboxDir, mailbox), entry)
+	if err != nil {
+		return err
+	}
+
+	err = fileSystem.Remove(filePath)
+	if err != nil {
+		return err
+	}
+
+	if mailboxDir != backupDir {
+		return nil
+	}
+	for _, indexed := range entries {
+		err = fileSystem.Remove(path.Join(backupDir, indexed.indexPath))
+		if err != nil && !errors.Is(err, hackpadfs.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// uidIndexEntry is an entry of the uid index
+type uidIndexEntry struct {
+	uid uint32
+	// indexPath is the path of the entry relative to the backup directory
+	indexPath string
+}
+
+// readUidIndex returns the entries of the uid index by the message paths
+// they point to. Messages with the same content may share a path.
+func readUidIndex(fileSystem FS, backupDir string) (map[string][]uidIndexEntry, error) {
+	uids := map[string][]uidIndexEntry{}
+	indexDir := path.Join(backupDir, uidIndexDir)
+	err := walkIfExists(fileSystem, indexDir, func(filePath string, d fs.DirEntry) error {
+		var uid uint32
+		if _, err := fmt.Sscanf(d.Name(), "%d", &uid); err != nil {
+			return nil
+		}
+
+		messagePath, err := hackpadfs.ReadFile(fileSystem, filePath)
+		if err != nil {
+			return err
+		}
+
+		indexPath := strings.TrimPrefix(strings.TrimPrefix(filePath, backupDir), "/")
+		uids[string(messagePath)] = append(uids[string(messagePath)], uidIndexEntry{uid: uid, indexPath: indexPath})
+		return nil
+	})
+
+	return uids, err
+}
+
+// uidOf returns the uid of the first of entries or 0 if there is none
+func uidOf(entries []uidIndexEntry) uint32 {
+	if len(entries) == 0 {
+		return 0
+	}
+	return entries[0].uid
+}
@@ -0,0 +1,152 @@
+package imap_backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"github.com/hack-pad/hackpadfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCasStoreDeduplicatesBodies(t *testing.T) {
+	fs := newMemFS(t)
+	backup := newTestBackup(t, fs, Config{BackupDir: "backup", Format: FormatCas})
+
+	assert.NoError(t, backup.SaveMessage("INBOX", testMessage(1, "invoice", "<1@example.com>", "same body"), fs, "backup"))
+	assert.NoError(t, backup.SaveMessage("INBOX/Rechnungen", testMessage(7, "invoice", "<1@example.com>", "same body"), fs, "backup"))
+	assert.NoError(t, backup.SaveMessage("INBOX", testMessage(2, "other", "<2@example.com>", "other body"), fs, "backup"))
+	// saving again does not duplicate the manifest entry
+	assert.NoError(t, backup.SaveMessage("INBOX", testMessage(1, "invoice", "<1@example.com>", "same body"), fs, "backup"))
+
+	sum := sha256.Sum256([]byte("same body"))
+	hash := hex.EncodeToString(sum[:])
+
+	inbox, err := ReadManifest(fs, GetManifestPath("backup", "INBOX"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(inbox))
+	assert.Equal(t, hash, inbox[0].Hash)
+	assert.Equal(t, uint32(1), inbox[0].Uid)
+	assert.Equal(t, "<1@example.com>", inbox[0].MessageId)
+	assert.Equal(t, int64(len("same body")), inbox[0].Size)
+
+	invoices, err := ReadManifest(fs, GetManifestPath("backup", "INBOX/Rechnungen"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(invoices))
+	assert.Equal(t, hash, invoices[0].Hash)
+
+	blob, err := OpenBlob(fs, "backup", hash)
+	assert.NoError(t, err)
+	content, err := io.ReadAll(blob)
+	assert.NoError(t, err)
+	assert.NoError(t, blob.Close())
+	assert.Equal(t, "same body", string(content))
+
+	tmpEntries, err := hackpadfs.ReadDir(fs, "backup/.blobs/tmp")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(tmpEntries))
+
+	result, err := CollectGarbage(fs, "backup", false)
+	assert.NoError(t, err)
+	assert.Equal(t, GarbageCollection{Blobs: 2}, result)
+}
+
+func TestCasStoreTombstoneAndGarbageCollection(t *testing.T) {
+	fs := newMemFS(t)
+	backup := newTestBackup(t, fs, Config{BackupDir: "backup", Format: FormatCas})
+
+	assert.NoError(t, backup.SaveMessage("INBOX", testMessage(1, "first", "<1@example.com>", "first body"), fs, "backup"))
+	assert.NoError(t, backup.SaveMessage("INBOX", testMessage(2, "second", "<2@example.com>", "second body"), fs, "backup"))
+
+	backup.HandleExpunge("INBOX", 1)
+
+	inbox, err := ReadManifest(fs, GetManifestPath("backup", "INBOX"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(inbox))
+	assert.Equal(t, uint32(2), inbox[0].Uid)
+
+	deleted, err := ReadManifest(fs, GetManifestPath("backup/deleted", "INBOX"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(deleted))
+	assert.Equal(t, uint32(1), deleted[0].Uid)
+
+	// the tombstone area keeps the blob
+	result, err := CollectGarbage(fs, "backup", false)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.RemovedBlobs)
+
+	assert.NoError(t, fs.Remove(GetManifestPath("backup/deleted", "INBOX")))
+
+	result, err = CollectGarbage(fs, "backup", true)
+	assert.NoError(t, err)
+	assert.Equal(t, GarbageCollection{Blobs: 2, RemovedBlobs: 1, FreedBytes: int64(len("first body"))}, result)
+	_, err = fs.Stat(GetBlobPath("backup", deleted[0].Hash))
+	assert.NoError(t, err)
+
+	result, err = CollectGarbage(fs, "backup", false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.RemovedBlobs)
+	_, err = fs.Stat(GetBlobPath("backup", deleted[0].Hash))
+	assert.ErrorIs(t, err, hackpadfs.ErrNotExist)
+	_, err = fs.Stat(GetBlobPath("backup", inbox[0].Hash))
+	assert.NoError(t, err)
+}
+
+func TestMigrateEmlToCas(t *testing.T) {
+	fs := newMemFS(t)
+	backup := newTestBackup(t, fs, Config{BackupDir: "backup"})
+
+	first := testMessage(1, "first", "<1@example.com>", "Subject: first\r\nMessage-Id: <1@example.com>\r\n\r\nsame body\r\n")
+	copied := testMessage(5, "copy", "<1@example.com>", "Subject: first\r\nMessage-Id: <1@example.com>\r\n\r\nsame body\r\n")
+	expunged := testMessage(2, "second", "<2@example.com>", "Subject: second\r\n\r\nsecond body\r\n")
+	assert.NoError(t, backup.SaveMessage("INBOX", first, fs, "backup"))
+	assert.NoError(t, backup.SaveMessage("Archive", copied, fs, "backup"))
+	assert.NoError(t, backup.SaveMessage("INBOX", expunged, fs, "backup"))
+	backup.HandleExpunge("INBOX", 2)
+
+	migrated, err := MigrateEmlToCas(fs, "backup")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, migrated)
+
+	_, err = fs.Stat("backup/" + GetPathOfMessage("INBOX", first, sha256Of([]byte("Subject: first\r\nMessage-Id: <1@example.com>\r\n\r\nsame body\r\n"))))
+	assert.ErrorIs(t, err, hackpadfs.ErrNotExist)
+	_, err = fs.Stat("backup/deleted/" + GetPathOfMessage("INBOX", expunged, sha256Of([]byte("Subject: second\r\n\r\nsecond body\r\n"))))
+	assert.ErrorIs(t, err, hackpadfs.ErrNotExist)
+	_, err = fs.Stat("backup/" + getUidIndexPath("INBOX", 0, 1))
+	assert.ErrorIs(t, err, hackpadfs.ErrNotExist)
+
+	inbox, err := ReadManifest(fs, GetManifestPath("backup", "INBOX"))
+	assert.NoError(t, err)
+	assert.Equal(t, []ManifestEntry{{
+		Hash:      inbox[0].Hash,
+		Size:      int64(len("Subject: first\r\nMessage-Id: <1@example.com>\r\n\r\nsame body\r\n")),
+		Uid:       1,
+		MessageId: "<1@example.com>",
+		Subject:   "first",
+		Date:      first.Envelope.Date,
+	}}, inbox)
+
+	archive, err := ReadManifest(fs, GetManifestPath("backup", "Archive"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(archive))
+	assert.Equal(t, inbox[0].Hash, archive[0].Hash)
+
+	deleted, err := ReadManifest(fs, GetManifestPath("backup/deleted", "INBOX"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(deleted))
+
+	result, err := CollectGarbage(fs, "backup", false)
+	assert.NoError(t, err)
+	assert.Equal(t, GarbageCollection{Blobs: 2}, result)
+
+	// expunges of migrated messages use the manifest
+	newTestBackup(t, fs, Config{BackupDir: "backup", Format: FormatCas}).HandleExpunge("INBOX", 1)
+	deleted, err = ReadManifest(fs, GetManifestPath("backup/deleted", "INBOX"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(deleted))
+
+	migrated, err = MigrateEmlToCas(fs, "backup")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, migrated)
+}
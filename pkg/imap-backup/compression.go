@@ -0,0 +1,375 @@
+package imap_backup
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hack-pad/hackpadfs"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressions of message files
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// compressionExtensions are appended to the names of .eml files. Maildir
+// files and blobs keep their names, readers detect the compression by the
+// content of a file.
+var compressionExtensions = map[string]string{
+	CompressionGzip: ".gz",
+	CompressionZstd: ".zst",
+}
+
+// normalizeCompression returns the compression of a config value
+func normalizeCompression(compression string) (string, error) {
+	switch strings.ToLower(compression) {
+	case "", CompressionNone:
+		return CompressionNone, nil
+	case CompressionGzip:
+		return CompressionGzip, nil
+	case CompressionZstd:
+		return CompressionZstd, nil
+	default:
+		return "", fmt.Errorf("unknown compression %s", compression)
+	}
+}
+
+// isEmlFile reports whether name is an .eml file, compressed or not
+func isEmlFile(name string) bool {
+	return strings.HasSuffix(trimCompressionExtension(name), emlExtension)
+}
+
+func trimCompressionExtension(name string) string {
+	for _, extension := range compressionExtensions {
+		if strings.HasSuffix(name, extension) {
+			return strings.TrimSuffix(name, extension)
+		}
+	}
+	return name
+}
+
+// compressingWriter returns a writer that compresses into w. The writer must
+// be closed to flush the compressed data.
+func compressingWriter(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// writeMessageFile writes body compressed to filePath
+func writeMessageFile(fs FS, filePath string, body io.Reader, compression string) error {
+	file, err := fs.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer, ok := file.(io.Writer)
+	if !ok {
+		return fmt.Errorf("failed to write file. file is not an io.Writer")
+	}
+
+	compressor, err := compressingWriter(writer, compression)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(compressor, body)
+	if err != nil {
+		compressor.Close()
+		return err
+	}
+
+	err = compressor.Close()
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// compressionOf returns the compression of the data in br without consuming
+// it
+func compressionOf(br *bufio.Reader) (string, error) {
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, zstdMagic):
+		return CompressionZstd, nil
+	case bytes.HasPrefix(magic, gzipMagic):
+		return CompressionGzip, nil
+	default:
+		return CompressionNone, nil
+	}
+}
+
+// decompressingReader returns a reader of the decompressed content of r
+func decompressingReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	compression, err := compressionOf(br)
+	if err != nil {
+		return nil, err
+	}
+
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewReader(br)
+	case CompressionZstd:
+		decoder, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return io.NopCloser(br), nil
+	}
+}
+
+// OpenMessageFile opens a message file of the backup and decompresses it if
+// it is compressed
+func OpenMessageFile(fileSystem FS, filePath string) (io.ReadCloser, error) {
+	file, err := fileSystem.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := decompressingReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to decompress %s: %w", filePath, err)
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{reader, closerFunc(func() error {
+		return errors.Join(reader.Close(), file.Close())
+	})}, nil
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// Recompress rewrites the message files and blobs of the backup with the
+// compression and returns the number of rewritten files. Renamed .eml files
+// are updated in the uid index and the metadata. mbox files are left alone.
+func (i *ImapBackup) Recompress(compression string) (int, error) {
+	compression, err := normalizeCompression(compression)
+	if err != nil {
+		return 0, err
+	}
+
+	fileSystem, backupDir := i.fileSystem, i.backupDir
+	var messagePaths []string
+	err = hackpadfs.WalkDir(fileSystem, backupDir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath := strings.TrimPrefix(strings.TrimPrefix(filePath, backupDir), "/")
+		if d.IsDir() {
+			switch {
+			case relPath == uidIndexDir, relPath == manifestsDir, relPath == metadataDir, relPath == path.Join(blobsDir, blobsTmpDir):
+				return fs.SkipDir
+			case d.Name() == maildirTmp && isMaildir(fileSystem, path.Dir(filePath)):
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		dir := path.Dir(relPath)
+		switch {
+		case (path.Base(dir) == maildirNew || path.Base(dir) == maildirCur) &&
+			(isMaildir(fileSystem, path.Dir(path.Dir(filePath))) || strings.HasPrefix(relPath, deletedDir+"/")):
+			// tombstones of Maildir messages are not in a complete Maildir
+			messagePaths = append(messagePaths, relPath)
+		case isEmlFile(d.Name()) && dir != ".":
+			messagePaths = append(messagePaths, relPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	uids, err := readUidIndex(fileSystem, backupDir)
+	if err != nil {
+		return 0, err
+	}
+
+	metadata := metadataByPath{}
+	recompressed := 0
+	for _, messagePath := range messagePaths {
+		newPath, changed, err := recompressFile(fileSystem, backupDir, messagePath, compression)
+		if err != nil {
+			return recompressed, fmt.Errorf("failed to recompress %s: %w", messagePath, err)
+		}
+		if !changed {
+			continue
+		}
+		recompressed++
+
+		if newPath != messagePath {
+			err := i.moveMessagePath(messagePath, newPath, uids, metadata)
+			if err != nil {
+				return recompressed, err
+			}
+		}
+	}
+	return recompressed, nil
+}
+
+// recompressFile rewrites the message file at messagePath with compression
+// unless it already has it. It returns the new path of the file.
+func recompressFile(fileSystem FS, backupDir string, messagePath string, compression string) (string, bool, error) {
+	filePath := path.Join(backupDir, messagePath)
+	file, err := fileSystem.Open(filePath)
+	if err != nil {
+		return "", false, err
+	}
+	defer file.Close()
+
+	br := bufio.NewReader(file)
+	current, err := compressionOf(br)
+	if err != nil {
+		return "", false, err
+	}
+	if current == compression {
+		return messagePath, false, nil
+	}
+	file.Close()
+
+	info, err := hackpadfs.Stat(fileSystem, filePath)
+	if err != nil {
+		return "", false, err
+	}
+
+	newPath := messagePath
+	if isEmlFile(path.Base(messagePath)) && !strings.HasPrefix(messagePath, blobsDir+"/") {
+		newPath = trimCompressionExtension(messagePath) + compressionExtensions[compression]
+	}
+
+	body, err := OpenMessageFile(fileSystem, filePath)
+	if err != nil {
+		return "", false, err
+	}
+	defer body.Close()
+
+	tmpPath := filePath + ".recompress"
+	err = writeMessageFile(fileSystem, tmpPath, body, compression)
+	if err != nil {
+		fileSystem.Remove(tmpPath)
+		return "", false, err
+	}
+	body.Close()
+
+	newFilePath := path.Join(backupDir, newPath)
+	err = fileSystem.Rename(tmpPath, newFilePath)
+	if err != nil {
+		return "", false, err
+	}
+	if newFilePath != filePath {
+		err = fileSystem.Remove(filePath)
+		if err != nil {
+			return "", false, err
+		}
+	}
+
+	return newPath, true, fileSystem.Chtimes(newFilePath, time.Now(), info.ModTime())
+}
+
+// metadataByPath holds the metadata records of mailboxes by the path of their
+// message files. The metadata of a mailbox is read once when it is first
+// needed.
+type metadataByPath map[string]map[string][]MessageMetadata
+
+// recordsAt returns the metadata records of mailbox with messagePath
+func (m metadataByPath) recordsAt(fs FS, backupDir string, mailbox string, messagePath string) ([]MessageMetadata, error) {
+	byPath, ok := m[mailbox]
+	if !ok {
+		metadata, err := ReadMetadata(fs, backupDir, mailbox)
+		if err != nil {
+			return nil, err
+		}
+
+		byPath = map[string][]MessageMetadata{}
+		for _, record := range metadata {
+			if record.Path != "" {
+				byPath[record.Path] = append(byPath[record.Path], record)
+			}
+		}
+		m[mailbox] = byPath
+	}
+	return byPath[messagePath], nil
+}
+
+// moveMessagePath points the uid index and the metadata of the message at
+// oldPath to newPath
+func (i *ImapBackup) moveMessagePath(oldPath string, newPath string, uids map[string][]uidIndexEntry, metadata metadataByPath) error {
+	mailbox := path.Dir(oldPath)
+	if strings.HasPrefix(oldPath, deletedDir+"/") {
+		mailbox = strings.TrimPrefix(mailbox, deletedDir+"/")
+	}
+
+	for _, indexed := range uids[oldPath] {
+		err := i.fileSystem.WriteFile(path.Join(i.backupDir, indexed.indexPath), []byte(newPath), os.ModePerm)
+		if err != nil {
+			return err
+		}
+	}
+	uids[newPath] = append(uids[newPath], uids[oldPath]...)
+	delete(uids, oldPath)
+
+	records, err := metadata.recordsAt(i.fileSystem, i.backupDir, mailbox, oldPath)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		err := i.appendMetadata(i.fileSystem, i.backupDir, MessageMetadata{
+			Mailbox:     mailbox,
+			Uid:         record.Uid,
+			UidValidity: record.UidValidity,
+			Path:        newPath,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	metadata[mailbox][newPath] = append(metadata[mailbox][newPath], records...)
+	delete(metadata[mailbox], oldPath)
+	return nil
+}
@@ -0,0 +1,134 @@
+package imap_backup
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/hack-pad/hackpadfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressedBackupFormats(t *testing.T) {
+	for _, format := range []string{FormatEml, FormatMaildir, FormatCas} {
+		for _, compression := range []string{CompressionGzip, CompressionZstd} {
+			t.Run(format+"/"+compression, func(t *testing.T) {
+				fs := newMemFS(t)
+				backup := newTestBackup(t, fs, Config{BackupDir: "backup", Format: format, Compression: compression})
+				backup.HandleUidValidity("INBOX", 1)
+
+				body := strings.Repeat("compressible body\r\n", 100)
+				assert.NoError(t, backup.SaveMessage("INBOX", testMessage(1, "first", "<1@example.com>", body), fs, "backup"))
+
+				metadata, err := ReadMetadata(fs, "backup", "INBOX")
+				assert.NoError(t, err)
+				filePath := GetBlobPath("backup", metadata[0].Sha256)
+				if format != FormatCas {
+					filePath = path.Join("backup", metadata[0].Path)
+				}
+				if format == FormatEml {
+					assert.True(t, strings.HasSuffix(filePath, ".eml"+compressionExtensions[compression]), filePath)
+				}
+
+				raw, err := hackpadfs.ReadFile(fs, filePath)
+				assert.NoError(t, err)
+				magic := map[string][]byte{CompressionGzip: gzipMagic, CompressionZstd: zstdMagic}[compression]
+				assert.True(t, bytes.HasPrefix(raw, magic))
+				assert.Less(t, len(raw), len(body))
+
+				messages := walkBackup(t, fs, "backup")
+				assert.Equal(t, 1, len(messages))
+				assert.Equal(t, body, messages[0].body)
+			})
+		}
+	}
+}
+
+func TestMboxIsNotCompressed(t *testing.T) {
+	_, err := NewMessageStore(Config{Format: FormatMbox, Compression: CompressionZstd})
+	assert.Error(t, err)
+
+	_, err = NewMessageStore(Config{Format: FormatEml, Compression: "lz4"})
+	assert.Error(t, err)
+
+	// the backup does not fall back to another format
+	_, err = NewImapBackup(newMemFS(t), Config{Format: FormatMbox, Compression: CompressionZstd})
+	assert.Error(t, err)
+}
+
+func TestRecompress(t *testing.T) {
+	fs := newMemFS(t)
+	backup := newTestBackup(t, fs, Config{BackupDir: "backup"})
+	backup.HandleUidValidity("INBOX", 1)
+
+	assert.NoError(t, backup.SaveMessage("INBOX", testMessage(1, "kept", "<1@example.com>", "kept body"), fs, "backup"))
+	assert.NoError(t, backup.SaveMessage("INBOX", testMessage(2, "expunged", "<2@example.com>", "expunged body"), fs, "backup"))
+	backup.HandleExpunge("INBOX", 2)
+
+	recompressed, err := backup.Recompress(CompressionZstd)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, recompressed)
+
+	metadata, err := ReadMetadata(fs, "backup", "INBOX")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(metadata))
+	for _, record := range metadata {
+		assert.True(t, strings.HasSuffix(record.Path, ".eml.zst"), record.Path)
+		_, err := hackpadfs.Stat(fs, path.Join("backup", record.Path))
+		assert.NoError(t, err)
+	}
+	assert.True(t, strings.HasPrefix(metadata[1].Path, deletedDir+"/"))
+
+	indexed, err := hackpadfs.ReadFile(fs, path.Join("backup", getUidIndexPath("INBOX", 1, 1)))
+	assert.NoError(t, err)
+	assert.Equal(t, metadata[0].Path, string(indexed))
+
+	messages := walkBackup(t, fs, "backup")
+	assert.Equal(t, 1, len(messages))
+	assert.Equal(t, "kept body", messages[0].body)
+
+	recompressed, err = backup.Recompress(CompressionZstd)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, recompressed)
+
+	// a later expunge finds the renamed file
+	backup.HandleExpunge("INBOX", 1)
+	assert.Equal(t, 0, len(walkBackup(t, fs, "backup")))
+}
+
+// openCountingFS counts how often files are opened for reading
+type openCountingFS struct {
+	memFS
+	opens map[string]int
+}
+
+func (f openCountingFS) Open(name string) (fs.File, error) {
+	f.opens[name]++
+	return f.memFS.Open(name)
+}
+
+func TestRecompressReadsMetadataOnce(t *testing.T) {
+	fs := openCountingFS{newMemFS(t), map[string]int{}}
+	backup := newTestBackup(t, fs, Config{BackupDir: "backup"})
+	backup.HandleUidValidity("INBOX", 1)
+
+	for uid := uint32(1); uid <= 3; uid++ {
+		body := fmt.Sprintf("body %d", uid)
+		assert.NoError(t, backup.SaveMessage("INBOX", testMessage(uid, body, "", body), fs, "backup"))
+	}
+
+	clear(fs.opens)
+	recompressed, err := backup.Recompress(CompressionGzip)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, recompressed)
+	assert.Equal(t, 1, fs.opens[GetMetadataPath("backup", "INBOX")])
+
+	metadata, err := ReadMetadata(fs, "backup", "INBOX")
+	assert.NoError(t, err)
+	for _, record := range metadata {
+		assert.True(t, strings.HasSuffix(record.Path, ".eml.gz"), record.Path)
+	}
+}
@@ -0,0 +1,998 @@
+package imap_backup
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hack-pad/hackpadfs"
+	"golang.org/x/crypto/scrypt"
+)
+
+// An encrypted file starts with a header of
+//
+//	magic (8) | salt (16) | key id (8) | file nonce (16)
+//
+// followed by records of encryptionRecordSize bytes of plaintext, of which
+// only the last may be shorter, and a final record
+//
+//	ciphertext length (4, big endian, high bit set in the final record) | nonce (12) | ciphertext
+//
+// whose plaintext is the plaintext size of the file (8, big endian). Records
+// are sealed with AES-256-GCM on their own so that files can be appended to
+// and read from an offset. The additional data of a record is
+//
+//	file nonce (16) | record index (8, big endian) | final (1)
+//
+// As all records but the last ones have the same size, the plaintext size
+// and the record of an offset follow from the size of the file. Appending
+// overwrites the last record and the final record, so a file has exactly
+// one final record at its end, and changed, reordered, dropped or cut off
+// records are detected. Replacing a file by an older version of it is not.
+// The key of a file is derived from the master key and the file nonce, the
+// master key of a passphrase is derived with scrypt and the salt.
+const encryptionMagic = "IMAPENC\x01"
+
+const (
+	encryptionSaltSize      = 16
+	encryptionKeyIdSize     = 8
+	encryptionFileNonceSize = 16
+	encryptionHeaderSize    = len(encryptionMagic) + encryptionSaltSize + encryptionKeyIdSize + encryptionFileNonceSize
+	encryptionKeySize       = 32
+	encryptionNonceSize     = 12
+	encryptionTagSize       = 16
+	encryptionRecordSize    = 64 * 1024
+	// encryptionFinalFlag marks the final record in the ciphertext length
+	encryptionFinalFlag        = 1 << 31
+	encryptionTrailerSize      = 8
+	encryptionRecordHeaderSize = 4 + encryptionNonceSize
+	encryptionFullRecordSize   = encryptionRecordHeaderSize + encryptionRecordSize + encryptionTagSize
+	encryptionFinalRecordSize  = encryptionRecordHeaderSize + encryptionTrailerSize + encryptionTagSize
+)
+
+// ErrNoEncryptionKey is returned when a file is written without a key
+var ErrNoEncryptionKey = errors.New("no encryption key configured")
+
+// EncryptionKey is a passphrase or a key file
+type EncryptionKey struct {
+	// Passphrase derives the key with scrypt
+	Passphrase string `json:"passphrase" yaml:"passphrase"`
+	// KeyFile is a local file with a key of 32 random bytes, raw or hex encoded
+	KeyFile string `json:"keyFile" yaml:"keyFile"`
+}
+
+type EncryptionConfig struct {
+	// the key that encrypts new files
+	EncryptionKey `json:",inline" yaml:",inline"`
+	// OldKeys decrypt files that were written before the key was rotated
+	OldKeys []EncryptionKey `json:"oldKeys" yaml:"oldKeys"`
+}
+
+// EncryptionConfigFromFlags returns the config of a key file and of the
+// passphrase in the environment variable passphraseEnv, or nil if neither is
+// given
+func EncryptionConfigFromFlags(keyFile string, passphraseEnv string) (*EncryptionConfig, error) {
+	key := EncryptionKey{KeyFile: keyFile}
+	if passphraseEnv != "" {
+		key.Passphrase = os.Getenv(passphraseEnv)
+		if key.Passphrase == "" {
+			return nil, fmt.Errorf("environment variable %s is empty", passphraseEnv)
+		}
+	}
+
+	if key == (EncryptionKey{}) {
+		return nil, nil
+	}
+	return &EncryptionConfig{EncryptionKey: key}, nil
+}
+
+// Keyring holds the keys of an encrypted backup. The first key encrypts, all
+// keys decrypt.
+type Keyring struct {
+	keys []keySource
+
+	lock    sync.Mutex
+	derived map[derivedKey][]byte
+}
+
+type keySource struct {
+	passphrase []byte
+	raw        []byte
+}
+
+type derivedKey struct {
+	key  int
+	salt string
+}
+
+// NewKeyring loads the keys of cfg. A keyring without config has no keys and
+// only reads unencrypted files.
+func NewKeyring(cfg *EncryptionConfig) (*Keyring, error) {
+	keyring := &Keyring{derived: map[derivedKey][]byte{}}
+	if cfg == nil {
+		return keyring, nil
+	}
+
+	for n, key := range append([]EncryptionKey{cfg.EncryptionKey}, cfg.OldKeys...) {
+		source, err := loadKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %d: %w", n, err)
+		}
+		keyring.keys = append(keyring.keys, source)
+	}
+	return keyring, nil
+}
+
+func loadKey(key EncryptionKey) (keySource, error) {
+	switch {
+	case key.Passphrase != "" && key.KeyFile != "":
+		return keySource{}, errors.New("passphrase and keyFile are mutually exclusive")
+	case key.Passphrase != "":
+		return keySource{passphrase: []byte(key.Passphrase)}, nil
+	case key.KeyFile == "":
+		return keySource{}, errors.New("passphrase or keyFile is required")
+	}
+
+	content, err := os.ReadFile(key.KeyFile)
+	if err != nil {
+		return keySource{}, err
+	}
+	if len(content) == encryptionKeySize {
+		return keySource{raw: content}, nil
+	}
+
+	raw, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(raw) != encryptionKeySize {
+		return keySource{}, fmt.Errorf("%s does not contain a key of %d bytes", key.KeyFile, encryptionKeySize)
+	}
+	return keySource{raw: raw}, nil
+}
+
+// masterKey returns the master key of the nth key for salt
+func (k *Keyring) masterKey(n int, salt []byte) ([]byte, error) {
+	source := k.keys[n]
+	if source.raw != nil {
+		return source.raw, nil
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	cacheKey := derivedKey{key: n, salt: string(salt)}
+	if key, ok := k.derived[cacheKey]; ok {
+		return key, nil
+	}
+
+	key, err := scrypt.Key(source.passphrase, salt, 1<<15, 8, 1, encryptionKeySize)
+	if err != nil {
+		return nil, err
+	}
+	k.derived[cacheKey] = key
+	return key, nil
+}
+
+func keyIdOf(masterKey []byte) []byte {
+	sum := sha256.Sum256(append([]byte("imap-mirror key id\x00"), masterKey...))
+	return sum[:encryptionKeyIdSize]
+}
+
+// isCurrent reports whether header was written with the key that encrypts
+// new files
+func (k *Keyring) isCurrent(header encryptionHeader) (bool, error) {
+	if len(k.keys) == 0 {
+		return false, ErrNoEncryptionKey
+	}
+
+	masterKey, err := k.masterKey(0, header.salt)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(keyIdOf(masterKey), header.keyId), nil
+}
+
+// aead returns the cipher of the file with header
+func (k *Keyring) aead(header encryptionHeader) (cipher.AEAD, error) {
+	for n := range k.keys {
+		masterKey, err := k.masterKey(n, header.salt)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(keyIdOf(masterKey), header.keyId) {
+			return fileAead(masterKey, header.fileNonce)
+		}
+	}
+	return nil, errors.New("none of the encryption keys matches")
+}
+
+func fileAead(masterKey []byte, fileNonce []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, masterKey, fileNonce, "imap-mirror file key", encryptionKeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type encryptionHeader struct {
+	salt      []byte
+	keyId     []byte
+	fileNonce []byte
+}
+
+func (h encryptionHeader) bytes() []byte {
+	header := make([]byte, 0, encryptionHeaderSize)
+	header = append(header, encryptionMagic...)
+	header = append(header, h.salt...)
+	header = append(header, h.keyId...)
+	return append(header, h.fileNonce...)
+}
+
+// readEncryptionHeader reads the header of a file. It returns the bytes read
+// if the file is not encrypted.
+func readEncryptionHeader(r io.Reader) (encryptionHeader, bool, []byte, error) {
+	header := make([]byte, encryptionHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return encryptionHeader{}, false, nil, err
+	}
+
+	if n < len(encryptionMagic) || string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return encryptionHeader{}, false, header[:n], nil
+	} else if n < encryptionHeaderSize {
+		return encryptionHeader{}, false, nil, errors.New("encryption header is truncated")
+	}
+
+	rest := header[len(encryptionMagic):]
+	return encryptionHeader{
+		salt:      rest[:encryptionSaltSize],
+		keyId:     rest[encryptionSaltSize : encryptionSaltSize+encryptionKeyIdSize],
+		fileNonce: rest[encryptionSaltSize+encryptionKeyIdSize:],
+	}, true, nil, nil
+}
+
+// readRecordHeader returns the ciphertext length and nonce of the next
+// record and whether it is the final record, or io.EOF at the end of the
+// file
+func readRecordHeader(r io.Reader) (int, bool, []byte, error) {
+	header := make([]byte, encryptionRecordHeaderSize)
+	_, err := io.ReadFull(r, header)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, false, nil, errors.New("encrypted record is truncated")
+	} else if err != nil {
+		return 0, false, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header)
+	final := length&encryptionFinalFlag != 0
+	length &^= encryptionFinalFlag
+	switch {
+	case final && length != encryptionTrailerSize+encryptionTagSize,
+		!final && (length <= encryptionTagSize || length > encryptionRecordSize+encryptionTagSize):
+		return 0, false, nil, fmt.Errorf("invalid encrypted record length %d", length)
+	}
+	return int(length), final, header[4:], nil
+}
+
+// encryptedLayout returns the plaintext size and the number of records
+// before the final record of an encrypted file of fileSize bytes. It reports
+// false if no file has that size.
+func encryptedLayout(fileSize int64) (int64, uint64, bool) {
+	data := fileSize - int64(encryptionHeaderSize+encryptionFinalRecordSize)
+	if data < 0 {
+		return 0, 0, false
+	}
+
+	records := data / encryptionFullRecordSize
+	size := records * encryptionRecordSize
+	if rest := data % encryptionFullRecordSize; rest > 0 {
+		if rest <= encryptionRecordHeaderSize+encryptionTagSize {
+			return 0, 0, false
+		}
+		size += rest - encryptionRecordHeaderSize - encryptionTagSize
+		records++
+	}
+	return size, uint64(records), true
+}
+
+// recordOffset returns the file offset of the record at index
+func recordOffset(index uint64) int64 {
+	return int64(encryptionHeaderSize) + int64(index)*encryptionFullRecordSize
+}
+
+// recordData returns the additional data of the record at index
+func recordData(fileNonce []byte, index uint64, final bool) []byte {
+	data := make([]byte, 0, len(fileNonce)+9)
+	data = append(data, fileNonce...)
+	data = binary.BigEndian.AppendUint64(data, index)
+	if final {
+		return append(data, 1)
+	}
+	return append(data, 0)
+}
+
+func sealRecord(aead cipher.AEAD, fileNonce []byte, index uint64, final bool, plaintext []byte) []byte {
+	record := make([]byte, 4+encryptionNonceSize, 4+encryptionNonceSize+len(plaintext)+encryptionTagSize)
+	rand.Read(record[4:])
+	record = aead.Seal(record, record[4:], plaintext, recordData(fileNonce, index, final))
+	length := uint32(len(record) - encryptionRecordHeaderSize)
+	if final {
+		length |= encryptionFinalFlag
+	}
+	binary.BigEndian.PutUint32(record, length)
+	return record
+}
+
+// EncryptedFS encrypts the files written to the wrapped FS and decrypts them
+// when they are read. Unencrypted files are read as they are and encrypted
+// before they are appended to.
+type EncryptedFS struct {
+	fs      FS
+	keyring *Keyring
+	// salt of the files written by this FS, so that a passphrase is derived
+	// once
+	salt []byte
+}
+
+var _ FS = &EncryptedFS{}
+
+func NewEncryptedFS(fileSystem FS, keyring *Keyring) *EncryptedFS {
+	salt := make([]byte, encryptionSaltSize)
+	rand.Read(salt)
+	return &EncryptedFS{fs: fileSystem, keyring: keyring, salt: salt}
+}
+
+// WithEncryption wraps fileSystem in an EncryptedFS if cfg is set
+func WithEncryption(fileSystem FS, cfg *EncryptionConfig) (FS, error) {
+	if cfg == nil {
+		return fileSystem, nil
+	}
+
+	keyring, err := NewKeyring(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewEncryptedFS(fileSystem, keyring), nil
+}
+
+func (e *EncryptedFS) newHeader() (encryptionHeader, cipher.AEAD, error) {
+	if len(e.keyring.keys) == 0 {
+		return encryptionHeader{}, nil, ErrNoEncryptionKey
+	}
+
+	masterKey, err := e.keyring.masterKey(0, e.salt)
+	if err != nil {
+		return encryptionHeader{}, nil, err
+	}
+
+	header := encryptionHeader{salt: e.salt, keyId: keyIdOf(masterKey), fileNonce: make([]byte, encryptionFileNonceSize)}
+	rand.Read(header.fileNonce)
+	aead, err := fileAead(masterKey, header.fileNonce)
+	return header, aead, err
+}
+
+func (e *EncryptedFS) Open(name string) (fs.File, error) {
+	return e.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (e *EncryptedFS) OpenFile(name string, flag int, perm os.FileMode) (fs.File, error) {
+	switch {
+	case flag&(os.O_WRONLY|os.O_RDWR) == 0:
+		return e.openForReading(name, flag, perm)
+	case flag&os.O_RDWR != 0:
+		return nil, fmt.Errorf("failed to open %s. encrypted files are either read or written", name)
+	case flag&os.O_APPEND != 0:
+		return e.openForAppending(name, flag, perm)
+	}
+	return e.create(name, flag|os.O_TRUNC, perm)
+}
+
+func (e *EncryptedFS) openForReading(name string, flag int, perm os.FileMode) (fs.File, error) {
+	file, err := e.fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	} else if info.IsDir() {
+		return file, nil
+	}
+
+	header, encrypted, prefix, err := readEncryptionHeader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+
+	if !encrypted {
+		if seeker, ok := file.(io.Seeker); ok {
+			_, err := seeker.Seek(0, io.SeekStart)
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+			return file, nil
+		}
+		return &prefixedFile{File: file, reader: io.MultiReader(bytes.NewReader(prefix), file)}, nil
+	}
+
+	aead, err := e.keyring.aead(header)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to decrypt %s: %w", name, err)
+	}
+	return &decryptingFile{File: file, fs: e, name: name, aead: aead, fileNonce: header.fileNonce}, nil
+}
+
+func (e *EncryptedFS) create(name string, flag int, perm os.FileMode) (fs.File, error) {
+	header, aead, err := e.newHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := e.fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	writer, ok := file.(io.Writer)
+	if !ok {
+		file.Close()
+		return nil, fmt.Errorf("failed to write %s. file is not an io.Writer", name)
+	}
+
+	_, err = writer.Write(header.bytes())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &encryptingFile{File: file, writer: writer, aead: aead, fileNonce: header.fileNonce}, nil
+}
+
+func (e *EncryptedFS) openForAppending(name string, flag int, perm os.FileMode) (fs.File, error) {
+	header, encrypted, empty, err := e.inspect(name)
+	if errors.Is(err, hackpadfs.ErrNotExist) || empty {
+		return e.create(name, flag&^os.O_APPEND|os.O_TRUNC, perm)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !encrypted {
+		err := e.encryptInPlace(name, perm)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt %s: %w", name, err)
+		}
+
+		header, _, _, err = e.inspect(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	aead, err := e.keyring.aead(header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %w", name, err)
+	}
+
+	size, last, err := e.tail(name, aead, header.fileNonce)
+	if err != nil {
+		return nil, err
+	}
+
+	// the last record is written again with the appended plaintext
+	file, err := e.fs.OpenFile(name, flag&^os.O_APPEND, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	writer, ok := file.(io.WriteSeeker)
+	if !ok {
+		file.Close()
+		return nil, fmt.Errorf("failed to write %s. file is not an io.WriteSeeker", name)
+	}
+
+	index := uint64(size / encryptionRecordSize)
+	_, err = writer.Seek(recordOffset(index), io.SeekStart)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &encryptingFile{
+		File:      file,
+		writer:    writer,
+		aead:      aead,
+		fileNonce: header.fileNonce,
+		index:     index,
+		written:   size - int64(len(last)),
+		buffer:    last,
+	}, nil
+}
+
+// tail returns the plaintext size of the encrypted file at name and the
+// plaintext of its last record if that is not full. It reads the final
+// record and the last record only.
+func (e *EncryptedFS) tail(name string, aead cipher.AEAD, fileNonce []byte) (int64, []byte, error) {
+	file, err := e.fs.Open(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, nil, err
+	}
+	size, records, ok := encryptedLayout(info.Size())
+	if !ok {
+		return 0, nil, fmt.Errorf("encrypted file %s is truncated", name)
+	}
+
+	seeker, ok := file.(io.Seeker)
+	if !ok {
+		return 0, nil, fmt.Errorf("failed to read %s. file is not an io.Seeker", name)
+	}
+	reader := &decryptingFile{File: file, fs: e, name: name, aead: aead, fileNonce: fileNonce}
+
+	// the final record checks the size
+	_, err = seeker.Seek(info.Size()-encryptionFinalRecordSize, io.SeekStart)
+	if err != nil {
+		return 0, nil, err
+	}
+	reader.index, reader.offset = records, size
+	_, err = reader.nextRecord()
+	if err == nil && !reader.final {
+		err = errors.New("the last record is not the final record")
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("encrypted file %s is truncated: %w", name, err)
+	}
+
+	if size%encryptionRecordSize == 0 {
+		return size, nil, nil
+	}
+	_, err = seeker.Seek(recordOffset(records-1), io.SeekStart)
+	if err != nil {
+		return 0, nil, err
+	}
+	reader.index, reader.final = records-1, false
+	last, err := reader.nextRecord()
+	if err != nil {
+		return 0, nil, err
+	}
+	return size, last, nil
+}
+
+// inspect returns the encryption header of the file at name
+func (e *EncryptedFS) inspect(name string) (header encryptionHeader, encrypted bool, empty bool, err error) {
+	file, err := e.fs.Open(name)
+	if err != nil {
+		return encryptionHeader{}, false, false, err
+	}
+	defer file.Close()
+
+	header, encrypted, prefix, err := readEncryptionHeader(file)
+	return header, encrypted, !encrypted && len(prefix) == 0, err
+}
+
+// encryptInPlace replaces the unencrypted file at name by its encryption
+func (e *EncryptedFS) encryptInPlace(name string, perm os.FileMode) error {
+	info, err := hackpadfs.Stat(e.fs, name)
+	if err != nil {
+		return err
+	}
+
+	file, err := e.fs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	tmpPath := name + ".encrypting"
+	err = writeFileFrom(e, tmpPath, file)
+	if err != nil {
+		e.fs.Remove(tmpPath)
+		return err
+	}
+	file.Close()
+
+	err = e.fs.Rename(tmpPath, name)
+	if err != nil {
+		return err
+	}
+	return e.fs.Chtimes(name, time.Now(), info.ModTime())
+}
+
+func (e *EncryptedFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return writeFileFrom(e, name, bytes.NewReader(data))
+}
+
+// Stat returns the plaintext size of encrypted files, which follows from the
+// size of the file
+func (e *EncryptedFS) Stat(name string) (fs.FileInfo, error) {
+	info, err := hackpadfs.Stat(e.fs, name)
+	if err != nil || info.IsDir() {
+		return info, err
+	}
+
+	file, err := e.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	_, encrypted, _, err := readEncryptionHeader(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	} else if !encrypted {
+		return info, nil
+	}
+
+	size, _, ok := encryptedLayout(info.Size())
+	if !ok {
+		return nil, fmt.Errorf("encrypted file %s is truncated", name)
+	}
+	return plaintextInfo{FileInfo: info, size: size}, nil
+}
+
+type plaintextInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (i plaintextInfo) Size() int64 {
+	return i.size
+}
+
+func (e *EncryptedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return hackpadfs.ReadDir(e.fs, name)
+}
+
+func (e *EncryptedFS) MkdirAll(name string, perm os.FileMode) error {
+	return e.fs.MkdirAll(name, perm)
+}
+
+func (e *EncryptedFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return e.fs.Chtimes(name, atime, mtime)
+}
+
+func (e *EncryptedFS) Rename(oldpath, newpath string) error {
+	return e.fs.Rename(oldpath, newpath)
+}
+
+func (e *EncryptedFS) Remove(name string) error {
+	return e.fs.Remove(name)
+}
+
+// Rekey encrypts all files below dir that are unencrypted or encrypted with
+// an old key with the current key and returns the number of rewritten files.
+// Files for which skip returns true are left alone.
+func (e *EncryptedFS) Rekey(dir string, skip func(filePath string) bool) (int, error) {
+	var files []string
+	err := hackpadfs.WalkDir(e.fs, dir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() && (skip == nil || !skip(filePath)) {
+			files = append(files, filePath)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	rekeyed := 0
+	for _, filePath := range files {
+		header, encrypted, empty, err := e.inspect(filePath)
+		if err != nil {
+			return rekeyed, fmt.Errorf("failed to read %s: %w", filePath, err)
+		}
+		if empty {
+			continue
+		}
+
+		if encrypted {
+			current, err := e.keyring.isCurrent(header)
+			if err != nil {
+				return rekeyed, err
+			} else if current {
+				continue
+			}
+		}
+
+		err = e.rekeyFile(filePath)
+		if err != nil {
+			return rekeyed, fmt.Errorf("failed to rekey %s: %w", filePath, err)
+		}
+		rekeyed++
+	}
+	return rekeyed, nil
+}
+
+func (e *EncryptedFS) rekeyFile(filePath string) error {
+	info, err := hackpadfs.Stat(e.fs, filePath)
+	if err != nil {
+		return err
+	}
+
+	file, err := e.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	tmpPath := filePath + ".rekey"
+	err = writeFileFrom(e, tmpPath, file)
+	if err != nil {
+		e.fs.Remove(tmpPath)
+		return err
+	}
+	file.Close()
+
+	err = e.fs.Rename(tmpPath, filePath)
+	if err != nil {
+		return err
+	}
+	return e.fs.Chtimes(filePath, time.Now(), info.ModTime())
+}
+
+// prefixedFile is an unencrypted file that cannot seek back to the bytes
+// read to check for the encryption header
+type prefixedFile struct {
+	fs.File
+	reader io.Reader
+}
+
+func (f *prefixedFile) Read(p []byte) (int, error) {
+	return f.reader.Read(p)
+}
+
+type encryptingFile struct {
+	fs.File
+	writer    io.Writer
+	aead      cipher.AEAD
+	fileNonce []byte
+	// index is the index of the next record
+	index uint64
+	// written is the plaintext size of the records before the buffer
+	written int64
+	buffer  []byte
+	closed  bool
+}
+
+func (f *encryptingFile) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), encryptionRecordSize-len(f.buffer))
+		f.buffer = append(f.buffer, p[:n]...)
+		p = p[n:]
+		written += n
+
+		if len(f.buffer) == encryptionRecordSize {
+			if err := f.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (f *encryptingFile) flush() error {
+	if len(f.buffer) == 0 {
+		return nil
+	}
+
+	_, err := f.writer.Write(sealRecord(f.aead, f.fileNonce, f.index, false, f.buffer))
+	f.written += int64(len(f.buffer))
+	f.buffer = f.buffer[:0]
+	f.index++
+	return err
+}
+
+// Close writes the buffered plaintext and the final record
+func (f *encryptingFile) Close() error {
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+
+	err := f.flush()
+	if err == nil {
+		trailer := binary.BigEndian.AppendUint64(nil, uint64(f.written))
+		_, err = f.writer.Write(sealRecord(f.aead, f.fileNonce, f.index, true, trailer))
+	}
+	return errors.Join(err, f.File.Close())
+}
+
+type decryptingFile struct {
+	fs.File
+	fs        *EncryptedFS
+	name      string
+	aead      cipher.AEAD
+	fileNonce []byte
+	// record is the unread plaintext of the current record
+	record []byte
+	// offset is the plaintext offset of the next read
+	offset int64
+	// index is the index of the next record
+	index uint64
+	// short is set if the last record read was not full, it must be the last
+	// one before the final record
+	short bool
+	// final is set once the final record was read
+	final bool
+}
+
+func (f *decryptingFile) Read(p []byte) (int, error) {
+	for len(f.record) == 0 {
+		if f.final {
+			return 0, io.EOF
+		}
+
+		var err error
+		f.record, err = f.nextRecord()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, f.record)
+	f.record = f.record[n:]
+	f.offset += int64(n)
+	return n, nil
+}
+
+// nextRecord reads and opens the next record. The final record must have
+// the plaintext size read so far and end the file.
+func (f *decryptingFile) nextRecord() ([]byte, error) {
+	length, final, nonce, err := readRecordHeader(f.File)
+	if errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("encrypted file %s is truncated", f.name)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", f.name, err)
+	}
+	if !final && f.short {
+		return nil, fmt.Errorf("encrypted file %s has a short record before its end", f.name)
+	}
+
+	ciphertext := make([]byte, length)
+	_, err = io.ReadFull(f.File, ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("encrypted record of %s is truncated: %w", f.name, err)
+	}
+
+	plaintext, err := f.aead.Open(ciphertext[:0], nonce, ciphertext, recordData(f.fileNonce, f.index, final))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt record %d of %s: %w", f.index, f.name, err)
+	}
+	f.index++
+
+	if !final {
+		f.short = len(plaintext) < encryptionRecordSize
+		return plaintext, nil
+	}
+
+	if size := int64(binary.BigEndian.Uint64(plaintext)); size != f.offset {
+		return nil, fmt.Errorf("encrypted file %s is truncated. it has %d of %d bytes", f.name, f.offset, size)
+	}
+	if n, _ := f.File.Read(make([]byte, 1)); n > 0 {
+		return nil, fmt.Errorf("encrypted file %s continues after its final record", f.name)
+	}
+	f.final = true
+	return nil, nil
+}
+
+// Seek moves to a plaintext offset. The record of the offset follows from
+// the size of the file.
+func (f *decryptingFile) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := f.File.(io.Seeker)
+	if !ok {
+		return 0, fmt.Errorf("failed to seek %s. file is not an io.Seeker", f.name)
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	default:
+		return 0, fmt.Errorf("failed to seek %s. whence %d is not supported", f.name, whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("failed to seek %s. negative offset", f.name)
+	}
+
+	info, err := f.File.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size, _, ok := encryptedLayout(info.Size())
+	if !ok {
+		return 0, fmt.Errorf("encrypted file %s is truncated", f.name)
+	}
+
+	target := min(offset, size)
+	index := uint64(target / encryptionRecordSize)
+	_, err = seeker.Seek(recordOffset(index), io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	f.record = nil
+	f.offset = int64(index) * encryptionRecordSize
+	f.index = index
+	f.short = false
+	f.final = false
+
+	if target > f.offset {
+		record, err := f.nextRecord()
+		if err != nil {
+			return 0, err
+		}
+
+		f.record = record[target-f.offset:]
+		f.offset = target
+	}
+	return offset, nil
+}
+
+func (f *decryptingFile) Stat() (fs.FileInfo, error) {
+	return f.fs.Stat(f.name)
+}
+
+// CopyTree copies the files below srcDir to dstDir and keeps their
+// modification times. Copying from an EncryptedFS decrypts the files, copying
+// to one encrypts them.
+func CopyTree(src FS, srcDir string, dst FS, dstDir string) (int, error) {
+	copied := 0
+	err := hackpadfs.WalkDir(src, srcDir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		relPath := strings.TrimPrefix(strings.TrimPrefix(filePath, srcDir), "/")
+		dstPath := path.Join(dstDir, relPath)
+		err = dst.MkdirAll(path.Dir(dstPath), os.ModePerm)
+		if err != nil {
+			return err
+		}
+
+		file, err := src.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		err = writeFileFrom(dst, dstPath, file)
+		if err != nil {
+			return fmt.Errorf("failed to copy %s: %w", filePath, err)
+		}
+
+		copied++
+		return dst.Chtimes(dstPath, time.Now(), info.ModTime())
+	})
+	return copied, err
+}
@@ -0,0 +1,327 @@
+package imap_backup
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/hack-pad/hackpadfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestKeyring(t *testing.T, keys ...EncryptionKey) *Keyring {
+	cfg := &EncryptionConfig{EncryptionKey: keys[0], OldKeys: keys[1:]}
+	keyring, err := NewKeyring(cfg)
+	assert.NoError(t, err)
+	return keyring
+}
+
+func TestEncryptionConfigFromFlags(t *testing.T) {
+	cfg, err := EncryptionConfigFromFlags("", "")
+	assert.NoError(t, err)
+	assert.Nil(t, cfg)
+
+	cfg, err = EncryptionConfigFromFlags("/run/secrets/backup.key", "")
+	assert.NoError(t, err)
+	assert.Equal(t, &EncryptionConfig{EncryptionKey: EncryptionKey{KeyFile: "/run/secrets/backup.key"}}, cfg)
+
+	t.Setenv("TEST_BACKUP_PASSPHRASE", "secret")
+	cfg, err = EncryptionConfigFromFlags("", "TEST_BACKUP_PASSPHRASE")
+	assert.NoError(t, err)
+	assert.Equal(t, &EncryptionConfig{EncryptionKey: EncryptionKey{Passphrase: "secret"}}, cfg)
+
+	_, err = EncryptionConfigFromFlags("", "TEST_BACKUP_PASSPHRASE_UNSET")
+	assert.ErrorContains(t, err, "is empty")
+}
+
+func TestEncryptedFSRoundTrip(t *testing.T) {
+	fs := newMemFS(t)
+	encrypted := NewEncryptedFS(fs, newTestKeyring(t, EncryptionKey{Passphrase: "secret"}))
+	assert.NoError(t, fs.MkdirAll("backup", os.ModePerm))
+
+	content := bytes.Repeat([]byte("0123456789"), encryptionRecordSize/5)
+	assert.NoError(t, encrypted.WriteFile("backup/message.eml", content, os.ModePerm))
+
+	raw, err := hackpadfs.ReadFile(fs, "backup/message.eml")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(raw), encryptionMagic))
+	assert.False(t, bytes.Contains(raw, []byte("0123456789")))
+
+	decrypted, err := hackpadfs.ReadFile(encrypted, "backup/message.eml")
+	assert.NoError(t, err)
+	assert.Equal(t, content, decrypted)
+
+	info, err := encrypted.Stat("backup/message.eml")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), info.Size())
+
+	file, err := encrypted.Open("backup/message.eml")
+	assert.NoError(t, err)
+	defer file.Close()
+	offset := int64(encryptionRecordSize + 3)
+	_, err = file.(io.Seeker).Seek(offset, io.SeekStart)
+	assert.NoError(t, err)
+	rest, err := io.ReadAll(file)
+	assert.NoError(t, err)
+	assert.Equal(t, content[offset:], rest)
+
+	// a wrong passphrase does not decrypt
+	other := NewEncryptedFS(fs, newTestKeyring(t, EncryptionKey{Passphrase: "other"}))
+	_, err = hackpadfs.ReadFile(other, "backup/message.eml")
+	assert.Error(t, err)
+
+	copied, err := CopyTree(encrypted, "backup", fs, "plain")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, copied)
+	plain, err := hackpadfs.ReadFile(fs, "plain/message.eml")
+	assert.NoError(t, err)
+	assert.Equal(t, content, plain)
+}
+
+func TestEncryptedFSAppend(t *testing.T) {
+	fs := newMemFS(t)
+	encrypted := NewEncryptedFS(fs, newTestKeyring(t, EncryptionKey{Passphrase: "secret"}))
+	assert.NoError(t, fs.MkdirAll("backup", os.ModePerm))
+
+	// unencrypted files are encrypted before they are appended to
+	assert.NoError(t, fs.WriteFile("backup/INBOX.jsonl", []byte("plain\n"), os.ModePerm))
+	for _, line := range []string{"first\n", "second\n"} {
+		_, err := appendToFile(encrypted, "backup/INBOX.jsonl", func(w io.Writer) error {
+			_, err := w.Write([]byte(line))
+			return err
+		})
+		assert.NoError(t, err)
+	}
+
+	raw, err := hackpadfs.ReadFile(fs, "backup/INBOX.jsonl")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(raw), encryptionMagic))
+
+	content, err := hackpadfs.ReadFile(encrypted, "backup/INBOX.jsonl")
+	assert.NoError(t, err)
+	assert.Equal(t, "plain\nfirst\nsecond\n", string(content))
+
+	info, err := encrypted.Stat("backup/INBOX.jsonl")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), info.Size())
+}
+
+func TestEncryptedFSRejectsChangedRecords(t *testing.T) {
+	fs := newMemFS(t)
+	encrypted := NewEncryptedFS(fs, newTestKeyring(t, EncryptionKey{Passphrase: "secret"}))
+	assert.NoError(t, fs.MkdirAll("backup", os.ModePerm))
+
+	content := bytes.Repeat([]byte("0123456789"), encryptionRecordSize/5+1)
+	assert.NoError(t, encrypted.WriteFile("backup/message.eml", content, os.ModePerm))
+	written, err := hackpadfs.ReadFile(fs, "backup/message.eml")
+	assert.NoError(t, err)
+
+	for _, line := range []string{"appended", "again"} {
+		_, err := appendToFile(encrypted, "backup/message.eml", func(w io.Writer) error {
+			_, err := w.Write([]byte(line))
+			return err
+		})
+		assert.NoError(t, err)
+	}
+
+	raw, err := hackpadfs.ReadFile(fs, "backup/message.eml")
+	assert.NoError(t, err)
+	header, records := splitRecords(t, raw)
+	// two full records, the last record with the appended lines and the final
+	// record
+	assert.Equal(t, 4, len(records))
+
+	decrypted, err := hackpadfs.ReadFile(encrypted, "backup/message.eml")
+	assert.NoError(t, err)
+	assert.Equal(t, append(content, "appendedagain"...), decrypted)
+
+	join := func(records ...[]byte) []byte {
+		return bytes.Join(append([][]byte{header}, records...), nil)
+	}
+	tests := map[string][]byte{
+		"reordered":                             join(records[1], records[0], records[2], records[3]),
+		"dropped":                               join(records[0], records[2], records[3]),
+		"cut off":                               join(records[0], records[1]),
+		"final record dropped":                  join(records[0], records[1], records[2]),
+		"final record moved":                    join(records[0], records[1], records[3]),
+		"continued":                             append(join(records...), records[0]...),
+		"cut off at the end of the first write": raw[:len(written)],
+	}
+	for name, changed := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, fs.WriteFile("backup/changed.eml", changed, os.ModePerm))
+			_, err := hackpadfs.ReadFile(encrypted, "backup/changed.eml")
+			assert.Error(t, err)
+		})
+	}
+
+	// a cut off file is not appended to
+	assert.NoError(t, fs.WriteFile("backup/changed.eml", join(records[0], records[1]), os.ModePerm))
+	_, err = appendToFile(encrypted, "backup/changed.eml", func(w io.Writer) error {
+		_, err := w.Write([]byte("appended"))
+		return err
+	})
+	assert.ErrorContains(t, err, "truncated")
+}
+
+// splitRecords splits an encrypted file into its header and records
+func splitRecords(t *testing.T, raw []byte) ([]byte, [][]byte) {
+	header, rest := raw[:encryptionHeaderSize], raw[encryptionHeaderSize:]
+
+	var records [][]byte
+	for len(rest) > 0 {
+		length, _, _, err := readRecordHeader(bytes.NewReader(rest))
+		assert.NoError(t, err)
+		size := encryptionRecordHeaderSize + length
+		records = append(records, rest[:size])
+		rest = rest[size:]
+	}
+	return header, records
+}
+
+// readCountingFS counts the bytes read from its files
+type readCountingFS struct {
+	memFS
+	read *int64
+}
+
+type readCountingFile struct {
+	hackpadfs.File
+	read *int64
+}
+
+func (f readCountingFS) OpenFile(name string, flag int, perm os.FileMode) (hackpadfs.File, error) {
+	file, err := f.memFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return readCountingFile{file, f.read}, nil
+}
+
+func (f readCountingFS) Open(name string) (hackpadfs.File, error) {
+	return f.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (f readCountingFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	*f.read += int64(n)
+	return n, err
+}
+
+func (f readCountingFile) Write(p []byte) (int, error) {
+	return hackpadfs.WriteFile(f.File, p)
+}
+
+func (f readCountingFile) Seek(offset int64, whence int) (int64, error) {
+	return hackpadfs.SeekFile(f.File, offset, whence)
+}
+
+func TestEncryptedFSAppendsAndSeeksWithoutReadingTheFile(t *testing.T) {
+	fs := readCountingFS{newMemFS(t), new(int64)}
+	encrypted := NewEncryptedFS(fs, newTestKeyring(t, EncryptionKey{Passphrase: "secret"}))
+
+	content := bytes.Repeat([]byte("0123456789"), encryptionRecordSize)
+	assert.NoError(t, encrypted.WriteFile("large.jsonl", content, os.ModePerm))
+
+	// the final record and the last record are read
+	*fs.read = 0
+	_, err := appendToFile(encrypted, "large.jsonl", func(w io.Writer) error {
+		_, err := w.Write([]byte("line\n"))
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Less(t, *fs.read, int64(2*encryptionFullRecordSize))
+
+	*fs.read = 0
+	info, err := encrypted.Stat("large.jsonl")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)+len("line\n")), info.Size())
+	assert.Less(t, *fs.read, int64(encryptionFullRecordSize))
+
+	file, err := encrypted.Open("large.jsonl")
+	assert.NoError(t, err)
+	defer file.Close()
+	*fs.read = 0
+	_, err = file.(io.Seeker).Seek(int64(len(content)), io.SeekStart)
+	assert.NoError(t, err)
+	rest, err := io.ReadAll(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "line\n", string(rest))
+	assert.Less(t, *fs.read, int64(2*encryptionFullRecordSize))
+}
+
+func TestEncryptedFSReadsUnencryptedFiles(t *testing.T) {
+	fs := newMemFS(t)
+	assert.NoError(t, fs.MkdirAll("backup", os.ModePerm))
+	assert.NoError(t, fs.WriteFile("backup/message.eml", []byte("plain"), os.ModePerm))
+
+	keyring, err := NewKeyring(nil)
+	assert.NoError(t, err)
+	encrypted := NewEncryptedFS(fs, keyring)
+
+	content, err := hackpadfs.ReadFile(encrypted, "backup/message.eml")
+	assert.NoError(t, err)
+	assert.Equal(t, "plain", string(content))
+
+	assert.ErrorIs(t, encrypted.WriteFile("backup/other.eml", []byte("plain"), os.ModePerm), ErrNoEncryptionKey)
+}
+
+func TestEncryptedFSRekey(t *testing.T) {
+	fs := newMemFS(t)
+	keyFile := path.Join(t.TempDir(), "key")
+	assert.NoError(t, os.WriteFile(keyFile, []byte(strings.Repeat("ab", encryptionKeySize)+"\n"), 0600))
+
+	oldKey := EncryptionKey{Passphrase: "old"}
+	newKey := EncryptionKey{KeyFile: keyFile}
+
+	old := NewEncryptedFS(fs, newTestKeyring(t, oldKey))
+	assert.NoError(t, fs.MkdirAll("backup/INBOX", os.ModePerm))
+	assert.NoError(t, old.WriteFile("backup/INBOX/1.eml", []byte("first"), os.ModePerm))
+	assert.NoError(t, fs.WriteFile("backup/INBOX/2.eml", []byte("second"), os.ModePerm))
+	assert.NoError(t, fs.WriteFile("backup/.state.json", []byte("{}"), os.ModePerm))
+
+	rotated := NewEncryptedFS(fs, newTestKeyring(t, newKey, oldKey))
+	rekeyed, err := rotated.Rekey("backup", func(filePath string) bool {
+		return filePath == "backup/.state.json"
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, rekeyed)
+
+	// the old key is no longer needed
+	current := NewEncryptedFS(fs, newTestKeyring(t, newKey))
+	for name, expected := range map[string]string{"backup/INBOX/1.eml": "first", "backup/INBOX/2.eml": "second"} {
+		content, err := hackpadfs.ReadFile(current, name)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(content))
+	}
+
+	state, err := hackpadfs.ReadFile(fs, "backup/.state.json")
+	assert.NoError(t, err)
+	assert.Equal(t, "{}", string(state))
+
+	rekeyed, err = current.Rekey("backup", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, rekeyed)
+}
+
+func TestEncryptedBackupFormats(t *testing.T) {
+	for _, format := range []string{FormatEml, FormatMaildir, FormatMbox, FormatCas} {
+		t.Run(format, func(t *testing.T) {
+			fs := NewEncryptedFS(newMemFS(t), newTestKeyring(t, EncryptionKey{Passphrase: "secret"}))
+			backup := newTestBackup(t, fs, Config{BackupDir: "backup", Format: format})
+			backup.HandleUidValidity("INBOX", 1)
+
+			assert.NoError(t, backup.SaveMessage("INBOX", testMessage(1, "first", "<1@example.com>", "first body\r\n"), fs, "backup"))
+			assert.NoError(t, backup.SaveMessage("INBOX", testMessage(2, "second", "<2@example.com>", "second body\r\n"), fs, "backup"))
+
+			bodies := []string{}
+			for _, message := range walkBackup(t, fs, "backup") {
+				bodies = append(bodies, strings.TrimSpace(message.body))
+			}
+			assert.Equal(t, []string{"first body", "second body"}, bodies)
+		})
+	}
+}
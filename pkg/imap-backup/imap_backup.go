@@ -1,14 +1,16 @@
 package imap_backup
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path"
-	"regexp"
 	"strings"
+	"sync"
 	"time"
-	"unicode"
 	"unicode/utf8"
 
 	"github.com/emersion/go-imap"
@@ -16,87 +18,439 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+const uidIndexDir = ".uids"
+const deletedDir = "deleted"
+
 type FS interface {
 	hackpadfs.FS
+	hackpadfs.OpenFileFS
 	hackpadfs.WriteFileFS
 	hackpadfs.MkdirAllFS
 	hackpadfs.ChtimesFS
+	hackpadfs.RenameFS
+	hackpadfs.RemoveFS
 }
 
+// Backup formats
+const (
+	FormatEml     = "eml"
+	FormatMaildir = "maildir"
+	FormatMbox    = "mbox"
+	FormatCas     = "cas"
+)
+
 type Config struct {
 	BackupDir string `json:"backupDir" yaml:"backupDir"`
+	// Format is the layout of the backup: eml (default), maildir, mbox or cas
+	Format string `json:"backupFormat" yaml:"backupFormat"`
+	// Compression of the message files: none (default), gzip or zstd
+	Compression string `json:"backupCompression" yaml:"backupCompression"`
+	// Encryption encrypts the backup files if set
+	Encryption *EncryptionConfig `json:"encryption" yaml:"encryption"`
+	// Retention are the rules of the prune command
+	Retention *RetentionConfig `json:"retention" yaml:"retention"`
+	// NameTemplate is the text/template of the names of .eml files, see
+	// MessageName. It must use {{.Hash}}.
+	NameTemplate string `json:"nameTemplate" yaml:"nameTemplate"`
+	// MaildirSeparator starts the flags in the names of Maildir files: ":"
+	// (default) or "!" on file systems without colons such as SMB shares
+	MaildirSeparator string `json:"maildirSeparator" yaml:"maildirSeparator"`
+}
+
+// MessageStore writes messages into a layout below the backup directory
+type MessageStore interface {
+	// WriteMessage writes body and returns the path of the message file
+	// relative to backupDir or an empty path if the message has no file of
+	// its own
+	WriteMessage(fs FS, backupDir string, mailbox string, message *imap.Message, body io.Reader) (string, error)
+}
+
+// FlagStore is implemented by stores that keep the flags of messages
+type FlagStore interface {
+	// UpdateFlags applies flags to the message at messagePath (relative to
+	// backupDir) and returns its new path
+	UpdateFlags(fs FS, backupDir string, messagePath string, flags []string) (string, error)
+}
+
+// TombstoneStore is implemented by stores that move expunged messages into
+// the tombstone area themselves instead of by the uid index
+type TombstoneStore interface {
+	TombstoneMessage(fs FS, backupDir string, mailbox string, uid uint32) error
 }
 
 type ImapBackup struct {
 	fileSystem FS
 	backupDir  string
+	format     string
+	store      MessageStore
+
+	metadataLock  sync.Mutex
+	uidValidities map[string]uint32
+	// delimiters are the hierarchy delimiters of the listed mailboxes
+	delimiters map[string]string
+	// livePaths are the files of the messages of a mailbox by the path of its
+	// metadata, read on the first expunge in the mailbox
+	livePaths map[string]*livePaths
 }
 
 var FetchBodySection = imap.BodySectionName{}
 
-func NewImapBackup(fileSystem FS, cfg Config) *ImapBackup {
+func NewImapBackup(fileSystem FS, cfg Config) (*ImapBackup, error) {
+	store, err := NewMessageStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	return &ImapBackup{
 		fileSystem: fileSystem,
 		backupDir:  cfg.BackupDir,
+		format:     cfg.Format,
+		store:      store,
+
+		uidValidities: map[string]uint32{},
+		delimiters:    map[string]string{},
+		livePaths:     map[string]*livePaths{},
+	}, nil
+}
+
+func NewMessageStore(cfg Config) (MessageStore, error) {
+	compression, err := normalizeCompression(cfg.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(cfg.Format) {
+	case "", FormatEml:
+		names, err := NewMessageNamer(cfg.NameTemplate)
+		if err != nil {
+			return nil, err
+		}
+		return EmlStore{Compression: compression, Names: names}, nil
+	case FormatMaildir:
+		separator, err := normalizeMaildirSeparator(cfg.MaildirSeparator)
+		if err != nil {
+			return nil, err
+		}
+		return NewMaildirStore(compression, separator), nil
+	case FormatMbox:
+		if compression != CompressionNone {
+			return nil, fmt.Errorf("the %s format cannot be compressed", FormatMbox)
+		}
+		return NewMboxStore(), nil
+	case FormatCas:
+		return NewCasStore(compression), nil
+	default:
+		return nil, fmt.Errorf("unknown backup format %s", cfg.Format)
 	}
 }
 
+// HandleMailboxes remembers the hierarchy delimiters of the mailboxes. The
+// Handle methods map server names to directories with MailboxPath.
+func (i *ImapBackup) HandleMailboxes(mailboxes []*imap.MailboxInfo) {
+	i.metadataLock.Lock()
+	defer i.metadataLock.Unlock()
+
+	for _, mailbox := range mailboxes {
+		if mailbox != nil {
+			i.delimiters[mailbox.Name] = mailbox.Delimiter
+		}
+	}
+}
+
+// mailboxPath returns the directory of a server mailbox. Mailboxes that were
+// not listed are separated by slashes.
+func (i *ImapBackup) mailboxPath(mailbox string) string {
+	i.metadataLock.Lock()
+	defer i.metadataLock.Unlock()
+
+	delimiter, ok := i.delimiters[mailbox]
+	if !ok {
+		delimiter = "/"
+	}
+	return MailboxPath(mailbox, delimiter, i.format)
+}
+
 func (i *ImapBackup) HandleMessage(mailbox string, message *imap.Message) {
+	mailbox = i.mailboxPath(mailbox)
 	err := i.SaveMessage(mailbox, message, i.fileSystem, i.backupDir)
 	if err != nil {
 		log.Error(err)
 		return
 	}
-
 }
 
-func (i *ImapBackup) SaveMessage(mailbox string, message *imap.Message, fs FS, backupDir string) error {
-	filePath := path.Join(backupDir, GetPathOfMessage(mailbox, message))
-	err := fs.MkdirAll(path.Dir(filePath), os.ModePerm)
+// HandleMessageStream saves a message whose body is read from body
+func (i *ImapBackup) HandleMessageStream(mailbox string, message *imap.Message, body io.Reader) {
+	mailbox = i.mailboxPath(mailbox)
+	err := i.SaveMessageStream(mailbox, message, body, i.fileSystem, i.backupDir)
 	if err != nil {
-		return err
+		log.Error(err)
+		return
 	}
+}
 
-	err = (func() error {
-		body := message.GetBody(&FetchBodySection)
-		bodyBytes, err := io.ReadAll(body)
+// HandleFlags records the new flags in the metadata and renames the backup
+// of the message if the store keeps flags
+func (i *ImapBackup) HandleFlags(mailbox string, message *imap.Message) {
+	mailbox = i.mailboxPath(mailbox)
+	log := log.WithFields(log.Fields{"mailbox": mailbox, "uid": message.Uid})
+
+	messagePath := ""
+	if flagStore, ok := i.store.(FlagStore); ok {
+		var err error
+		messagePath, err = i.UpdateFlags(mailbox, message.Uid, message.Flags, flagStore, i.fileSystem, i.backupDir)
 		if err != nil {
-			return err
+			log.Error(err)
 		}
+	}
 
-		return fs.WriteFile(filePath, bodyBytes, os.ModePerm)
-	})()
+	err := i.appendMetadata(i.fileSystem, i.backupDir, MessageMetadata{
+		Mailbox:     mailbox,
+		Uid:         message.Uid,
+		UidValidity: i.uidValidity(mailbox),
+		Flags:       nonNilFlags(message.Flags),
+		Labels:      messageLabels(message),
+		Path:        messagePath,
+	})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// UpdateFlags applies the flags to the backup of the message and returns its
+// new path. The path is empty if the message was never backed up.
+func (i *ImapBackup) UpdateFlags(mailbox string, uid uint32, flags []string, flagStore FlagStore, fs FS, backupDir string) (string, error) {
+	indexPath := path.Join(backupDir, getUidIndexPath(mailbox, i.uidValidity(mailbox), uid))
+	messagePath, err := hackpadfs.ReadFile(fs, indexPath)
+	if errors.Is(err, hackpadfs.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
 
+	newPath, err := flagStore.UpdateFlags(fs, backupDir, string(messagePath), flags)
+	if err != nil {
+		return "", err
+	}
+
+	return newPath, fs.WriteFile(indexPath, []byte(newPath), os.ModePerm)
+}
+
+// HandleExpunge moves the backup of an expunged message into the deleted/
+// tombstone area
+func (i *ImapBackup) HandleExpunge(mailbox string, uid uint32) {
+	mailbox = i.mailboxPath(mailbox)
+	err := i.TombstoneMessage(mailbox, uid, i.fileSystem, i.backupDir)
+	if err != nil {
+		log.WithFields(log.Fields{"mailbox": mailbox, "uid": uid}).Error(err)
+	}
+}
+
+// TombstoneMessage moves the backup of the message into the tombstone area
+// and marks it as expunged in the metadata
+func (i *ImapBackup) TombstoneMessage(mailbox string, uid uint32, fs FS, backupDir string) error {
+	deletedPath, err := i.tombstoneMessage(mailbox, uid, fs, backupDir)
 	if err != nil {
 		return err
 	}
 
-	err = fs.Chtimes(filePath, time.Now(), message.Envelope.Date)
-	return err
+	return i.appendMetadata(fs, backupDir, MessageMetadata{
+		Mailbox:     mailbox,
+		Uid:         uid,
+		UidValidity: i.uidValidity(mailbox),
+		Path:        deletedPath,
+		Expunged:    true,
+	})
 }
 
-func GetPathOfMessage(mailbox string, message *imap.Message) string {
-	envelope := message.Envelope
-	fileName := ""
+// tombstoneMessage returns the path of the message in the tombstone area if
+// the store has a file per message
+func (i *ImapBackup) tombstoneMessage(mailbox string, uid uint32, fs FS, backupDir string) (string, error) {
+	if tombstoneStore, ok := i.store.(TombstoneStore); ok {
+		return "", tombstoneStore.TombstoneMessage(fs, backupDir, mailbox, uid)
+	}
+
+	uidValidity := i.uidValidity(mailbox)
+	indexPath := path.Join(backupDir, getUidIndexPath(mailbox, uidValidity, uid))
+	messagePath, err := hackpadfs.ReadFile(fs, indexPath)
+	if errors.Is(err, hackpadfs.ErrNotExist) {
+		log.WithFields(log.Fields{"mailbox": mailbox, "uid": uid}).Debug("expunged message was never backed up")
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	deletedPath := path.Join(deletedDir, string(messagePath))
+	srcPath := path.Join(backupDir, string(messagePath))
+	destPath := path.Join(backupDir, deletedPath)
+	err = fs.MkdirAll(path.Dir(destPath), os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+
+	// messages with the same content share their file
+	shared, err := i.isSharedPath(fs, backupDir, mailbox, uidValidity, uid, string(messagePath))
+	if err != nil {
+		return "", err
+	}
 
-	if envelope != nil {
-		fileName = fmt.Sprintf("%s_%s", cropString(envelope.Subject, 200), envelope.MessageId)
+	if shared {
+		err = copyMessageFile(fs, srcPath, destPath)
 	} else {
-		fileName = fmt.Sprintf("%d", message.Uid)
+		err = fs.Rename(srcPath, destPath)
+	}
+	if err != nil && !errors.Is(err, hackpadfs.ErrNotExist) {
+		return "", err
 	}
 
-	secureString := new(strings.Builder)
-	for _, c := range fileName {
-		if unicode.IsSpace(c) || c == '/' {
-			secureString.WriteRune('_')
-		} else {
-			secureString.WriteRune(c)
+	log.WithFields(log.Fields{"mailbox": mailbox, "uid": uid, "path": destPath}).Info("moved expunged message to tombstone area")
+	return deletedPath, fs.Remove(indexPath)
+}
+
+func (i *ImapBackup) SaveMessage(mailbox string, message *imap.Message, fs FS, backupDir string) error {
+	body := message.GetBody(&FetchBodySection)
+	if body == nil {
+		return fmt.Errorf("message %d has no body", message.Uid)
+	}
+
+	return i.SaveMessageStream(mailbox, message, body, fs, backupDir)
+}
+
+// SaveMessageStream copies body to the backup file of the message without
+// holding it in memory
+func (i *ImapBackup) SaveMessageStream(mailbox string, message *imap.Message, body io.Reader, fs FS, backupDir string) error {
+	hasher := sha256.New()
+	hashedBody := io.TeeReader(body, hasher)
+	messagePath, err := i.store.WriteMessage(fs, backupDir, mailbox, message, hashedBody)
+	if err != nil {
+		return err
+	}
+
+	// stores skip the body of messages they already have
+	_, err = io.Copy(io.Discard, hashedBody)
+	if err != nil {
+		return err
+	}
+
+	err = writeUidIndex(fs, backupDir, mailbox, i.uidValidity(mailbox), message.Uid, messagePath)
+	if err != nil {
+		return err
+	}
+
+	metadata := i.newMessageMetadata(mailbox, message)
+	metadata.Sha256 = hex.EncodeToString(hasher.Sum(nil))
+	metadata.Path = messagePath
+	return i.appendMetadata(fs, backupDir, metadata)
+}
+
+// EmlStore writes every message to <mailbox>/<name>.eml, named by Names.
+// Compressed messages get the extension of the compression, e.g. .eml.zst.
+type EmlStore struct {
+	Compression string
+	Names       MessageNamer
+}
+
+func (s EmlStore) WriteMessage(fs FS, backupDir string, mailbox string, message *imap.Message, body io.Reader) (string, error) {
+	return s.writeNamedMessage(fs, backupDir, mailbox, message, body)
+}
+
+func setMessageTime(fs FS, filePath string, message *imap.Message) error {
+	if message.Envelope == nil {
+		return nil
+	}
+	return fs.Chtimes(filePath, time.Now(), message.Envelope.Date)
+}
+
+func writeFileFrom(fs FS, filePath string, reader io.Reader) error {
+	file, err := fs.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer, ok := file.(io.Writer)
+	if !ok {
+		return fmt.Errorf("failed to write file. file is not an io.Writer")
+	}
+
+	_, err = io.Copy(writer, reader)
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// isSharedPath reports whether a message of the mailbox other than uid that
+// is not expunged is backed up in the file at messagePath. The metadata of
+// the mailbox is read once, appendMetadata keeps it up to date.
+func (i *ImapBackup) isSharedPath(fs FS, backupDir string, mailbox string, uidValidity uint32, uid uint32, messagePath string) (bool, error) {
+	i.metadataLock.Lock()
+	defer i.metadataLock.Unlock()
+
+	metadataPath := GetMetadataPath(backupDir, mailbox)
+	live, ok := i.livePaths[metadataPath]
+	if !ok {
+		metadata, err := ReadMetadata(fs, backupDir, mailbox)
+		if err != nil {
+			return false, err
 		}
+
+		live = newLivePaths()
+		for _, record := range metadata {
+			live.apply(record)
+		}
+		i.livePaths[metadataPath] = live
+	}
+
+	users := live.users[pathKey{uidValidity, messagePath}]
+	if live.paths[messageKey{uidValidity, uid}] == messagePath {
+		users--
+	}
+	return users > 0, nil
+}
+
+// copyMessageFile copies the file at srcPath to destPath and keeps its
+// modification time
+func copyMessageFile(fs FS, srcPath string, destPath string) error {
+	info, err := hackpadfs.Stat(fs, srcPath)
+	if err != nil {
+		return err
 	}
 
-	replaceRegex := regexp.MustCompile(`[^a-zA-Z\d_\-]`)
+	file, err := fs.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = writeFileFrom(fs, destPath, file)
+	if err != nil {
+		return err
+	}
+	return fs.Chtimes(destPath, time.Now(), info.ModTime())
+}
+
+// writeUidIndex remembers the path of the message so that it can be found by
+// uid once the message is expunged
+func writeUidIndex(fs FS, backupDir string, mailbox string, uidValidity uint32, uid uint32, messagePath string) error {
+	if uid == 0 || messagePath == "" {
+		return nil
+	}
+
+	indexPath := path.Join(backupDir, getUidIndexPath(mailbox, uidValidity, uid))
+	err := fs.MkdirAll(path.Dir(indexPath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	return fs.WriteFile(indexPath, []byte(messagePath), os.ModePerm)
+}
 
-	return fmt.Sprintf("%s/%s.eml", mailbox, replaceRegex.ReplaceAllString(secureString.String(), "_"))
+// getUidIndexPath returns the path of the index entry of a message. Uids of
+// different UIDVALIDITYs are different messages.
+func getUidIndexPath(mailbox string, uidValidity uint32, uid uint32) string {
+	return fmt.Sprintf("%s/%s/%d/%d", uidIndexDir, mailbox, uidValidity, uid)
 }
 
 func cropString(in string, max int) string {
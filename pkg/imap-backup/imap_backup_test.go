@@ -0,0 +1,143 @@
+package imap_backup
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/hack-pad/hackpadfs"
+	"github.com/hack-pad/hackpadfs/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleExpungeMovesToTombstone(t *testing.T) {
+	fs := newMemFS(t)
+
+	backup := newTestBackup(t, fs, Config{BackupDir: "backup"})
+	message := testMessage(42, "hello", "<id@example.com>", "body")
+
+	assert.NoError(t, backup.SaveMessage("INBOX", message, fs, "backup"))
+	messagePath := "backup/" + GetPathOfMessage("INBOX", message, sha256Of([]byte("body")))
+	_, err := fs.Stat(messagePath)
+	assert.NoError(t, err)
+
+	backup.HandleExpunge("INBOX", 42)
+
+	_, err = fs.Stat(messagePath)
+	assert.ErrorIs(t, err, hackpadfs.ErrNotExist)
+
+	content, err := hackpadfs.ReadFile(fs, "backup/deleted/"+GetPathOfMessage("INBOX", message, sha256Of([]byte("body"))))
+	assert.NoError(t, err)
+	assert.Equal(t, "body", string(content))
+
+	// unknown uids are ignored
+	backup.HandleExpunge("INBOX", 43)
+}
+
+func TestHandleExpungeKeepsSharedFile(t *testing.T) {
+	fs := newMemFS(t)
+
+	backup := newTestBackup(t, fs, Config{BackupDir: "backup"})
+	backup.HandleUidValidity("INBOX", 1)
+	first := testMessage(1, "hello", "<id@example.com>", "body")
+	second := testMessage(2, "hello", "<id@example.com>", "body")
+	assert.NoError(t, backup.SaveMessage("INBOX", first, fs, "backup"))
+	assert.NoError(t, backup.SaveMessage("INBOX", second, fs, "backup"))
+
+	// both uids have the same content and share the file
+	messagePath := GetPathOfMessage("INBOX", first, sha256Of([]byte("body")))
+	assert.Equal(t, messagePath, GetPathOfMessage("INBOX", second, sha256Of([]byte("body"))))
+
+	backup.HandleExpunge("INBOX", 1)
+	content, err := hackpadfs.ReadFile(fs, "backup/"+messagePath)
+	assert.NoError(t, err)
+	assert.Equal(t, "body", string(content))
+	content, err = hackpadfs.ReadFile(fs, "backup/deleted/"+messagePath)
+	assert.NoError(t, err)
+	assert.Equal(t, "body", string(content))
+
+	// the last uid moves the file
+	backup.HandleExpunge("INBOX", 2)
+	_, err = fs.Stat("backup/" + messagePath)
+	assert.ErrorIs(t, err, hackpadfs.ErrNotExist)
+	_, err = fs.Stat("backup/deleted/" + messagePath)
+	assert.NoError(t, err)
+}
+
+func TestHandleExpungeReadsMetadataOnce(t *testing.T) {
+	fs := openCountingFS{newMemFS(t), map[string]int{}}
+
+	backup := newTestBackup(t, fs, Config{BackupDir: "backup"})
+	backup.HandleUidValidity("INBOX", 1)
+	assert.NoError(t, backup.SaveMessage("INBOX", testMessage(1, "hello", "<id@example.com>", "body"), fs, "backup"))
+	assert.NoError(t, backup.SaveMessage("INBOX", testMessage(2, "hello", "<id@example.com>", "body"), fs, "backup"))
+	messagePath := "backup/" + GetPathOfMessage("INBOX", testMessage(1, "hello", "<id@example.com>", "body"), sha256Of([]byte("body")))
+
+	backup.HandleExpunge("INBOX", 1)
+	// saved after the metadata was read
+	assert.NoError(t, backup.SaveMessage("INBOX", testMessage(3, "hello", "<id@example.com>", "body"), fs, "backup"))
+	backup.HandleExpunge("INBOX", 2)
+	_, err := fs.Stat(messagePath)
+	assert.NoError(t, err)
+
+	backup.HandleExpunge("INBOX", 3)
+	_, err = fs.Stat(messagePath)
+	assert.ErrorIs(t, err, hackpadfs.ErrNotExist)
+	assert.Equal(t, 1, fs.opens[GetMetadataPath("backup", "INBOX")])
+}
+
+func TestHandleExpungeIgnoresOtherUidValidity(t *testing.T) {
+	fs := newMemFS(t)
+
+	backup := newTestBackup(t, fs, Config{BackupDir: "backup"})
+	backup.HandleUidValidity("INBOX", 1)
+	old := testMessage(1, "old", "<old@example.com>", "old body")
+	assert.NoError(t, backup.SaveMessage("INBOX", old, fs, "backup"))
+
+	// after the reset uid 1 is another message
+	backup.HandleUidValidity("INBOX", 2)
+	backup.HandleExpunge("INBOX", 1)
+
+	_, err := fs.Stat("backup/" + GetPathOfMessage("INBOX", old, sha256Of([]byte("old body"))))
+	assert.NoError(t, err)
+	_, err = fs.Stat("backup/" + getUidIndexPath("INBOX", 1, 1))
+	assert.NoError(t, err)
+}
+
+func testMessage(uid uint32, subject string, messageId string, body string) *imap.Message {
+	return &imap.Message{
+		Uid: uid,
+		Envelope: &imap.Envelope{
+			Subject:   subject,
+			MessageId: messageId,
+			Date:      time.Date(2024, time.February, 18, 22, 47, 30, 0, time.UTC),
+		},
+		Body: map[*imap.BodySectionName]imap.Literal{
+			&FetchBodySection: strings.NewReader(body),
+		},
+	}
+}
+
+type memFS struct {
+	*mem.FS
+}
+
+func newMemFS(t *testing.T) memFS {
+	fs, err := mem.NewFS()
+	assert.NoError(t, err)
+	return memFS{fs}
+}
+
+// newTestBackup returns a backup of cfg that must be valid
+func newTestBackup(t *testing.T, fs FS, cfg Config) *ImapBackup {
+	backup, err := NewImapBackup(fs, cfg)
+	require.NoError(t, err)
+	return backup
+}
+
+func (fs memFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return hackpadfs.WriteFullFile(fs.FS, name, data, perm)
+}
@@ -0,0 +1,138 @@
+package imap_backup
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/emersion/go-imap/utf7"
+)
+
+// defaultMailbox is the directory of mailboxes without a name
+const defaultMailbox = "INBOX"
+
+// reservedNames are the file names Windows and therefore SMB shares refuse
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// MailboxPath returns the directory of a server mailbox relative to the
+// backup directory. name is UTF-8 as the IMAP client returns it, callers with
+// names in modified UTF-7 decode them with DecodeMailboxName first. Every
+// level of the hierarchy separated by delimiter becomes a directory and
+// characters that are not allowed in file names are escaped as %XX. Names of
+// the hidden directories and the tombstone area are escaped as well, so no
+// mailbox can collide with them. In backups of the Maildir format, child
+// mailboxes named like the Maildir subdirectories of their parent are
+// escaped too. MailboxName reverses the mapping.
+func MailboxPath(name string, delimiter string, format string) string {
+	maildir := strings.EqualFold(format, FormatMaildir)
+
+	var levels []string
+	if delimiter == "" {
+		levels = []string{name}
+	} else {
+		levels = strings.Split(name, delimiter)
+	}
+
+	var dirs []string
+	for _, level := range levels {
+		if level == "" {
+			continue
+		}
+		dirs = append(dirs, escapeMailboxLevel(level, len(dirs) == 0, maildir))
+	}
+
+	if len(dirs) == 0 {
+		return defaultMailbox
+	}
+	return strings.Join(dirs, "/")
+}
+
+// MailboxName returns the server name of the mailbox in the directory
+// mailboxPath of the backup. The name is UTF-8, the IMAP client encodes it.
+func MailboxName(mailboxPath string, delimiter string) string {
+	if delimiter == "" {
+		delimiter = "/"
+	}
+
+	levels := strings.Split(mailboxPath, "/")
+	for i, level := range levels {
+		levels[i] = unescapeMailboxLevel(level)
+	}
+	return strings.Join(levels, delimiter)
+}
+
+// DecodeMailboxName decodes a name in modified UTF-7 as it is sent on the
+// wire. Names from the IMAP client are decoded already and must not be
+// decoded again. Names that are no valid modified UTF-7 are kept.
+func DecodeMailboxName(name string) string {
+	if !strings.Contains(name, "&") {
+		return name
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] >= utf8.RuneSelf {
+			return name
+		}
+	}
+
+	decoded, err := utf7.Encoding.NewDecoder().String(name)
+	if err != nil {
+		return name
+	}
+	return decoded
+}
+
+// escapeMailboxLevel escapes one level of a mailbox name so that it is a
+// valid file name. first is set for the top level, which must not be the
+// name of the tombstone area or a hidden directory. maildir is set for
+// backups of the Maildir format, where the other levels must not be the name
+// of a Maildir subdirectory.
+func escapeMailboxLevel(level string, first bool, maildir bool) string {
+	escaped := new(strings.Builder)
+	last := len(level) - 1
+	for i := 0; i < len(level); i++ {
+		c := level[i]
+		escape := c < 0x20 || c == 0x7f || strings.IndexByte(`%/\:*?"<>|`, c) >= 0 ||
+			(i == 0 && c == '.') ||
+			(i == last && (c == '.' || c == ' '))
+		if escape {
+			fmt.Fprintf(escaped, "%%%02X", c)
+		} else {
+			escaped.WriteByte(c)
+		}
+	}
+
+	name := escaped.String()
+	base, _, _ := strings.Cut(name, ".")
+	isMaildirDir := name == maildirTmp || name == maildirNew || name == maildirCur
+	if reservedNames[strings.ToUpper(base)] || (first && name == deletedDir) || (!first && maildir && isMaildirDir) {
+		name = fmt.Sprintf("%%%02X", name[0]) + name[1:]
+	}
+	return name
+}
+
+// unescapeMailboxLevel reverses escapeMailboxLevel. Invalid escapes are kept.
+func unescapeMailboxLevel(level string) string {
+	if !strings.Contains(level, "%") {
+		return level
+	}
+
+	unescaped := new(strings.Builder)
+	for i := 0; i < len(level); i++ {
+		if level[i] == '%' && i+2 < len(level) {
+			if c, err := strconv.ParseUint(level[i+1:i+3], 16, 8); err == nil {
+				unescaped.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		unescaped.WriteByte(level[i])
+	}
+	return unescaped.String()
+}
@@ -0,0 +1,101 @@
+package imap_backup
+
+import (
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMailboxPath(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		delimiter string
+		path      string
+	}{
+		{"INBOX", ".", "INBOX"},
+		{"INBOX.Rechnungen", ".", "INBOX/Rechnungen"},
+		{"INBOX/Rechnungen", "/", "INBOX/Rechnungen"},
+		{"INBOX.a/b", ".", "INBOX/a%2Fb"},
+		{"Entwürfe", "/", "Entwürfe"},
+		{"Tom & Jerry", "/", "Tom & Jerry"},
+		// decoded names are not decoded again
+		{"A&-B", "/", "A&-B"},
+		{"Entw&APw-rfe", "/", "Entw&APw-rfe"},
+		{"Fragen?: <ja|nein>", "/", "Fragen%3F%3A %3Cja%7Cnein%3E"},
+		{"100%", "/", "100%25"},
+		{"deleted", "/", "%64eleted"},
+		{"INBOX/deleted", "/", "INBOX/deleted"},
+		{".uids", "/", "%2Euids"},
+		{"a/../b", "/", "a/%2E%2E/b"},
+		{"Notes. ", "/", "Notes.%20"},
+		{"CON", "/", "%43ON"},
+		{"aux.txt", "/", "%61ux.txt"},
+		{"/INBOX//Sent/", "/", "INBOX/Sent"},
+		{"", "/", "INBOX"},
+	} {
+		path := MailboxPath(test.name, test.delimiter, FormatEml)
+		assert.Equal(t, test.path, path, test.name)
+		if test.name != "" && test.name[0] != '/' {
+			assert.Equal(t, test.name, MailboxName(path, test.delimiter), test.name)
+		}
+	}
+}
+
+func TestMaildirMailboxPath(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		path string
+	}{
+		{"INBOX/tmp", "INBOX/%74mp"},
+		{"INBOX/new", "INBOX/%6Eew"},
+		{"INBOX/cur/new", "INBOX/%63ur/%6Eew"},
+		// the top level is no Maildir
+		{"new", "new"},
+		{"INBOX/news", "INBOX/news"},
+	} {
+		path := MailboxPath(test.name, "/", FormatMaildir)
+		assert.Equal(t, test.path, path, test.name)
+		assert.Equal(t, test.name, MailboxName(path, "/"), test.name)
+	}
+	assert.Equal(t, "INBOX/new", MailboxPath("INBOX/new", "/", FormatEml))
+}
+
+func TestDecodeMailboxName(t *testing.T) {
+	assert.Equal(t, "Entwürfe", DecodeMailboxName("Entw&APw-rfe"))
+	assert.Equal(t, "A&B", DecodeMailboxName("A&-B"))
+	assert.Equal(t, "Tom & Jerry", DecodeMailboxName("Tom & Jerry"))
+	assert.Equal(t, "Entwürfe", DecodeMailboxName("Entwürfe"))
+	assert.Equal(t, "Entwürfe", MailboxPath(DecodeMailboxName("Entw&APw-rfe"), "/", FormatEml))
+}
+
+func TestHandleMailboxes(t *testing.T) {
+	fs := newMemFS(t)
+	backup := newTestBackup(t, fs, Config{BackupDir: "backup"})
+	backup.HandleMailboxes([]*imap.MailboxInfo{{Name: "INBOX.Rechnungen", Delimiter: "."}})
+
+	backup.HandleUidValidity("INBOX.Rechnungen", 1)
+	backup.HandleMessage("INBOX.Rechnungen", testMessage(1, "invoice", "<1@example.com>", "Subject: invoice\r\n\r\nbody\r\n"))
+
+	messages := walkBackup(t, fs, "backup")
+	assert.Equal(t, 1, len(messages))
+	assert.Equal(t, "INBOX/Rechnungen", messages[0].Mailbox)
+	assert.Equal(t, uint32(1), messages[0].UidValidity)
+}
+
+func TestHandleMailboxesMaildirChildren(t *testing.T) {
+	fs := newMemFS(t)
+	backup := newTestBackup(t, fs, Config{BackupDir: "backup", Format: FormatMaildir})
+	backup.HandleMailboxes([]*imap.MailboxInfo{{Name: "INBOX", Delimiter: "/"}, {Name: "INBOX/new", Delimiter: "/"}})
+
+	backup.HandleUidValidity("INBOX", 1)
+	backup.HandleMessage("INBOX", testMessage(1, "parent", "<1@example.com>", "Subject: parent\r\n\r\nparent body\r\n"))
+	backup.HandleUidValidity("INBOX/new", 1)
+	backup.HandleMessage("INBOX/new", testMessage(1, "child", "<2@example.com>", "Subject: child\r\n\r\nchild body\r\n"))
+
+	messages := walkBackup(t, fs, "backup")
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, "INBOX/%6Eew", messages[0].Mailbox)
+	assert.Equal(t, "INBOX/new", MailboxName(messages[0].Mailbox, "/"))
+	assert.Equal(t, "INBOX", messages[1].Mailbox)
+}
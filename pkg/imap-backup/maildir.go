@@ -0,0 +1,205 @@
+package imap_backup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// Maildir subdirectories
+const (
+	maildirTmp = "tmp"
+	maildirNew = "new"
+	maildirCur = "cur"
+)
+
+// Maildir info separators
+const (
+	// MaildirSeparatorColon is the separator of the Maildir specification
+	MaildirSeparatorColon = ":"
+	// MaildirSeparatorPortable is the separator on file systems that do not
+	// allow colons in file names, such as SMB shares
+	MaildirSeparatorPortable = "!"
+)
+
+// maildirInfoVersion follows the separator at the start of the info part of
+// a file name with flags
+const maildirInfoVersion = "2,"
+
+// maildirFlags maps IMAP flags to the Maildir flag letters
+var maildirFlags = map[string]byte{
+	imap.DraftFlag:    'D',
+	imap.FlaggedFlag:  'F',
+	"$Forwarded":      'P',
+	imap.AnsweredFlag: 'R',
+	imap.SeenFlag:     'S',
+	imap.DeletedFlag:  'T',
+}
+
+// MaildirStore writes every mailbox as a Maildir <mailbox>/{tmp,new,cur}.
+// Messages without flags are delivered to new, all others to cur with the
+// flags in the file name. Compressed messages keep their names.
+type MaildirStore struct {
+	hostname    string
+	pid         int
+	counter     *atomic.Uint64
+	compression string
+	separator   string
+}
+
+// NewMaildirStore returns a store that starts the flags in file names with
+// separator, MaildirSeparatorColon or MaildirSeparatorPortable
+func NewMaildirStore(compression string, separator string) MaildirStore {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	return MaildirStore{
+		hostname:    maildirHostname(hostname, separator),
+		pid:         os.Getpid(),
+		counter:     &atomic.Uint64{},
+		compression: compression,
+		separator:   separator,
+	}
+}
+
+// WithoutColons returns the config for a file system whose file names may not
+// contain colons. Maildir files use the portable separator unless another
+// one is configured.
+func (c Config) WithoutColons() (Config, error) {
+	separator, err := normalizeMaildirSeparator(c.MaildirSeparator)
+	if err != nil {
+		return c, err
+	}
+
+	if c.MaildirSeparator == "" {
+		c.MaildirSeparator = MaildirSeparatorPortable
+	} else if separator == MaildirSeparatorColon && strings.EqualFold(c.Format, FormatMaildir) {
+		return c, fmt.Errorf("maildir separator %q is not allowed in file names of the storage", separator)
+	}
+	return c, nil
+}
+
+// normalizeMaildirSeparator returns the separator of cfg, the one of the
+// specification by default
+func normalizeMaildirSeparator(separator string) (string, error) {
+	switch separator {
+	case "", MaildirSeparatorColon:
+		return MaildirSeparatorColon, nil
+	case MaildirSeparatorPortable:
+		return MaildirSeparatorPortable, nil
+	}
+	return "", fmt.Errorf("unknown maildir separator %q. use %q or %q", separator, MaildirSeparatorColon, MaildirSeparatorPortable)
+}
+
+func (s MaildirStore) WriteMessage(fs FS, backupDir string, mailbox string, message *imap.Message, body io.Reader) (string, error) {
+	for _, dir := range []string{maildirTmp, maildirNew, maildirCur} {
+		err := fs.MkdirAll(path.Join(backupDir, mailbox, dir), os.ModePerm)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	name := s.uniqueName(time.Now())
+	tmpPath := path.Join(backupDir, mailbox, maildirTmp, name)
+	err := writeMessageFile(fs, tmpPath, body, s.compression)
+	if err != nil {
+		fs.Remove(tmpPath)
+		return "", fmt.Errorf("failed to write %s: %w", tmpPath, err)
+	}
+
+	err = setMessageTime(fs, tmpPath, message)
+	if err != nil {
+		return "", err
+	}
+
+	messagePath := path.Join(mailbox, maildirNew, name)
+	if len(message.Flags) > 0 {
+		messagePath = path.Join(mailbox, maildirCur, name+maildirInfo(s.separator, message.Flags))
+	}
+
+	// the rename makes the complete message visible to readers
+	err = fs.Rename(tmpPath, path.Join(backupDir, messagePath))
+	if err != nil {
+		return "", err
+	}
+
+	return messagePath, nil
+}
+
+func (s MaildirStore) UpdateFlags(fs FS, backupDir string, messagePath string, flags []string) (string, error) {
+	mailboxDir := path.Dir(path.Dir(messagePath))
+	name, _, _ := cutMaildirInfo(path.Base(messagePath))
+
+	newPath := path.Join(mailboxDir, maildirCur, name+maildirInfo(s.separator, flags))
+	if newPath == messagePath {
+		return messagePath, nil
+	}
+
+	err := fs.Rename(path.Join(backupDir, messagePath), path.Join(backupDir, newPath))
+	if err != nil {
+		return "", err
+	}
+
+	return newPath, nil
+}
+
+// uniqueName returns a name like 1700000000.M123456P42Q7.hostname that is
+// unique for this host
+func (s MaildirStore) uniqueName(now time.Time) string {
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, s.pid, s.counter.Add(1), s.hostname)
+}
+
+// maildirInfo returns the info suffix of the flags, e.g. :2,FRS
+func maildirInfo(separator string, flags []string) string {
+	var letters []byte
+	for _, flag := range flags {
+		for imapFlag, letter := range maildirFlags {
+			if strings.EqualFold(flag, imapFlag) {
+				letters = append(letters, letter)
+			}
+		}
+	}
+
+	// flags must be sorted in ASCII order
+	slices.Sort(letters)
+	return separator + maildirInfoVersion + string(slices.Compact(letters))
+}
+
+// cutMaildirInfo splits a file name into the unique name and the flags of
+// the info part. Names with either separator are understood, so that a
+// backup can be read without its config.
+func cutMaildirInfo(name string) (string, string, bool) {
+	for _, separator := range []string{MaildirSeparatorColon, MaildirSeparatorPortable} {
+		if unique, info, ok := strings.Cut(name, separator+maildirInfoVersion); ok {
+			return unique, info, true
+		}
+	}
+	return name, "", false
+}
+
+// maildirHostname escapes the characters that are not allowed in the
+// hostname part of a file name. The escapes of the specification contain
+// backslashes, which separate paths on SMB shares, so the portable names
+// replace these characters instead.
+func maildirHostname(hostname string, separator string) string {
+	if separator == MaildirSeparatorColon {
+		hostname = strings.ReplaceAll(hostname, "/", `\057`)
+		return strings.ReplaceAll(hostname, ":", `\072`)
+	}
+
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|!`, r) {
+			return '_'
+		}
+		return r
+	}, hostname)
+}
@@ -0,0 +1,119 @@
+package imap_backup
+
+import (
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/hack-pad/hackpadfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaildirInfo(t *testing.T) {
+	assert.Equal(t, ":2,", maildirInfo(MaildirSeparatorColon, nil))
+	assert.Equal(t, ":2,FRS", maildirInfo(MaildirSeparatorColon, []string{imap.SeenFlag, imap.AnsweredFlag, imap.FlaggedFlag}))
+	assert.Equal(t, ":2,DPT", maildirInfo(MaildirSeparatorColon, []string{"$forwarded", imap.DeletedFlag, imap.DraftFlag, imap.RecentFlag, "$Label1"}))
+}
+
+func TestMaildirStoreWriteMessage(t *testing.T) {
+	fs := newMemFS(t)
+	backup := newTestBackup(t, fs, Config{BackupDir: "backup", Format: FormatMaildir})
+
+	unseen := testMessage(1, "hello", "<id@example.com>", "unseen body")
+	seen := testMessage(2, "hello", "<id@example.com>", "seen body")
+	seen.Flags = []string{imap.SeenFlag, imap.FlaggedFlag}
+
+	assert.NoError(t, backup.SaveMessage("INBOX", unseen, fs, "backup"))
+	assert.NoError(t, backup.SaveMessage("INBOX", seen, fs, "backup"))
+
+	newEntries, err := hackpadfs.ReadDir(fs, "backup/INBOX/new")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(newEntries))
+	assert.NotContains(t, newEntries[0].Name(), ":")
+
+	curEntries, err := hackpadfs.ReadDir(fs, "backup/INBOX/cur")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(curEntries))
+	assert.True(t, strings.HasSuffix(curEntries[0].Name(), ":2,FS"))
+
+	// same message id, but unique names
+	assert.NotEqual(t, newEntries[0].Name(), strings.TrimSuffix(curEntries[0].Name(), ":2,FS"))
+
+	tmpEntries, err := hackpadfs.ReadDir(fs, "backup/INBOX/tmp")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(tmpEntries))
+
+	content, err := hackpadfs.ReadFile(fs, path.Join("backup/INBOX/cur", curEntries[0].Name()))
+	assert.NoError(t, err)
+	assert.Equal(t, "seen body", string(content))
+}
+
+func TestMaildirStoreUpdateFlags(t *testing.T) {
+	fs := newMemFS(t)
+	backup := newTestBackup(t, fs, Config{BackupDir: "backup", Format: FormatMaildir})
+
+	message := testMessage(1, "hello", "<id@example.com>", "body")
+	assert.NoError(t, backup.SaveMessage("INBOX", message, fs, "backup"))
+
+	message.Flags = []string{imap.SeenFlag, imap.AnsweredFlag}
+	backup.HandleFlags("INBOX", message)
+
+	newEntries, err := hackpadfs.ReadDir(fs, "backup/INBOX/new")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(newEntries))
+
+	curEntries, err := hackpadfs.ReadDir(fs, "backup/INBOX/cur")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(curEntries))
+	assert.True(t, strings.HasSuffix(curEntries[0].Name(), ":2,RS"))
+
+	// the expunge still finds the renamed message
+	backup.HandleExpunge("INBOX", 1)
+	content, err := hackpadfs.ReadFile(fs, path.Join("backup/deleted/INBOX/cur", curEntries[0].Name()))
+	assert.NoError(t, err)
+	assert.Equal(t, "body", string(content))
+}
+
+func TestMaildirStorePortableSeparator(t *testing.T) {
+	fs := newMemFS(t)
+	backup := newTestBackup(t, fs, Config{BackupDir: "backup", Format: FormatMaildir, MaildirSeparator: MaildirSeparatorPortable})
+	backup.HandleUidValidity("INBOX", 1)
+
+	message := testMessage(1, "hello", "<id@example.com>", "body")
+	message.Flags = []string{imap.SeenFlag}
+	assert.NoError(t, backup.SaveMessage("INBOX", message, fs, "backup"))
+
+	message.Flags = []string{imap.SeenFlag, imap.AnsweredFlag}
+	backup.HandleFlags("INBOX", message)
+
+	curEntries, err := hackpadfs.ReadDir(fs, "backup/INBOX/cur")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(curEntries))
+	assert.True(t, strings.HasSuffix(curEntries[0].Name(), "!2,RS"))
+	assert.NotContains(t, curEntries[0].Name(), ":")
+
+	// the flags are read back without the config
+	messages := walkBackup(t, fs, "backup")
+	assert.Equal(t, 1, len(messages))
+	assert.ElementsMatch(t, []string{imap.AnsweredFlag, imap.SeenFlag}, messages[0].Flags)
+
+	assert.Equal(t, `host\072name\057x`, maildirHostname("host:name/x", MaildirSeparatorColon))
+	assert.Equal(t, "host_name_x_y", maildirHostname(`host:name/x\y`, MaildirSeparatorPortable))
+
+	_, err = NewMessageStore(Config{Format: FormatMaildir, MaildirSeparator: ";"})
+	assert.ErrorContains(t, err, "unknown maildir separator")
+}
+
+func TestConfigWithoutColons(t *testing.T) {
+	cfg, err := Config{Format: FormatMaildir}.WithoutColons()
+	assert.NoError(t, err)
+	assert.Equal(t, MaildirSeparatorPortable, cfg.MaildirSeparator)
+
+	_, err = Config{Format: FormatMaildir, MaildirSeparator: MaildirSeparatorColon}.WithoutColons()
+	assert.ErrorContains(t, err, "not allowed")
+
+	// other formats do not use the separator
+	_, err = Config{Format: FormatEml, MaildirSeparator: MaildirSeparatorColon}.WithoutColons()
+	assert.NoError(t, err)
+}
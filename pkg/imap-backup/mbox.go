@@ -0,0 +1,705 @@
+package imap_backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/hack-pad/hackpadfs"
+	log "github.com/sirupsen/logrus"
+)
+
+const mboxExtension = ".mbox"
+const mboxIndexExtension = ".idx"
+const mboxSpoolExtension = ".tmp"
+
+// mboxRewriteExtension is the extension of an mbox and of its index while
+// they are rewritten
+const mboxRewriteExtension = ".rewrite"
+
+// mboxSpoolSize is the size up to which a message is hashed in memory before
+// it is appended. Larger messages are spooled to a temporary file.
+const mboxSpoolSize = 8 << 20
+
+// mboxDateLayout is the asctime layout of the date in From_ lines
+const mboxDateLayout = "Mon Jan _2 15:04:05 2006"
+const mboxDefaultSender = "MAILER-DAEMON"
+
+var mboxFromLine = []byte("From ")
+
+// MboxStore appends every message to <mailbox>.mbox in the mboxrd format.
+// Each mbox has a sidecar index <mailbox>.mbox.idx with the offset and length
+// of every message, so appends never scan the mbox and messages can be read
+// without parsing the whole file. Messages with a Message-ID and body hash
+// that are already in the index are not appended again, also after the
+// UIDVALIDITY of the mailbox changed.
+//
+// Messages of an mbox are not moved into the tombstone area when they are
+// expunged, the mbox stays a complete archive.
+type MboxStore struct {
+	lock    *sync.Mutex
+	indexes map[string]map[string]bool
+}
+
+// MboxIndexEntry is a message of an mbox. Offset and Length cover the From_
+// line and the quoted message, Sha256 is the hash of the unquoted message.
+type MboxIndexEntry struct {
+	Offset    int64
+	Length    int64
+	Uid       uint32
+	MessageId string
+	Sha256    string
+}
+
+// WithoutAppends returns the config for a file system that rewrites files
+// which are appended to. The mbox format would upload the whole mbox for
+// every message and is refused.
+func (c Config) WithoutAppends() (Config, error) {
+	if strings.EqualFold(c.Format, FormatMbox) {
+		return c, fmt.Errorf("the %s format is not supported by storage that cannot append to files", FormatMbox)
+	}
+	return c, nil
+}
+
+func NewMboxStore() MboxStore {
+	return MboxStore{
+		lock:    &sync.Mutex{},
+		indexes: map[string]map[string]bool{},
+	}
+}
+
+// WriteMessage appends the message to the mbox of the mailbox. It returns an
+// empty path because the message has no file of its own.
+func (s MboxStore) WriteMessage(fs FS, backupDir string, mailbox string, message *imap.Message, body io.Reader) (string, error) {
+	sender, date, messageId := mboxSender(message), time.Now(), ""
+	if !message.InternalDate.IsZero() {
+		date = message.InternalDate
+	} else if message.Envelope != nil && !message.Envelope.Date.IsZero() {
+		date = message.Envelope.Date
+	}
+	if message.Envelope != nil {
+		messageId = message.Envelope.MessageId
+	}
+
+	mboxPath := path.Join(backupDir, mailbox+mboxExtension)
+	err := s.Append(fs, mboxPath, MboxIndexEntry{Uid: message.Uid, MessageId: messageId}, sender, date, body)
+	return "", err
+}
+
+// Append writes body as a new message to the end of the mbox at mboxPath
+// and records it in the index. MessageId of entry and the hash of body
+// identify the message in the index.
+func (s MboxStore) Append(fs FS, mboxPath string, entry MboxIndexEntry, sender string, date time.Time, body io.Reader) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	known, err := s.index(fs, mboxPath)
+	if err != nil {
+		return err
+	}
+
+	err = fs.MkdirAll(path.Dir(mboxPath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	spooled, err := spoolMboxBody(fs, mboxPath+mboxSpoolExtension, body)
+	if err != nil {
+		return err
+	}
+	defer spooled.Close()
+
+	entry.Sha256 = spooled.sha256
+	key := mboxIndexKey(entry)
+	if known[key] {
+		return nil
+	}
+
+	entry.Offset = 0
+	info, err := hackpadfs.Stat(fs, mboxPath)
+	if err == nil {
+		entry.Offset = info.Size()
+	} else if !errors.Is(err, hackpadfs.ErrNotExist) {
+		return err
+	}
+
+	entry.Length, err = appendToFile(fs, mboxPath, func(w io.Writer) error {
+		return writeMboxrd(w, sender, date, spooled)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to append to %s: %w", mboxPath, err)
+	}
+
+	_, err = appendToFile(fs, mboxPath+mboxIndexExtension, func(w io.Writer) error {
+		_, err := io.WriteString(w, formatMboxIndexEntry(entry))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update the index of %s: %w", mboxPath, err)
+	}
+
+	known[key] = true
+	return nil
+}
+
+// spooledBody is a message body that was read to hash it before it is
+// appended
+type spooledBody struct {
+	io.Reader
+	sha256 string
+	close  func() error
+}
+
+func (b *spooledBody) Close() error {
+	return b.close()
+}
+
+// spoolMboxBody reads body to hash it. Bodies larger than mboxSpoolSize are
+// written to a temporary file at tmpPath, which is removed on Close.
+func spoolMboxBody(fs FS, tmpPath string, body io.Reader) (*spooledBody, error) {
+	hasher := sha256.New()
+	head, err := io.ReadAll(io.LimitReader(io.TeeReader(body, hasher), mboxSpoolSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(head) <= mboxSpoolSize {
+		return &spooledBody{
+			Reader: bytes.NewReader(head),
+			sha256: hex.EncodeToString(hasher.Sum(nil)),
+			close:  func() error { return nil },
+		}, nil
+	}
+
+	err = writeFileFrom(fs, tmpPath, io.MultiReader(bytes.NewReader(head), io.TeeReader(body, hasher)))
+	if err != nil {
+		fs.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to spool %s: %w", tmpPath, err)
+	}
+
+	file, err := fs.Open(tmpPath)
+	if err != nil {
+		fs.Remove(tmpPath)
+		return nil, err
+	}
+	return &spooledBody{
+		Reader: file,
+		sha256: hex.EncodeToString(hasher.Sum(nil)),
+		close: func() error {
+			return errors.Join(file.Close(), fs.Remove(tmpPath))
+		},
+	}, nil
+}
+
+// index returns the keys of the messages in the mbox and loads the index
+// on first use
+func (s MboxStore) index(fs FS, mboxPath string) (map[string]bool, error) {
+	if known, ok := s.indexes[mboxPath]; ok {
+		return known, nil
+	}
+
+	entries, err := ReadMboxIndex(fs, mboxPath)
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if key := mboxIndexKey(entry); key != "" {
+			known[key] = true
+		}
+	}
+
+	s.indexes[mboxPath] = known
+	return known, nil
+}
+
+// mboxIndexKey identifies the message of entry independently of its uid, so
+// that messages are recognized after a UIDVALIDITY reset. Entries without a
+// hash are not recognized.
+func mboxIndexKey(entry MboxIndexEntry) string {
+	if entry.Sha256 == "" {
+		return ""
+	}
+	return entry.Sha256 + " " + entry.MessageId
+}
+
+func formatMboxIndexEntry(entry MboxIndexEntry) string {
+	messageId := strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' {
+			return ' '
+		}
+		return r
+	}, entry.MessageId)
+
+	return fmt.Sprintf("%d\t%d\t%d\t%s\t%s\n", entry.Offset, entry.Length, entry.Uid, messageId, entry.Sha256)
+}
+
+// ReadMboxIndex returns the index entries of the mbox at mboxPath. A missing
+// index is empty. An index whose last entry does not end at the end of the
+// mbox belongs to another state of the mbox, after a crash between writing
+// the mbox and its index. It is replaced by the index of a rewrite of the
+// mbox that matches or rebuilt from the mbox.
+func ReadMboxIndex(fs FS, mboxPath string) ([]MboxIndexEntry, error) {
+	entries, err := readMboxIndexFile(fs, mboxPath+mboxIndexExtension)
+	if errors.Is(err, hackpadfs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	size := int64(0)
+	info, err := hackpadfs.Stat(fs, mboxPath)
+	if err == nil {
+		size = info.Size()
+	} else if !errors.Is(err, hackpadfs.ErrNotExist) {
+		return nil, err
+	}
+	if mboxIndexEnd(entries) == size {
+		return entries, nil
+	}
+
+	// the mbox of a rewrite was moved into place, its index was not
+	rewrittenPath := mboxPath + mboxRewriteExtension + mboxIndexExtension
+	rewritten, err := readMboxIndexFile(fs, rewrittenPath)
+	if err == nil && mboxIndexEnd(rewritten) == size {
+		log.WithField("path", mboxPath).Warn("completing the rewrite of the mbox index")
+		return rewritten, fs.Rename(rewrittenPath, mboxPath+mboxIndexExtension)
+	} else if err != nil && !errors.Is(err, hackpadfs.ErrNotExist) {
+		return nil, err
+	}
+
+	log.WithField("path", mboxPath).Warn("the index does not match the mbox, rebuilding it")
+	entries, err = rebuildMboxIndex(fs, mboxPath, entries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rebuild the index of %s: %w", mboxPath, err)
+	}
+	return entries, writeMboxIndex(fs, mboxPath, entries)
+}
+
+// mboxIndexEnd returns the end of the last message of entries
+func mboxIndexEnd(entries []MboxIndexEntry) int64 {
+	if len(entries) == 0 {
+		return 0
+	}
+	last := entries[len(entries)-1]
+	return last.Offset + last.Length
+}
+
+// rebuildMboxIndex indexes the messages of the mbox at mboxPath. The uids
+// and Message-IDs of old entries are kept for the messages with their hash,
+// messages that were not in the index have no uid.
+func rebuildMboxIndex(fs FS, mboxPath string, old []MboxIndexEntry) ([]MboxIndexEntry, error) {
+	known := map[string][]MboxIndexEntry{}
+	for _, entry := range old {
+		known[entry.Sha256] = append(known[entry.Sha256], entry)
+	}
+
+	file, err := fs.Open(mboxPath)
+	if errors.Is(err, hackpadfs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := NewMboxReader(file)
+	var entries []MboxIndexEntry
+	for {
+		message, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		hasher := sha256.New()
+		body := io.TeeReader(message.Body, hasher)
+		entry := MboxIndexEntry{Offset: message.offset}
+		if parsed, err := mail.ReadMessage(body); err == nil {
+			entry.MessageId = strings.TrimSpace(parsed.Header.Get("Message-Id"))
+		}
+		_, err = io.Copy(io.Discard, body)
+		if err != nil {
+			return nil, err
+		}
+		entry.Sha256 = hex.EncodeToString(hasher.Sum(nil))
+
+		if matches := known[entry.Sha256]; len(matches) > 0 {
+			entry.Uid, entry.MessageId = matches[0].Uid, matches[0].MessageId
+			known[entry.Sha256] = matches[1:]
+		}
+		if n := len(entries); n > 0 {
+			entries[n-1].Length = entry.Offset - entries[n-1].Offset
+		}
+		entries = append(entries, entry)
+	}
+
+	if n := len(entries); n > 0 {
+		entries[n-1].Length = reader.offset() - entries[n-1].Offset
+	}
+	return entries, nil
+}
+
+// writeMboxIndex replaces the index of the mbox at mboxPath by entries
+func writeMboxIndex(fs FS, mboxPath string, entries []MboxIndexEntry) error {
+	index := new(strings.Builder)
+	for _, entry := range entries {
+		index.WriteString(formatMboxIndexEntry(entry))
+	}
+
+	tmpPath := mboxPath + mboxRewriteExtension + mboxIndexExtension
+	err := fs.WriteFile(tmpPath, []byte(index.String()), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return fs.Rename(tmpPath, mboxPath+mboxIndexExtension)
+}
+
+func readMboxIndexFile(fs FS, indexPath string) ([]MboxIndexEntry, error) {
+	content, err := hackpadfs.ReadFile(fs, indexPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []MboxIndexEntry
+	for i, line := range strings.Split(string(content), "\n") {
+		if line == "" {
+			continue
+		}
+
+		// entries written before the hash was recorded have four fields
+		fields := strings.SplitN(line, "\t", 5)
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("invalid index entry in line %d of %s", i+1, indexPath)
+		}
+
+		offset, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		length, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		uid, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+
+		entry := MboxIndexEntry{Offset: offset, Length: length, Uid: uint32(uid), MessageId: fields[3]}
+		if len(fields) == 5 {
+			entry.Sha256 = fields[4]
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// OpenMboxMessage returns the unquoted message of an index entry. The file
+// of the mbox must support seeking.
+func OpenMboxMessage(fs FS, mboxPath string, entry MboxIndexEntry) (io.ReadCloser, error) {
+	message, file, err := openMboxMessage(fs, mboxPath, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{message.Body, file}, nil
+}
+
+func openMboxMessage(fs FS, mboxPath string, entry MboxIndexEntry) (*MboxMessage, io.Closer, error) {
+	file, err := fs.Open(mboxPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	seeker, ok := file.(io.Seeker)
+	if !ok {
+		file.Close()
+		return nil, nil, fmt.Errorf("failed to read %s. file is not an io.Seeker", mboxPath)
+	}
+
+	_, err = seeker.Seek(entry.Offset, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	message, err := NewMboxReader(io.LimitReader(file, entry.Length)).Next()
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("no message at offset %d of %s: %w", entry.Offset, mboxPath, err)
+	}
+
+	return message, file, nil
+}
+
+func appendToFile(fs FS, filePath string, write func(w io.Writer) error) (int64, error) {
+	file, err := fs.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, os.ModePerm)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	writer, ok := file.(io.Writer)
+	if !ok {
+		return 0, fmt.Errorf("failed to write file. file is not an io.Writer")
+	}
+
+	counter := &countingWriter{writer: writer}
+	bw := bufio.NewWriter(counter)
+	err = write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		return counter.written, err
+	}
+
+	return counter.written, file.Close()
+}
+
+type countingWriter struct {
+	writer  io.Writer
+	written int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func mboxSender(message *imap.Message) string {
+	if message.Envelope == nil || len(message.Envelope.From) == 0 {
+		return mboxDefaultSender
+	}
+
+	address := message.Envelope.From[0].Address()
+	if address == "" || strings.ContainsAny(address, " \t\r\n") {
+		return mboxDefaultSender
+	}
+	return address
+}
+
+// writeMboxrd writes the From_ line, the message with every line matching
+// ^>*From  quoted by another > and the empty line that ends the message
+func writeMboxrd(w io.Writer, sender string, date time.Time, body io.Reader) error {
+	bw, ok := w.(*bufio.Writer)
+	if !ok {
+		bw = bufio.NewWriter(w)
+	}
+
+	_, err := fmt.Fprintf(bw, "From %s %s\n", sender, date.UTC().Format(mboxDateLayout))
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(body)
+	atLineStart := true
+	for {
+		if atLineStart && isQuotedFromLine(br, 0) {
+			if err := bw.WriteByte('>'); err != nil {
+				return err
+			}
+		}
+
+		line, err := br.ReadSlice('\n')
+		if _, err := bw.Write(line); err != nil {
+			return err
+		}
+
+		if len(line) > 0 {
+			atLineStart = line[len(line)-1] == '\n'
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			return err
+		}
+	}
+
+	if !atLineStart {
+		if err := bw.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+	if err := bw.WriteByte('\n'); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// isQuotedFromLine reports whether the next line starts with at least
+// minQuotes > followed by From
+func isQuotedFromLine(br *bufio.Reader, minQuotes int) bool {
+	for n := 0; ; n++ {
+		prefix, err := br.Peek(n + len(mboxFromLine))
+		if err != nil {
+			return false
+		}
+		if prefix[n] != '>' {
+			return n >= minQuotes && bytes.Equal(prefix[n:], mboxFromLine)
+		}
+	}
+}
+
+// MboxMessage is a message read from an mbox. Body must be read before the
+// next message.
+type MboxMessage struct {
+	Sender string
+	Date   time.Time
+	Body   io.Reader
+	// offset is the offset of the From_ line in the mbox
+	offset int64
+}
+
+// MboxReader reads the messages of an mboxrd file
+type MboxReader struct {
+	br      *bufio.Reader
+	read    *countingReader
+	current *mboxBodyReader
+}
+
+func NewMboxReader(r io.Reader) *MboxReader {
+	read := &countingReader{reader: r}
+	return &MboxReader{br: bufio.NewReader(read), read: read}
+}
+
+// offset returns the offset of the next byte in the mbox
+func (r *MboxReader) offset() int64 {
+	return r.read.n - int64(r.br.Buffered())
+}
+
+// countingReader counts the bytes read from reader
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// Next returns the next message or io.EOF at the end of the mbox
+func (r *MboxReader) Next() (*MboxMessage, error) {
+	if r.current != nil {
+		_, err := io.Copy(io.Discard, r.current)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	offset := r.offset()
+	line, err := r.br.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return nil, io.EOF
+	} else if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	fromLine, ok := strings.CutPrefix(strings.TrimRight(line, "\r\n"), string(mboxFromLine))
+	if !ok {
+		return nil, fmt.Errorf("invalid mbox. expected From_ line, got %q", cropString(line, 80))
+	}
+
+	message := &MboxMessage{Sender: mboxDefaultSender, offset: offset}
+	sender, date, _ := strings.Cut(strings.TrimSpace(fromLine), " ")
+	if sender != "" {
+		message.Sender = sender
+	}
+	message.Date, _ = time.Parse(mboxDateLayout, strings.TrimSpace(date))
+
+	r.current = &mboxBodyReader{br: r.br, atLineStart: true}
+	message.Body = r.current
+	return message, nil
+}
+
+// mboxBodyReader reads one message up to the next From_ line. The newline
+// at the end of each line is held back until the next line is known, because
+// the last one belongs to the separator.
+type mboxBodyReader struct {
+	br          *bufio.Reader
+	chunk       []byte
+	atLineStart bool
+	newline     bool
+	done        bool
+	err         error
+}
+
+var newlineBytes = []byte{'\n'}
+
+func (r *mboxBodyReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.done {
+			if r.err != nil {
+				return 0, r.err
+			}
+			return 0, io.EOF
+		}
+		r.next()
+	}
+
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+func (r *mboxBodyReader) next() {
+	if r.atLineStart {
+		_, err := r.br.Peek(1)
+		if err != nil || (isQuotedFromLine(r.br, 0) && !isQuotedFromLine(r.br, 1)) {
+			if err != nil && err != io.EOF {
+				r.err = err
+			}
+			r.done = true
+			return
+		}
+
+		if isQuotedFromLine(r.br, 1) {
+			r.br.Discard(1)
+		}
+
+		r.atLineStart = false
+		if r.newline {
+			r.newline = false
+			r.chunk = newlineBytes
+			return
+		}
+	}
+
+	line, err := r.br.ReadSlice('\n')
+	switch {
+	case err == nil:
+		r.chunk = line[:len(line)-1]
+		r.newline = true
+		r.atLineStart = true
+	case errors.Is(err, bufio.ErrBufferFull):
+		r.chunk = line
+	case err == io.EOF:
+		r.chunk = line
+		r.atLineStart = true
+	default:
+		r.err = err
+		r.done = true
+	}
+}
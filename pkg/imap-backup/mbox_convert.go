@@ -0,0 +1,224 @@
+package imap_backup
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/mail"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/hack-pad/hackpadfs"
+	log "github.com/sirupsen/logrus"
+)
+
+const emlExtension = ".eml"
+
+var headerDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		if imap.CharsetReader != nil {
+			return imap.CharsetReader(charset, input)
+		}
+		return nil, fmt.Errorf("unhandled charset %q", charset)
+	},
+}
+
+// ConvertEmlToMbox appends every .eml file of the backup at emlDir to the
+// mbox of its mailbox below mboxDir. The messages of a mailbox are appended
+// in the order of their dates.
+func ConvertEmlToMbox(fileSystem FS, emlDir string, mboxDir string) error {
+	mailboxes := map[string][]emlFile{}
+	err := hackpadfs.WalkDir(fileSystem, emlDir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath := strings.TrimPrefix(strings.TrimPrefix(filePath, emlDir), "/")
+		if d.IsDir() {
+			if relPath == uidIndexDir || relPath == deletedDir {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if !isEmlFile(d.Name()) {
+			return nil
+		}
+
+		mailbox := path.Dir(relPath)
+		if mailbox == "." {
+			log.WithField("path", filePath).Warn("skipping message outside of a mailbox")
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		mailboxes[mailbox] = append(mailboxes[mailbox], emlFile{path: filePath, modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	store := NewMboxStore()
+	for mailbox, files := range mailboxes {
+		slices.SortStableFunc(files, func(a, b emlFile) int {
+			return a.modTime.Compare(b.modTime)
+		})
+
+		mboxPath := path.Join(mboxDir, mailbox+mboxExtension)
+		for _, file := range files {
+			err := appendEmlToMbox(fileSystem, store, mboxPath, file)
+			if err != nil {
+				return err
+			}
+		}
+
+		log.WithFields(log.Fields{"mailbox": mailbox, "messages": len(files), "path": mboxPath}).Info("converted mailbox to mbox")
+	}
+
+	return nil
+}
+
+type emlFile struct {
+	path    string
+	modTime time.Time
+}
+
+func appendEmlToMbox(fileSystem FS, store MboxStore, mboxPath string, file emlFile) error {
+	header, err := readEmlHeader(fileSystem, file.path)
+	if err != nil {
+		return err
+	}
+
+	sender := mboxDefaultSender
+	if from, err := mail.ParseAddress(header.Get("From")); err == nil && from.Address != "" && !strings.ContainsAny(from.Address, " \t") {
+		sender = from.Address
+	}
+
+	date, err := header.Date()
+	if err != nil {
+		date = file.modTime
+	}
+
+	body, err := OpenMessageFile(fileSystem, file.path)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	entry := MboxIndexEntry{MessageId: strings.TrimSpace(header.Get("Message-Id"))}
+	return store.Append(fileSystem, mboxPath, entry, sender, date, body)
+}
+
+func readEmlHeader(fileSystem FS, filePath string) (mail.Header, error) {
+	file, err := OpenMessageFile(fileSystem, filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	message, err := mail.ReadMessage(bufio.NewReader(file))
+	if err != nil {
+		// the body is copied as is even if the header is broken
+		log.WithField("path", filePath).WithError(err).Warn("failed to parse message header")
+		return mail.Header{}, nil
+	}
+
+	return message.Header, nil
+}
+
+// ConvertMboxToEml writes every message of the mbox files below mboxDir as an
+// .eml file of its mailbox below emlDir
+func ConvertMboxToEml(fileSystem FS, mboxDir string, emlDir string) error {
+	return hackpadfs.WalkDir(fileSystem, mboxDir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), mboxExtension) {
+			return nil
+		}
+
+		relPath := strings.TrimPrefix(strings.TrimPrefix(filePath, mboxDir), "/")
+		mailbox := strings.TrimSuffix(relPath, mboxExtension)
+
+		count, err := convertMboxToEml(fileSystem, filePath, emlDir, mailbox)
+		if err != nil {
+			return err
+		}
+
+		log.WithFields(log.Fields{"mailbox": mailbox, "messages": count, "path": filePath}).Info("converted mbox to eml")
+		return nil
+	})
+}
+
+func convertMboxToEml(fileSystem FS, mboxPath string, emlDir string, mailbox string) (int, error) {
+	file, err := fileSystem.Open(mboxPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := NewMboxReader(file)
+	count := 0
+	for {
+		mboxMessage, err := reader.Next()
+		if err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return count, err
+		}
+
+		body := bufio.NewReader(mboxMessage.Body)
+		rawHeader, err := readRawHeader(body)
+		if err != nil {
+			return count, err
+		}
+
+		message := &imap.Message{Envelope: &imap.Envelope{Date: mboxMessage.Date}}
+		if parsed, err := mail.ReadMessage(bytes.NewReader(rawHeader)); err == nil {
+			message.Envelope.MessageId = strings.TrimSpace(parsed.Header.Get("Message-Id"))
+			message.Envelope.Subject = parsed.Header.Get("Subject")
+			if subject, err := headerDecoder.DecodeHeader(message.Envelope.Subject); err == nil {
+				message.Envelope.Subject = subject
+			}
+			if date, err := parsed.Header.Date(); err == nil {
+				message.Envelope.Date = date
+			}
+		}
+
+		_, err = EmlStore{}.WriteMessage(fileSystem, emlDir, mailbox, message, io.MultiReader(bytes.NewReader(rawHeader), body))
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+// readRawHeader reads the header of a message up to and including the empty
+// line that ends it
+func readRawHeader(br *bufio.Reader) ([]byte, error) {
+	header := new(bytes.Buffer)
+	for {
+		line, err := br.ReadBytes('\n')
+		header.Write(line)
+		if err == io.EOF {
+			return header.Bytes(), nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return header.Bytes(), nil
+		}
+	}
+}
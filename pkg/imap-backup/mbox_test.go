@@ -0,0 +1,227 @@
+package imap_backup
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/hack-pad/hackpadfs"
+	"github.com/stretchr/testify/assert"
+)
+
+const quotingBody = "Subject: quoting\r\n\r\nFrom the start\r\n>From quoted\r\n>>From twice\r\n From not quoted\r\nlast line\r\n"
+
+func TestWriteMboxrdQuotesFromLines(t *testing.T) {
+	out := new(bytes.Buffer)
+	date := time.Date(2024, time.February, 8, 22, 47, 30, 0, time.UTC)
+	assert.NoError(t, writeMboxrd(out, "me@example.com", date, strings.NewReader(quotingBody)))
+
+	assert.Equal(t, "From me@example.com Thu Feb  8 22:47:30 2024\n"+
+		"Subject: quoting\r\n\r\n>From the start\r\n>>From quoted\r\n>>>From twice\r\n From not quoted\r\nlast line\r\n\n", out.String())
+}
+
+func TestMboxReaderRoundTrip(t *testing.T) {
+	bodies := []string{quotingBody, "Subject: no newline\r\n\r\nbody", "", "Subject: empty lines\n\n\n\nbody\n"}
+
+	out := new(bytes.Buffer)
+	for _, body := range bodies {
+		assert.NoError(t, writeMboxrd(out, "me@example.com", time.Now(), strings.NewReader(body)))
+	}
+
+	reader := NewMboxReader(out)
+	for _, body := range bodies {
+		message, err := reader.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, "me@example.com", message.Sender)
+
+		content, err := io.ReadAll(message.Body)
+		assert.NoError(t, err)
+		if body == bodies[1] {
+			// a missing newline at the end cannot be told apart from the separator
+			body += "\n"
+		}
+		assert.Equal(t, body, string(content))
+	}
+
+	_, err := reader.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestMboxStoreAppendsWithIndex(t *testing.T) {
+	fs := newMemFS(t)
+	backup := newTestBackup(t, fs, Config{BackupDir: "backup", Format: FormatMbox})
+
+	first := testMessage(1, "first", "<1@example.com>", quotingBody)
+	first.Envelope.From = []*imap.Address{{MailboxName: "me", HostName: "example.com"}}
+	second := testMessage(2, "second", "<2@example.com>", "Subject: second\r\n\r\nbody\r\n")
+
+	assert.NoError(t, backup.SaveMessage("INBOX", first, fs, "backup"))
+	assert.NoError(t, backup.SaveMessage("INBOX", second, fs, "backup"))
+	// already in the index, also with the uid of another UIDVALIDITY
+	backup.HandleUidValidity("INBOX", 2)
+	assert.NoError(t, backup.SaveMessage("INBOX", testMessage(7, "second", "<2@example.com>", "Subject: second\r\n\r\nbody\r\n"), fs, "backup"))
+
+	entries, err := ReadMboxIndex(fs, "backup/INBOX.mbox")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, uint32(1), entries[0].Uid)
+	assert.Equal(t, "<2@example.com>", entries[1].MessageId)
+	assert.Equal(t, entries[0].Offset+entries[0].Length, entries[1].Offset)
+
+	info, err := fs.Stat("backup/INBOX.mbox")
+	assert.NoError(t, err)
+	assert.Equal(t, entries[1].Offset+entries[1].Length, info.Size())
+
+	message, err := OpenMboxMessage(fs, "backup/INBOX.mbox", entries[1])
+	assert.NoError(t, err)
+	content, err := io.ReadAll(message)
+	assert.NoError(t, err)
+	assert.NoError(t, message.Close())
+	assert.Equal(t, "Subject: second\r\n\r\nbody\r\n", string(content))
+
+	mbox, err := hackpadfs.ReadFile(fs, "backup/INBOX.mbox")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(mbox), "From me@example.com Sun Feb 18 22:47:30 2024\n"))
+
+	// the mbox has no uid index, expunges keep the archive intact
+	backup.HandleExpunge("INBOX", 1)
+	_, err = fs.Stat("backup/INBOX.mbox")
+	assert.NoError(t, err)
+}
+
+func TestConfigWithoutAppends(t *testing.T) {
+	_, err := Config{Format: FormatMbox}.WithoutAppends()
+	assert.ErrorContains(t, err, "not supported")
+
+	cfg, err := Config{Format: FormatEml}.WithoutAppends()
+	assert.NoError(t, err)
+	assert.Equal(t, Config{Format: FormatEml}, cfg)
+}
+
+func TestConvertEmlToMboxAndBack(t *testing.T) {
+	fs := newMemFS(t)
+	backup := newTestBackup(t, fs, Config{BackupDir: "eml"})
+
+	bodies := []string{
+		"Subject: first\r\nMessage-Id: <1@example.com>\r\nFrom: Me <me@example.com>\r\n\r\n" + "From here\r\n",
+		"Subject: second\r\nMessage-Id: <2@example.com>\r\n\r\nbody\r\n",
+	}
+	messages := []*imap.Message{
+		testMessage(1, "first", "<1@example.com>", bodies[0]),
+		testMessage(2, "second", "<2@example.com>", bodies[1]),
+	}
+	messages[0].Envelope.Date = messages[1].Envelope.Date.Add(-time.Hour)
+	for _, message := range messages {
+		assert.NoError(t, backup.SaveMessage("INBOX/Sub", message, fs, "eml"))
+	}
+
+	assert.NoError(t, ConvertEmlToMbox(fs, "eml", "mbox"))
+
+	entries, err := ReadMboxIndex(fs, "mbox/INBOX/Sub.mbox")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "<1@example.com>", entries[0].MessageId)
+
+	// converting again does not duplicate messages
+	assert.NoError(t, ConvertEmlToMbox(fs, "eml", "mbox"))
+	entries, err = ReadMboxIndex(fs, "mbox/INBOX/Sub.mbox")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(entries))
+
+	assert.NoError(t, ConvertMboxToEml(fs, "mbox", "restored"))
+	for n, message := range messages {
+		messagePath := GetPathOfMessage("INBOX/Sub", message, sha256Of([]byte(bodies[n])))
+		original, err := hackpadfs.ReadFile(fs, "eml/"+messagePath)
+		assert.NoError(t, err)
+		restored, err := hackpadfs.ReadFile(fs, "restored/"+messagePath)
+		assert.NoError(t, err)
+		assert.Equal(t, string(original), string(restored))
+	}
+}
+
+func TestMboxStoreSpoolsLargeMessages(t *testing.T) {
+	fs := newMemFS(t)
+	store := NewMboxStore()
+
+	body := strings.Repeat("large body\r\n", mboxSpoolSize/10)
+	for i := 0; i < 2; i++ {
+		err := store.Append(fs, "INBOX.mbox", MboxIndexEntry{MessageId: "<large@example.com>"}, mboxDefaultSender, time.Now(), strings.NewReader(body))
+		assert.NoError(t, err)
+	}
+
+	entries, err := ReadMboxIndex(fs, "INBOX.mbox")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, sha256Of([]byte(body)), entries[0].Sha256)
+
+	message, err := OpenMboxMessage(fs, "INBOX.mbox", entries[0])
+	assert.NoError(t, err)
+	content, err := io.ReadAll(message)
+	assert.NoError(t, err)
+	assert.NoError(t, message.Close())
+	assert.Equal(t, body, string(content))
+
+	// the spooled copy is removed
+	_, err = fs.Stat("INBOX.mbox" + mboxSpoolExtension)
+	assert.ErrorIs(t, err, hackpadfs.ErrNotExist)
+
+	// indexes without hashes are still read
+	assert.NoError(t, fs.WriteFile("old.mbox", []byte("0123456789"), os.ModePerm))
+	assert.NoError(t, fs.WriteFile("old.mbox.idx", []byte("0\t10\t1\t<old@example.com>\n"), os.ModePerm))
+	entries, err = ReadMboxIndex(fs, "old.mbox")
+	assert.NoError(t, err)
+	assert.Equal(t, []MboxIndexEntry{{Length: 10, Uid: 1, MessageId: "<old@example.com>"}}, entries)
+}
+
+func TestReadMboxIndexRepairsMismatchedIndex(t *testing.T) {
+	fs := newMemFS(t)
+	backup := newTestBackup(t, fs, Config{BackupDir: "backup", Format: FormatMbox})
+	assert.NoError(t, backup.SaveMessage("INBOX", testMessage(1, "first", "<1@example.com>", "Message-ID: <1@example.com>\r\nSubject: first\r\n\r\nfirst body\r\n"), fs, "backup"))
+	assert.NoError(t, backup.SaveMessage("INBOX", testMessage(2, "second", "<2@example.com>", "Message-ID: <2@example.com>\r\nSubject: second\r\n\r\nsecond body\r\n"), fs, "backup"))
+
+	mboxPath := "backup/INBOX.mbox"
+	indexPath := mboxPath + mboxIndexExtension
+	index, err := hackpadfs.ReadFile(fs, indexPath)
+	assert.NoError(t, err)
+	entries, err := ReadMboxIndex(fs, mboxPath)
+	assert.NoError(t, err)
+
+	// the second message was appended to the mbox, not to the index
+	firstLine := strings.SplitAfter(string(index), "\n")[0]
+	assert.NoError(t, fs.WriteFile(indexPath, []byte(firstLine), os.ModePerm))
+	rebuilt, err := ReadMboxIndex(fs, mboxPath)
+	assert.NoError(t, err)
+	unknown := entries[1]
+	unknown.Uid = 0
+	assert.Equal(t, []MboxIndexEntry{entries[0], unknown}, rebuilt)
+	repaired, err := ReadMboxIndex(fs, mboxPath)
+	assert.NoError(t, err)
+	assert.Equal(t, rebuilt, repaired)
+
+	// a rewrite replaced the mbox, not the index
+	assert.NoError(t, fs.WriteFile(indexPath, index, os.ModePerm))
+	assert.NoError(t, rewriteMbox(fs, mboxPath, map[int64]bool{entries[0].Offset: true}))
+	rewritten, err := hackpadfs.ReadFile(fs, indexPath)
+	assert.NoError(t, err)
+	assert.NoError(t, fs.WriteFile(mboxPath+mboxRewriteExtension+mboxIndexExtension, rewritten, os.ModePerm))
+	assert.NoError(t, fs.WriteFile(indexPath, index, os.ModePerm))
+
+	second := entries[1]
+	second.Offset = 0
+	completed, err := ReadMboxIndex(fs, mboxPath)
+	assert.NoError(t, err)
+	assert.Equal(t, []MboxIndexEntry{second}, completed)
+	_, err = fs.Stat(mboxPath + mboxRewriteExtension + mboxIndexExtension)
+	assert.ErrorIs(t, err, hackpadfs.ErrNotExist)
+
+	message, err := OpenMboxMessage(fs, mboxPath, completed[0])
+	assert.NoError(t, err)
+	content, err := io.ReadAll(message)
+	assert.NoError(t, err)
+	assert.NoError(t, message.Close())
+	assert.Equal(t, "Message-ID: <2@example.com>\r\nSubject: second\r\n\r\nsecond body\r\n", string(content))
+}
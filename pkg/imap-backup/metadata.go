@@ -0,0 +1,257 @@
+package imap_backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/hack-pad/hackpadfs"
+)
+
+const metadataDir = ".metadata"
+const metadataExtension = ".jsonl"
+
+// FetchGmailLabels is the fetch item of the labels of a message on Gmail
+const FetchGmailLabels imap.FetchItem = "X-GM-LABELS"
+
+// MessageMetadata is the server state of a message. The metadata of a
+// mailbox is kept in .metadata/<mailbox>.jsonl. Every change appends a
+// record, records of flag changes and expunges only have the changed fields.
+// Expunged and Pruned stay set once a record set them.
+type MessageMetadata struct {
+	Mailbox      string    `json:"mailbox"`
+	Uid          uint32    `json:"uid"`
+	UidValidity  uint32    `json:"uidValidity,omitempty"`
+	Flags        []string  `json:"flags"`
+	InternalDate time.Time `json:"internalDate,omitzero"`
+	Size         uint32    `json:"size,omitempty"`
+	Labels       []string  `json:"labels,omitempty"`
+	MessageId    string    `json:"messageId,omitempty"`
+	Sha256       string    `json:"sha256,omitempty"`
+	// Path is the path of the message file relative to the backup directory.
+	// It is empty for stores without a file per message.
+	Path     string `json:"path,omitempty"`
+	Expunged bool   `json:"expunged,omitempty"`
+	// Pruned is set once the retention removed the message from the backup
+	Pruned bool `json:"pruned,omitempty"`
+}
+
+// HandleUidValidity remembers the UIDVALIDITY of the mailbox for the metadata
+// of its messages
+func (i *ImapBackup) HandleUidValidity(mailbox string, uidValidity uint32) {
+	mailbox = i.mailboxPath(mailbox)
+	i.metadataLock.Lock()
+	defer i.metadataLock.Unlock()
+
+	i.uidValidities[mailbox] = uidValidity
+}
+
+func (i *ImapBackup) uidValidity(mailbox string) uint32 {
+	i.metadataLock.Lock()
+	defer i.metadataLock.Unlock()
+
+	return i.uidValidities[mailbox]
+}
+
+// newMessageMetadata returns the metadata of a message as it was fetched
+func (i *ImapBackup) newMessageMetadata(mailbox string, message *imap.Message) MessageMetadata {
+	metadata := MessageMetadata{
+		Mailbox:      mailbox,
+		Uid:          message.Uid,
+		UidValidity:  i.uidValidity(mailbox),
+		Flags:        nonNilFlags(message.Flags),
+		InternalDate: message.InternalDate,
+		Size:         message.Size,
+		Labels:       messageLabels(message),
+	}
+	if message.Envelope != nil {
+		metadata.MessageId = message.Envelope.MessageId
+	}
+	return metadata
+}
+
+// messageLabels returns the Gmail labels of a message if they were fetched
+func messageLabels(message *imap.Message) []string {
+	fields, ok := message.Items[FetchGmailLabels].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	labels := make([]string, 0, len(fields))
+	for _, field := range fields {
+		label, err := imap.ParseString(field)
+		if err == nil {
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// nonNilFlags returns flags as an empty list if there are none, because
+// records without flags do not change them
+func nonNilFlags(flags []string) []string {
+	if flags == nil {
+		return []string{}
+	}
+	return flags
+}
+
+// appendMetadata appends a record to the metadata of its mailbox
+func (i *ImapBackup) appendMetadata(fs FS, backupDir string, metadata MessageMetadata) error {
+	if metadata.Uid == 0 {
+		return nil
+	}
+
+	line, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	i.metadataLock.Lock()
+	defer i.metadataLock.Unlock()
+
+	metadataPath := GetMetadataPath(backupDir, metadata.Mailbox)
+	err = fs.MkdirAll(path.Dir(metadataPath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	_, err = appendToFile(fs, metadataPath, func(w io.Writer) error {
+		_, err := w.Write(append(line, '\n'))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to append to %s: %w", metadataPath, err)
+	}
+
+	if live, ok := i.livePaths[metadataPath]; ok {
+		live.apply(metadata)
+	}
+	return nil
+}
+
+// messageKey identifies a message by its UIDVALIDITY and UID
+type messageKey struct {
+	uidValidity uint32
+	uid         uint32
+}
+
+// pathKey is a message file of the messages of a UIDVALIDITY
+type pathKey struct {
+	uidValidity uint32
+	path        string
+}
+
+// livePaths are the files of the messages of a mailbox that are neither
+// expunged nor pruned
+type livePaths struct {
+	paths map[messageKey]string
+	// users is the number of messages in a file
+	users map[pathKey]int
+	gone  map[messageKey]bool
+}
+
+func newLivePaths() *livePaths {
+	return &livePaths{paths: map[messageKey]string{}, users: map[pathKey]int{}, gone: map[messageKey]bool{}}
+}
+
+// apply updates the paths with a metadata record or the merged metadata of
+// a message
+func (l *livePaths) apply(record MessageMetadata) {
+	key := messageKey{record.UidValidity, record.Uid}
+	if l.gone[key] {
+		return
+	}
+
+	if record.Expunged || record.Pruned || record.Path != "" {
+		if oldPath, ok := l.paths[key]; ok {
+			l.users[pathKey{key.uidValidity, oldPath}]--
+			delete(l.paths, key)
+		}
+	}
+
+	switch {
+	case record.Expunged || record.Pruned:
+		l.gone[key] = true
+	case record.Path != "":
+		l.paths[key] = record.Path
+		l.users[pathKey{key.uidValidity, record.Path}]++
+	}
+}
+
+// GetMetadataPath returns the path of the metadata of mailbox
+func GetMetadataPath(backupDir string, mailbox string) string {
+	return path.Join(backupDir, metadataDir, mailbox+metadataExtension)
+}
+
+// ReadMetadata returns the metadata of the messages of mailbox with all
+// changes applied, in the order the messages were saved. A message is
+// identified by its UIDVALIDITY and UID.
+func ReadMetadata(fs FS, backupDir string, mailbox string) ([]MessageMetadata, error) {
+	metadataPath := GetMetadataPath(backupDir, mailbox)
+	content, err := hackpadfs.ReadFile(fs, metadataPath)
+	if errors.Is(err, hackpadfs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var messages []MessageMetadata
+	positions := map[messageKey]int{}
+	for n, line := range strings.Split(string(content), "\n") {
+		if line == "" {
+			continue
+		}
+
+		record := MessageMetadata{}
+		err := json.Unmarshal([]byte(line), &record)
+		if err != nil {
+			return nil, fmt.Errorf("invalid record in line %d of %s: %w", n+1, metadataPath, err)
+		}
+
+		key := messageKey{record.UidValidity, record.Uid}
+		position, ok := positions[key]
+		if !ok {
+			positions[key] = len(messages)
+			messages = append(messages, record)
+			continue
+		}
+
+		messages[position].apply(record)
+	}
+
+	return messages, nil
+}
+
+// apply updates m with the fields that are set in record
+func (m *MessageMetadata) apply(record MessageMetadata) {
+	if record.Flags != nil {
+		m.Flags = record.Flags
+	}
+	if !record.InternalDate.IsZero() {
+		m.InternalDate = record.InternalDate
+	}
+	if record.Size != 0 {
+		m.Size = record.Size
+	}
+	if record.Labels != nil {
+		m.Labels = record.Labels
+	}
+	if record.MessageId != "" {
+		m.MessageId = record.MessageId
+	}
+	if record.Sha256 != "" {
+		m.Sha256 = record.Sha256
+	}
+	if record.Path != "" {
+		m.Path = record.Path
+	}
+	m.Expunged = m.Expunged || record.Expunged
+	m.Pruned = m.Pruned || record.Pruned
+}
@@ -0,0 +1,81 @@
+package imap_backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadataFollowsMessageChanges(t *testing.T) {
+	fs := newMemFS(t)
+	backup := newTestBackup(t, fs, Config{BackupDir: "backup", Format: FormatMaildir})
+	backup.HandleUidValidity("INBOX", 1234)
+
+	internalDate := time.Date(2024, time.March, 1, 8, 0, 0, 0, time.UTC)
+	message := testMessage(7, "hello", "<id@example.com>", "body")
+	message.InternalDate = internalDate
+	message.Size = 4
+	message.Flags = []string{imap.SeenFlag}
+	message.Items = map[imap.FetchItem]interface{}{
+		FetchGmailLabels: []interface{}{`\Inbox`, "Rechnungen"},
+	}
+	assert.NoError(t, backup.SaveMessage("INBOX", message, fs, "backup"))
+
+	sum := sha256.Sum256([]byte("body"))
+	metadata, err := ReadMetadata(fs, "backup", "INBOX")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(metadata))
+	savedPath := metadata[0].Path
+	assert.Equal(t, MessageMetadata{
+		Mailbox:      "INBOX",
+		Uid:          7,
+		UidValidity:  1234,
+		Flags:        []string{imap.SeenFlag},
+		InternalDate: internalDate,
+		Size:         4,
+		Labels:       []string{`\Inbox`, "Rechnungen"},
+		MessageId:    "<id@example.com>",
+		Sha256:       hex.EncodeToString(sum[:]),
+		Path:         savedPath,
+	}, metadata[0])
+
+	backup.HandleFlags("INBOX", &imap.Message{Uid: 7, Flags: []string{imap.SeenFlag, imap.FlaggedFlag}})
+
+	metadata, err = ReadMetadata(fs, "backup", "INBOX")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(metadata))
+	assert.Equal(t, []string{imap.SeenFlag, imap.FlaggedFlag}, metadata[0].Flags)
+	assert.Equal(t, []string{`\Inbox`, "Rechnungen"}, metadata[0].Labels)
+	assert.NotEqual(t, savedPath, metadata[0].Path)
+	assert.Equal(t, internalDate, metadata[0].InternalDate)
+
+	// all flags removed
+	backup.HandleFlags("INBOX", &imap.Message{Uid: 7})
+	backup.HandleExpunge("INBOX", 7)
+
+	metadata, err = ReadMetadata(fs, "backup", "INBOX")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(metadata))
+	assert.Equal(t, []string{}, metadata[0].Flags)
+	assert.True(t, metadata[0].Expunged)
+	assert.Equal(t, "deleted/INBOX/cur/", metadata[0].Path[:len("deleted/INBOX/cur/")])
+
+	// later records of the message do not undo the expunge
+	assert.NoError(t, backup.appendMetadata(fs, "backup", MessageMetadata{Mailbox: "INBOX", Uid: 7, UidValidity: 1234, Flags: []string{imap.SeenFlag}}))
+	metadata, err = ReadMetadata(fs, "backup", "INBOX")
+	assert.NoError(t, err)
+	assert.True(t, metadata[0].Expunged)
+
+	// a new UIDVALIDITY starts new messages
+	backup.HandleUidValidity("INBOX", 1235)
+	assert.NoError(t, backup.SaveMessage("INBOX", testMessage(7, "hello", "<id@example.com>", "body"), fs, "backup"))
+	metadata, err = ReadMetadata(fs, "backup", "INBOX")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(metadata))
+	assert.Equal(t, uint32(1235), metadata[1].UidValidity)
+	assert.False(t, metadata[1].Expunged)
+}
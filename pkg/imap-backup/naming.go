@@ -0,0 +1,358 @@
+package imap_backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/mail"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+
+	"github.com/emersion/go-imap"
+	"github.com/hack-pad/hackpadfs"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/text/unicode/norm"
+)
+
+// DefaultNameTemplate names .eml files like
+// 2024-02-18_3f2a9c1b7e4d5a60_hello-world.eml
+const DefaultNameTemplate = "{{.Date}}_{{.Hash}}_{{.Slug}}"
+
+// nameHashLength is the number of hex digits of the hash in a name
+const nameHashLength = 16
+
+// maxSlugLength keeps names well below the path limits of SMB shares
+const maxSlugLength = 50
+
+var defaultNamer = MessageNamer{template: template.Must(template.New("name").Parse(DefaultNameTemplate))}
+
+// transliterations are the letters that do not decompose into an ASCII letter
+// and a combining mark
+var transliterations = map[rune]string{
+	'ä': "ae", 'ö': "oe", 'ü': "ue", 'Ä': "Ae", 'Ö': "Oe", 'Ü': "Ue",
+	'ß': "ss", 'ẞ': "SS", 'æ': "ae", 'Æ': "Ae", 'œ': "oe", 'Œ': "Oe",
+	'ø': "o", 'Ø': "O", 'ł': "l", 'Ł': "L", 'đ': "d", 'Đ': "D",
+	'ð': "d", 'Ð': "D", 'þ': "th", 'Þ': "Th", 'ı': "i",
+}
+
+// MessageName are the fields of the name template of a message file
+type MessageName struct {
+	// Date and Time of the message in UTC as 2006-01-02 and 150405
+	Date string
+	Time string
+	// Hash are the first hex digits of the SHA-256 of the message, they make
+	// the name unique
+	Hash string
+	// Slug is the subject transliterated to lower case ASCII
+	Slug string
+	Uid  uint32
+}
+
+// NewMessageName returns the name fields of a message with the SHA-256 hash
+// of its body
+func NewMessageName(date time.Time, subject string, hash string, uid uint32) MessageName {
+	name := MessageName{Date: "undated", Time: "000000", Hash: hash, Slug: Slugify(subject), Uid: uid}
+	if !date.IsZero() {
+		name.Date = date.UTC().Format("2006-01-02")
+		name.Time = date.UTC().Format("150405")
+	}
+	if len(name.Hash) > nameHashLength {
+		name.Hash = name.Hash[:nameHashLength]
+	}
+	return name
+}
+
+// MessageNamer names the files of messages with a template. The zero value
+// uses DefaultNameTemplate.
+type MessageNamer struct {
+	template *template.Template
+}
+
+// NewMessageNamer parses the template of the names. The template must use
+// {{.Hash}} so that names are unique.
+func NewMessageNamer(nameTemplate string) (MessageNamer, error) {
+	if nameTemplate == "" {
+		return defaultNamer, nil
+	}
+
+	tpl, err := template.New("name").Option("missingkey=error").Parse(nameTemplate)
+	if err != nil {
+		return MessageNamer{}, fmt.Errorf("invalid name template: %w", err)
+	}
+
+	namer := MessageNamer{template: tpl}
+	sample := NewMessageName(time.Now(), "subject", "0123456789abcdef", 1)
+	name, err := namer.render(sample)
+	if err != nil {
+		return MessageNamer{}, fmt.Errorf("invalid name template: %w", err)
+	}
+	if !strings.Contains(name, sample.Hash) {
+		return MessageNamer{}, fmt.Errorf("name template %s does not use {{.Hash}}", nameTemplate)
+	}
+	return namer, nil
+}
+
+func (n MessageNamer) render(name MessageName) (string, error) {
+	tpl := n.template
+	if tpl == nil {
+		tpl = defaultNamer.template
+	}
+
+	rendered := new(strings.Builder)
+	err := tpl.Execute(rendered, name)
+	if err != nil {
+		return "", err
+	}
+
+	// the template must not create directories or hidden files
+	safe := strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' || r == '.') {
+			return r
+		}
+		return '_'
+	}, rendered.String())
+	return strings.TrimLeft(safe, "."), nil
+}
+
+// Path returns the path of the .eml file of the message relative to the
+// backup directory
+func (n MessageNamer) Path(mailbox string, name MessageName) string {
+	fileName, err := n.render(name)
+	if err != nil || fileName == "" {
+		// templates are checked by NewMessageNamer
+		fileName = name.Date + "_" + name.Hash
+	}
+	return path.Join(mailbox, fileName+emlExtension)
+}
+
+// Slugify transliterates s to lower case ASCII words separated by dashes
+func Slugify(s string) string {
+	ascii := new(strings.Builder)
+	for _, r := range s {
+		if transliteration, ok := transliterations[r]; ok {
+			ascii.WriteString(transliteration)
+			continue
+		}
+		// letters with accents are decomposed into the letter and its marks
+		for _, d := range norm.NFD.String(string(r)) {
+			if !unicode.Is(unicode.Mn, d) {
+				ascii.WriteRune(d)
+			}
+		}
+	}
+
+	slug := new(strings.Builder)
+	dash := false
+	for _, r := range strings.ToLower(ascii.String()) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if dash && slug.Len() > 0 {
+				slug.WriteByte('-')
+			}
+			if slug.Len() >= maxSlugLength {
+				break
+			}
+			slug.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+
+	if slug.Len() == 0 {
+		return "no-subject"
+	}
+	return strings.TrimSuffix(slug.String(), "-")
+}
+
+// GetPathOfMessage returns the path of the .eml file of the message with the
+// SHA-256 hash of its body in the default naming scheme
+func GetPathOfMessage(mailbox string, message *imap.Message, hash string) string {
+	return defaultNamer.Path(mailbox, messageNameOf(message, hash))
+}
+
+func messageNameOf(message *imap.Message, hash string) MessageName {
+	date, subject := message.InternalDate, ""
+	if message.Envelope != nil {
+		subject = message.Envelope.Subject
+		if !message.Envelope.Date.IsZero() {
+			date = message.Envelope.Date
+		}
+	}
+	return NewMessageName(date, subject, hash, message.Uid)
+}
+
+// RenameMessages renames the .eml files of the backup, including the tombstone
+// area, to the naming scheme of the backup and returns the number of renamed
+// files. The date and subject are read from the header of a file, its
+// modification time is the date of messages without one. Renamed files are
+// updated in the uid index and the metadata. Files that end up with the name
+// of an existing file have the same content and are removed.
+func (i *ImapBackup) RenameMessages(dryRun bool) (int, error) {
+	namer := defaultNamer
+	if store, ok := i.store.(EmlStore); ok {
+		namer = store.Names
+	}
+
+	fileSystem, backupDir := i.fileSystem, i.backupDir
+	var messagePaths []string
+	err := hackpadfs.WalkDir(fileSystem, backupDir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath := strings.TrimPrefix(strings.TrimPrefix(filePath, backupDir), "/")
+		if d.IsDir() {
+			switch relPath {
+			case uidIndexDir, blobsDir, manifestsDir, metadataDir, path.Join(deletedDir, manifestsDir):
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if isEmlFile(d.Name()) && path.Dir(relPath) != "." {
+			messagePaths = append(messagePaths, relPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	uids, err := readUidIndex(fileSystem, backupDir)
+	if err != nil {
+		return 0, err
+	}
+
+	metadata := metadataByPath{}
+	renamed := 0
+	for _, messagePath := range messagePaths {
+		newPath, err := i.messagePathOf(namer, messagePath, uidOf(uids[messagePath]))
+		if err != nil {
+			return renamed, fmt.Errorf("failed to name %s: %w", messagePath, err)
+		}
+		if newPath == messagePath {
+			continue
+		}
+
+		log.WithFields(log.Fields{"path": messagePath, "newPath": newPath, "dryRun": dryRun}).Info("renaming message")
+		renamed++
+		if dryRun {
+			continue
+		}
+
+		err = i.renameMessage(messagePath, newPath, uids, metadata)
+		if err != nil {
+			return renamed, err
+		}
+	}
+	return renamed, nil
+}
+
+// messagePathOf returns the path of the message file at messagePath in the
+// naming scheme of namer
+func (i *ImapBackup) messagePathOf(namer MessageNamer, messagePath string, uid uint32) (string, error) {
+	filePath := path.Join(i.backupDir, messagePath)
+	file, err := OpenMessageFile(i.fileSystem, filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := hackpadfs.Stat(i.fileSystem, filePath)
+	if err != nil {
+		return "", err
+	}
+
+	date, subject := info.ModTime(), ""
+	if parsed, err := mail.ReadMessage(bytes.NewReader(content)); err == nil {
+		subject = parsed.Header.Get("Subject")
+		if decoded, err := headerDecoder.DecodeHeader(subject); err == nil {
+			subject = decoded
+		}
+		if headerDate, err := parsed.Header.Date(); err == nil {
+			date = headerDate
+		}
+	}
+
+	sum := sha256.Sum256(content)
+	mailbox, prefix := path.Dir(messagePath), ""
+	if strings.HasPrefix(messagePath, deletedDir+"/") {
+		mailbox, prefix = strings.TrimPrefix(mailbox, deletedDir+"/"), deletedDir
+	}
+
+	name := NewMessageName(date, subject, hex.EncodeToString(sum[:]), uid)
+	extension := strings.TrimPrefix(messagePath, trimCompressionExtension(messagePath))
+	return path.Join(prefix, namer.Path(mailbox, name)) + extension, nil
+}
+
+// renameMessage moves the file at oldPath to newPath unless a file with the
+// same name exists and points the uid index and metadata to it
+func (i *ImapBackup) renameMessage(oldPath string, newPath string, uids map[string][]uidIndexEntry, metadata metadataByPath) error {
+	oldFilePath, newFilePath := path.Join(i.backupDir, oldPath), path.Join(i.backupDir, newPath)
+	_, err := hackpadfs.Stat(i.fileSystem, newFilePath)
+	switch {
+	case err == nil:
+		err = i.fileSystem.Remove(oldFilePath)
+	case errors.Is(err, hackpadfs.ErrNotExist):
+		err = i.fileSystem.Rename(oldFilePath, newFilePath)
+	}
+	if err != nil {
+		return err
+	}
+
+	return i.moveMessagePath(oldPath, newPath, uids, metadata)
+}
+
+// writeNamedMessage writes body to a temporary file in the directory of the
+// mailbox and moves it to its name once the hash of the body is known. It
+// returns the path of the file relative to backupDir.
+func (s EmlStore) writeNamedMessage(fs FS, backupDir string, mailbox string, message *imap.Message, body io.Reader) (string, error) {
+	dir := path.Join(backupDir, mailbox)
+	err := fs.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+
+	tmpPath := path.Join(dir, "."+randomName()+".tmp")
+	hasher := sha256.New()
+	err = writeMessageFile(fs, tmpPath, io.TeeReader(body, hasher), s.Compression)
+	if err != nil {
+		// never keep a truncated message
+		fs.Remove(tmpPath)
+		return "", fmt.Errorf("failed to write %s: %w", tmpPath, err)
+	}
+
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	messagePath := s.Names.Path(mailbox, messageNameOf(message, hash)) + compressionExtensions[s.Compression]
+	filePath := path.Join(backupDir, messagePath)
+
+	_, err = hackpadfs.Stat(fs, filePath)
+	if err == nil {
+		// the name is unique, the existing file has the same content
+		return messagePath, fs.Remove(tmpPath)
+	} else if !errors.Is(err, hackpadfs.ErrNotExist) {
+		fs.Remove(tmpPath)
+		return "", err
+	}
+
+	err = setMessageTime(fs, tmpPath, message)
+	if err != nil {
+		fs.Remove(tmpPath)
+		return "", err
+	}
+
+	return messagePath, fs.Rename(tmpPath, filePath)
+}
@@ -0,0 +1,117 @@
+package imap_backup
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hack-pad/hackpadfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlugify(t *testing.T) {
+	assert.Equal(t, "gruesse-aus-koeln-ueberraschung", Slugify("Grüße aus Köln – Überraschung!"))
+	assert.Equal(t, "cafe-deja-vu-re-fw", Slugify("  Café déjà vu [RE: FW]  "))
+	assert.Equal(t, "no-subject", Slugify("日本語"))
+	assert.Equal(t, "no-subject", Slugify(""))
+
+	long := Slugify(strings.Repeat("very long subject ", 50))
+	assert.LessOrEqual(t, len(long), maxSlugLength)
+	assert.False(t, strings.HasSuffix(long, "-"))
+}
+
+func TestEmlNamesAreUnique(t *testing.T) {
+	fs := newMemFS(t)
+	backup := newTestBackup(t, fs, Config{BackupDir: "backup"})
+
+	// messages without Message-ID and with the same subject
+	first := testMessage(1, "Grüße", "", "Subject: Gruesse\r\n\r\nfirst\r\n")
+	second := testMessage(2, "Grüße", "", "Subject: Gruesse\r\n\r\nsecond\r\n")
+	assert.NoError(t, backup.SaveMessage("INBOX", first, fs, "backup"))
+	assert.NoError(t, backup.SaveMessage("INBOX", second, fs, "backup"))
+
+	metadata, err := ReadMetadata(fs, "backup", "INBOX")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(metadata))
+	assert.NotEqual(t, metadata[0].Path, metadata[1].Path)
+	assert.True(t, strings.HasPrefix(metadata[0].Path, "INBOX/2024-02-18_"), metadata[0].Path)
+	assert.True(t, strings.HasSuffix(metadata[0].Path, "_gruesse.eml"), metadata[0].Path)
+	assert.Equal(t, 2, len(walkBackup(t, fs, "backup")))
+
+	// the same message under another uid keeps its name
+	again := testMessage(3, "Grüße", "", "Subject: Gruesse\r\n\r\nfirst\r\n")
+	assert.NoError(t, backup.SaveMessage("INBOX", again, fs, "backup"))
+	metadata, err = ReadMetadata(fs, "backup", "INBOX")
+	assert.NoError(t, err)
+	assert.Equal(t, metadata[0].Path, metadata[2].Path)
+	assert.Equal(t, 2, len(walkBackup(t, fs, "backup")))
+}
+
+func TestNameTemplate(t *testing.T) {
+	_, err := NewMessageNamer("{{.Slug}}")
+	assert.Error(t, err)
+	_, err = NewMessageNamer("{{.Unknown}}_{{.Hash}}")
+	assert.Error(t, err)
+
+	namer, err := NewMessageNamer("{{.Date}}/{{.Time}}-{{.Hash}}")
+	assert.NoError(t, err)
+	name := NewMessageName(time.Date(2024, time.March, 1, 8, 30, 0, 0, time.UTC), "subject", strings.Repeat("ab", 32), 7)
+	assert.Equal(t, "INBOX/2024-03-01_083000-abababababababab.eml", namer.Path("INBOX", name))
+
+	fs := newMemFS(t)
+	backup := newTestBackup(t, fs, Config{BackupDir: "backup", NameTemplate: "{{.Uid}}-{{.Hash}}"})
+	assert.NoError(t, backup.SaveMessage("INBOX", testMessage(7, "subject", "<7@example.com>", "body"), fs, "backup"))
+	_, err = hackpadfs.Stat(fs, "backup/INBOX/7-"+sha256Of([]byte("body"))[:nameHashLength]+".eml")
+	assert.NoError(t, err)
+}
+
+func TestRenameMessages(t *testing.T) {
+	fs := newMemFS(t)
+	backup := newTestBackup(t, fs, Config{BackupDir: "backup", Compression: CompressionGzip})
+	backup.HandleUidValidity("INBOX", 1)
+
+	// files in the previous naming scheme
+	kept := "Subject: =?UTF-8?Q?K=C3=B6ln?=\r\nDate: Fri, 01 Mar 2024 08:00:00 +0000\r\n\r\nkept\r\n"
+	oldPath := "INBOX/K_ln__1_example_com_.eml.gz"
+	assert.NoError(t, fs.MkdirAll("backup/INBOX", os.ModePerm))
+	assert.NoError(t, writeMessageFile(fs, path.Join("backup", oldPath), strings.NewReader(kept), CompressionGzip))
+	assert.NoError(t, writeUidIndex(fs, "backup", "INBOX", 1, 1, oldPath))
+	assert.NoError(t, backup.appendMetadata(fs, "backup", MessageMetadata{Mailbox: "INBOX", Uid: 1, UidValidity: 1, Sha256: sha256Of([]byte(kept)), Path: oldPath}))
+
+	assert.NoError(t, fs.MkdirAll("backup/deleted/INBOX", os.ModePerm))
+	assert.NoError(t, fs.WriteFile("backup/deleted/INBOX/old_.eml", []byte("Subject: old\r\n\r\nold\r\n"), os.ModePerm))
+
+	renamed, err := backup.RenameMessages(true)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, renamed)
+	_, err = hackpadfs.Stat(fs, path.Join("backup", oldPath))
+	assert.NoError(t, err)
+
+	renamed, err = backup.RenameMessages(false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, renamed)
+
+	newPath := "INBOX/2024-03-01_" + sha256Of([]byte(kept))[:nameHashLength] + "_koeln.eml.gz"
+	indexed, err := hackpadfs.ReadFile(fs, path.Join("backup", getUidIndexPath("INBOX", 1, 1)))
+	assert.NoError(t, err)
+	assert.Equal(t, newPath, string(indexed))
+
+	metadata, err := ReadMetadata(fs, "backup", "INBOX")
+	assert.NoError(t, err)
+	assert.Equal(t, newPath, metadata[0].Path)
+
+	entries, err := hackpadfs.ReadDir(fs, "backup/deleted/INBOX")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.True(t, strings.HasSuffix(entries[0].Name(), "_old.eml"), entries[0].Name())
+
+	messages := walkBackup(t, fs, "backup")
+	assert.Equal(t, 1, len(messages))
+	assert.Equal(t, kept, messages[0].body)
+
+	renamed, err = backup.RenameMessages(false)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, renamed)
+}
@@ -0,0 +1,615 @@
+package imap_backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/mail"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hack-pad/hackpadfs"
+	log "github.com/sirupsen/logrus"
+)
+
+// Actions of the retention
+const (
+	RetentionDelete  = "delete"
+	RetentionArchive = "archive"
+)
+
+// defaultAuditLog is the audit log of Prune relative to the backup directory
+const defaultAuditLog = ".audit.jsonl"
+
+// RetentionConfig are the rules that Prune applies to the backup. Paths are
+// relative to the root of the file system like the backup directory.
+type RetentionConfig struct {
+	// Rules are matched in order against the mailbox of a message, the first
+	// matching rule applies. Messages of mailboxes without a rule are kept.
+	Rules []RetentionRule `json:"rules" yaml:"rules"`
+	// Action is delete (default) or archive
+	Action string `json:"action" yaml:"action"`
+	// ArchiveDir receives the archived messages as .eml files. It must be
+	// outside of the backup directory.
+	ArchiveDir string `json:"archiveDir" yaml:"archiveDir"`
+	// LegalHold are Message-IDs of messages that are never pruned
+	LegalHold []string `json:"legalHold" yaml:"legalHold"`
+	// LegalHoldFile is a file with more Message-IDs, one per line
+	LegalHoldFile string `json:"legalHoldFile" yaml:"legalHoldFile"`
+	// AuditLog is the file that records every pruned message before it is
+	// removed. It defaults to .audit.jsonl in the backup directory.
+	AuditLog string `json:"auditLog" yaml:"auditLog"`
+}
+
+// RetentionRule keeps the messages of the mailboxes that match Mailbox for
+// MaxAge
+type RetentionRule struct {
+	// Mailbox is a path.Match pattern like "Spam" or "Archive/*"
+	Mailbox string `json:"mailbox" yaml:"mailbox"`
+	// MaxAge is the age of a message after which it is pruned. Messages are
+	// kept forever if it is 0.
+	MaxAge time.Duration `json:"maxAge" yaml:"maxAge"`
+}
+
+// PruneResult is the result of Prune
+type PruneResult struct {
+	// Pruned are the deleted or archived messages
+	Pruned int
+	// Held are the expired messages that are kept by the legal hold
+	Held int
+}
+
+// AuditRecord is a line of the audit log of Prune
+type AuditRecord struct {
+	Time        time.Time `json:"time"`
+	Action      string    `json:"action"`
+	Mailbox     string    `json:"mailbox"`
+	Key         string    `json:"key"`
+	Uid         uint32    `json:"uid,omitempty"`
+	MessageId   string    `json:"messageId,omitempty"`
+	Date        time.Time `json:"date"`
+	Rule        string    `json:"rule"`
+	MaxAge      string    `json:"maxAge"`
+	ArchivePath string    `json:"archivePath,omitempty"`
+}
+
+type pruneCandidate struct {
+	message     BackupMessage
+	messageId   string
+	rule        RetentionRule
+	archivePath string
+}
+
+type pruner struct {
+	backup     *ImapBackup
+	cfg        RetentionConfig
+	now        time.Time
+	dryRun     bool
+	legalHold  map[string]bool
+	candidates []pruneCandidate
+	result     PruneResult
+}
+
+// Prune deletes or archives the messages of the backup, including the
+// tombstone area, that are older than the rule of their mailbox allows.
+// Messages on the legal hold are kept. Every pruned message is appended to the
+// audit log. Blobs of pruned messages of the cas format stay until
+// CollectGarbage. With dryRun the messages are only logged.
+//
+// Prune must not run while messages are saved to the backup.
+func (i *ImapBackup) Prune(cfg RetentionConfig, now time.Time, dryRun bool) (PruneResult, error) {
+	p, err := i.newPruner(cfg, now, dryRun)
+	if err != nil {
+		return PruneResult{}, err
+	}
+
+	err = WalkBackup(i.fileSystem, i.backupDir, p.consider)
+	if err != nil {
+		return p.result, err
+	}
+
+	err = p.considerTombstones()
+	if err != nil {
+		return p.result, err
+	}
+
+	return p.result, p.prune()
+}
+
+func (i *ImapBackup) newPruner(cfg RetentionConfig, now time.Time, dryRun bool) (*pruner, error) {
+	switch strings.ToLower(cfg.Action) {
+	case "", RetentionDelete:
+		cfg.Action = RetentionDelete
+	case RetentionArchive:
+		cfg.Action = RetentionArchive
+		if cfg.ArchiveDir == "" {
+			return nil, fmt.Errorf("the archive action needs an archiveDir")
+		}
+
+		archiveDir, backupDir := path.Clean(cfg.ArchiveDir), path.Clean(i.backupDir)
+		if backupDir == "." || archiveDir == backupDir || strings.HasPrefix(archiveDir, backupDir+"/") {
+			return nil, fmt.Errorf("archiveDir %s must be outside of the backup directory", cfg.ArchiveDir)
+		}
+	default:
+		return nil, fmt.Errorf("unknown retention action %s", cfg.Action)
+	}
+
+	for _, rule := range cfg.Rules {
+		if _, err := path.Match(rule.Mailbox, ""); err != nil {
+			return nil, fmt.Errorf("invalid mailbox pattern %s: %w", rule.Mailbox, err)
+		}
+	}
+
+	if cfg.AuditLog == "" {
+		cfg.AuditLog = path.Join(i.backupDir, defaultAuditLog)
+	}
+
+	legalHold, err := readLegalHold(i.fileSystem, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pruner{backup: i, cfg: cfg, now: now, dryRun: dryRun, legalHold: legalHold}, nil
+}
+
+// readLegalHold returns the normalized Message-IDs of the legal hold
+func readLegalHold(fileSystem FS, cfg RetentionConfig) (map[string]bool, error) {
+	messageIds := cfg.LegalHold
+	if cfg.LegalHoldFile != "" {
+		content, err := hackpadfs.ReadFile(fileSystem, cfg.LegalHoldFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the legal hold: %w", err)
+		}
+		messageIds = append(messageIds, strings.Split(string(content), "\n")...)
+	}
+
+	legalHold := map[string]bool{}
+	for _, messageId := range messageIds {
+		if messageId := normalizeMessageId(messageId); messageId != "" && !strings.HasPrefix(messageId, "#") {
+			legalHold[messageId] = true
+		}
+	}
+	return legalHold, nil
+}
+
+// normalizeMessageId returns the Message-ID without spaces and angle brackets
+func normalizeMessageId(messageId string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(messageId), "<"), ">")
+}
+
+// ruleOf returns the first rule that matches mailbox
+func (p *pruner) ruleOf(mailbox string) (RetentionRule, bool) {
+	for _, rule := range p.cfg.Rules {
+		if matched, _ := path.Match(rule.Mailbox, mailbox); matched {
+			return rule, true
+		}
+	}
+	return RetentionRule{}, false
+}
+
+// consider adds the message to the candidates if it is expired and archives
+// it
+func (p *pruner) consider(message BackupMessage, body io.Reader) error {
+	rule, ok := p.ruleOf(message.Mailbox)
+	if !ok || rule.MaxAge <= 0 || message.Date.IsZero() || p.now.Sub(message.Date) < rule.MaxAge {
+		return nil
+	}
+
+	log := log.WithFields(log.Fields{"mailbox": message.Mailbox, "key": message.Key})
+	if message.format == "" {
+		log.Warn("expired message of an mbox without index cannot be pruned")
+		return nil
+	}
+
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("failed to read %s of %s: %w", message.Key, message.Mailbox, err)
+	}
+
+	candidate := pruneCandidate{message: message, messageId: headerMessageId(content), rule: rule}
+	if p.legalHold[normalizeMessageId(candidate.messageId)] {
+		log.WithField("messageId", candidate.messageId).Info("keeping expired message on legal hold")
+		p.result.Held++
+		return nil
+	}
+
+	if p.cfg.Action == RetentionArchive {
+		candidate.archivePath, err = p.archive(message, content)
+		if err != nil {
+			return err
+		}
+	}
+
+	p.candidates = append(p.candidates, candidate)
+	return nil
+}
+
+func headerMessageId(content []byte) string {
+	message, err := mail.ReadMessage(bytes.NewReader(content))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(message.Header.Get("Message-Id"))
+}
+
+// archive writes the message to <archiveDir>/<mailbox>/<sha256>.eml and
+// returns its path
+func (p *pruner) archive(message BackupMessage, content []byte) (string, error) {
+	archivePath := path.Join(p.cfg.ArchiveDir, message.Mailbox, sha256Of(content)+emlExtension)
+	if p.dryRun {
+		return archivePath, nil
+	}
+
+	fileSystem := p.backup.fileSystem
+	err := fileSystem.MkdirAll(path.Dir(archivePath), os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+
+	err = writeMessageFile(fileSystem, archivePath, bytes.NewReader(content), CompressionNone)
+	if err != nil {
+		fileSystem.Remove(archivePath)
+		return "", fmt.Errorf("failed to archive %s of %s: %w", message.Key, message.Mailbox, err)
+	}
+
+	return archivePath, fileSystem.Chtimes(archivePath, p.now, message.Date)
+}
+
+// considerTombstones considers the messages of the tombstone area
+func (p *pruner) considerTombstones() error {
+	fileSystem, backupDir := p.backup.fileSystem, p.backup.backupDir
+	deletedRoot := path.Join(backupDir, deletedDir)
+	manifestsRoot := path.Join(deletedRoot, manifestsDir)
+
+	return walkIfExists(fileSystem, deletedRoot, func(filePath string, d fs.DirEntry) error {
+		relPath := strings.TrimPrefix(strings.TrimPrefix(filePath, backupDir), "/")
+		mailboxPath := strings.TrimPrefix(filePath, deletedRoot+"/")
+		dir := path.Dir(mailboxPath)
+
+		message := BackupMessage{Key: relPath, file: relPath}
+		switch {
+		case strings.HasPrefix(filePath, manifestsRoot+"/"):
+			if !strings.HasSuffix(d.Name(), manifestExtension) {
+				return nil
+			}
+			mailbox := strings.TrimSuffix(strings.TrimPrefix(filePath, manifestsRoot+"/"), manifestExtension)
+			return p.considerTombstoneManifest(filePath, relPath, mailbox)
+		case path.Base(dir) == maildirNew || path.Base(dir) == maildirCur:
+			message.Mailbox, message.format = path.Dir(dir), FormatMaildir
+		case isEmlFile(d.Name()):
+			message.Mailbox, message.format = dir, FormatEml
+		default:
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		message.Date = info.ModTime()
+
+		file, err := OpenMessageFile(fileSystem, filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		return p.consider(message, file)
+	})
+}
+
+func (p *pruner) considerTombstoneManifest(manifestPath string, relPath string, mailbox string) error {
+	entries, err := ReadManifest(p.backup.fileSystem, manifestPath)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		message := BackupMessage{
+			Mailbox: mailbox,
+			Key:     fmt.Sprintf("%d:%s", entry.Uid, entry.Hash),
+			Date:    entry.Date,
+			Uid:     entry.Uid,
+			Sha256:  entry.Hash,
+			format:  FormatCas,
+			file:    relPath,
+		}
+
+		err := func() error {
+			blob, err := OpenBlob(p.backup.fileSystem, p.backup.backupDir, entry.Hash)
+			if err != nil {
+				return err
+			}
+			defer blob.Close()
+
+			return p.consider(message, blob)
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prune removes the candidates from the backup
+func (p *pruner) prune() error {
+	mboxes := map[string][]pruneCandidate{}
+	manifests := map[string][]pruneCandidate{}
+	for _, candidate := range p.candidates {
+		message := candidate.message
+		log.WithFields(log.Fields{
+			"mailbox": message.Mailbox,
+			"key":     message.Key,
+			"date":    message.Date,
+			"action":  p.cfg.Action,
+			"dryRun":  p.dryRun,
+		}).Info("pruning expired message")
+
+		switch {
+		case p.dryRun:
+			p.result.Pruned++
+		case message.format == FormatMbox:
+			mboxes[message.file] = append(mboxes[message.file], candidate)
+		case message.format == FormatCas:
+			manifests[message.file] = append(manifests[message.file], candidate)
+		default:
+			err := p.audit(candidate)
+			if err != nil {
+				return err
+			}
+			err = p.removeFile(candidate)
+			if err != nil {
+				return err
+			}
+			err = p.pruned(candidate)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for mboxPath, candidates := range mboxes {
+		err := p.removeFromMbox(mboxPath, candidates)
+		if err != nil {
+			return err
+		}
+	}
+
+	for manifestPath, candidates := range manifests {
+		err := p.removeFromManifest(manifestPath, candidates)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeFile removes the file of an eml or Maildir message and its uid index
+func (p *pruner) removeFile(candidate pruneCandidate) error {
+	fileSystem, backupDir := p.backup.fileSystem, p.backup.backupDir
+	message := candidate.message
+
+	err := fileSystem.Remove(path.Join(backupDir, message.file))
+	if err != nil && !errors.Is(err, hackpadfs.ErrNotExist) {
+		return err
+	}
+
+	if message.Uid == 0 {
+		return nil
+	}
+
+	indexPath := path.Join(backupDir, getUidIndexPath(message.Mailbox, message.UidValidity, message.Uid))
+	indexed, err := hackpadfs.ReadFile(fileSystem, indexPath)
+	if errors.Is(err, hackpadfs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if string(indexed) != message.file {
+		return nil
+	}
+	return fileSystem.Remove(indexPath)
+}
+
+// removeFromMbox rewrites the mbox without the messages of the candidates
+func (p *pruner) removeFromMbox(relPath string, candidates []pruneCandidate) error {
+	remove := map[int64]bool{}
+	for _, candidate := range candidates {
+		offset, err := strconv.ParseInt(candidate.message.Key, 10, 64)
+		if err != nil {
+			return err
+		}
+		remove[offset] = true
+	}
+
+	for _, candidate := range candidates {
+		err := p.audit(candidate)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := rewriteMbox(p.backup.fileSystem, path.Join(p.backup.backupDir, relPath), remove)
+	if err != nil {
+		return fmt.Errorf("failed to prune %s: %w", relPath, err)
+	}
+
+	for _, candidate := range candidates {
+		err := p.pruned(candidate)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriteMbox copies the messages of the mbox at mboxPath that are not at an
+// offset of remove into a new mbox and index that replace the old ones. The
+// mbox is replaced first, ReadMboxIndex completes the rewrite if the index
+// was not replaced.
+func rewriteMbox(fileSystem FS, mboxPath string, remove map[int64]bool) error {
+	entries, err := ReadMboxIndex(fileSystem, mboxPath)
+	if err != nil {
+		return err
+	}
+
+	src, err := fileSystem.Open(mboxPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	seeker, ok := src.(io.Seeker)
+	if !ok {
+		return fmt.Errorf("failed to read %s. file is not an io.Seeker", mboxPath)
+	}
+
+	tmpPath := mboxPath + mboxRewriteExtension
+	dst, err := fileSystem.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	writer, ok := dst.(io.Writer)
+	if !ok {
+		return fmt.Errorf("failed to write file. file is not an io.Writer")
+	}
+
+	index := new(strings.Builder)
+	offset := int64(0)
+	for _, entry := range entries {
+		if remove[entry.Offset] {
+			continue
+		}
+
+		_, err := seeker.Seek(entry.Offset, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(writer, src, entry.Length)
+		if err != nil {
+			return err
+		}
+
+		entry.Offset = offset
+		offset += entry.Length
+		index.WriteString(formatMboxIndexEntry(entry))
+	}
+
+	err = dst.Close()
+	if err != nil {
+		return err
+	}
+
+	err = fileSystem.WriteFile(tmpPath+mboxIndexExtension, []byte(index.String()), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	src.Close()
+	err = fileSystem.Rename(tmpPath, mboxPath)
+	if err != nil {
+		return err
+	}
+	return fileSystem.Rename(tmpPath+mboxIndexExtension, mboxPath+mboxIndexExtension)
+}
+
+// removeFromManifest removes the entries of the candidates from the manifest
+func (p *pruner) removeFromManifest(relPath string, candidates []pruneCandidate) error {
+	manifestPath := path.Join(p.backup.backupDir, relPath)
+	entries, err := ReadManifest(p.backup.fileSystem, manifestPath)
+	if err != nil {
+		return err
+	}
+
+	remove := map[string]bool{}
+	for _, candidate := range candidates {
+		remove[candidate.message.Key] = true
+	}
+
+	kept := entries[:0]
+	for _, entry := range entries {
+		if !remove[fmt.Sprintf("%d:%s", entry.Uid, entry.Hash)] {
+			kept = append(kept, entry)
+		}
+	}
+
+	for _, candidate := range candidates {
+		err := p.audit(candidate)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = writeManifest(p.backup.fileSystem, manifestPath, kept)
+	if err != nil {
+		return err
+	}
+
+	for _, candidate := range candidates {
+		err := p.pruned(candidate)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruned records the removed message in the metadata
+func (p *pruner) pruned(candidate pruneCandidate) error {
+	message := candidate.message
+	p.result.Pruned++
+
+	if message.Uid == 0 || strings.HasPrefix(message.file, deletedDir+"/") {
+		return nil
+	}
+	return p.backup.appendMetadata(p.backup.fileSystem, p.backup.backupDir, MessageMetadata{
+		Mailbox:     message.Mailbox,
+		Uid:         message.Uid,
+		UidValidity: message.UidValidity,
+		Pruned:      true,
+	})
+}
+
+// audit records the message in the audit log before it is removed, a message
+// is not removed unless it is recorded
+func (p *pruner) audit(candidate pruneCandidate) error {
+	message := candidate.message
+	line, err := json.Marshal(AuditRecord{
+		Time:        p.now,
+		Action:      p.cfg.Action,
+		Mailbox:     message.Mailbox,
+		Key:         message.Key,
+		Uid:         message.Uid,
+		MessageId:   candidate.messageId,
+		Date:        message.Date,
+		Rule:        candidate.rule.Mailbox,
+		MaxAge:      candidate.rule.MaxAge.String(),
+		ArchivePath: candidate.archivePath,
+	})
+	if err != nil {
+		return err
+	}
+
+	fileSystem := p.backup.fileSystem
+	err = fileSystem.MkdirAll(path.Dir(p.cfg.AuditLog), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	_, err = appendToFile(fileSystem, p.cfg.AuditLog, func(w io.Writer) error {
+		_, err := w.Write(append(line, '\n'))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to append to %s: %w", p.cfg.AuditLog, err)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package imap_backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hack-pad/hackpadfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func testRetentionConfig() RetentionConfig {
+	return RetentionConfig{
+		Rules: []RetentionRule{
+			{Mailbox: "Spam", MaxAge: 30 * 24 * time.Hour},
+			{Mailbox: "Trash", MaxAge: 365 * 24 * time.Hour},
+			{Mailbox: "*"},
+		},
+		LegalHold: []string{"<held@example.com>"},
+	}
+}
+
+func readAuditLog(t *testing.T, fs FS, auditPath string) []AuditRecord {
+	content, err := hackpadfs.ReadFile(fs, auditPath)
+	assert.NoError(t, err)
+
+	var records []AuditRecord
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		record := AuditRecord{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Date(2024, time.June, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, format := range []string{FormatEml, FormatMaildir, FormatMbox, FormatCas} {
+		t.Run(format, func(t *testing.T) {
+			fs := newMemFS(t)
+			backup := newTestBackup(t, fs, Config{BackupDir: "backup", Format: format})
+
+			save := func(mailbox string, uid uint32, subject string, messageId string, age time.Duration) {
+				backup.HandleUidValidity(mailbox, 1)
+				body := fmt.Sprintf("Message-ID: %s\r\nSubject: %s\r\n\r\n%s body\r\n", messageId, subject, subject)
+				message := testMessage(uid, subject, messageId, body)
+				message.InternalDate = now.Add(-age)
+				assert.NoError(t, backup.SaveMessage(mailbox, message, fs, "backup"))
+			}
+			save("Spam", 1, "expired", "<expired@example.com>", 60*24*time.Hour)
+			save("Spam", 2, "recent", "<recent@example.com>", 10*24*time.Hour)
+			save("Spam", 3, "held", "<held@example.com>", 60*24*time.Hour)
+			save("INBOX", 1, "old", "<old@example.com>", 5*365*24*time.Hour)
+
+			result, err := backup.Prune(testRetentionConfig(), now, true)
+			assert.NoError(t, err)
+			assert.Equal(t, PruneResult{Pruned: 1, Held: 1}, result)
+			assert.Equal(t, 4, len(walkBackup(t, fs, "backup")))
+
+			result, err = backup.Prune(testRetentionConfig(), now, false)
+			assert.NoError(t, err)
+			assert.Equal(t, PruneResult{Pruned: 1, Held: 1}, result)
+
+			bodies := []string{}
+			for _, message := range walkBackup(t, fs, "backup") {
+				bodies = append(bodies, message.Mailbox+":"+strings.TrimSpace(message.body[strings.Index(message.body, "\r\n\r\n"):]))
+			}
+			assert.Equal(t, []string{"INBOX:old body", "Spam:held body", "Spam:recent body"}, bodies)
+
+			records := readAuditLog(t, fs, path.Join("backup", defaultAuditLog))
+			assert.Equal(t, 1, len(records))
+			assert.Equal(t, "Spam", records[0].Mailbox)
+			assert.Equal(t, "<expired@example.com>", records[0].MessageId)
+			assert.Equal(t, RetentionDelete, records[0].Action)
+
+			report, err := Verify(fs, "backup")
+			assert.NoError(t, err)
+			assert.True(t, report.Ok(), "%+v", report)
+
+			result, err = backup.Prune(testRetentionConfig(), now, false)
+			assert.NoError(t, err)
+			assert.Equal(t, PruneResult{Held: 1}, result)
+		})
+	}
+}
+
+func TestPruneArchivesTombstones(t *testing.T) {
+	now := time.Date(2024, time.June, 1, 0, 0, 0, 0, time.UTC)
+	fs := newMemFS(t)
+	backup := newTestBackup(t, fs, Config{BackupDir: "backup"})
+	backup.HandleUidValidity("Trash", 1)
+
+	// the modification time of the file is the date of the envelope
+	message := testMessage(1, "deleted", "<deleted@example.com>", "Subject: deleted\r\n\r\ndeleted body\r\n")
+	message.Envelope.Date = now.Add(-2 * 365 * 24 * time.Hour)
+	assert.NoError(t, backup.SaveMessage("Trash", message, fs, "backup"))
+	backup.HandleExpunge("Trash", 1)
+
+	cfg := testRetentionConfig()
+	cfg.Action = RetentionArchive
+	cfg.ArchiveDir = "backup/archive"
+	_, err := backup.Prune(cfg, now, false)
+	assert.Error(t, err)
+
+	cfg.ArchiveDir = "archive"
+	cfg.AuditLog = "audit/prune.jsonl"
+	result, err := backup.Prune(cfg, now, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.Pruned)
+
+	metadata, err := ReadMetadata(fs, "backup", "Trash")
+	assert.NoError(t, err)
+	_, err = hackpadfs.Stat(fs, path.Join("backup", metadata[0].Path))
+	assert.ErrorIs(t, err, hackpadfs.ErrNotExist)
+
+	records := readAuditLog(t, fs, "audit/prune.jsonl")
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, RetentionArchive, records[0].Action)
+
+	archived, err := hackpadfs.ReadFile(fs, records[0].ArchivePath)
+	assert.NoError(t, err)
+	assert.Equal(t, "Subject: deleted\r\n\r\ndeleted body\r\n", string(archived))
+}
+
+func TestPruneKeepsMessagesWithoutAuditRecord(t *testing.T) {
+	now := time.Date(2024, time.June, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, format := range []string{FormatEml, FormatMbox, FormatCas} {
+		t.Run(format, func(t *testing.T) {
+			fs := newMemFS(t)
+			backup := newTestBackup(t, fs, Config{BackupDir: "backup", Format: format})
+			backup.HandleUidValidity("Spam", 1)
+			message := testMessage(1, "expired", "<expired@example.com>", "Subject: expired\r\n\r\nexpired body\r\n")
+			message.InternalDate = now.Add(-60 * 24 * time.Hour)
+			assert.NoError(t, backup.SaveMessage("Spam", message, fs, "backup"))
+
+			// the audit log cannot be written below a file
+			assert.NoError(t, fs.WriteFile("audit", []byte("not a directory"), os.ModePerm))
+			cfg := testRetentionConfig()
+			cfg.AuditLog = "audit/prune.jsonl"
+			_, err := backup.Prune(cfg, now, false)
+			assert.Error(t, err)
+
+			assert.Equal(t, 1, len(walkBackup(t, fs, "backup")))
+			metadata, err := ReadMetadata(fs, "backup", "Spam")
+			assert.NoError(t, err)
+			assert.False(t, metadata[0].Pruned)
+		})
+	}
+}
+
+func TestPruneLegalHoldFile(t *testing.T) {
+	fs := newMemFS(t)
+	backup := newTestBackup(t, fs, Config{BackupDir: "backup"})
+	assert.NoError(t, fs.WriteFile("hold.txt", []byte("# case 42\n<a@example.com>\n b@example.com \n"), os.ModePerm))
+
+	legalHold, err := readLegalHold(fs, RetentionConfig{LegalHold: []string{"<c@example.com>"}, LegalHoldFile: "hold.txt"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"a@example.com": true, "b@example.com": true, "c@example.com": true}, legalHold)
+
+	_, err = backup.Prune(RetentionConfig{LegalHoldFile: "missing.txt"}, time.Now(), true)
+	assert.Error(t, err)
+}
@@ -0,0 +1,267 @@
+package imap_backup
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/hack-pad/hackpadfs"
+	"github.com/sg3des/eml"
+)
+
+// VerifyReport lists the problems found in a backup. Missing messages are on
+// the server or in the metadata but not in the backup, extra messages are in
+// the backup but no longer on the server. Pruned messages are on the server
+// but were removed from the backup by Prune, they are no problem.
+type VerifyReport struct {
+	Messages  int             `json:"messages"`
+	Missing   []VerifyProblem `json:"missing"`
+	Extra     []VerifyProblem `json:"extra"`
+	Corrupt   []VerifyProblem `json:"corrupt"`
+	Duplicate []VerifyProblem `json:"duplicate"`
+	Pruned    []VerifyProblem `json:"pruned"`
+
+	// backedUp are the messages of every mailbox that have a uid
+	backedUp map[string][]BackupMessage
+	// pruned are the messages of every mailbox that the metadata records as
+	// pruned
+	pruned map[string]map[messageKey]bool
+}
+
+// VerifyProblem is a message of a VerifyReport
+type VerifyProblem struct {
+	Mailbox   string `json:"mailbox"`
+	Key       string `json:"key,omitempty"`
+	Uid       uint32 `json:"uid,omitempty"`
+	MessageId string `json:"messageId,omitempty"`
+	Reason    string `json:"reason"`
+}
+
+// Ok reports whether the report has no problems
+func (r *VerifyReport) Ok() bool {
+	return len(r.Missing) == 0 && len(r.Extra) == 0 && len(r.Corrupt) == 0 && len(r.Duplicate) == 0
+}
+
+// Mailboxes returns the mailboxes of the backup that have messages with uids
+func (r *VerifyReport) Mailboxes() []string {
+	mailboxes := make([]string, 0, len(r.backedUp))
+	for mailbox := range r.backedUp {
+		mailboxes = append(mailboxes, mailbox)
+	}
+	slices.Sort(mailboxes)
+	return mailboxes
+}
+
+// Verify reads every message of the backup at backupDir, compares it with the
+// checksum of the metadata or manifest and parses it as RFC 5322 message.
+// Messages of a mailbox with the same Message-ID or content are duplicates.
+// Messages of the metadata without a file in the backup are missing.
+func Verify(fileSystem FS, backupDir string) (*VerifyReport, error) {
+	report := &VerifyReport{
+		Missing:   []VerifyProblem{},
+		Extra:     []VerifyProblem{},
+		Corrupt:   []VerifyProblem{},
+		Duplicate: []VerifyProblem{},
+		Pruned:    []VerifyProblem{},
+		backedUp:  map[string][]BackupMessage{},
+		pruned:    map[string]map[messageKey]bool{},
+	}
+	byMessageId := map[string]string{}
+	byHash := map[string]string{}
+
+	err := walkBackupMessages(fileSystem, backupDir, func(message BackupMessage, body io.Reader) error {
+		report.Messages++
+		problem := VerifyProblem{Mailbox: message.Mailbox, Key: message.Key, Uid: message.Uid}
+		if message.Uid != 0 {
+			report.backedUp[message.Mailbox] = append(report.backedUp[message.Mailbox], message)
+		}
+
+		content, err := io.ReadAll(body)
+		if err != nil {
+			problem.Reason = fmt.Sprintf("failed to read message: %s", err)
+			report.Corrupt = append(report.Corrupt, problem)
+			return nil
+		}
+
+		hash := sha256Of(content)
+		if message.Sha256 != "" && message.Sha256 != hash && !hasChecksumWithNewline(content, message.Sha256) {
+			problem.Reason = fmt.Sprintf("checksum %s does not match %s", hash, message.Sha256)
+			report.Corrupt = append(report.Corrupt, problem)
+			return nil
+		}
+
+		parsed, err := eml.Parse(content)
+		if err != nil {
+			problem.Reason = fmt.Sprintf("invalid message: %s", err)
+			report.Corrupt = append(report.Corrupt, problem)
+			return nil
+		}
+		problem.MessageId = parsed.MessageId
+
+		if parsed.MessageId != "" {
+			idKey := message.Mailbox + "\x00" + parsed.MessageId
+			if key, ok := byMessageId[idKey]; ok {
+				problem.Reason = fmt.Sprintf("same Message-ID as %s", key)
+				report.Duplicate = append(report.Duplicate, problem)
+				return nil
+			}
+			byMessageId[idKey] = message.Key
+		}
+
+		hashKey := message.Mailbox + "\x00" + hash
+		if key, ok := byHash[hashKey]; ok {
+			problem.Reason = fmt.Sprintf("same content as %s", key)
+			report.Duplicate = append(report.Duplicate, problem)
+			return nil
+		}
+		byHash[hashKey] = message.Key
+		return nil
+	}, func(message BackupMessage, err error) error {
+		problem := VerifyProblem{Mailbox: message.Mailbox, Key: message.Key, Uid: message.Uid}
+		if errors.Is(err, hackpadfs.ErrNotExist) {
+			problem.Reason = "file is missing"
+			report.Missing = append(report.Missing, problem)
+		} else {
+			problem.Reason = fmt.Sprintf("failed to open message: %s", err)
+			report.Corrupt = append(report.Corrupt, problem)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = report.verifyMetadata(fileSystem, backupDir)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// hasChecksumWithNewline reports whether content without its last line break
+// has the checksum. mbox files end every message with a line break.
+func hasChecksumWithNewline(content []byte, checksum string) bool {
+	trimmed, ok := bytes.CutSuffix(content, []byte("\n"))
+	return ok && sha256Of(trimmed) == checksum
+}
+
+func sha256Of(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyMetadata reports the saved messages of the metadata that are not in
+// the backup and collects the pruned messages for CrossCheck
+func (r *VerifyReport) verifyMetadata(fileSystem FS, backupDir string) error {
+	metadataRoot := path.Join(backupDir, metadataDir)
+	return walkIfExists(fileSystem, metadataRoot, func(filePath string, d fs.DirEntry) error {
+		if !strings.HasSuffix(d.Name(), metadataExtension) {
+			return nil
+		}
+
+		mailbox := strings.TrimSuffix(strings.TrimPrefix(filePath, metadataRoot+"/"), metadataExtension)
+		records, err := ReadMetadata(fileSystem, backupDir, mailbox)
+		if err != nil {
+			return err
+		}
+
+		for _, record := range records {
+			if record.Pruned {
+				if r.pruned[mailbox] == nil {
+					r.pruned[mailbox] = map[messageKey]bool{}
+				}
+				r.pruned[mailbox][messageKey{record.UidValidity, record.Uid}] = true
+			}
+			if record.Expunged || record.Pruned || record.Sha256 == "" {
+				continue
+			}
+
+			problem := VerifyProblem{Mailbox: mailbox, Key: record.Path, Uid: record.Uid, MessageId: record.MessageId}
+			if record.Path != "" {
+				_, err := hackpadfs.Stat(fileSystem, path.Join(backupDir, record.Path))
+				if errors.Is(err, hackpadfs.ErrNotExist) {
+					problem.Reason = "file of the metadata is missing"
+					r.Missing = append(r.Missing, problem)
+				} else if err != nil {
+					return err
+				}
+				continue
+			}
+
+			if !r.hasMessage(mailbox, record.UidValidity, record.Uid) {
+				problem.Reason = "message of the metadata is missing"
+				r.Missing = append(r.Missing, problem)
+			}
+		}
+		return nil
+	})
+}
+
+// hasMessage reports whether the backup has the message. Messages without a
+// known UIDVALIDITY match any.
+func (r *VerifyReport) hasMessage(mailbox string, uidValidity uint32, uid uint32) bool {
+	for _, message := range r.backedUp[mailbox] {
+		if message.Uid == uid && (message.UidValidity == 0 || message.UidValidity == uidValidity) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPruned reports whether the metadata records the message as pruned. A
+// uidValidity of 0 matches any.
+func (r *VerifyReport) isPruned(mailbox string, uidValidity uint32, uid uint32) bool {
+	if uidValidity != 0 {
+		return r.pruned[mailbox][messageKey{uidValidity, uid}]
+	}
+	for key := range r.pruned[mailbox] {
+		if key.uid == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// CrossCheck compares the backup of mailbox with the uids of the mailbox on
+// the server. Uids on the server without backup are missing unless they were
+// pruned, backed up uids of the same UIDVALIDITY that are not on the server
+// are extra. A uidValidity of 0 compares all backed up messages of the
+// mailbox.
+func (r *VerifyReport) CrossCheck(mailbox string, uidValidity uint32, uids []uint32) {
+	compared := map[uint32]bool{}
+	var messages []BackupMessage
+	for _, message := range r.backedUp[mailbox] {
+		if uidValidity != 0 && message.UidValidity != 0 && message.UidValidity != uidValidity {
+			continue
+		}
+		compared[message.Uid] = true
+		messages = append(messages, message)
+	}
+
+	onServer := map[uint32]bool{}
+	for _, uid := range uids {
+		onServer[uid] = true
+		if !compared[uid] && r.isPruned(mailbox, uidValidity, uid) {
+			r.Pruned = append(r.Pruned, VerifyProblem{Mailbox: mailbox, Uid: uid, Reason: "message on the server was pruned from the backup"})
+		} else if !compared[uid] {
+			r.Missing = append(r.Missing, VerifyProblem{Mailbox: mailbox, Uid: uid, Reason: "message on the server is not backed up"})
+		}
+	}
+
+	slices.SortFunc(messages, func(a, b BackupMessage) int {
+		return cmp.Compare(a.Uid, b.Uid)
+	})
+	for _, message := range messages {
+		if !onServer[message.Uid] {
+			r.Extra = append(r.Extra, VerifyProblem{Mailbox: mailbox, Key: message.Key, Uid: message.Uid, Reason: "message is no longer on the server"})
+		}
+	}
+}
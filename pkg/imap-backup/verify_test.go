@@ -0,0 +1,119 @@
+package imap_backup
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testRfc5322Message(uid uint32, subject string) string {
+	return fmt.Sprintf("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: %s\r\nMessage-ID: <%d@example.com>\r\nDate: Sun, 18 Feb 2024 22:47:30 +0000\r\n\r\n%s body\r\n", subject, uid, subject)
+}
+
+func TestVerify(t *testing.T) {
+	for _, format := range []string{FormatEml, FormatMaildir, FormatMbox, FormatCas} {
+		t.Run(format, func(t *testing.T) {
+			fs := newMemFS(t)
+			backup := newTestBackup(t, fs, Config{BackupDir: "backup", Format: format})
+			backup.HandleUidValidity("INBOX", 1)
+
+			for uid, subject := range map[uint32]string{1: "first", 2: "second"} {
+				message := testMessage(uid, subject, fmt.Sprintf("<%d@example.com>", uid), testRfc5322Message(uid, subject))
+				assert.NoError(t, backup.SaveMessage("INBOX", message, fs, "backup"))
+			}
+
+			report, err := Verify(fs, "backup")
+			assert.NoError(t, err)
+			assert.Equal(t, 2, report.Messages)
+			assert.True(t, report.Ok(), "%+v", report)
+			assert.Equal(t, []string{"INBOX"}, report.Mailboxes())
+
+			report.CrossCheck("INBOX", 1, []uint32{1, 3})
+			assert.Equal(t, []VerifyProblem{{Mailbox: "INBOX", Uid: 3, Reason: "message on the server is not backed up"}}, report.Missing)
+			assert.Equal(t, 1, len(report.Extra))
+			assert.Equal(t, uint32(2), report.Extra[0].Uid)
+
+			// messages of another UIDVALIDITY are not compared
+			report, err = Verify(fs, "backup")
+			assert.NoError(t, err)
+			report.CrossCheck("INBOX", 2, nil)
+			assert.True(t, report.Ok(), "%+v", report)
+		})
+	}
+}
+
+func TestVerifyProblems(t *testing.T) {
+	fs := newMemFS(t)
+	backup := newTestBackup(t, fs, Config{BackupDir: "backup"})
+	backup.HandleUidValidity("INBOX", 1)
+
+	for uid, subject := range map[uint32]string{1: "corrupt", 2: "missing", 3: "original"} {
+		message := testMessage(uid, subject, fmt.Sprintf("<%d@example.com>", uid), testRfc5322Message(uid, subject))
+		assert.NoError(t, backup.SaveMessage("INBOX", message, fs, "backup"))
+	}
+	// the same message saved again under another uid
+	assert.NoError(t, backup.SaveMessage("INBOX", testMessage(4, "copy", "<4@example.com>", testRfc5322Message(3, "original")), fs, "backup"))
+
+	metadata, err := ReadMetadata(fs, "backup", "INBOX")
+	assert.NoError(t, err)
+	paths := map[uint32]string{}
+	for _, record := range metadata {
+		paths[record.Uid] = path.Join("backup", record.Path)
+	}
+	assert.NoError(t, fs.WriteFile(paths[1], []byte(testRfc5322Message(1, "tampered")), os.ModePerm))
+	assert.NoError(t, fs.Remove(paths[2]))
+
+	report, err := Verify(fs, "backup")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, report.Messages)
+	assert.False(t, report.Ok())
+
+	assert.Equal(t, 1, len(report.Corrupt))
+	assert.Equal(t, uint32(1), report.Corrupt[0].Uid)
+
+	assert.Equal(t, 1, len(report.Duplicate))
+	assert.Equal(t, "3@example.com", report.Duplicate[0].MessageId)
+
+	assert.Equal(t, 1, len(report.Missing))
+	assert.Equal(t, uint32(2), report.Missing[0].Uid)
+	assert.Equal(t, "file of the metadata is missing", report.Missing[0].Reason)
+}
+
+func TestCrossCheckPrunedMessages(t *testing.T) {
+	now := time.Date(2024, time.June, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, format := range []string{FormatEml, FormatMaildir, FormatMbox, FormatCas} {
+		t.Run(format, func(t *testing.T) {
+			fs := newMemFS(t)
+			backup := newTestBackup(t, fs, Config{BackupDir: "backup", Format: format})
+			backup.HandleUidValidity("Spam", 1)
+
+			for uid, messageId := range map[uint32]string{1: "<expired@example.com>", 2: "<held@example.com>"} {
+				message := testMessage(uid, "spam", messageId, fmt.Sprintf("Message-ID: %s\r\nSubject: spam\r\n\r\nspam body %d\r\n", messageId, uid))
+				message.InternalDate = now.Add(-60 * 24 * time.Hour)
+				assert.NoError(t, backup.SaveMessage("Spam", message, fs, "backup"))
+			}
+			result, err := backup.Prune(testRetentionConfig(), now, false)
+			assert.NoError(t, err)
+			assert.Equal(t, PruneResult{Pruned: 1, Held: 1}, result)
+
+			// the pruned message is still on the server, the held one is backed up
+			report, err := Verify(fs, "backup")
+			assert.NoError(t, err)
+			report.CrossCheck("Spam", 1, []uint32{1, 2})
+			assert.True(t, report.Ok(), "%+v", report)
+			assert.Equal(t, []VerifyProblem{{Mailbox: "Spam", Uid: 1, Reason: "message on the server was pruned from the backup"}}, report.Pruned)
+
+			// a new message with the uid of another UIDVALIDITY was not pruned
+			report, err = Verify(fs, "backup")
+			assert.NoError(t, err)
+			report.CrossCheck("Spam", 2, []uint32{1})
+			assert.Equal(t, 1, len(report.Missing))
+			assert.Empty(t, report.Pruned)
+		})
+	}
+}
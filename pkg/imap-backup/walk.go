@@ -0,0 +1,341 @@
+package imap_backup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hack-pad/hackpadfs"
+)
+
+// BackupMessage is a message found in a backup directory
+type BackupMessage struct {
+	Mailbox string
+	// Key identifies the message within its mailbox and does not change when
+	// the flags of the message change
+	Key   string
+	Flags []string
+	Date  time.Time
+	// Uid and UidValidity are the server ids of the message if the backup
+	// knows them
+	Uid         uint32
+	UidValidity uint32
+	// Sha256 is the checksum of the body when it was saved if the backup
+	// knows it
+	Sha256 string
+
+	// format is the format of the backup the message was found in and file
+	// the message file, mbox or manifest relative to the backup directory
+	format string
+	file   string
+}
+
+// WalkBackup calls fn for every message of the backup at backupDir in any of
+// the formats eml, maildir, mbox and cas. Messages in the tombstone area and
+// messages of mbox files that are expunged according to the metadata are
+// skipped. Flags and dates are taken from the metadata if the backup has
+// it. body must not be used after fn returned.
+func WalkBackup(fileSystem FS, backupDir string, fn func(message BackupMessage, body io.Reader) error) error {
+	return walkBackupMessages(fileSystem, backupDir, fn, func(message BackupMessage, err error) error {
+		return err
+	})
+}
+
+// walkBackupMessages is WalkBackup that calls onError for messages that cannot be
+// opened instead of stopping
+func walkBackupMessages(fileSystem FS, backupDir string, fn func(message BackupMessage, body io.Reader) error, onError func(message BackupMessage, err error) error) error {
+	walker := &backupWalker{
+		fs:        fileSystem,
+		backupDir: backupDir,
+		metadata:  map[string]*metadataIndex{},
+		fn:        fn,
+		onError:   onError,
+	}
+
+	err := hackpadfs.WalkDir(fileSystem, backupDir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath := strings.TrimPrefix(strings.TrimPrefix(filePath, backupDir), "/")
+		if d.IsDir() {
+			switch {
+			case relPath == uidIndexDir, relPath == blobsDir, relPath == manifestsDir, relPath == metadataDir, relPath == deletedDir:
+				return fs.SkipDir
+			case d.Name() == maildirTmp && isMaildir(fileSystem, path.Dir(filePath)):
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		dir := path.Dir(relPath)
+		switch {
+		case (path.Base(dir) == maildirNew || path.Base(dir) == maildirCur) && isMaildir(fileSystem, path.Dir(path.Dir(filePath))):
+			return walker.maildirMessage(relPath)
+		case isEmlFile(d.Name()) && dir != ".":
+			return walker.emlMessage(relPath, d)
+		case strings.HasSuffix(d.Name(), mboxExtension):
+			return walker.mbox(relPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return walkIfExists(fileSystem, path.Join(backupDir, manifestsDir), func(filePath string, d fs.DirEntry) error {
+		if !strings.HasSuffix(d.Name(), manifestExtension) {
+			return nil
+		}
+
+		relPath := strings.TrimPrefix(filePath, path.Join(backupDir, manifestsDir)+"/")
+		return walker.manifest(filePath, strings.TrimSuffix(relPath, manifestExtension))
+	})
+}
+
+// isMaildir reports whether dir has the subdirectories of a Maildir
+func isMaildir(fileSystem FS, dir string) bool {
+	for _, sub := range []string{maildirTmp, maildirNew, maildirCur} {
+		info, err := hackpadfs.Stat(fileSystem, path.Join(dir, sub))
+		if err != nil || !info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+type backupWalker struct {
+	fs        FS
+	backupDir string
+	metadata  map[string]*metadataIndex
+	fn        func(message BackupMessage, body io.Reader) error
+	onError   func(message BackupMessage, err error) error
+}
+
+// metadataIndex is the current metadata of the messages of a mailbox
+type metadataIndex struct {
+	byPath map[string]MessageMetadata
+	byUid  map[uint32]MessageMetadata
+}
+
+func (w *backupWalker) metadataOf(mailbox string) (*metadataIndex, error) {
+	if index, ok := w.metadata[mailbox]; ok {
+		return index, nil
+	}
+
+	records, err := ReadMetadata(w.fs, w.backupDir, mailbox)
+	if err != nil {
+		return nil, err
+	}
+
+	index := &metadataIndex{byPath: map[string]MessageMetadata{}, byUid: map[uint32]MessageMetadata{}}
+	for _, record := range records {
+		if record.Path != "" && !record.Expunged && !record.Pruned {
+			index.byPath[record.Path] = record
+		}
+		// the metadata of the latest UIDVALIDITY comes last
+		index.byUid[record.Uid] = record
+	}
+
+	w.metadata[mailbox] = index
+	return index, nil
+}
+
+// apply sets flags and date of message from metadata if there is any
+func (w *backupWalker) apply(message *BackupMessage, metadata MessageMetadata, ok bool) {
+	if !ok || metadata.Expunged {
+		return
+	}
+
+	message.Flags = metadata.Flags
+	if !metadata.InternalDate.IsZero() {
+		message.Date = metadata.InternalDate
+	}
+	message.Uid = metadata.Uid
+	message.UidValidity = metadata.UidValidity
+	message.Sha256 = metadata.Sha256
+}
+
+func (w *backupWalker) emlMessage(relPath string, d fs.DirEntry) error {
+	info, err := d.Info()
+	if err != nil {
+		return err
+	}
+
+	// the modification time of .eml files is the date of the message
+	message := BackupMessage{Mailbox: path.Dir(relPath), Key: relPath, Date: info.ModTime(), format: FormatEml, file: relPath}
+	index, err := w.metadataOf(message.Mailbox)
+	if err != nil {
+		return err
+	}
+	metadata, ok := index.byPath[relPath]
+	w.apply(&message, metadata, ok)
+
+	return w.file(message, relPath)
+}
+
+func (w *backupWalker) maildirMessage(relPath string) error {
+	mailbox := path.Dir(path.Dir(relPath))
+	name, info, hasInfo := cutMaildirInfo(path.Base(relPath))
+
+	message := BackupMessage{Mailbox: mailbox, Key: path.Join(mailbox, name), format: FormatMaildir, file: relPath}
+	if hasInfo {
+		message.Flags = maildirFlagsOf(info)
+	}
+
+	fileInfo, err := hackpadfs.Stat(w.fs, path.Join(w.backupDir, relPath))
+	if err != nil {
+		return err
+	}
+	message.Date = fileInfo.ModTime()
+
+	index, err := w.metadataOf(mailbox)
+	if err != nil {
+		return err
+	}
+	metadata, ok := index.byPath[relPath]
+	w.apply(&message, metadata, ok)
+
+	return w.file(message, relPath)
+}
+
+func (w *backupWalker) file(message BackupMessage, relPath string) error {
+	file, err := OpenMessageFile(w.fs, path.Join(w.backupDir, relPath))
+	if err != nil {
+		return w.onError(message, err)
+	}
+	defer file.Close()
+
+	return w.fn(message, file)
+}
+
+func (w *backupWalker) mbox(relPath string) error {
+	mailbox := strings.TrimSuffix(relPath, mboxExtension)
+	mboxPath := path.Join(w.backupDir, relPath)
+
+	entries, err := ReadMboxIndex(w.fs, mboxPath)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return w.mboxWithoutIndex(mailbox, mboxPath)
+	}
+
+	index, err := w.metadataOf(mailbox)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		err := w.mboxMessage(mailbox, relPath, entry, index)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *backupWalker) mboxMessage(mailbox string, relPath string, entry MboxIndexEntry, index *metadataIndex) error {
+	message := BackupMessage{Mailbox: mailbox, Key: fmt.Sprintf("%d", entry.Offset), Uid: entry.Uid, format: FormatMbox, file: relPath}
+	metadata, ok := index.byUid[entry.Uid]
+	ok = ok && entry.Uid != 0
+	if ok && metadata.Expunged {
+		// mbox files keep expunged messages
+		return nil
+	}
+
+	mboxMessage, file, err := openMboxMessage(w.fs, path.Join(w.backupDir, relPath), entry)
+	if err != nil {
+		return w.onError(message, err)
+	}
+	defer file.Close()
+
+	message.Date = mboxMessage.Date
+	w.apply(&message, metadata, ok)
+
+	return w.fn(message, mboxMessage.Body)
+}
+
+func (w *backupWalker) mboxWithoutIndex(mailbox string, mboxPath string) error {
+	file, err := w.fs.Open(mboxPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := NewMboxReader(file)
+	for n := 0; ; n++ {
+		mboxMessage, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		message := BackupMessage{Mailbox: mailbox, Key: fmt.Sprintf("#%d", n), Date: mboxMessage.Date}
+		err = w.fn(message, mboxMessage.Body)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (w *backupWalker) manifest(manifestPath string, mailbox string) error {
+	entries, err := ReadManifest(w.fs, manifestPath)
+	if err != nil {
+		return err
+	}
+
+	index, err := w.metadataOf(mailbox)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		message := BackupMessage{
+			Mailbox: mailbox,
+			Key:     fmt.Sprintf("%d:%s", entry.Uid, entry.Hash),
+			Date:    entry.Date,
+			Uid:     entry.Uid,
+			format:  FormatCas,
+			file:    strings.TrimPrefix(manifestPath, w.backupDir+"/"),
+		}
+		metadata, ok := index.byUid[entry.Uid]
+		w.apply(&message, metadata, ok && entry.Uid != 0 && metadata.Sha256 == entry.Hash)
+		message.Sha256 = entry.Hash
+
+		err := w.blob(message, entry.Hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *backupWalker) blob(message BackupMessage, hash string) error {
+	file, err := OpenBlob(w.fs, w.backupDir, hash)
+	if err != nil {
+		return w.onError(message, err)
+	}
+	defer file.Close()
+
+	return w.fn(message, file)
+}
+
+// maildirFlagsOf returns the IMAP flags of the letters of a Maildir info
+func maildirFlagsOf(letters string) []string {
+	flags := []string{}
+	for imapFlag, letter := range maildirFlags {
+		if strings.IndexByte(letters, letter) >= 0 {
+			flags = append(flags, imapFlag)
+		}
+	}
+
+	slices.Sort(flags)
+	return flags
+}
@@ -0,0 +1,68 @@
+package imap_backup
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/stretchr/testify/assert"
+)
+
+type walkedMessage struct {
+	BackupMessage
+	body string
+}
+
+func walkBackup(t *testing.T, fs FS, backupDir string) []walkedMessage {
+	var messages []walkedMessage
+	err := WalkBackup(fs, backupDir, func(message BackupMessage, body io.Reader) error {
+		content, err := io.ReadAll(body)
+		messages = append(messages, walkedMessage{message, string(content)})
+		return err
+	})
+	assert.NoError(t, err)
+
+	slices.SortFunc(messages, func(a, b walkedMessage) int {
+		return strings.Compare(a.Mailbox+a.body, b.Mailbox+b.body)
+	})
+	return messages
+}
+
+func TestWalkBackupFormats(t *testing.T) {
+	internalDate := time.Date(2024, time.March, 1, 8, 0, 0, 0, time.UTC)
+
+	for _, format := range []string{FormatEml, FormatMaildir, FormatMbox, FormatCas} {
+		t.Run(format, func(t *testing.T) {
+			fs := newMemFS(t)
+			backup := newTestBackup(t, fs, Config{BackupDir: "backup", Format: format})
+			backup.HandleUidValidity("INBOX", 1)
+
+			seen := testMessage(1, "seen", "<1@example.com>", "seen body\r\n")
+			seen.Flags = []string{imap.SeenFlag}
+			seen.InternalDate = internalDate
+			expunged := testMessage(2, "expunged", "<2@example.com>", "expunged body\r\n")
+			archived := testMessage(3, "archived", "<3@example.com>", "archived body\r\n")
+
+			assert.NoError(t, backup.SaveMessage("INBOX", seen, fs, "backup"))
+			assert.NoError(t, backup.SaveMessage("INBOX", expunged, fs, "backup"))
+			assert.NoError(t, backup.SaveMessage("Archive/2024", archived, fs, "backup"))
+			backup.HandleExpunge("INBOX", 2)
+
+			messages := walkBackup(t, fs, "backup")
+
+			bodies := []string{}
+			for _, message := range messages {
+				bodies = append(bodies, message.Mailbox+":"+strings.TrimSpace(message.body))
+			}
+			assert.Equal(t, []string{"Archive/2024:archived body", "INBOX:seen body"}, bodies)
+
+			inbox := messages[len(messages)-1]
+			assert.Equal(t, []string{imap.SeenFlag}, inbox.Flags)
+			assert.True(t, internalDate.Equal(inbox.Date), inbox.Date)
+			assert.NotEmpty(t, inbox.Key)
+		})
+	}
+}
@@ -2,26 +2,37 @@ package imap_client
 
 import "C"
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-imap"
-	"github.com/emersion/go-imap/client"
 	"github.com/hack-pad/hackpadfs"
 	log "github.com/sirupsen/logrus"
 )
 
+// FetchBatchSize and FetchBatchWaitTime are the defaults of the number of
+// messages fetched at once and the pause between two fetches
 const FetchBatchSize = 100
 const FetchBatchWaitTime = 500 * time.Millisecond
 const loopLimitTime = 2 * time.Second
+const defaultFullSyncInterval = 1 * time.Hour
 
 var FetchBodySection = imap.BodySectionName{}
 var FetchItems = []imap.FetchItem{
 	imap.FetchUid,
 	imap.FetchEnvelope,
+	imap.FetchFlags,
+	imap.FetchInternalDate,
+	imap.FetchRFC822Size,
 	FetchBodySection.FetchItem(),
 }
 
@@ -29,10 +40,47 @@ type HandleMessagePlugin interface {
 	HandleMessage(mailbox string, message *imap.Message)
 }
 
+// HandleFlagsPlugin is notified about flag changes of already known messages.
+// Only called if the server supports CONDSTORE.
+type HandleFlagsPlugin interface {
+	HandleFlags(mailbox string, message *imap.Message)
+}
+
+// HandleVanishedPlugin is notified about expunged messages reported by the
+// server. Only called if the server supports QRESYNC.
+type HandleVanishedPlugin interface {
+	HandleVanished(mailbox string, uids []uint32)
+}
+
+// HandleExpungePlugin is notified about messages that were removed from the
+// server since they were handled
+type HandleExpungePlugin interface {
+	HandleExpunge(mailbox string, uid uint32)
+}
+
+// HandleMessageStreamPlugin is used instead of HandleMessage. The message
+// contains no body, it is read from body instead. body must not be used after
+// HandleMessageStream returned.
+type HandleMessageStreamPlugin interface {
+	HandleMessageStream(mailbox string, message *imap.Message, body io.Reader)
+}
+
+// HandleMailboxesPlugin is told about all mailboxes of the server, including
+// their hierarchy delimiters, whenever they are listed
+type HandleMailboxesPlugin interface {
+	HandleMailboxes(mailboxes []*imap.MailboxInfo)
+}
+
 type SelectMailboxesPlugin interface {
 	SelectMailboxes() []string
 }
 
+// ShutdownPlugin finishes pending work before the client logs out. Plugins
+// without it are closed if they implement io.Closer.
+type ShutdownPlugin interface {
+	Shutdown(ctx context.Context) error
+}
+
 type FS interface {
 	hackpadfs.FS
 	hackpadfs.OpenFileFS
@@ -48,18 +96,50 @@ type Config struct {
 	StateDir          string  `json:"stateDir" yaml:"stateDir"`
 	StateFile         *string `json:"stateFile" yaml:"stateFile"`
 	LastMessageOffset uint32  `json:"lastMessageOffset" yaml:"lastMessageOffset"`
+	// OAuth2 replaces the password authentication if set
+	OAuth2 *OAuth2Config `json:"oauth2" yaml:"oauth2"`
+	// TokenCacheFS is the file system of the OAuth2 token cache below
+	// StateDir. It defaults to the state file system.
+	TokenCacheFS FS              `json:"-" yaml:"-"`
+	Transport    TransportConfig `json:"transport" yaml:"transport"`
+	Retry        RetryConfig     `json:"retry" yaml:"retry"`
+	// WatchMailboxes are watched for changes with NOTIFY or IDLE. Defaults to INBOX.
+	WatchMailboxes []string `json:"watchMailboxes" yaml:"watchMailboxes"`
+	// FullSyncInterval is the time between runs over all mailboxes. Defaults to 1 hour.
+	FullSyncInterval time.Duration `json:"fullSyncInterval" yaml:"fullSyncInterval"`
+	// FetchBatchSize is the number of messages fetched at once. Defaults to 100.
+	FetchBatchSize int `json:"fetchBatchSize" yaml:"fetchBatchSize"`
+	// FetchBatchWaitTime is the pause between two batches. Defaults to 500ms.
+	FetchBatchWaitTime time.Duration `json:"fetchBatchWaitTime" yaml:"fetchBatchWaitTime"`
+	// MaxBatchBytes limits the size of the message bodies that are fetched
+	// into memory at once. Defaults to 64 MiB.
+	MaxBatchBytes int64 `json:"maxBatchBytes" yaml:"maxBatchBytes"`
+	// MaxMessageBytes is the size above which a message body is not held in
+	// memory but streamed in chunks of this size. Plugins that do not support
+	// streaming only get the envelope of such messages. Defaults to 8 MiB.
+	MaxMessageBytes int64 `json:"maxMessageBytes" yaml:"maxMessageBytes"`
 }
 
 type Client struct {
 	activeConnection  *Connection
-	idleConnection    *Connection
+	idleConnections   []*Connection
+	idleParams        ConnectionParams
+	watchMailboxes    []string
+	fullSyncInterval  time.Duration
+	batchSize         int
+	batchWaitTime     time.Duration
+	maxBatchBytes     int64
+	maxMessageBytes   int64
 	config            Config
 	messageHandlers   []HandleMessagePlugin
+	mailboxHandlers   map[string][]HandleMessagePlugin
 	state             *State
 	stateFS           FS
 	stateDirectory    string
 	lastMessageOffset uint32
 	stateFile         string
+	stateLoaded       bool
+	watchers          *sync.WaitGroup
 }
 
 func NewClient(stateFS FS, cfg Config, messageHandlers []HandleMessagePlugin) *Client {
@@ -68,6 +148,47 @@ func NewClient(stateFS FS, cfg Config, messageHandlers []HandleMessagePlugin) *C
 		stateFile = *cfg.StateFile
 	}
 
+	watchMailboxes := cfg.WatchMailboxes
+	if len(watchMailboxes) == 0 {
+		watchMailboxes = []string{"INBOX"}
+	}
+
+	fullSyncInterval := cfg.FullSyncInterval
+	if fullSyncInterval <= 0 {
+		fullSyncInterval = defaultFullSyncInterval
+	}
+
+	fetchBatchSize := cfg.FetchBatchSize
+	if fetchBatchSize <= 0 {
+		fetchBatchSize = FetchBatchSize
+	}
+
+	fetchBatchWaitTime := cfg.FetchBatchWaitTime
+	if fetchBatchWaitTime <= 0 {
+		fetchBatchWaitTime = FetchBatchWaitTime
+	}
+
+	maxBatchBytes := cfg.MaxBatchBytes
+	if maxBatchBytes <= 0 {
+		maxBatchBytes = defaultMaxBatchBytes
+	}
+
+	maxMessageBytes := cfg.MaxMessageBytes
+	if maxMessageBytes <= 0 {
+		maxMessageBytes = defaultMaxMessageBytes
+	}
+
+	var tokenSource TokenSource
+	oauth2Mechanism := ""
+	if cfg.OAuth2 != nil {
+		tokenCacheFS := cfg.TokenCacheFS
+		if tokenCacheFS == nil {
+			tokenCacheFS = stateFS
+		}
+		tokenSource = NewOAuth2TokenSource(tokenCacheFS, cfg.StateDir, *cfg.OAuth2)
+		oauth2Mechanism = cfg.OAuth2.Mechanism
+	}
+
 	return &Client{
 		stateFS:           stateFS,
 		stateDirectory:    cfg.StateDir,
@@ -76,16 +197,34 @@ func NewClient(stateFS FS, cfg Config, messageHandlers []HandleMessagePlugin) *C
 		messageHandlers:   messageHandlers,
 		lastMessageOffset: cfg.LastMessageOffset,
 		stateFile:         stateFile,
+		watchMailboxes:    watchMailboxes,
+		fullSyncInterval:  fullSyncInterval,
+		batchSize:         fetchBatchSize,
+		batchWaitTime:     fetchBatchWaitTime,
+		maxBatchBytes:     maxBatchBytes,
+		maxMessageBytes:   maxMessageBytes,
+		watchers:          &sync.WaitGroup{},
 		activeConnection: NewConnection(ConnectionParams{
 			ImapAddr:     cfg.ImapAddr,
 			ImapUsername: cfg.ImapUsername,
 			ImapPassword: cfg.ImapPassword,
+			Transport:    cfg.Transport,
+			Retry:        cfg.Retry,
+
+			TokenSource:     tokenSource,
+			OAuth2Mechanism: oauth2Mechanism,
+			Enable:          []string{CapQresync, CapCondstore},
 		}),
-		idleConnection: NewConnection(ConnectionParams{
+		idleParams: ConnectionParams{
 			ImapAddr:     cfg.ImapAddr,
 			ImapUsername: cfg.ImapUsername,
 			ImapPassword: cfg.ImapPassword,
-		}),
+			Transport:    cfg.Transport,
+			Retry:        cfg.Retry,
+
+			TokenSource:     tokenSource,
+			OAuth2Mechanism: oauth2Mechanism,
+		},
 	}
 }
 
@@ -94,42 +233,70 @@ func NewClient(stateFS FS, cfg Config, messageHandlers []HandleMessagePlugin) *C
 // }
 
 func (c *Client) open() error {
-	err := c.idleConnection.Open()
+	idleConnection := NewConnection(c.idleParams)
+	err := idleConnection.Open()
 	if err != nil {
 		return err
 	}
+	c.idleConnections = []*Connection{idleConnection}
 
 	return c.activeConnection.Open()
 }
 
 func (c *Client) Close() error {
+	return c.Shutdown(context.Background())
+}
+
+// Shutdown lets the plugins finish their pending work until ctx is done,
+// writes the state file and logs out. Run must have returned before.
+func (c *Client) Shutdown(ctx context.Context) error {
+	var errs []error
 	for _, plugin := range c.messageHandlers {
-		if closer, ok := plugin.(io.Closer); ok {
+		if shutdownPlugin, ok := plugin.(ShutdownPlugin); ok {
+			errs = append(errs, shutdownPlugin.Shutdown(ctx))
+		} else if closer, ok := plugin.(io.Closer); ok {
 			closer.Close()
 		}
 	}
 
+	// never overwrite the state file with a state that was not read
+	if c.stateLoaded {
+		err := c.updateStateFile()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to write state file: %w", err))
+		}
+	}
+
 	if c.activeConnection != nil {
 		c.activeConnection.Close()
 	}
 
-	if c.idleConnection != nil {
-		c.idleConnection.Close()
+	for _, idleConnection := range c.idleConnections {
+		idleConnection.Close()
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
 func (c *Client) Open() error {
 	return c.open()
 }
 
-func (c *Client) Run() error {
+// Run processes the mailboxes until ctx is done or an error occurs. The
+// watchers are stopped before it returns.
+func (c *Client) Run(ctx context.Context) error {
 	lastLoopRun := time.Now()
+	events := make(chan string, watchEventBufferSize)
+	watchCtx, stopWatching := context.WithCancel(ctx)
+	c.watch(watchCtx, events)
+	defer func() {
+		stopWatching()
+		c.watchers.Wait()
+	}()
 
 	for {
 		log.Info("starting loop")
-		mailboxes, err := c.listMailboxNames(c.activeConnection)
+		mailboxes, err := c.listMailboxNames(ctx, c.activeConnection)
 		if err != nil {
 			return err
 		}
@@ -139,63 +306,85 @@ func (c *Client) Run() error {
 			return err
 		}
 
+		c.mailboxHandlers = routePlugins(c.messageHandlers, mailboxes)
+
 		for _, mbName := range mailboxes {
-			err = c.runOnMailbox(mbName)
-			if err != nil {
+			if len(c.mailboxHandlers[mbName]) == 0 {
+				continue
+			}
+
+			err = c.runOnMailbox(ctx, mbName)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			} else if err != nil {
 				log.WithField("mailbox", mbName).Error(err)
 				continue
 			}
 		}
 
-		err = c.waitForMailboxUpdate("INBOX")
+		err = c.runOnEvents(ctx, events, time.After(c.fullSyncInterval), &lastLoopRun)
 		if err != nil {
-			log.WithError(err).Error("failed to wait for mailbox update. sleeping for 1 hour")
-			time.Sleep(1 * time.Hour)
-			continue
+			return err
 		}
 
-		limitCalls(&lastLoopRun)
+		err = limitCalls(ctx, &lastLoopRun)
+		if err != nil {
+			return err
+		}
 	}
 }
 
-func limitCalls(lastCall *time.Time) {
-	time.Sleep(loopLimitTime - time.Since(*lastCall))
-	*lastCall = time.Now()
-}
-
-func (c *Client) waitForMailboxUpdate(mailbox string) error {
-	const logoutTimeout = 1 * time.Minute
-
-	log.WithField("mailbox", mailbox).Info("waiting for mailbox update")
-	defer log.WithField("mailbox", mailbox).Info("mailbox updated")
+// runOnEvents processes only the mailboxes reported by the watchers until the
+// next full sync is due
+func (c *Client) runOnEvents(ctx context.Context, events <-chan string, fullSync <-chan time.Time, lastLoopRun *time.Time) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-fullSync:
+			return nil
+		case mailbox := <-events:
+			err := limitCalls(ctx, lastLoopRun)
+			if err != nil {
+				return err
+			}
 
-	_, err := c.idleConnection.Select(mailbox, true)
-	if err != nil {
-		return err
-	}
+			// merge events that arrived in the meantime
+			pending := map[string]struct{}{mailbox: {}}
+			for drained := false; !drained; {
+				select {
+				case mailbox := <-events:
+					pending[mailbox] = struct{}{}
+				default:
+					drained = true
+				}
+			}
 
-	updateChan := make(chan client.Update, 16)
-	c.idleConnection.SetUpdates(updateChan)
-	defer func() {
-		c.idleConnection.SetUpdates(nil)
-		close(updateChan)
-	}()
+			err = c.readState()
+			if err != nil {
+				return err
+			}
 
-	stopChan := make(chan struct{})
-	go func() {
-		defer close(stopChan)
+			for mailbox := range pending {
+				if len(c.handlersOf(mailbox)) == 0 {
+					continue
+				}
 
-		for update := range updateChan {
-			switch update.(type) {
-			case *client.MailboxUpdate:
-				return
-			default:
-				continue
+				err = c.runOnMailbox(ctx, mailbox)
+				if ctx.Err() != nil {
+					return ctx.Err()
+				} else if err != nil {
+					log.WithField("mailbox", mailbox).Error(err)
+				}
 			}
 		}
-	}()
+	}
+}
 
-	return c.idleConnection.Idle(stopChan, &client.IdleOptions{LogoutTimeout: logoutTimeout})
+func limitCalls(ctx context.Context, lastCall *time.Time) error {
+	err := sleepContext(ctx, loopLimitTime-time.Since(*lastCall))
+	*lastCall = time.Now()
+	return err
 }
 
 func (c *Client) readState() error {
@@ -209,6 +398,7 @@ func (c *Client) readState() error {
 			defer stateFile.Close()
 			_, err = c.state.ReadFrom(stateFile)
 			if err == nil {
+				c.stateLoaded = true
 				return nil
 			} else {
 				log.WithError(err).Warn("failed to read/parse state file")
@@ -231,6 +421,7 @@ func (c *Client) readState() error {
 			defer backupStateFile.Close()
 			_, err = c.state.ReadFrom(backupStateFile)
 			if err == nil {
+				c.stateLoaded = true
 				return nil
 			} else {
 				log.WithError(err).Error("failed to read/parse backup file")
@@ -240,6 +431,7 @@ func (c *Client) readState() error {
 			if os.IsNotExist(err) {
 				if stateDoesNotExists {
 					log.WithError(err).Info("backup file does not exist. assuming blank state")
+					c.stateLoaded = true
 					return nil
 				}
 			}
@@ -250,107 +442,223 @@ func (c *Client) readState() error {
 	}
 }
 
-func (c *Client) runOnMailbox(mailboxName string) error {
+func (c *Client) runOnMailbox(ctx context.Context, mailboxName string) error {
 	log.WithField("mailbox", mailboxName).Info("processing mailbox")
-	if !c.state.Mailboxes.HasMailbox(mailboxName) {
-		return c.fetchAllMessages(mailboxName)
+
+	condstore := c.activeConnection.Enabled(CapCondstore)
+	statusItems := []imap.StatusItem{imap.StatusUidValidity, imap.StatusMessages}
+	if condstore {
+		statusItems = append(statusItems, StatusHighestModSeq)
 	}
 
-	mbStatus, err := c.activeConnection.Status(mailboxName, []imap.StatusItem{imap.StatusUidValidity})
+	mbStatus, err := c.activeConnection.Status(ctx, mailboxName, statusItems)
 	if err != nil {
 		return err
 	}
+	highestModSeq := statusHighestModSeq(mbStatus)
 
-	mbState := c.state.Mailboxes.Mailbox(mailboxName)
-	if mbStatus.UidValidity != mbState.SavedUidValidity {
-		return c.fetchAllMessages(mailboxName)
+	if !c.state.Mailboxes.HasMailbox(mailboxName) || mbStatus.UidValidity != c.state.Mailboxes.Mailbox(mailboxName).SavedUidValidity {
+		err = c.fetchAllMessages(ctx, mailboxName)
+		if err != nil {
+			return err
+		}
+
+		c.state.Mailboxes.Mailbox(mailboxName).HighestModSeq = highestModSeq
+		return c.updateStateFile()
 	}
 
-	return c.fetchUids(mailboxName, mbState.SavedLastUid)
-}
+	mbState := c.state.Mailboxes.Mailbox(mailboxName)
+	if condstore && mbState.HighestModSeq != 0 && mbState.HighestModSeq == highestModSeq {
+		log.WithField("mailbox", mailboxName).Debug("mailbox unchanged since last run")
+		return nil
+	}
 
-func (c *Client) fetchAllMessages(mailbox string) error {
-	mbStatus, err := c.activeConnection.Select(mailbox, true)
+	lastUid := mbState.SavedLastUid
+	err = c.fetchUids(ctx, mailboxName, lastUid)
 	if err != nil {
 		return err
 	}
-	state := c.state.Mailboxes.Mailbox(mailbox)
-	state.SavedLastUid = 0
-	state.SavedUidValidity = mbStatus.UidValidity
 
-	for i := uint32(1); i < mbStatus.Messages; i += FetchBatchSize {
-		err = c.fetchBatched(c.activeConnection, i, FetchBatchSize)
+	qresync := c.activeConnection.Enabled(CapQresync)
+	changesFetched := condstore && mbState.HighestModSeq != 0 && lastUid != 0
+	if changesFetched {
+		err = c.fetchChanges(ctx, mailboxName, lastUid, mbState.HighestModSeq, qresync)
 		if err != nil {
 			return err
 		}
+	}
 
-		time.Sleep(FetchBatchWaitTime)
+	// with QRESYNC expunges are already reported by fetchChanges
+	if !changesFetched || !qresync || mbState.KnownUids == nil {
+		err = c.detectExpunges(ctx, mailboxName, mbStatus.Messages)
+		if err != nil {
+			return err
+		}
+	}
+
+	mbState.HighestModSeq = highestModSeq
+	return c.updateStateFile()
+}
+
+// fetchChanges fetches flag changes and expunges of messages up to lastUid
+// that happened after modSeq
+func (c *Client) fetchChanges(ctx context.Context, mailbox string, lastUid uint32, modSeq uint64, qresync bool) error {
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(1, lastUid)
+
+	messages, vanished, err := c.activeConnection.UidFetchChangedSince(ctx, seqset, c.activeConnection.WithLabels(FetchChangesItems), modSeq, qresync)
+	if err != nil {
+		return fmt.Errorf("failed to fetch changes: %w", err)
+	}
+
+	for _, msg := range messages {
+		c.handleFlags(mailbox, msg)
+	}
+
+	if len(vanished) > 0 {
+		c.handleVanished(mailbox, vanished)
 	}
 
 	return nil
 }
 
-func (c *Client) fetchUids(mailbox string, uidBegin uint32) error {
-	mbStatus, err := c.activeConnection.Select(mailbox, true)
+// detectExpunges compares the known uids of the mailbox with the uids on the
+// server. messageCount is the number of messages reported by STATUS and is
+// used to skip the search if nothing was removed.
+func (c *Client) detectExpunges(ctx context.Context, mailbox string, messageCount uint32) error {
 	state := c.state.Mailboxes.Mailbox(mailbox)
-	state.SavedUidValidity = mbStatus.UidValidity
+	if state.KnownUids != nil && state.KnownUids.Count() == int(messageCount) {
+		return nil
+	}
+
+	uids, err := c.activeConnection.UidSearch(ctx, &imap.SearchCriteria{})
+	if err != nil {
+		return fmt.Errorf("failed to search uids: %w", err)
+	}
+	serverUids := NewUidSet(uids...)
+
+	if state.KnownUids != nil {
+		expunged := state.KnownUids.Difference(serverUids)
+		if len(expunged) > 0 {
+			c.handleExpunged(mailbox, expunged)
+		}
+	}
+
+	// uids on the server that were never handled (e.g. of an older state
+	// file) are considered known from now on
+	state.KnownUids = serverUids
+	return nil
+}
+
+// fetchAllMessages handles all messages of a mailbox that is new or whose
+// UIDVALIDITY changed
+func (c *Client) fetchAllMessages(ctx context.Context, mailbox string) error {
+	mbStatus, err := c.activeConnection.Select(ctx, mailbox, true)
 	if err != nil {
 		return err
 	}
 
-	seqset := new(imap.SeqSet)
-	offsettedUidBegin := uint32(0)
-	if uidBegin >= c.lastMessageOffset {
-		offsettedUidBegin = uidBegin - (c.lastMessageOffset - 1)
+	state := c.state.Mailboxes.Mailbox(mailbox)
+	if state.SavedUidValidity != mbStatus.UidValidity {
+		state.SavedLastUid = 0
+		state.HighestModSeq = 0
+		state.KnownUids = NewUidSet()
 	}
-	seqset.AddRange(offsettedUidBegin, 0)
+	state.SavedUidValidity = mbStatus.UidValidity
+	c.handleUidValidity(mailbox, mbStatus.UidValidity)
 
-	messages, err := c.activeConnection.UidFetch(seqset, FetchItems)
+	return c.fetchUidsFrom(ctx, mailbox, state.SavedLastUid+1)
+}
+
+// fetchUids handles all messages after uidBegin. With a last message offset
+// the last messages before uidBegin are handled again.
+func (c *Client) fetchUids(ctx context.Context, mailbox string, uidBegin uint32) error {
+	mbStatus, err := c.activeConnection.Select(ctx, mailbox, true)
 	if err != nil {
-		return fmt.Errorf("failed to fetch messages: %w", err)
+		return err
 	}
+	state := c.state.Mailboxes.Mailbox(mailbox)
+	state.SavedUidValidity = mbStatus.UidValidity
+	c.handleUidValidity(mailbox, mbStatus.UidValidity)
 
-	for _, msg := range messages {
-		// skip over first message because it was the last message on the last run
-		if c.lastMessageOffset == 0 && state.SavedLastUid == msg.Uid {
-			continue
+	firstUid := uidBegin + 1
+	if c.lastMessageOffset > 0 {
+		firstUid = 1
+		if uidBegin >= c.lastMessageOffset {
+			firstUid = uidBegin - (c.lastMessageOffset - 1)
 		}
-
-		state.SavedLastUid = msg.Uid
-		c.handleMessage(mailbox, msg)
 	}
 
-	return nil
+	return c.fetchUidsFrom(ctx, mailbox, firstUid)
 }
 
-func (c *Client) fetchBatched(conn *Connection, begin uint32, length uint32) error {
-	seqset := new(imap.SeqSet)
-	seqset.AddRange(begin, begin+length)
+// fetchUidsFrom handles the messages of the selected mailbox with a uid of at
+// least firstUid in batches. The state file is written after every batch, so
+// an interrupted run resumes after the last batch.
+func (c *Client) fetchUidsFrom(ctx context.Context, mailbox string, firstUid uint32) error {
+	searchSet := new(imap.SeqSet)
+	searchSet.AddRange(firstUid, 0)
 
-	messages, err := conn.Fetch(seqset, FetchItems)
+	uids, err := c.activeConnection.UidSearch(ctx, &imap.SearchCriteria{Uid: searchSet})
 	if err != nil {
-		return fmt.Errorf("failed to fetch messages: %w", err)
+		return fmt.Errorf("failed to search uids: %w", err)
 	}
 
-	mb := conn.Mailbox()
-	mbName := ""
-	if mb != nil {
-		mbName = mb.Name
+	// n:* always matches the message with the highest uid
+	uids = slices.DeleteFunc(uids, func(uid uint32) bool { return uid < firstUid })
+	slices.Sort(uids)
+	if len(uids) == 0 {
+		return nil
 	}
 
-	for _, msg := range messages {
-		c.handleMessage(mbName, msg)
+	log.WithFields(log.Fields{"mailbox": mailbox, "messages": len(uids)}).Info("fetching messages")
+
+	for begin := 0; begin < len(uids); begin += c.batchSize {
+		if begin > 0 {
+			err = sleepContext(ctx, c.batchWaitTime)
+			if err != nil {
+				return err
+			}
+		}
+
+		batch := uids[begin:min(begin+c.batchSize, len(uids))]
+		seqset := new(imap.SeqSet)
+		seqset.AddNum(batch...)
+
+		messages, err := c.activeConnection.UidFetch(ctx, seqset, c.activeConnection.WithLabels(FetchHeaderItems))
+		if err != nil {
+			return fmt.Errorf("failed to fetch messages: %w", err)
+		}
+		slices.SortFunc(messages, func(a, b *imap.Message) int { return cmp.Compare(a.Uid, b.Uid) })
+
+		err = c.handleMessages(ctx, mailbox, messages)
+
+		// the checkpoint is written even if the batch was not finished
+		stateErr := c.updateStateFile()
+		if err != nil {
+			return err
+		} else if stateErr != nil {
+			return fmt.Errorf("failed to write checkpoint: %w", stateErr)
+		}
 	}
 
 	return nil
 }
 
-func (c *Client) listMailboxNames(conn *Connection) ([]string, error) {
-	mailboxes, err := conn.List("", "*")
+// listMailboxNames lists the mailboxes of the server and tells the
+// HandleMailboxesPlugins about them
+func (c *Client) listMailboxNames(ctx context.Context, conn *Connection) ([]string, error) {
+	mailboxes, err := conn.List(ctx, "", "*")
 	if err != nil {
 		return nil, fmt.Errorf("failed to list mailboxes: %w", err)
 	}
 
+	for _, plugin := range c.messageHandlers {
+		if mailboxesPlugin, ok := plugin.(HandleMailboxesPlugin); ok {
+			mailboxesPlugin.HandleMailboxes(mailboxes)
+		}
+	}
+
 	var mailboxNames []string
 	for _, mb := range mailboxes {
 		mailboxNames = append(mailboxNames, mb.Name)
@@ -359,7 +667,20 @@ func (c *Client) listMailboxNames(conn *Connection) ([]string, error) {
 	return mailboxNames, nil
 }
 
-func (c *Client) handleMessage(mailbox string, message *imap.Message) {
+// handlersOf returns the plugins that selected the mailbox
+func (c *Client) handlersOf(mailbox string) []HandleMessagePlugin {
+	if handlers, ok := c.mailboxHandlers[mailbox]; ok {
+		return handlers
+	}
+
+	return routePlugins(c.messageHandlers, []string{mailbox})[mailbox]
+}
+
+// handleMessage hands the message with its body to the plugins. body is nil
+// for messages that are too large to be held in memory. newStream then
+// returns a new reader of the body for every HandleMessageStreamPlugin and
+// the other plugins only get the envelope.
+func (c *Client) handleMessage(mailbox string, message *imap.Message, body []byte, newStream func() io.Reader) {
 	log := log.WithField("mailbox", mailbox)
 	if message != nil && message.Envelope != nil {
 		log = log.WithField("subject", message.Envelope.Subject)
@@ -369,49 +690,94 @@ func (c *Client) handleMessage(mailbox string, message *imap.Message) {
 		return
 	}
 
-	for _, handleMessagePlugin := range c.messageHandlers {
-		handleMessagePlugin.HandleMessage(mailbox, message)
+	for _, handleMessagePlugin := range c.handlersOf(mailbox) {
+		if streamPlugin, ok := handleMessagePlugin.(HandleMessageStreamPlugin); ok {
+			if body != nil {
+				streamPlugin.HandleMessageStream(mailbox, message, bytes.NewReader(body))
+			} else {
+				streamPlugin.HandleMessageStream(mailbox, message, newStream())
+			}
+			continue
+		}
+
+		pluginMessage := message
+		if body != nil {
+			// every plugin gets its own reader of the body
+			messageWithBody := *message
+			messageWithBody.Body = map[*imap.BodySectionName]imap.Literal{
+				&FetchBodySection: bytes.NewReader(body),
+			}
+			pluginMessage = &messageWithBody
+		}
+		handleMessagePlugin.HandleMessage(mailbox, pluginMessage)
 	}
 
-	c.state.Mailboxes.Mailbox(mailbox).SavedLastUid = message.Uid
+	mbState := c.state.Mailboxes.Mailbox(mailbox)
+	if mbState.KnownUids != nil {
+		mbState.KnownUids.AddNum(message.Uid)
+	}
+}
 
-	err := c.updateStateFile()
-	if err != nil {
-		log.Error(err)
+func (c *Client) handleFlags(mailbox string, message *imap.Message) {
+	log.WithFields(log.Fields{"mailbox": mailbox, "uid": message.Uid, "flags": message.Flags}).Debug("flags changed")
+
+	for _, plugin := range c.handlersOf(mailbox) {
+		if flagsPlugin, ok := plugin.(HandleFlagsPlugin); ok {
+			flagsPlugin.HandleFlags(mailbox, message)
+		}
 	}
 }
 
-func (c *Client) updateStateFile() error {
-	stateFilePath, backupFilePath, tempFilePath := c.stateFiles()
-	c.stateFS.MkdirAll(c.stateDirectory, os.ModePerm)
+func (c *Client) handleVanished(mailbox string, uids []uint32) {
+	log.WithFields(log.Fields{"mailbox": mailbox, "count": len(uids)}).Info("messages vanished")
 
-	// write to temp file
-	{
-		tempFile, err := c.stateFS.OpenFile(tempFilePath, os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			return err
+	for _, plugin := range c.handlersOf(mailbox) {
+		if vanishedPlugin, ok := plugin.(HandleVanishedPlugin); ok {
+			vanishedPlugin.HandleVanished(mailbox, uids)
 		}
-		defer tempFile.Close()
+	}
 
-		if truncFile, ok := tempFile.(hackpadfs.TruncaterFile); ok {
-			err = truncFile.Truncate(0)
-			if err != nil {
-				return err
+	// servers may report uids that never existed
+	if knownUids := c.state.Mailboxes.Mailbox(mailbox).KnownUids; knownUids != nil {
+		var known []uint32
+		for _, uid := range uids {
+			if knownUids.Contains(uid) {
+				known = append(known, uid)
 			}
-		} else {
-			return fmt.Errorf("failed to write to temp file. tempFile is not a hackpadfs.TruncaterFile")
 		}
+		uids = known
+	}
 
-		if tempFile, ok := tempFile.(io.Writer); ok {
-			_, err = c.state.WriteTo(tempFile)
-			if err != nil {
-				return err
+	c.handleExpunged(mailbox, uids)
+}
+
+func (c *Client) handleExpunged(mailbox string, uids []uint32) {
+	for _, uid := range uids {
+		log.WithFields(log.Fields{"mailbox": mailbox, "uid": uid}).Info("message expunged")
+
+		for _, plugin := range c.handlersOf(mailbox) {
+			if expungePlugin, ok := plugin.(HandleExpungePlugin); ok {
+				expungePlugin.HandleExpunge(mailbox, uid)
 			}
-		} else {
-			return fmt.Errorf("failed to write to temp file. tempFile is not an io.Writer")
 		}
 	}
 
+	if knownUids := c.state.Mailboxes.Mailbox(mailbox).KnownUids; knownUids != nil {
+		knownUids.Remove(uids...)
+	}
+}
+
+func (c *Client) updateStateFile() error {
+	stateFilePath, backupFilePath, tempFilePath := c.stateFiles()
+	c.stateFS.MkdirAll(c.stateDirectory, os.ModePerm)
+
+	// write to temp file, it must be closed before it can be renamed on SMB
+	// shares
+	err := c.writeStateTo(tempFilePath)
+	if err != nil {
+		return err
+	}
+
 	if _, err := c.stateFS.Stat(stateFilePath); !os.IsNotExist(err) {
 		// move state file to backup file
 		err := c.stateFS.Rename(stateFilePath, backupFilePath)
@@ -421,7 +787,7 @@ func (c *Client) updateStateFile() error {
 	}
 
 	// rename temp file to state file
-	err := c.stateFS.Rename(tempFilePath, stateFilePath)
+	err = c.stateFS.Rename(tempFilePath, stateFilePath)
 	if err != nil {
 		return err
 	}
@@ -429,6 +795,35 @@ func (c *Client) updateStateFile() error {
 	return nil
 }
 
+// writeStateTo writes the state into the file at filePath
+func (c *Client) writeStateTo(filePath string) error {
+	file, err := c.stateFS.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if truncFile, ok := file.(hackpadfs.TruncaterFile); ok {
+		err = truncFile.Truncate(0)
+		if err != nil {
+			return err
+		}
+	} else {
+		return fmt.Errorf("failed to write state. %s is not a hackpadfs.TruncaterFile", filePath)
+	}
+
+	if writer, ok := file.(io.Writer); ok {
+		_, err = c.state.WriteTo(writer)
+		if err != nil {
+			return err
+		}
+	} else {
+		return fmt.Errorf("failed to write state. %s is not an io.Writer", filePath)
+	}
+
+	return file.Close()
+}
+
 func (c Client) stateFiles() (stateFile, backupFile, tmpFile string) {
 	stateFile = path.Join(c.stateDirectory, c.stateFile)
 	backupFile = stateFile + ".backup"
@@ -2,11 +2,18 @@ package imap_client
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
 	"github.com/hack-pad/hackpadfs/mem"
 	"github.com/stretchr/testify/assert"
 )
@@ -16,6 +23,8 @@ func TestReadState(t *testing.T) {
 	state.Mailboxes["test"] = &MailboxState{
 		SavedLastUid:     1,
 		SavedUidValidity: 2,
+		HighestModSeq:    3,
+		KnownUids:        NewUidSet(1),
 	}
 
 	buf := bytes.NewBuffer(nil)
@@ -28,6 +37,59 @@ func TestReadState(t *testing.T) {
 	assert.Equal(t, state, readState)
 }
 
+func TestUidSet(t *testing.T) {
+	set := NewUidSet(1, 2, 3, 5, 8, 9)
+	assert.Equal(t, 6, set.Count())
+	assert.Equal(t, "1:3,5,8:9", set.String())
+
+	set.Remove(2, 9)
+	assert.Equal(t, "1,3,5,8", set.String())
+	assert.Equal(t, []uint32{1, 8}, set.Difference(NewUidSet(3, 5, 6)))
+
+	data, err := json.Marshal(set)
+	assert.NoError(t, err)
+	assert.Equal(t, `"1,3,5,8"`, string(data))
+
+	readSet := &UidSet{}
+	assert.NoError(t, json.Unmarshal(data, readSet))
+	assert.Equal(t, set, readSet)
+}
+
+type selectingPlugin []string
+
+func (p selectingPlugin) HandleMessage(mailbox string, message *imap.Message) {}
+
+func (p selectingPlugin) SelectMailboxes() []string {
+	return p
+}
+
+type allPlugin struct{}
+
+func (allPlugin) HandleMessage(mailbox string, message *imap.Message) {}
+
+func TestRoutePlugins(t *testing.T) {
+	inbox := selectingPlugin{"INBOX"}
+	archive := selectingPlugin{"Archive*"}
+	all := allPlugin{}
+
+	routes := routePlugins([]HandleMessagePlugin{inbox, archive, all}, []string{"INBOX", "Archive.2024", "Sent"})
+	assert.Equal(t, []HandleMessagePlugin{inbox, all}, routes["INBOX"])
+	assert.Equal(t, []HandleMessagePlugin{archive, all}, routes["Archive.2024"])
+	assert.Equal(t, []HandleMessagePlugin{all}, routes["Sent"])
+
+	routes = routePlugins([]HandleMessagePlugin{inbox}, []string{"INBOX", "Sent"})
+	assert.Empty(t, routes["Sent"])
+}
+
+func TestMatchMailbox(t *testing.T) {
+	assert.True(t, matchMailbox("INBOX", "INBOX"))
+	assert.False(t, matchMailbox("INBOX", "INBOX.Rechnungen"))
+	assert.True(t, matchMailbox("INBOX*", "INBOX.Rechnungen"))
+	assert.True(t, matchMailbox("*", "[Gmail]/All Mail"))
+	assert.True(t, matchMailbox("*.Shit", "Spam.Shit"))
+	assert.False(t, matchMailbox("[Gmail]*", "Gmail"))
+}
+
 func TestClientReadState(t *testing.T) {
 	fs, err := mem.NewFS()
 	assert.NoError(t, err)
@@ -135,3 +197,314 @@ func writeToFile(fs *mem.FS, path string, data string) error {
 		return err
 	}
 }
+
+func TestClientRunStopsOnCancel(t *testing.T) {
+	addr := startTestServer(t, nil, false)
+
+	fs, err := mem.NewFS()
+	assert.NoError(t, err)
+
+	client := NewClient(fs, Config{
+		ImapAddr:     addr,
+		ImapUsername: "username",
+		ImapPassword: "password",
+		StateDir:     "state",
+		Transport:    TransportConfig{Mode: TransportPlain},
+	}, []HandleMessagePlugin{allPlugin{}})
+	assert.NoError(t, client.Open())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(500*time.Millisecond, cancel)
+
+	start := time.Now()
+	err = client.Run(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	assert.NoError(t, client.Shutdown(context.Background()))
+	assert.False(t, client.activeConnection.IsOpen())
+
+	stateFile, err := fs.Open("state/.state.json")
+	assert.NoError(t, err)
+	defer stateFile.Close()
+
+	state := NewState()
+	_, err = state.ReadFrom(stateFile)
+	assert.NoError(t, err)
+	assert.True(t, state.Mailboxes.HasMailbox("INBOX"))
+}
+
+type recordingPlugin struct {
+	uids      []uint32
+	onMessage func()
+}
+
+func (p *recordingPlugin) HandleMessage(mailbox string, message *imap.Message) {
+	p.uids = append(p.uids, message.Uid)
+	if p.onMessage != nil {
+		p.onMessage()
+	}
+}
+
+func TestClientFetchResumesAfterBatch(t *testing.T) {
+	addr := startTestServer(t, nil, false)
+
+	// the test server has one message with uid 6 in INBOX
+	appendClient, err := imapclient.Dial(addr)
+	assert.NoError(t, err)
+	assert.NoError(t, appendClient.Login("username", "password"))
+	for i := 0; i < 4; i++ {
+		body := fmt.Sprintf("Subject: test %d\r\n\r\nbody\r\n", i)
+		assert.NoError(t, appendClient.Append("INBOX", nil, time.Now(), bytes.NewBufferString(body)))
+	}
+	appendClient.Logout()
+
+	fs, err := mem.NewFS()
+	assert.NoError(t, err)
+
+	plugin := &recordingPlugin{}
+	client := NewClient(fs, Config{
+		ImapAddr:           addr,
+		ImapUsername:       "username",
+		ImapPassword:       "password",
+		StateDir:           "state",
+		Transport:          TransportConfig{Mode: TransportPlain},
+		FetchBatchSize:     2,
+		FetchBatchWaitTime: time.Millisecond,
+	}, []HandleMessagePlugin{plugin})
+	assert.NoError(t, client.Open())
+	defer client.Close()
+	assert.NoError(t, client.readState())
+
+	// stop in the middle of the second batch
+	ctx, cancel := context.WithCancel(context.Background())
+	plugin.onMessage = func() {
+		if len(plugin.uids) == 3 {
+			cancel()
+		}
+	}
+	err = client.runOnMailbox(ctx, "INBOX")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, []uint32{6, 7, 8}, plugin.uids)
+
+	// the checkpoint was written to the state file
+	assert.NoError(t, client.readState())
+	assert.Equal(t, uint32(8), client.state.Mailboxes.Mailbox("INBOX").SavedLastUid)
+
+	plugin.onMessage = nil
+	assert.NoError(t, client.runOnMailbox(context.Background(), "INBOX"))
+	assert.Equal(t, []uint32{6, 7, 8, 9, 10}, plugin.uids)
+	assert.Equal(t, uint32(10), client.state.Mailboxes.Mailbox("INBOX").SavedLastUid)
+
+	// nothing new
+	assert.NoError(t, client.runOnMailbox(context.Background(), "INBOX"))
+	assert.Equal(t, 5, len(plugin.uids))
+}
+
+type streamPlugin struct {
+	bodies   map[uint32]string
+	onStream func()
+}
+
+func (p *streamPlugin) HandleMessage(mailbox string, message *imap.Message) {}
+
+func (p *streamPlugin) HandleMessageStream(mailbox string, message *imap.Message, body io.Reader) {
+	if p.onStream != nil {
+		p.onStream()
+	}
+	content, _ := io.ReadAll(body)
+	p.bodies[message.Uid] = string(content)
+}
+
+func TestClientStreamsLargeMessages(t *testing.T) {
+	addr := startTestServer(t, nil, false)
+
+	serverClient, err := imapclient.Dial(addr)
+	assert.NoError(t, err)
+	assert.NoError(t, serverClient.Login("username", "password"))
+	largeBody := "Subject: large\r\n\r\n" + strings.Repeat("0123456789", 50) + "\r\n"
+	assert.NoError(t, serverClient.Append("INBOX", nil, time.Now(), bytes.NewBufferString(largeBody)))
+
+	// body of the message the test server starts with
+	_, err = serverClient.Select("INBOX", true)
+	assert.NoError(t, err)
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(6)
+	messages := make(chan *imap.Message, 1)
+	assert.NoError(t, serverClient.UidFetch(seqset, FetchItems, messages))
+	smallBody, err := io.ReadAll((<-messages).GetBody(&FetchBodySection))
+	assert.NoError(t, err)
+	serverClient.Logout()
+
+	fs, err := mem.NewFS()
+	assert.NoError(t, err)
+
+	bodyPlugin := &streamPlugin{bodies: map[uint32]string{}}
+	envelopePlugin := &recordingPlugin{}
+	var envelopeBodies []imap.Literal
+	client := NewClient(fs, Config{
+		ImapAddr:        addr,
+		ImapUsername:    "username",
+		ImapPassword:    "password",
+		StateDir:        "state",
+		Transport:       TransportConfig{Mode: TransportPlain},
+		MaxMessageBytes: int64(len(smallBody)),
+	}, []HandleMessagePlugin{bodyPlugin, envelopePlugin, bodyCheckingPlugin(func(message *imap.Message) {
+		envelopeBodies = append(envelopeBodies, message.GetBody(&FetchBodySection))
+	})})
+	assert.NoError(t, client.Open())
+	defer client.Close()
+	assert.NoError(t, client.readState())
+
+	assert.NoError(t, client.runOnMailbox(context.Background(), "INBOX"))
+
+	// the large message is streamed in chunks of the size of the small one
+	assert.Equal(t, string(smallBody), bodyPlugin.bodies[6])
+	assert.Equal(t, largeBody, bodyPlugin.bodies[7])
+
+	// plugins without streaming only get the envelope of large messages
+	assert.Equal(t, []uint32{6, 7}, envelopePlugin.uids)
+	assert.Equal(t, 2, len(envelopeBodies))
+	assert.NotNil(t, envelopeBodies[0])
+	assert.Nil(t, envelopeBodies[1])
+}
+
+func TestClientKeepsCheckpointBeforeUnreadLargeMessage(t *testing.T) {
+	addr := startTestServer(t, nil, false)
+
+	appendClient, err := imapclient.Dial(addr)
+	assert.NoError(t, err)
+	assert.NoError(t, appendClient.Login("username", "password"))
+	largeBody := "Subject: large\r\n\r\n" + strings.Repeat("0123456789", 50) + "\r\n"
+	assert.NoError(t, appendClient.Append("INBOX", nil, time.Now(), bytes.NewBufferString(largeBody)))
+	appendClient.Logout()
+
+	fs, err := mem.NewFS()
+	assert.NoError(t, err)
+
+	plugin := &streamPlugin{bodies: map[uint32]string{}}
+	client := NewClient(fs, Config{
+		ImapAddr:        addr,
+		ImapUsername:    "username",
+		ImapPassword:    "password",
+		StateDir:        "state",
+		Transport:       TransportConfig{Mode: TransportPlain},
+		MaxMessageBytes: 100,
+	}, []HandleMessagePlugin{plugin})
+	assert.NoError(t, client.Open())
+	defer client.Close()
+	assert.NoError(t, client.readState())
+
+	// stop while the plugin streams the large message and ignores the error
+	ctx, cancel := context.WithCancel(context.Background())
+	plugin.onStream = func() {
+		if len(plugin.bodies) == 1 {
+			cancel()
+		}
+	}
+	err = client.runOnMailbox(ctx, "INBOX")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, "", plugin.bodies[7])
+
+	assert.NoError(t, client.readState())
+	assert.Equal(t, uint32(6), client.state.Mailboxes.Mailbox("INBOX").SavedLastUid)
+
+	// the next run streams it again
+	plugin.onStream = nil
+	assert.NoError(t, client.runOnMailbox(context.Background(), "INBOX"))
+	assert.Equal(t, largeBody, plugin.bodies[7])
+	assert.Equal(t, uint32(7), client.state.Mailboxes.Mailbox("INBOX").SavedLastUid)
+}
+
+type bodyCheckingPlugin func(message *imap.Message)
+
+func (p bodyCheckingPlugin) HandleMessage(mailbox string, message *imap.Message) {
+	p(message)
+}
+
+type metadataPlugin struct {
+	uidValidities map[string]uint32
+	messages      []*imap.Message
+}
+
+func (p *metadataPlugin) HandleMessage(mailbox string, message *imap.Message) {
+	p.messages = append(p.messages, message)
+}
+
+func (p *metadataPlugin) HandleUidValidity(mailbox string, uidValidity uint32) {
+	p.uidValidities[mailbox] = uidValidity
+}
+
+func TestClientHandsMetadataToPlugins(t *testing.T) {
+	addr := startTestServer(t, nil, false)
+
+	appendClient, err := imapclient.Dial(addr)
+	assert.NoError(t, err)
+	assert.NoError(t, appendClient.Login("username", "password"))
+	date := time.Date(2023, time.March, 4, 5, 6, 7, 0, time.UTC)
+	body := "Subject: metadata\r\n\r\nbody\r\n"
+	assert.NoError(t, appendClient.Append("INBOX", []string{imap.SeenFlag, "$Label1"}, date, bytes.NewBufferString(body)))
+	appendClient.Logout()
+
+	fs, err := mem.NewFS()
+	assert.NoError(t, err)
+
+	plugin := &metadataPlugin{uidValidities: map[string]uint32{}}
+	client := NewClient(fs, Config{
+		ImapAddr:     addr,
+		ImapUsername: "username",
+		ImapPassword: "password",
+		StateDir:     "state",
+		Transport:    TransportConfig{Mode: TransportPlain},
+	}, []HandleMessagePlugin{plugin})
+	assert.NoError(t, client.Open())
+	defer client.Close()
+	assert.NoError(t, client.readState())
+
+	assert.NoError(t, client.runOnMailbox(context.Background(), "INBOX"))
+
+	assert.Equal(t, client.state.Mailboxes.Mailbox("INBOX").SavedUidValidity, plugin.uidValidities["INBOX"])
+	assert.NotZero(t, plugin.uidValidities["INBOX"])
+
+	assert.Equal(t, 2, len(plugin.messages))
+	message := plugin.messages[1]
+	assert.Equal(t, uint32(7), message.Uid)
+	assert.True(t, date.Equal(message.InternalDate))
+	assert.Equal(t, uint32(len(body)), message.Size)
+	assert.Contains(t, message.Flags, imap.SeenFlag)
+	assert.Contains(t, message.Flags, "$label1")
+}
+
+type mailboxesPlugin struct {
+	allPlugin
+	delimiters map[string]string
+}
+
+func (p *mailboxesPlugin) HandleMailboxes(mailboxes []*imap.MailboxInfo) {
+	for _, mailbox := range mailboxes {
+		p.delimiters[mailbox.Name] = mailbox.Delimiter
+	}
+}
+
+func TestClientHandsMailboxesToPlugins(t *testing.T) {
+	addr := startTestServer(t, nil, false)
+
+	fs, err := mem.NewFS()
+	assert.NoError(t, err)
+
+	plugin := &mailboxesPlugin{delimiters: map[string]string{}}
+	client := NewClient(fs, Config{
+		ImapAddr:     addr,
+		ImapUsername: "username",
+		ImapPassword: "password",
+		StateDir:     "state",
+		Transport:    TransportConfig{Mode: TransportPlain},
+	}, []HandleMessagePlugin{plugin})
+	assert.NoError(t, client.Open())
+	defer client.Close()
+
+	mailboxes, err := client.listMailboxNames(context.Background(), client.activeConnection)
+	assert.NoError(t, err)
+	assert.Contains(t, mailboxes, "INBOX")
+	assert.Contains(t, plugin.delimiters, "INBOX")
+}
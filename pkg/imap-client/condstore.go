@@ -0,0 +1,161 @@
+package imap_client
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+)
+
+// RFC 7162 extensions
+const (
+	CapCondstore = "CONDSTORE"
+	CapQresync   = "QRESYNC"
+)
+
+const StatusHighestModSeq imap.StatusItem = "HIGHESTMODSEQ"
+const FetchModSeq imap.FetchItem = "MODSEQ"
+
+var FetchChangesItems = []imap.FetchItem{
+	imap.FetchUid,
+	imap.FetchFlags,
+	FetchModSeq,
+}
+
+// uidFetchChangedSince is a UID FETCH command with the CHANGEDSINCE modifier
+// (RFC 7162 section 3.1.4) and optionally the VANISHED modifier (section 3.2.6)
+type uidFetchChangedSince struct {
+	SeqSet       *imap.SeqSet
+	Items        []imap.FetchItem
+	ChangedSince uint64
+	Vanished     bool
+}
+
+func (cmd *uidFetchChangedSince) Command() *imap.Command {
+	fetch := (&commands.Fetch{SeqSet: cmd.SeqSet, Items: cmd.Items}).Command()
+
+	modifiers := []interface{}{
+		imap.RawString("CHANGEDSINCE"),
+		imap.RawString(strconv.FormatUint(cmd.ChangedSince, 10)),
+	}
+	if cmd.Vanished {
+		modifiers = append(modifiers, imap.RawString("VANISHED"))
+	}
+	fetch.Arguments = append(fetch.Arguments, modifiers)
+
+	return (&commands.Uid{Cmd: fetch}).Command()
+}
+
+// vanishedResponse handles VANISHED responses (RFC 7162 section 3.2.10)
+type vanishedResponse struct {
+	Uids []uint32
+}
+
+func (r *vanishedResponse) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || name != "VANISHED" {
+		return responses.ErrUnhandled
+	}
+
+	// skip the optional (EARLIER) tag
+	if len(fields) > 0 {
+		if _, isList := fields[0].([]interface{}); isList {
+			fields = fields[1:]
+		}
+	}
+
+	if len(fields) < 1 {
+		return errors.New("VANISHED response without uid set")
+	}
+
+	uidSetString, ok := fields[0].(string)
+	if !ok {
+		return errors.New("VANISHED response uid set is not a string")
+	}
+
+	uidSet, err := imap.ParseSeqSet(uidSetString)
+	if err != nil {
+		return err
+	}
+
+	r.Uids = append(r.Uids, expandSeqSet(uidSet)...)
+	return nil
+}
+
+type multiHandler []responses.Handler
+
+func (h multiHandler) Handle(resp imap.Resp) error {
+	for _, handler := range h {
+		if err := handler.Handle(resp); err != responses.ErrUnhandled {
+			return err
+		}
+	}
+	return responses.ErrUnhandled
+}
+
+func expandSeqSet(seqSet *imap.SeqSet) []uint32 {
+	var result []uint32
+	for _, seq := range seqSet.Set {
+		// dynamic ranges are not expected in server responses
+		if seq.Start == 0 || seq.Stop == 0 {
+			continue
+		}
+
+		start, stop := seq.Start, seq.Stop
+		if start > stop {
+			start, stop = stop, start
+		}
+
+		for uid := start; uid <= stop && uid != 0; uid++ {
+			result = append(result, uid)
+		}
+	}
+	return result
+}
+
+func parseModSeq(f interface{}) (uint64, error) {
+	if list, ok := f.([]interface{}); ok {
+		if len(list) != 1 {
+			return 0, errors.New("invalid mod-sequence list")
+		}
+		f = list[0]
+	}
+
+	switch f := f.(type) {
+	case uint64:
+		return f, nil
+	case uint32:
+		return uint64(f), nil
+	case string:
+		return strconv.ParseUint(f, 10, 64)
+	case imap.RawString:
+		return strconv.ParseUint(string(f), 10, 64)
+	default:
+		return 0, errors.New("mod-sequence is not a number")
+	}
+}
+
+// statusHighestModSeq returns the HIGHESTMODSEQ of a STATUS response or 0 if
+// the server did not send it
+func statusHighestModSeq(status *imap.MailboxStatus) uint64 {
+	if status == nil {
+		return 0
+	}
+
+	status.ItemsLocker.Lock()
+	defer status.ItemsLocker.Unlock()
+	for k, v := range status.Items {
+		if strings.EqualFold(string(k), string(StatusHighestModSeq)) {
+			modSeq, err := parseModSeq(v)
+			if err != nil {
+				return 0
+			}
+			return modSeq
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,295 @@
+package imap_client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+	"github.com/hack-pad/hackpadfs/mem"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUidFetchChangedSinceCommand(t *testing.T) {
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(1, 42)
+
+	cmd := (&uidFetchChangedSince{
+		SeqSet:       seqset,
+		Items:        []imap.FetchItem{imap.FetchUid, imap.FetchFlags},
+		ChangedSince: 12345678901,
+		Vanished:     true,
+	}).Command()
+	cmd.Tag = "A1"
+
+	buf := new(bytes.Buffer)
+	w := imap.NewWriter(buf)
+	assert.NoError(t, cmd.WriteTo(w))
+	assert.NoError(t, w.Flush())
+
+	assert.Equal(t, "A1 UID FETCH 1:42 (UID FLAGS) (CHANGEDSINCE 12345678901 VANISHED)\r\n", buf.String())
+}
+
+func TestVanishedResponse(t *testing.T) {
+	res := &vanishedResponse{}
+
+	err := res.Handle(&imap.DataResp{Tag: "*", Fields: []interface{}{"VANISHED", []interface{}{"EARLIER"}, "3:5,9"}})
+	assert.NoError(t, err)
+	err = res.Handle(&imap.DataResp{Tag: "*", Fields: []interface{}{"VANISHED", "11"}})
+	assert.NoError(t, err)
+	err = res.Handle(&imap.DataResp{Tag: "*", Fields: []interface{}{"1", "EXISTS"}})
+	assert.Equal(t, responses.ErrUnhandled, err)
+
+	assert.Equal(t, []uint32{3, 4, 5, 9, 11}, res.Uids)
+}
+
+func TestStatusHighestModSeq(t *testing.T) {
+	status := &imap.MailboxStatus{}
+	assert.NoError(t, status.Parse([]interface{}{"UIDVALIDITY", "7", "HIGHESTMODSEQ", "90060115205545359"}))
+
+	assert.Equal(t, uint32(7), status.UidValidity)
+	assert.Equal(t, uint64(90060115205545359), statusHighestModSeq(status))
+	assert.Equal(t, uint64(0), statusHighestModSeq(&imap.MailboxStatus{}))
+}
+
+// condstoreServer is a scripted IMAP server with one mailbox INBOX for the
+// CONDSTORE and QRESYNC paths the in-memory test server does not support
+type condstoreServer struct {
+	capabilities  string
+	uids          []uint32
+	highestModSeq uint64
+	// changed are the flags of the messages changed since the requested
+	// mod-sequence by uid
+	changed  map[uint32]string
+	vanished string
+
+	mu       sync.Mutex
+	commands []string
+}
+
+func startCondstoreServer(t *testing.T, server *condstoreServer) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func (s *condstoreServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	reply := func(lines ...string) {
+		for _, line := range lines {
+			fmt.Fprintf(conn, "%s\r\n", line)
+		}
+	}
+
+	reply("* OK [CAPABILITY " + s.capabilities + "] ready")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		tag, command, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		s.record(command)
+
+		upper := strings.ToUpper(command)
+		switch {
+		case strings.HasPrefix(upper, "CAPABILITY"):
+			reply("* CAPABILITY "+s.capabilities, tag+" OK done")
+		case strings.HasPrefix(upper, "ENABLE"):
+			reply("* ENABLED"+strings.TrimPrefix(upper, "ENABLE"), tag+" OK done")
+		case strings.HasPrefix(upper, "STATUS"):
+			items := fmt.Sprintf("UIDVALIDITY 1 MESSAGES %d", len(s.uids))
+			if strings.Contains(upper, "HIGHESTMODSEQ") {
+				items += fmt.Sprintf(" HIGHESTMODSEQ %d", s.highestModSeq)
+			}
+			reply("* STATUS INBOX ("+items+")", tag+" OK done")
+		case strings.HasPrefix(upper, "EXAMINE"), strings.HasPrefix(upper, "SELECT"):
+			reply(fmt.Sprintf("* %d EXISTS", len(s.uids)), "* OK [UIDVALIDITY 1] uids valid", tag+" OK [READ-ONLY] done")
+		case strings.HasPrefix(upper, "UID SEARCH"):
+			var uids []string
+			for _, uid := range s.uids {
+				uids = append(uids, strconv.FormatUint(uint64(uid), 10))
+			}
+			reply("* SEARCH "+strings.Join(uids, " "), tag+" OK done")
+		case strings.HasPrefix(upper, "UID FETCH") && strings.Contains(upper, "CHANGEDSINCE"):
+			if strings.Contains(upper, "VANISHED") && s.vanished != "" {
+				reply("* VANISHED (EARLIER) " + s.vanished)
+			}
+			for seq, uid := range s.uids {
+				if flags, ok := s.changed[uid]; ok {
+					reply(fmt.Sprintf("* %d FETCH (UID %d FLAGS (%s) MODSEQ (%d))", seq+1, uid, flags, s.highestModSeq))
+				}
+			}
+			reply(tag + " OK done")
+		case strings.HasPrefix(upper, "LOGOUT"):
+			reply("* BYE logging out", tag+" OK done")
+			return
+		default:
+			reply(tag + " OK done")
+		}
+	}
+}
+
+func (s *condstoreServer) record(command string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands = append(s.commands, command)
+}
+
+// sent reports whether a command starting with prefix was received
+func (s *condstoreServer) sent(prefix string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, command := range s.commands {
+		if strings.HasPrefix(command, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type changesPlugin struct {
+	flags    map[uint32][]string
+	vanished []uint32
+	expunged []uint32
+}
+
+func (p *changesPlugin) HandleMessage(mailbox string, message *imap.Message) {}
+
+func (p *changesPlugin) HandleFlags(mailbox string, message *imap.Message) {
+	p.flags[message.Uid] = message.Flags
+}
+
+func (p *changesPlugin) HandleVanished(mailbox string, uids []uint32) {
+	p.vanished = append(p.vanished, uids...)
+}
+
+func (p *changesPlugin) HandleExpunge(mailbox string, uid uint32) {
+	p.expunged = append(p.expunged, uid)
+}
+
+// openCondstoreClient opens a client on server whose state already knows the
+// messages 1 to 3 of INBOX up to highestModSeq
+func openCondstoreClient(t *testing.T, server *condstoreServer, highestModSeq uint64) (*Client, *changesPlugin) {
+	fs, err := mem.NewFS()
+	assert.NoError(t, err)
+
+	plugin := &changesPlugin{flags: map[uint32][]string{}}
+	client := NewClient(fs, Config{
+		ImapAddr:     startCondstoreServer(t, server),
+		ImapUsername: "username",
+		ImapPassword: "password",
+		StateDir:     "state",
+		Transport:    TransportConfig{Mode: TransportPlain},
+	}, []HandleMessagePlugin{plugin})
+	assert.NoError(t, client.Open())
+	t.Cleanup(func() { client.Close() })
+	assert.NoError(t, client.readState())
+
+	state := client.state.Mailboxes.Mailbox("INBOX")
+	state.SavedUidValidity = 1
+	state.SavedLastUid = 3
+	state.HighestModSeq = highestModSeq
+	state.KnownUids = NewUidSet(1, 2, 3)
+
+	return client, plugin
+}
+
+func TestClientCondstoreSkipsUnchangedMailbox(t *testing.T) {
+	server := &condstoreServer{capabilities: "IMAP4rev1 ENABLE CONDSTORE", uids: []uint32{1, 2, 3}, highestModSeq: 10}
+	client, plugin := openCondstoreClient(t, server, 10)
+
+	assert.NoError(t, client.runOnMailbox(context.Background(), "INBOX"))
+
+	assert.True(t, server.sent("STATUS INBOX (UIDVALIDITY MESSAGES HIGHESTMODSEQ)"))
+	assert.False(t, server.sent("EXAMINE"))
+	assert.False(t, server.sent("UID"))
+	assert.Empty(t, plugin.flags)
+}
+
+func TestClientCondstoreFetchesChanges(t *testing.T) {
+	server := &condstoreServer{
+		capabilities:  "IMAP4rev1 ENABLE CONDSTORE",
+		uids:          []uint32{1, 2},
+		highestModSeq: 12,
+		changed:       map[uint32]string{2: `\Seen \Flagged`},
+	}
+	client, plugin := openCondstoreClient(t, server, 10)
+
+	assert.NoError(t, client.runOnMailbox(context.Background(), "INBOX"))
+
+	// without QRESYNC expunges are detected with a search
+	assert.True(t, server.sent("UID FETCH 1:3 (UID FLAGS MODSEQ) (CHANGEDSINCE 10)"))
+	assert.Equal(t, map[uint32][]string{2: {imap.SeenFlag, imap.FlaggedFlag}}, plugin.flags)
+	assert.Equal(t, []uint32{3}, plugin.expunged)
+
+	// the HIGHESTMODSEQ is the checkpoint of the next run
+	assert.NoError(t, client.readState())
+	state := client.state.Mailboxes.Mailbox("INBOX")
+	assert.Equal(t, uint64(12), state.HighestModSeq)
+	assert.Equal(t, 2, state.KnownUids.Count())
+	assert.False(t, state.KnownUids.Contains(3))
+
+	server.changed = nil
+	plugin.flags = map[uint32][]string{}
+	assert.NoError(t, client.runOnMailbox(context.Background(), "INBOX"))
+	assert.Empty(t, plugin.flags)
+	assert.Equal(t, []uint32{3}, plugin.expunged)
+}
+
+func TestClientQresyncReportsVanished(t *testing.T) {
+	server := &condstoreServer{
+		capabilities:  "IMAP4rev1 ENABLE CONDSTORE QRESYNC",
+		uids:          []uint32{1, 2},
+		highestModSeq: 12,
+		changed:       map[uint32]string{1: `\Answered`},
+		vanished:      "3,7",
+	}
+	client, plugin := openCondstoreClient(t, server, 10)
+
+	assert.NoError(t, client.runOnMailbox(context.Background(), "INBOX"))
+
+	assert.True(t, server.sent("UID FETCH 1:3 (UID FLAGS MODSEQ) (CHANGEDSINCE 10 VANISHED)"))
+	assert.False(t, server.sent("UID SEARCH CHARSET UTF-8 ALL"))
+	assert.Equal(t, map[uint32][]string{1: {imap.AnsweredFlag}}, plugin.flags)
+	assert.Equal(t, []uint32{3, 7}, plugin.vanished)
+
+	// uids that were never known are not reported as expunged
+	assert.Equal(t, []uint32{3}, plugin.expunged)
+	assert.Equal(t, uint64(12), client.state.Mailboxes.Mailbox("INBOX").HighestModSeq)
+}
+
+func TestClientWithoutCondstore(t *testing.T) {
+	server := &condstoreServer{capabilities: "IMAP4rev1", uids: []uint32{1, 2}, highestModSeq: 12}
+	client, plugin := openCondstoreClient(t, server, 0)
+
+	assert.NoError(t, client.runOnMailbox(context.Background(), "INBOX"))
+
+	assert.False(t, server.sent("ENABLE"))
+	assert.True(t, server.sent("STATUS INBOX (UIDVALIDITY MESSAGES)"))
+	assert.False(t, server.sent("UID FETCH"))
+	assert.True(t, server.sent("UID SEARCH CHARSET UTF-8 ALL"))
+	assert.Empty(t, plugin.flags)
+	assert.Equal(t, []uint32{3}, plugin.expunged)
+	assert.Equal(t, uint64(0), client.state.Mailboxes.Mailbox("INBOX").HighestModSeq)
+}
@@ -1,21 +1,46 @@
 package imap_client
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	log "github.com/sirupsen/logrus"
 )
 
 type ConnectionParams struct {
 	ImapAddr     string
 	ImapUsername string
 	ImapPassword string
+	Transport    TransportConfig
+	// TokenSource enables OAuth2 authentication instead of the password
+	TokenSource TokenSource
+	// OAuth2Mechanism is XOAUTH2 (default) or OAUTHBEARER
+	OAuth2Mechanism string
+	// Enable lists extensions to ENABLE after login if the server advertises them
+	Enable []string
+	Retry  RetryConfig
 }
 
 type Connection struct {
 	imapClient *client.Client
 	params     ConnectionParams
+	enabled    map[string]bool
+	selected   *selectedMailbox
+	updates    chan<- client.Update
+}
+
+// selectedMailbox is selected again after a reconnect
+type selectedMailbox struct {
+	name     string
+	readOnly bool
 }
 
 func NewConnection(params ConnectionParams) *Connection {
@@ -25,13 +50,95 @@ func NewConnection(params ConnectionParams) *Connection {
 }
 
 func (c *Connection) Open() error {
-	imapClient, err := client.DialTLS(c.params.ImapAddr, nil)
+	imapClient, err := c.params.Transport.dial(c.params.ImapAddr)
 	if err != nil {
 		return err
 	}
+	imapClient.Updates = c.updates
 	c.imapClient = imapClient
 
-	return c.imapClient.Login(c.params.ImapUsername, c.params.ImapPassword)
+	err = c.login()
+	if err != nil {
+		return err
+	}
+
+	return c.enableExtensions()
+}
+
+func (c *Connection) login() error {
+	if c.params.TokenSource == nil {
+		return c.imapClient.Login(c.params.ImapUsername, c.params.ImapPassword)
+	}
+
+	err := c.authenticateOAuth2()
+	if err != nil {
+		// the cached token may have been revoked before it expired
+		log.WithError(err).Warn("oauth2 authentication failed. retrying with a new token")
+		c.params.TokenSource.Invalidate()
+		err = c.authenticateOAuth2()
+	}
+
+	return err
+}
+
+func (c *Connection) authenticateOAuth2() error {
+	token, err := c.params.TokenSource.Token()
+	if err != nil {
+		return err
+	}
+
+	saslClient, err := newOAuth2SaslClient(c.params.OAuth2Mechanism, c.params.ImapAddr, c.params.ImapUsername, token)
+	if err != nil {
+		return err
+	}
+
+	return c.imapClient.Authenticate(saslClient)
+}
+
+func (c *Connection) enableExtensions() error {
+	c.enabled = map[string]bool{}
+
+	var supported []string
+	for _, ext := range c.params.Enable {
+		ok, err := c.imapClient.Support(ext)
+		if err != nil {
+			return err
+		}
+		if ok {
+			supported = append(supported, ext)
+		}
+	}
+
+	if len(supported) == 0 {
+		return nil
+	}
+
+	enabled, err := c.imapClient.Enable(supported)
+	if err == client.ErrExtensionUnsupported {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, ext := range enabled {
+		c.enabled[strings.ToUpper(ext)] = true
+	}
+
+	// QRESYNC implies CONDSTORE (RFC 7162 section 3.2.3)
+	if c.enabled[CapQresync] {
+		c.enabled[CapCondstore] = true
+	}
+
+	return nil
+}
+
+// Enabled reports whether the extension was enabled on the current session
+func (c *Connection) Enabled(ext string) bool {
+	return c.enabled[strings.ToUpper(ext)]
+}
+
+func (c *Connection) IsOpen() bool {
+	return c.imapClient != nil
 }
 
 func (c *Connection) Close() error {
@@ -41,6 +148,7 @@ func (c *Connection) Close() error {
 	}
 
 	c.imapClient = nil
+	c.selected = nil
 	client.Logout()
 	return client.Terminate()
 }
@@ -53,8 +161,8 @@ func (c *Connection) State() imap.ConnState {
 	return c.imapClient.State()
 }
 
-func (c *Connection) Status(name string, items []imap.StatusItem) (result *imap.MailboxStatus, err error) {
-	_, err = try2simplifyAutoRelogin(c, func(data chan any) error {
+func (c *Connection) Status(ctx context.Context, name string, items []imap.StatusItem) (result *imap.MailboxStatus, err error) {
+	_, err = try2simplifyAutoRelogin(ctx, c, func(data chan any) error {
 		defer close(data)
 		result, err = c.imapClient.Status(name, items)
 		return err
@@ -67,8 +175,8 @@ func (c *Connection) Mailbox() *imap.MailboxStatus {
 	return c.imapClient.Mailbox()
 }
 
-func (c *Connection) Select(name string, readOnly bool) (result *imap.MailboxStatus, err error) {
-	_, err = try2simplifyAutoRelogin(c, func(data chan any) error {
+func (c *Connection) Select(ctx context.Context, name string, readOnly bool) (result *imap.MailboxStatus, err error) {
+	_, err = try2simplifyAutoRelogin(ctx, c, func(data chan any) error {
 		defer close(data)
 		result, err = c.imapClient.Select(name, readOnly)
 		return err
@@ -81,78 +189,313 @@ func (c *Connection) Select(name string, readOnly bool) (result *imap.MailboxSta
 		return nil, errors.New("failed to select mailbox")
 	}
 
+	c.selected = &selectedMailbox{name: name, readOnly: readOnly}
 	return result, nil
 }
 
-func (c *Connection) Create(name string) error {
-	_, err := try2simplifyAutoRelogin(c, func(data chan any) error {
+func (c *Connection) Create(ctx context.Context, name string) error {
+	_, err := try2simplifyAutoRelogin(ctx, c, func(data chan any) error {
 		defer close(data)
 		return c.imapClient.Create(name)
 	})
 	return err
 }
 
-func (c *Connection) Delete(name string) error {
-	_, err := try2simplifyAutoRelogin(c, func(data chan any) error {
+// Append appends a message to the mailbox. It is not sent again after the
+// connection was lost while the message may have been sent, because the
+// server may have stored it already. Callers check for the message before
+// they append it again.
+func (c *Connection) Append(ctx context.Context, mailbox string, flags []string, date time.Time, body []byte) error {
+	_, err := retryCommand(ctx, c, false, func(data chan any) error {
+		defer close(data)
+		return c.imapClient.Append(mailbox, flags, date, bytes.NewBuffer(body))
+	})
+	return err
+}
+
+func (c *Connection) Delete(ctx context.Context, name string) error {
+	_, err := try2simplifyAutoRelogin(ctx, c, func(data chan any) error {
 		defer close(data)
 		return c.imapClient.Delete(name)
 	})
 	return err
 }
 
-func (c *Connection) Rename(oldName, newName string) error {
-	_, err := try2simplifyAutoRelogin(c, func(data chan any) error {
+func (c *Connection) Rename(ctx context.Context, oldName, newName string) error {
+	_, err := try2simplifyAutoRelogin(ctx, c, func(data chan any) error {
 		defer close(data)
 		return c.imapClient.Rename(oldName, newName)
 	})
 	return err
 }
 
-func (c *Connection) List(ref, name string) ([]*imap.MailboxInfo, error) {
-	return try2simplifyAutoRelogin(c, func(ch chan *imap.MailboxInfo) error {
+func (c *Connection) List(ctx context.Context, ref, name string) ([]*imap.MailboxInfo, error) {
+	return try2simplifyAutoRelogin(ctx, c, func(ch chan *imap.MailboxInfo) error {
 		return c.imapClient.List(ref, name, ch)
 	})
 }
 
-func (c *Connection) UidFetch(seqset *imap.SeqSet, items []imap.FetchItem) ([]*imap.Message, error) {
-	return try2simplifyAutoRelogin(c, func(ch chan *imap.Message) error {
+func (c *Connection) UidFetch(ctx context.Context, seqset *imap.SeqSet, items []imap.FetchItem) ([]*imap.Message, error) {
+	return try2simplifyAutoRelogin(ctx, c, func(ch chan *imap.Message) error {
 		return c.imapClient.UidFetch(seqset, items, ch)
 	})
 }
 
-func (c *Connection) UidMove(seqset *imap.SeqSet, dest string) error {
-	_, err := try2simplifyAutoRelogin(c, func(data chan any) error {
+func (c *Connection) UidSearch(ctx context.Context, criteria *imap.SearchCriteria) (uids []uint32, err error) {
+	_, err = try2simplifyAutoRelogin(ctx, c, func(data chan any) error {
+		defer close(data)
+		uids, err = c.imapClient.UidSearch(criteria)
+		return err
+	})
+	return uids, err
+}
+
+func (c *Connection) UidMove(ctx context.Context, seqset *imap.SeqSet, dest string) error {
+	_, err := try2simplifyAutoRelogin(ctx, c, func(data chan any) error {
 		defer close(data)
 		return c.imapClient.UidMove(seqset, dest)
 	})
 	return err
 }
 
-func (c *Connection) Fetch(seqset *imap.SeqSet, items []imap.FetchItem) ([]*imap.Message, error) {
-	return try2simplifyAutoRelogin(c, func(data chan *imap.Message) error {
+// UidFetchChangedSince fetches all messages of seqset whose mod-sequence is
+// higher than modSeq. If vanished is true the server also reports the uids of
+// expunged messages (requires QRESYNC).
+func (c *Connection) UidFetchChangedSince(ctx context.Context, seqset *imap.SeqSet, items []imap.FetchItem, modSeq uint64, vanished bool) (messages []*imap.Message, vanishedUids []uint32, err error) {
+	messages, err = try2simplifyAutoRelogin(ctx, c, func(ch chan *imap.Message) error {
+		defer close(ch)
+
+		vanishedRes := &vanishedResponse{}
+		status, err := c.imapClient.Execute(&uidFetchChangedSince{
+			SeqSet:       seqset,
+			Items:        items,
+			ChangedSince: modSeq,
+			Vanished:     vanished,
+		}, multiHandler{
+			&responses.Fetch{Messages: ch, SeqSet: seqset, Uid: true},
+			vanishedRes,
+		})
+		if err != nil {
+			return err
+		}
+
+		vanishedUids = vanishedRes.Uids
+		return statusErr(status)
+	})
+
+	return messages, vanishedUids, err
+}
+
+func (c *Connection) Fetch(ctx context.Context, seqset *imap.SeqSet, items []imap.FetchItem) ([]*imap.Message, error) {
+	return try2simplifyAutoRelogin(ctx, c, func(data chan *imap.Message) error {
 		return c.imapClient.Fetch(seqset, items, data)
 	})
 }
 
-func (c *Connection) Idle(stop <-chan struct{}, opts *client.IdleOptions) error {
-	_, err := try2simplifyAutoRelogin(c, func(data chan any) error {
+// Idle idles until stop is closed or ctx is done
+func (c *Connection) Idle(ctx context.Context, stop <-chan struct{}, opts *client.IdleOptions) error {
+	_, err := try2simplifyAutoRelogin(ctx, c, func(data chan any) error {
 		defer close(data)
-		return c.imapClient.Idle(stop, opts)
+
+		stopOrDone := make(chan struct{})
+		finished := make(chan struct{})
+		defer close(finished)
+		go func() {
+			defer close(stopOrDone)
+			select {
+			case <-stop:
+			case <-ctx.Done():
+			case <-finished:
+			}
+		}()
+
+		err := c.imapClient.Idle(stopOrDone, opts)
+		if err == nil {
+			err = ctx.Err()
+		}
+		return err
+	})
+	return err
+}
+
+// IdleNotify idles until ctx is done and calls onStatus with the mailbox of
+// every notification requested by Notify
+func (c *Connection) IdleNotify(ctx context.Context, onStatus func(mailbox string)) error {
+	const logoutTimeout = 25 * time.Minute
+
+	_, err := try2simplifyAutoRelogin(ctx, c, func(data chan any) error {
+		defer close(data)
+
+		for {
+			restart := time.NewTimer(logoutTimeout)
+			stopOrRestart := make(chan struct{})
+			done := make(chan error, 1)
+			go func() {
+				status, err := c.imapClient.Execute(&commands.Idle{}, &notifyIdleResponse{
+					Idle:     &responses.Idle{Stop: stopOrRestart, RepliesCh: make(chan []byte, 10)},
+					onStatus: onStatus,
+				})
+				if err == nil {
+					err = statusErr(status)
+				}
+				done <- err
+			}()
+
+			select {
+			case <-restart.C:
+				close(stopOrRestart)
+				if err := <-done; err != nil {
+					return err
+				}
+			case <-ctx.Done():
+				restart.Stop()
+				close(stopOrRestart)
+				if err := <-done; err != nil {
+					return err
+				}
+				return ctx.Err()
+			case err := <-done:
+				restart.Stop()
+				close(stopOrRestart)
+				if err != nil {
+					return err
+				}
+			}
+		}
 	})
 	return err
 }
 
-func try2simplifyAutoRelogin[T any](c *Connection, f func(chan T) error) ([]T, error) {
-	res, err := try2simplify(f)
-	if err == client.ErrNotLoggedIn {
+// Notify requests notifications about the mailboxes (RFC 5465)
+func (c *Connection) Notify(ctx context.Context, mailboxes []string) error {
+	_, err := try2simplifyAutoRelogin(ctx, c, func(data chan any) error {
+		defer close(data)
+		status, err := c.imapClient.Execute(&notifySet{Mailboxes: mailboxes}, nil)
+		if err != nil {
+			return err
+		}
+		return statusErr(status)
+	})
+	return err
+}
+
+// statusErr is like StatusResp.Err but keeps the response code
+func statusErr(status *imap.StatusResp) error {
+	if status != nil && (status.Type == imap.StatusRespNo || status.Type == imap.StatusRespBad) {
+		return &imap.ErrStatusResp{Resp: status}
+	}
+	return status.Err()
+}
+
+func (c *Connection) Support(capability string) (bool, error) {
+	return c.imapClient.Support(capability)
+}
+
+// try2simplifyAutoRelogin runs f and retries it according to the retry
+// policy. The connection is reopened before retrying if it broke.
+// ctx is checked before every attempt and cancels the wait between attempts.
+// A command that was already sent is not aborted because the server may
+// have executed it anyway.
+func try2simplifyAutoRelogin[T any](ctx context.Context, c *Connection, f func(chan T) error) ([]T, error) {
+	return retryCommand(ctx, c, true, f)
+}
+
+// retryCommand runs f until it succeeds or fails permanently. If resend is
+// false, f is not run again after the connection was lost unless the command
+// was refused before it was sent. The connection is opened again anyway.
+func retryCommand[T any](ctx context.Context, c *Connection, resend bool, f func(chan T) error) ([]T, error) {
+	policy := c.params.Retry.withDefaults()
+
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// a connection that was lost before is replaced before the command
+		// is sent, as the failure would not be retried
+		if !resend && c.loggedOut() {
+			if err := c.reconnect(); err != nil {
+				return nil, fmt.Errorf("failed to reconnect: %w", err)
+			}
+		}
+
+		res, err := try2simplify(f)
+		class := classifyError(err)
+		if class == errorPermanent || ctx.Err() != nil {
+			return res, err
+		}
+
+		// go-imap only refuses commands without a session before sending them
+		if class == errorReconnect && !resend && !errors.Is(err, client.ErrNotLoggedIn) {
+			if reconnectErr := c.reconnect(); reconnectErr != nil {
+				log.WithError(reconnectErr).Warn("failed to reconnect")
+			}
+			return res, fmt.Errorf("connection lost while the command may have been sent. not sending it again: %w", err)
+		}
+
+		if attempt >= policy.MaxAttempts {
+			retryMetrics.Add("exhausted", 1)
+			return res, fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+
+		backoff := policy.Backoff(attempt)
+		log.WithError(err).WithFields(log.Fields{
+			"attempt": attempt,
+			"backoff": backoff,
+			"class":   class,
+		}).Warn("imap command failed. retrying")
+		retryMetrics.Add("retries", 1)
+		retryMetrics.Add(class.String(), 1)
+		if err := sleepContext(ctx, backoff); err != nil {
+			return res, err
+		}
+
+		if class == errorReconnect {
+			err = c.reconnect()
+			if err != nil {
+				log.WithError(err).Warn("failed to reconnect")
+			}
+		}
+	}
+}
+
+// loggedOut reports whether the connection was closed
+func (c *Connection) loggedOut() bool {
+	if c.imapClient == nil {
+		return false
+	}
+
+	select {
+	case <-c.imapClient.LoggedOut():
+		return true
+	default:
+		return false
+	}
+}
+
+// reconnect opens a new session and selects the previously selected mailbox
+func (c *Connection) reconnect() error {
+	retryMetrics.Add("reconnects", 1)
+
+	selected := c.selected
+	if c.imapClient != nil {
 		c.imapClient.Terminate()
-		err = c.Open()
-		if err == nil {
-			return try2simplifyAutoRelogin(c, f)
+	}
+
+	err := c.Open()
+	if err != nil {
+		return err
+	}
+
+	if selected != nil {
+		_, err = c.imapClient.Select(selected.name, selected.readOnly)
+		if err != nil {
+			return err
 		}
+		c.selected = selected
 	}
 
-	return res, err
+	return nil
 }
 
 func try2simplify[T any](f func(chan T) error) ([]T, error) {
@@ -175,5 +518,6 @@ func (c Connection) GetUpdates() chan<- client.Update {
 }
 
 func (c *Connection) SetUpdates(ch chan<- client.Update) {
+	c.updates = ch
 	c.imapClient.Updates = ch
 }
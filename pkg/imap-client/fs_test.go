@@ -0,0 +1,28 @@
+package imap_client_test
+
+import (
+	"strings"
+	"testing"
+
+	imapclient "github.com/Schidstorm/imap-mirror/pkg/imap-client"
+	"github.com/Schidstorm/imap-mirror/pkg/imap-client/fstest"
+	"github.com/hack-pad/hackpadfs/mem"
+	osfs "github.com/hack-pad/hackpadfs/os"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemFSContract(t *testing.T) {
+	fstest.Run(t, func(t *testing.T) (imapclient.FS, string) {
+		fs, err := mem.NewFS()
+		require.NoError(t, err)
+		return fs, ""
+	})
+}
+
+func TestLocalFSContract(t *testing.T) {
+	fstest.Run(t, func(t *testing.T) (imapclient.FS, string) {
+		fs, err := osfs.NewFS().Sub(strings.TrimPrefix(t.TempDir(), "/"))
+		require.NoError(t, err)
+		return fs.(imapclient.FS), ""
+	})
+}
@@ -0,0 +1,163 @@
+// Package fstest checks that a file system keeps the contract of
+// imap_client.FS the way the client and the backup rely on it.
+package fstest
+
+import (
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	imapclient "github.com/Schidstorm/imap-mirror/pkg/imap-client"
+	"github.com/hack-pad/hackpadfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// NewFS returns the file system under test and an empty directory on it for
+// the files of one test
+type NewFS func(t *testing.T) (fs imapclient.FS, dir string)
+
+// Run runs the contract tests against the file systems of newFS
+func Run(t *testing.T, newFS NewFS) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, fs imapclient.FS, dir string)
+	}{
+		{"WriteAndRead", testWriteAndRead},
+		{"TruncateShortens", testTruncateShortens},
+		{"MkdirAllExisting", testMkdirAllExisting},
+		{"StatMissing", testStatMissing},
+		{"RenameMoves", testRenameMoves},
+		{"RenameReplaces", testRenameReplaces},
+		{"RenameMissing", testRenameMissing},
+		{"StateFileRotation", testStateFileRotation},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fs, dir := newFS(t)
+			test.test(t, fs, dir)
+		})
+	}
+}
+
+// writeFile writes content like the state writer of the client does
+func writeFile(t *testing.T, fs imapclient.FS, name string, content string) {
+	file, err := fs.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+
+	truncater, ok := file.(hackpadfs.TruncaterFile)
+	require.True(t, ok, "files must implement hackpadfs.TruncaterFile")
+	require.NoError(t, truncater.Truncate(0))
+
+	writer, ok := file.(io.Writer)
+	require.True(t, ok, "files must implement io.Writer")
+	_, err = writer.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+}
+
+func readFile(t *testing.T, fs imapclient.FS, name string) string {
+	content, err := hackpadfs.ReadFile(fs, name)
+	require.NoError(t, err)
+	return string(content)
+}
+
+func assertMissing(t *testing.T, fs imapclient.FS, name string) {
+	_, err := fs.Stat(name)
+	assert.ErrorIs(t, err, hackpadfs.ErrNotExist, name)
+}
+
+func testWriteAndRead(t *testing.T, fs imapclient.FS, dir string) {
+	name := path.Join(dir, "file.txt")
+	writeFile(t, fs, name, "content")
+	assert.Equal(t, "content", readFile(t, fs, name))
+
+	info, err := fs.Stat(name)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len("content")), info.Size())
+	assert.False(t, info.IsDir())
+}
+
+func testTruncateShortens(t *testing.T, fs imapclient.FS, dir string) {
+	name := path.Join(dir, "file.txt")
+	writeFile(t, fs, name, "a longer content")
+	writeFile(t, fs, name, "short")
+	assert.Equal(t, "short", readFile(t, fs, name))
+}
+
+func testMkdirAllExisting(t *testing.T, fs imapclient.FS, dir string) {
+	name := path.Join(dir, "a", "b")
+	require.NoError(t, fs.MkdirAll(name, os.ModePerm))
+	require.NoError(t, fs.MkdirAll(name, os.ModePerm))
+
+	info, err := fs.Stat(name)
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+}
+
+func testStatMissing(t *testing.T, fs imapclient.FS, dir string) {
+	assertMissing(t, fs, path.Join(dir, "missing.txt"))
+
+	_, err := fs.Open(path.Join(dir, "missing.txt"))
+	assert.ErrorIs(t, err, hackpadfs.ErrNotExist)
+}
+
+func testRenameMoves(t *testing.T, fs imapclient.FS, dir string) {
+	oldName, newName := path.Join(dir, "old.txt"), path.Join(dir, "new.txt")
+	writeFile(t, fs, oldName, "content")
+
+	require.NoError(t, fs.Rename(oldName, newName))
+	assert.Equal(t, "content", readFile(t, fs, newName))
+	assertMissing(t, fs, oldName)
+}
+
+func testRenameReplaces(t *testing.T, fs imapclient.FS, dir string) {
+	oldName, newName := path.Join(dir, "old.txt"), path.Join(dir, "new.txt")
+	writeFile(t, fs, oldName, "new content")
+	writeFile(t, fs, newName, "replaced content")
+
+	require.NoError(t, fs.Rename(oldName, newName))
+	assert.Equal(t, "new content", readFile(t, fs, newName))
+	assertMissing(t, fs, oldName)
+	assert.Equal(t, []string{"new.txt"}, dirNames(t, fs, dir))
+}
+
+func testRenameMissing(t *testing.T, fs imapclient.FS, dir string) {
+	err := fs.Rename(path.Join(dir, "missing.txt"), path.Join(dir, "new.txt"))
+	assert.ErrorIs(t, err, hackpadfs.ErrNotExist)
+	assertMissing(t, fs, path.Join(dir, "new.txt"))
+}
+
+// testStateFileRotation writes the state like Client.updateStateFile
+func testStateFileRotation(t *testing.T, fs imapclient.FS, dir string) {
+	stateFile := path.Join(dir, ".state.json")
+	backupFile, tmpFile := stateFile+".backup", stateFile+".tmp"
+
+	for _, state := range []string{"first", "second", "third"} {
+		writeFile(t, fs, tmpFile, state)
+		if _, err := fs.Stat(stateFile); err == nil {
+			require.NoError(t, fs.Rename(stateFile, backupFile))
+		}
+		require.NoError(t, fs.Rename(tmpFile, stateFile))
+	}
+
+	assert.Equal(t, "third", readFile(t, fs, stateFile))
+	assert.Equal(t, "second", readFile(t, fs, backupFile))
+	assert.Equal(t, []string{".state.json", ".state.json.backup"}, dirNames(t, fs, dir))
+}
+
+func dirNames(t *testing.T, fs imapclient.FS, dir string) []string {
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := hackpadfs.ReadDir(fs, dir)
+	require.NoError(t, err)
+
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
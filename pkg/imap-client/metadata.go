@@ -0,0 +1,41 @@
+package imap_client
+
+import (
+	"slices"
+
+	"github.com/emersion/go-imap"
+)
+
+// Gmail IMAP extensions
+const CapGmailExt = "X-GM-EXT-1"
+
+const FetchGmailLabels imap.FetchItem = "X-GM-LABELS"
+
+// HandleUidValidityPlugin is told the UIDVALIDITY of a mailbox before its
+// messages, flag changes or expunges are handled
+type HandleUidValidityPlugin interface {
+	HandleUidValidity(mailbox string, uidValidity uint32)
+}
+
+// WithLabels returns items and the labels of the messages if the server
+// supports them
+func (c *Connection) WithLabels(items []imap.FetchItem) []imap.FetchItem {
+	if !c.IsOpen() {
+		return items
+	}
+
+	supported, err := c.Support(CapGmailExt)
+	if err != nil || !supported {
+		return items
+	}
+
+	return append(slices.Clip(items), FetchGmailLabels)
+}
+
+func (c *Client) handleUidValidity(mailbox string, uidValidity uint32) {
+	for _, plugin := range c.handlersOf(mailbox) {
+		if uidValidityPlugin, ok := plugin.(HandleUidValidityPlugin); ok {
+			uidValidityPlugin.HandleUidValidity(mailbox, uidValidity)
+		}
+	}
+}
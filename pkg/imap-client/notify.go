@@ -0,0 +1,59 @@
+package imap_client
+
+import (
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// RFC 5465 extension
+const CapNotify = "NOTIFY"
+
+// notifySet is a NOTIFY SET command (RFC 5465 section 3.1) which subscribes
+// to new, expunged and changed messages of the given mailboxes
+type notifySet struct {
+	Mailboxes []string
+}
+
+func (cmd *notifySet) Command() *imap.Command {
+	mailboxes := make([]interface{}, len(cmd.Mailboxes))
+	for i, mailbox := range cmd.Mailboxes {
+		encoded, _ := utf7.Encoding.NewEncoder().String(mailbox)
+		mailboxes[i] = imap.FormatMailboxName(encoded)
+	}
+
+	events := []interface{}{
+		imap.RawString("MessageNew"),
+		imap.RawString("MessageExpunge"),
+		imap.RawString("FlagChange"),
+	}
+
+	return &imap.Command{
+		Name: "NOTIFY",
+		Arguments: []interface{}{
+			imap.RawString("SET"),
+			[]interface{}{imap.RawString("mailboxes"), mailboxes, events},
+		},
+	}
+}
+
+// notifyIdleResponse handles an IDLE command and reports the mailbox of every
+// STATUS notification sent in the meantime
+type notifyIdleResponse struct {
+	*responses.Idle
+	onStatus func(mailbox string)
+}
+
+func (r *notifyIdleResponse) Handle(resp imap.Resp) error {
+	if err := r.Idle.Handle(resp); err != responses.ErrUnhandled {
+		return err
+	}
+
+	status := &responses.Status{}
+	if err := status.Handle(resp); err != nil {
+		return err
+	}
+
+	r.onStatus(status.Mailbox.Name)
+	return nil
+}
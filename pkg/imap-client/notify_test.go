@@ -0,0 +1,39 @@
+package imap_client
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotifySetCommand(t *testing.T) {
+	cmd := (&notifySet{Mailboxes: []string{"INBOX", "Rechnungen", "Entwürfe"}}).Command()
+	cmd.Tag = "A1"
+
+	buf := new(bytes.Buffer)
+	w := imap.NewWriter(buf)
+	assert.NoError(t, cmd.WriteTo(w))
+	assert.NoError(t, w.Flush())
+
+	assert.Equal(t, "A1 NOTIFY SET (mailboxes (INBOX \"Rechnungen\" \"Entw&APw-rfe\") (MessageNew MessageExpunge FlagChange))\r\n", buf.String())
+}
+
+func TestNotifyIdleResponse(t *testing.T) {
+	var mailboxes []string
+	res := &notifyIdleResponse{
+		Idle: &responses.Idle{},
+		onStatus: func(mailbox string) {
+			mailboxes = append(mailboxes, mailbox)
+		},
+	}
+
+	err := res.Handle(&imap.DataResp{Tag: "*", Fields: []interface{}{"STATUS", "Entw&APw-rfe", []interface{}{"MESSAGES", "3"}}})
+	assert.NoError(t, err)
+	err = res.Handle(&imap.DataResp{Tag: "*", Fields: []interface{}{"1", "EXISTS"}})
+	assert.Equal(t, responses.ErrUnhandled, err)
+
+	assert.Equal(t, []string{"Entwürfe"}, mailboxes)
+}
@@ -0,0 +1,285 @@
+package imap_client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/hack-pad/hackpadfs"
+	log "github.com/sirupsen/logrus"
+)
+
+// SASL mechanisms for OAuth2
+const (
+	MechanismXOAuth2     = "XOAUTH2"
+	MechanismOAuthBearer = "OAUTHBEARER"
+)
+
+const defaultTokenCacheFile = ".oauth2_token.json"
+const tokenExpiryMargin = 1 * time.Minute
+const tokenRequestTimeout = 30 * time.Second
+
+type OAuth2Config struct {
+	// Mechanism is XOAUTH2 (default) or OAUTHBEARER
+	Mechanism    string   `json:"mechanism" yaml:"mechanism"`
+	TokenURL     string   `json:"tokenUrl" yaml:"tokenUrl"`
+	ClientID     string   `json:"clientId" yaml:"clientId"`
+	ClientSecret string   `json:"clientSecret" yaml:"clientSecret"`
+	RefreshToken string   `json:"refreshToken" yaml:"refreshToken"`
+	Scopes       []string `json:"scopes" yaml:"scopes"`
+	// TokenCacheFile is relative to the state directory
+	TokenCacheFile string `json:"tokenCacheFile" yaml:"tokenCacheFile"`
+}
+
+// TokenSource provides OAuth2 access tokens
+type TokenSource interface {
+	Token() (string, error)
+	// Invalidate drops the current access token, e.g. after it was rejected
+	Invalidate()
+}
+
+type oauth2Token struct {
+	AccessToken  string    `json:"accessToken"`
+	RefreshToken string    `json:"refreshToken,omitempty"`
+	Expiry       time.Time `json:"expiry"`
+}
+
+func (t *oauth2Token) valid() bool {
+	return t != nil && t.AccessToken != "" && time.Now().Add(tokenExpiryMargin).Before(t.Expiry)
+}
+
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// OAuth2TokenSource refreshes access tokens with the refresh token flow and
+// caches them in a file. The cache holds the refresh token, it belongs on a
+// local or encrypted file system.
+type OAuth2TokenSource struct {
+	config     OAuth2Config
+	fs         FS
+	cachePath  string
+	httpClient *http.Client
+
+	mutex sync.Mutex
+	token *oauth2Token
+}
+
+func NewOAuth2TokenSource(fs FS, stateDir string, cfg OAuth2Config) *OAuth2TokenSource {
+	cacheFile := cfg.TokenCacheFile
+	if cacheFile == "" {
+		cacheFile = defaultTokenCacheFile
+	}
+
+	return &OAuth2TokenSource{
+		config:     cfg,
+		fs:         fs,
+		cachePath:  path.Join(stateDir, cacheFile),
+		httpClient: &http.Client{Timeout: tokenRequestTimeout},
+	}
+}
+
+func (s *OAuth2TokenSource) Token() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.token == nil {
+		token, err := s.readCache()
+		if err != nil {
+			log.WithError(err).Warn("failed to read oauth2 token cache")
+		}
+		s.token = token
+	}
+
+	if s.token.valid() {
+		return s.token.AccessToken, nil
+	}
+
+	token, err := s.refresh()
+	if err != nil {
+		return "", err
+	}
+	s.token = token
+
+	err = s.writeCache(token)
+	if err != nil {
+		log.WithError(err).Warn("failed to write oauth2 token cache")
+	}
+
+	return token.AccessToken, nil
+}
+
+func (s *OAuth2TokenSource) Invalidate() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.token != nil {
+		s.token.AccessToken = ""
+		s.token.Expiry = time.Time{}
+	}
+}
+
+func (s *OAuth2TokenSource) refreshToken() string {
+	// the token endpoint may have rotated the refresh token
+	if s.token != nil && s.token.RefreshToken != "" {
+		return s.token.RefreshToken
+	}
+	return s.config.RefreshToken
+}
+
+func (s *OAuth2TokenSource) refresh() (*oauth2Token, error) {
+	refreshToken := s.refreshToken()
+	if refreshToken == "" {
+		return nil, errors.New("no oauth2 refresh token configured")
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {s.config.ClientID},
+	}
+	if s.config.ClientSecret != "" {
+		form.Set("client_secret", s.config.ClientSecret)
+	}
+	if len(s.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.config.Scopes, " "))
+	}
+
+	log.WithField("tokenUrl", s.config.TokenURL).Info("refreshing oauth2 access token")
+	resp, err := s.httpClient.PostForm(s.config.TokenURL, form)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request oauth2 token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read oauth2 token response: %w", err)
+	}
+
+	tokenResp := tokenResponse{}
+	err = json.Unmarshal(body, &tokenResp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse oauth2 token response (status %d): %w", resp.StatusCode, err)
+	}
+
+	if resp.StatusCode != http.StatusOK || tokenResp.Error != "" {
+		return nil, fmt.Errorf("oauth2 token request failed (status %d): %s %s", resp.StatusCode, tokenResp.Error, tokenResp.ErrorDescription)
+	}
+
+	if tokenResp.AccessToken == "" {
+		return nil, errors.New("oauth2 token response contains no access token")
+	}
+
+	if tokenResp.RefreshToken == "" {
+		tokenResp.RefreshToken = refreshToken
+	}
+
+	return &oauth2Token{
+		AccessToken:  tokenResp.AccessToken,
+		RefreshToken: tokenResp.RefreshToken,
+		Expiry:       time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second),
+	}, nil
+}
+
+func (s *OAuth2TokenSource) readCache() (*oauth2Token, error) {
+	data, err := hackpadfs.ReadFile(s.fs, s.cachePath)
+	if errors.Is(err, hackpadfs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	token := &oauth2Token{}
+	return token, json.Unmarshal(data, token)
+}
+
+func (s *OAuth2TokenSource) writeCache(token *oauth2Token) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	err = s.fs.MkdirAll(path.Dir(s.cachePath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	// the cache is replaced by a rename so that it is never half written
+	tmpPath := s.cachePath + ".tmp"
+	cacheFile, err := s.fs.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	writer, ok := cacheFile.(io.Writer)
+	if !ok {
+		cacheFile.Close()
+		return fmt.Errorf("failed to write token cache. cacheFile is not an io.Writer")
+	}
+
+	_, err = writer.Write(data)
+	if closeErr := cacheFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return s.fs.Rename(tmpPath, s.cachePath)
+}
+
+// xoauth2Client implements the SASL XOAUTH2 mechanism used by Gmail and
+// Microsoft 365
+type xoauth2Client struct {
+	username string
+	token    string
+}
+
+func (a *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	ir = []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01")
+	return MechanismXOAuth2, ir, nil
+}
+
+func (a *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	// the server sends an error description as challenge. an empty response
+	// makes it fail the authentication with a tagged NO.
+	return []byte{}, nil
+}
+
+func newOAuth2SaslClient(mechanism string, addr string, username string, token string) (sasl.Client, error) {
+	switch strings.ToUpper(mechanism) {
+	case "", MechanismXOAuth2:
+		return &xoauth2Client{username: username, token: token}, nil
+	case MechanismOAuthBearer:
+		host, portString, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		port, _ := strconv.Atoi(portString)
+
+		return sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+			Username: username,
+			Token:    token,
+			Host:     host,
+			Port:     port,
+		}), nil
+	default:
+		return nil, fmt.Errorf("unsupported oauth2 mechanism %s", mechanism)
+	}
+}
@@ -0,0 +1,119 @@
+package imap_client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hack-pad/hackpadfs"
+	"github.com/hack-pad/hackpadfs/mem"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeTokenEndpoint struct {
+	requests      int
+	refreshTokens []string
+}
+
+func (e *fakeTokenEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.requests++
+	_ = r.ParseForm()
+	e.refreshTokens = append(e.refreshTokens, r.PostForm.Get("refresh_token"))
+
+	if r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("client_id") != "client" {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"access_token":  "access" + r.PostForm.Get("refresh_token"),
+		"token_type":    "Bearer",
+		"expires_in":    3600,
+		"refresh_token": "rotated",
+	})
+}
+
+func TestOAuth2TokenSource(t *testing.T) {
+	endpoint := &fakeTokenEndpoint{}
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+
+	fs, err := mem.NewFS()
+	assert.NoError(t, err)
+
+	cfg := OAuth2Config{
+		TokenURL:     server.URL,
+		ClientID:     "client",
+		RefreshToken: "initial",
+	}
+
+	source := NewOAuth2TokenSource(fs, "state", cfg)
+	token, err := source.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "accessinitial", token)
+
+	// cached in memory
+	token, err = source.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "accessinitial", token)
+	assert.Equal(t, 1, endpoint.requests)
+
+	// cached in the state filesystem
+	_, err = hackpadfs.Stat(fs, "state/.oauth2_token.json")
+	assert.NoError(t, err)
+	token, err = NewOAuth2TokenSource(fs, "state", cfg).Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "accessinitial", token)
+	assert.Equal(t, 1, endpoint.requests)
+
+	// a rejected token is refreshed with the rotated refresh token
+	source.Invalidate()
+	token, err = source.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "accessrotated", token)
+	assert.Equal(t, []string{"initial", "rotated"}, endpoint.refreshTokens)
+
+	// the cache was replaced as a whole
+	data, err := hackpadfs.ReadFile(fs, "state/.oauth2_token.json")
+	assert.NoError(t, err)
+	cached := oauth2Token{}
+	assert.NoError(t, json.Unmarshal(data, &cached))
+	assert.Equal(t, "accessrotated", cached.AccessToken)
+	_, err = hackpadfs.Stat(fs, "state/.oauth2_token.json.tmp")
+	assert.ErrorIs(t, err, hackpadfs.ErrNotExist)
+}
+
+func TestOAuth2TokenSourceError(t *testing.T) {
+	server := httptest.NewServer(&fakeTokenEndpoint{})
+	defer server.Close()
+
+	fs, err := mem.NewFS()
+	assert.NoError(t, err)
+
+	_, err = NewOAuth2TokenSource(fs, "state", OAuth2Config{
+		TokenURL:     server.URL,
+		ClientID:     "unknown",
+		RefreshToken: "initial",
+	}).Token()
+	assert.ErrorContains(t, err, "invalid_request")
+}
+
+func TestXOAuth2Client(t *testing.T) {
+	saslClient, err := newOAuth2SaslClient("", "imap.gmail.com:993", "user@example.com", "token")
+	assert.NoError(t, err)
+
+	mech, ir, err := saslClient.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, MechanismXOAuth2, mech)
+	assert.Equal(t, "user=user@example.com\x01auth=Bearer token\x01\x01", string(ir))
+
+	saslClient, err = newOAuth2SaslClient("oauthbearer", "outlook.office365.com:993", "user@example.com", "token")
+	assert.NoError(t, err)
+	mech, ir, err = saslClient.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, MechanismOAuthBearer, mech)
+	assert.Contains(t, string(ir), "auth=Bearer token")
+	assert.Contains(t, string(ir), "port=993")
+}
@@ -0,0 +1,142 @@
+package imap_client
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+const (
+	defaultRetryMaxAttempts    = 5
+	defaultRetryInitialBackoff = 1 * time.Second
+	defaultRetryMaxBackoff     = 5 * time.Minute
+)
+
+// retryMetrics counts retries, reconnects and exhausted retry budgets. They
+// are published with expvar as "imapRetries".
+var retryMetrics = expvar.NewMap("imapRetries")
+
+type RetryConfig struct {
+	// MaxAttempts is the number of tries of a command including the first
+	// one. Defaults to 5.
+	MaxAttempts int `json:"maxAttempts" yaml:"maxAttempts"`
+	// InitialBackoff is the wait time before the first retry. Defaults to 1s.
+	InitialBackoff time.Duration `json:"initialBackoff" yaml:"initialBackoff"`
+	// MaxBackoff caps the exponential backoff. Defaults to 5m.
+	MaxBackoff time.Duration `json:"maxBackoff" yaml:"maxBackoff"`
+}
+
+func (r RetryConfig) withDefaults() RetryConfig {
+	if r.MaxAttempts <= 0 {
+		r.MaxAttempts = defaultRetryMaxAttempts
+	}
+	if r.InitialBackoff <= 0 {
+		r.InitialBackoff = defaultRetryInitialBackoff
+	}
+	if r.MaxBackoff <= 0 {
+		r.MaxBackoff = defaultRetryMaxBackoff
+	}
+	return r
+}
+
+// Backoff returns the jittered wait time before retry number attempt
+// (starting at 1). The wait time doubles with every attempt and is randomized
+// to the range [backoff/2, backoff].
+func (r RetryConfig) Backoff(attempt int) time.Duration {
+	r = r.withDefaults()
+
+	backoff := r.InitialBackoff
+	for i := 1; i < attempt && backoff < r.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > r.MaxBackoff {
+		backoff = r.MaxBackoff
+	}
+
+	half := backoff / 2
+	return half + rand.N(half+1)
+}
+
+type errorClass int
+
+const (
+	// errorPermanent errors are returned immediately
+	errorPermanent errorClass = iota
+	// errorRetryable errors are retried on the same connection
+	errorRetryable
+	// errorReconnect errors are retried on a new connection
+	errorReconnect
+)
+
+func (c errorClass) String() string {
+	switch c {
+	case errorRetryable:
+		return "retryable"
+	case errorReconnect:
+		return "reconnect"
+	default:
+		return "permanent"
+	}
+}
+
+// retryableResponseCodes are RFC 5530 response codes of temporary failures
+var retryableResponseCodes = []imap.StatusRespCode{"UNAVAILABLE", "INUSE", "LIMIT"}
+
+func classifyError(err error) errorClass {
+	if err == nil {
+		return errorPermanent
+	}
+
+	if errors.Is(err, client.ErrNotLoggedIn) || errors.Is(err, client.ErrAlreadyLoggedOut) {
+		return errorReconnect
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) {
+		return errorReconnect
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return errorReconnect
+	}
+
+	// go-imap does not export these errors
+	message := err.Error()
+	if strings.Contains(message, "connection closed") || strings.Contains(message, "disconnected while idling") {
+		return errorReconnect
+	}
+
+	var statusErr *imap.ErrStatusResp
+	if errors.As(err, &statusErr) && statusErr.Resp != nil {
+		for _, code := range retryableResponseCodes {
+			if statusErr.Resp.Code == code {
+				return errorRetryable
+			}
+		}
+	}
+
+	return errorPermanent
+}
+
+// sleepContext waits for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
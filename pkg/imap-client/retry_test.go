@@ -0,0 +1,149 @@
+package imap_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyError(t *testing.T) {
+	assert.Equal(t, errorPermanent, classifyError(nil))
+	assert.Equal(t, errorPermanent, classifyError(errors.New("Mailbox doesn't exist")))
+	assert.Equal(t, errorReconnect, classifyError(client.ErrNotLoggedIn))
+	assert.Equal(t, errorReconnect, classifyError(fmt.Errorf("read: %w", io.EOF)))
+	assert.Equal(t, errorReconnect, classifyError(fmt.Errorf("write: %w", syscall.ECONNRESET)))
+	assert.Equal(t, errorReconnect, classifyError(errors.New("imap: connection closed")))
+	assert.Equal(t, errorRetryable, classifyError(&imap.ErrStatusResp{Resp: &imap.StatusResp{Type: imap.StatusRespNo, Code: "UNAVAILABLE"}}))
+	assert.Equal(t, errorPermanent, classifyError(&imap.ErrStatusResp{Resp: &imap.StatusResp{Type: imap.StatusRespNo, Code: "NONEXISTENT"}}))
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := RetryConfig{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second}
+
+	for i := 0; i < 100; i++ {
+		backoff := policy.Backoff(1)
+		assert.GreaterOrEqual(t, backoff, 500*time.Millisecond)
+		assert.LessOrEqual(t, backoff, time.Second)
+
+		backoff = policy.Backoff(3)
+		assert.GreaterOrEqual(t, backoff, 2*time.Second)
+		assert.LessOrEqual(t, backoff, 4*time.Second)
+
+		backoff = policy.Backoff(30)
+		assert.GreaterOrEqual(t, backoff, 5*time.Second)
+		assert.LessOrEqual(t, backoff, 10*time.Second)
+	}
+}
+
+func TestRetryReconnectsAndSelectsMailbox(t *testing.T) {
+	addr := startTestServer(t, nil, false)
+
+	conn := NewConnection(ConnectionParams{
+		ImapAddr:     addr,
+		ImapUsername: "username",
+		ImapPassword: "password",
+		Transport:    TransportConfig{Mode: TransportPlain},
+		Retry:        RetryConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+	})
+	assert.NoError(t, conn.Open())
+	defer conn.Close()
+
+	_, err := conn.Select(context.Background(), "INBOX", true)
+	assert.NoError(t, err)
+
+	// simulate a broken connection
+	assert.NoError(t, conn.imapClient.Terminate())
+	<-conn.imapClient.LoggedOut()
+
+	reconnects := retryMetrics.Get("reconnects")
+	uids, err := conn.UidSearch(context.Background(), &imap.SearchCriteria{})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{6}, uids)
+	assert.NotEqual(t, reconnects, retryMetrics.Get("reconnects"))
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	addr := startTestServer(t, nil, false)
+
+	conn := NewConnection(ConnectionParams{
+		ImapAddr:     addr,
+		ImapUsername: "username",
+		ImapPassword: "password",
+		Transport:    TransportConfig{Mode: TransportPlain},
+		Retry:        RetryConfig{MaxAttempts: 2, InitialBackoff: time.Millisecond},
+	})
+	assert.NoError(t, conn.Open())
+	defer conn.Close()
+
+	calls := 0
+	_, err := try2simplifyAutoRelogin(context.Background(), conn, func(data chan any) error {
+		defer close(data)
+		calls++
+		return io.EOF
+	})
+	assert.ErrorIs(t, err, io.EOF)
+	assert.ErrorContains(t, err, "giving up after 2 attempts")
+	assert.Equal(t, 2, calls)
+}
+
+func TestRetryStopsOnCancel(t *testing.T) {
+	conn := NewConnection(ConnectionParams{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	calls := 0
+	_, err := try2simplifyAutoRelogin(ctx, conn, func(data chan any) error {
+		defer close(data)
+		calls++
+		return nil
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 0, calls)
+}
+
+func TestRetryDoesNotResendAfterConnectionLoss(t *testing.T) {
+	addr := startTestServer(t, nil, false)
+
+	conn := NewConnection(ConnectionParams{
+		ImapAddr:     addr,
+		ImapUsername: "username",
+		ImapPassword: "password",
+		Transport:    TransportConfig{Mode: TransportPlain},
+		Retry:        RetryConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+	})
+	assert.NoError(t, conn.Open())
+	defer conn.Close()
+
+	calls := 0
+	_, err := retryCommand(context.Background(), conn, false, func(data chan any) error {
+		defer close(data)
+		calls++
+		return fmt.Errorf("write: %w", syscall.ECONNRESET)
+	})
+	assert.ErrorIs(t, err, syscall.ECONNRESET)
+	assert.ErrorContains(t, err, "not sending it again")
+	assert.Equal(t, 1, calls)
+
+	// the connection was opened again for the next command
+	_, err = conn.Select(context.Background(), "INBOX", true)
+	assert.NoError(t, err)
+
+	// a connection lost before the command is opened again first
+	assert.NoError(t, conn.imapClient.Terminate())
+	<-conn.imapClient.LoggedOut()
+
+	err = conn.Append(context.Background(), "INBOX", nil, time.Now(), []byte("Subject: retried\r\n\r\nbody\r\n"))
+	assert.NoError(t, err)
+	status, err := conn.Status(context.Background(), "INBOX", []imap.StatusItem{imap.StatusMessages})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), status.Messages)
+}
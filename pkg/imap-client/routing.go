@@ -0,0 +1,72 @@
+package imap_client
+
+import (
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SelectAllMailboxes selects every mailbox when returned by SelectMailboxes
+const SelectAllMailboxes = "*"
+
+// routePlugins computes which plugins receive messages of which mailbox.
+// Plugins that do not implement SelectMailboxesPlugin receive all mailboxes.
+func routePlugins(plugins []HandleMessagePlugin, mailboxes []string) map[string][]HandleMessagePlugin {
+	routes := make(map[string][]HandleMessagePlugin, len(mailboxes))
+	for _, mailbox := range mailboxes {
+		routes[mailbox] = nil
+	}
+
+	for _, plugin := range plugins {
+		var patterns []string
+		if selectPlugin, ok := plugin.(SelectMailboxesPlugin); ok {
+			patterns = selectPlugin.SelectMailboxes()
+		} else {
+			patterns = []string{SelectAllMailboxes}
+		}
+
+		for _, mailbox := range mailboxes {
+			if matchMailboxPatterns(patterns, mailbox) {
+				routes[mailbox] = append(routes[mailbox], plugin)
+			}
+		}
+	}
+
+	for mailbox, plugins := range routes {
+		if len(plugins) == 0 {
+			log.WithField("mailbox", mailbox).Debug("mailbox not selected by any plugin")
+		}
+	}
+
+	return routes
+}
+
+func matchMailboxPatterns(patterns []string, mailbox string) bool {
+	for _, pattern := range patterns {
+		if matchMailbox(pattern, mailbox) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchMailbox matches a mailbox name against a pattern in which * matches
+// any sequence of characters. Other characters are matched literally.
+func matchMailbox(pattern string, mailbox string) bool {
+	prefix, rest, wildcard := strings.Cut(pattern, "*")
+	if !wildcard {
+		return pattern == mailbox
+	}
+
+	if !strings.HasPrefix(mailbox, prefix) {
+		return false
+	}
+	mailbox = mailbox[len(prefix):]
+
+	for i := 0; i <= len(mailbox); i++ {
+		if matchMailbox(rest, mailbox[i:]) {
+			return true
+		}
+	}
+	return false
+}
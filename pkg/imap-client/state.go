@@ -3,6 +3,8 @@ package imap_client
 import (
 	"encoding/json"
 	"io"
+
+	"github.com/emersion/go-imap"
 )
 
 type State struct {
@@ -37,8 +39,72 @@ func (s *State) ReadFrom(reader io.Reader) (int64, error) {
 }
 
 type MailboxState struct {
-	SavedLastUid     uint32 `json:"savedLastUid"`
-	SavedUidValidity uint32 `json:"savedUidValidity"`
+	SavedLastUid     uint32  `json:"savedLastUid"`
+	SavedUidValidity uint32  `json:"savedUidValidity"`
+	HighestModSeq    uint64  `json:"highestModSeq,omitempty"`
+	KnownUids        *UidSet `json:"knownUids,omitempty"`
+}
+
+// UidSet is a set of message uids serialized in IMAP sequence set notation
+type UidSet struct {
+	imap.SeqSet
+}
+
+func NewUidSet(uids ...uint32) *UidSet {
+	set := &UidSet{}
+	set.AddNum(uids...)
+	return set
+}
+
+// Count returns the number of uids in the set
+func (s *UidSet) Count() int {
+	count := 0
+	for _, seq := range s.Set {
+		count += int(seq.Stop-seq.Start) + 1
+	}
+	return count
+}
+
+// Remove removes all given uids from the set
+func (s *UidSet) Remove(uids ...uint32) {
+	removed := NewUidSet(uids...)
+	remaining := &UidSet{}
+	for _, uid := range expandSeqSet(&s.SeqSet) {
+		if !removed.Contains(uid) {
+			remaining.AddNum(uid)
+		}
+	}
+	s.Set = remaining.Set
+}
+
+// Difference returns all uids of s that are not in other
+func (s *UidSet) Difference(other *UidSet) []uint32 {
+	var result []uint32
+	for _, uid := range expandSeqSet(&s.SeqSet) {
+		if !other.Contains(uid) {
+			result = append(result, uid)
+		}
+	}
+	return result
+}
+
+func (s UidSet) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *UidSet) UnmarshalJSON(data []byte) error {
+	var str string
+	err := json.Unmarshal(data, &str)
+	if err != nil {
+		return err
+	}
+
+	s.Clear()
+	if str == "" {
+		return nil
+	}
+
+	return s.Add(str)
 }
 
 type MailboxStateCollection map[string]*MailboxState
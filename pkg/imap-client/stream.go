@@ -0,0 +1,227 @@
+package imap_client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/emersion/go-imap"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultMaxBatchBytes = 64 << 20
+const defaultMaxMessageBytes = 8 << 20
+
+// FetchHeaderItems are fetched for every message before the bodies. The size
+// decides how the body is fetched.
+var FetchHeaderItems = []imap.FetchItem{
+	imap.FetchUid,
+	imap.FetchEnvelope,
+	imap.FetchFlags,
+	imap.FetchInternalDate,
+	imap.FetchRFC822Size,
+}
+
+var fetchBodyItems = []imap.FetchItem{
+	imap.FetchUid,
+	FetchBodySection.FetchItem(),
+}
+
+// handleMessages fetches the bodies of messages (fetched with
+// FetchHeaderItems) and hands them to the plugins in order. The bodies of
+// messages up to maxMessageBytes are fetched together until maxBatchBytes is
+// reached. Larger bodies are only streamed to HandleMessageStreamPlugins in
+// chunks of maxMessageBytes.
+func (c *Client) handleMessages(ctx context.Context, mailbox string, messages []*imap.Message) error {
+	state := c.state.Mailboxes.Mailbox(mailbox)
+
+	for len(messages) > 0 {
+		group := c.nextBodyGroup(messages)
+		messages = messages[len(group):]
+
+		large := len(group) == 1 && c.isLarge(group[0])
+		var bodies map[uint32][]byte
+		if !large {
+			var err error
+			bodies, err = c.fetchBodies(ctx, group)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, msg := range group {
+			// keep the checkpoint of the handled messages on shutdown
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			if large {
+				// a body that could not be read is fetched again on the next run
+				err := c.handleLargeMessage(ctx, mailbox, msg)
+				if err != nil {
+					return err
+				}
+			} else if body, ok := bodies[msg.Uid]; ok {
+				c.handleMessage(mailbox, msg, body, nil)
+			} else {
+				log.WithFields(log.Fields{"mailbox": mailbox, "uid": msg.Uid}).Warn("message vanished before its body was fetched")
+			}
+
+			if msg.Uid > state.SavedLastUid {
+				state.SavedLastUid = msg.Uid
+			}
+		}
+	}
+
+	return nil
+}
+
+// nextBodyGroup returns the first messages whose bodies fit into the memory
+// ceiling. A large message is always a group of its own.
+func (c *Client) nextBodyGroup(messages []*imap.Message) []*imap.Message {
+	if c.isLarge(messages[0]) {
+		return messages[:1]
+	}
+
+	size := int64(0)
+	for i, msg := range messages {
+		if c.isLarge(msg) {
+			return messages[:i]
+		}
+
+		size += int64(msg.Size)
+		if i > 0 && size > c.maxBatchBytes {
+			return messages[:i]
+		}
+	}
+
+	return messages
+}
+
+func (c *Client) isLarge(message *imap.Message) bool {
+	return int64(message.Size) > c.maxMessageBytes
+}
+
+func (c *Client) fetchBodies(ctx context.Context, messages []*imap.Message) (map[uint32][]byte, error) {
+	seqset := new(imap.SeqSet)
+	for _, msg := range messages {
+		seqset.AddNum(msg.Uid)
+	}
+
+	bodyMessages, err := c.activeConnection.UidFetch(ctx, seqset, fetchBodyItems)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch message bodies: %w", err)
+	}
+
+	bodies := make(map[uint32][]byte, len(bodyMessages))
+	for _, msg := range bodyMessages {
+		body, err := literalBytes(msg.GetBody(&FetchBodySection))
+		if err != nil {
+			return nil, err
+		}
+		bodies[msg.Uid] = body
+	}
+
+	return bodies, nil
+}
+
+// handleLargeMessage streams the body to every HandleMessageStreamPlugin. The
+// other plugins only get the envelope. It returns the first error reading the
+// body, even if the plugins ignored it, or the error of ctx after the plugins
+// are done.
+func (c *Client) handleLargeMessage(ctx context.Context, mailbox string, message *imap.Message) error {
+	log.WithFields(log.Fields{"mailbox": mailbox, "uid": message.Uid, "size": message.Size}).Info("streaming large message")
+
+	var readErr error
+	c.handleMessage(mailbox, message, nil, func() io.Reader {
+		return &partialBodyReader{
+			ctx:       ctx,
+			conn:      c.activeConnection,
+			uid:       message.Uid,
+			chunkSize: c.maxMessageBytes,
+			failed:    &readErr,
+		}
+	})
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return readErr
+}
+
+// literalBytes returns the content of a literal without copying it if
+// possible
+func literalBytes(literal imap.Literal) ([]byte, error) {
+	if literal == nil {
+		return []byte{}, nil
+	}
+	if buffer, ok := literal.(*bytes.Buffer); ok {
+		return buffer.Bytes(), nil
+	}
+	return io.ReadAll(literal)
+}
+
+// partialBodyReader reads the body of a message with BODY.PEEK[]<offset.size>
+// requests of chunkSize bytes each
+type partialBodyReader struct {
+	ctx       context.Context
+	conn      *Connection
+	uid       uint32
+	chunkSize int64
+	offset    int64
+	chunk     []byte
+	eof       bool
+	// failed is set to the first error fetching a chunk if not nil
+	failed *error
+}
+
+func (r *partialBodyReader) Read(p []byte) (int, error) {
+	if len(r.chunk) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+
+		err := r.fetchChunk()
+		if err != nil {
+			if r.failed != nil && *r.failed == nil {
+				*r.failed = err
+			}
+			return 0, err
+		}
+		if len(r.chunk) == 0 {
+			return 0, io.EOF
+		}
+	}
+
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+func (r *partialBodyReader) fetchChunk() error {
+	section := &imap.BodySectionName{Peek: true, Partial: []int{int(r.offset), int(r.chunkSize)}}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(r.uid)
+	messages, err := r.conn.UidFetch(r.ctx, seqset, []imap.FetchItem{imap.FetchUid, section.FetchItem()})
+	if err != nil {
+		return fmt.Errorf("failed to fetch body of message %d at offset %d: %w", r.uid, r.offset, err)
+	}
+
+	for _, msg := range messages {
+		if msg.Uid != r.uid {
+			continue
+		}
+
+		r.chunk, err = literalBytes(msg.GetBody(section))
+		if err != nil {
+			return err
+		}
+		r.offset += int64(len(r.chunk))
+		r.eof = int64(len(r.chunk)) < r.chunkSize
+		return nil
+	}
+
+	return fmt.Errorf("message %d vanished while fetching its body", r.uid)
+}
@@ -0,0 +1,172 @@
+package imap_client
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-imap/client"
+)
+
+// Transport modes
+const (
+	TransportTLS      = "tls"
+	TransportStartTLS = "starttls"
+	TransportPlain    = "plain"
+)
+
+type TransportConfig struct {
+	// Mode is tls (default, implicit TLS on port 993), starttls or plain
+	Mode string `json:"mode" yaml:"mode"`
+	// CAFile is a PEM bundle used instead of the system roots
+	CAFile string `json:"caFile" yaml:"caFile"`
+	// ClientCertFile and ClientKeyFile are a PEM client certificate and key
+	ClientCertFile string `json:"clientCertFile" yaml:"clientCertFile"`
+	ClientKeyFile  string `json:"clientKeyFile" yaml:"clientKeyFile"`
+	// MinTLSVersion is 1.0, 1.1, 1.2 (default) or 1.3
+	MinTLSVersion string `json:"minTlsVersion" yaml:"minTlsVersion"`
+	// ServerName overrides the host name used for SNI and verification
+	ServerName string `json:"serverName" yaml:"serverName"`
+	// PinnedCertificates are SHA-256 fingerprints of certificates in hex
+	// (colons are ignored). One certificate of the server chain must match.
+	PinnedCertificates []string `json:"pinnedCertificates" yaml:"pinnedCertificates"`
+	// InsecureSkipVerify disables the chain verification. Pinned certificates
+	// are still checked.
+	InsecureSkipVerify bool `json:"insecureSkipVerify" yaml:"insecureSkipVerify"`
+}
+
+// dial connects to addr using the configured transport
+func (t TransportConfig) dial(addr string) (*client.Client, error) {
+	switch strings.ToLower(t.Mode) {
+	case "", TransportTLS:
+		tlsConfig, err := t.TLSConfig(addr)
+		if err != nil {
+			return nil, err
+		}
+		return client.DialTLS(addr, tlsConfig)
+	case TransportStartTLS:
+		tlsConfig, err := t.TLSConfig(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		imapClient, err := client.Dial(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		// never fall back to plaintext if STARTTLS is not offered
+		if ok, err := imapClient.SupportStartTLS(); err != nil || !ok {
+			imapClient.Terminate()
+			if err == nil {
+				err = errors.New("server does not support STARTTLS")
+			}
+			return nil, err
+		}
+
+		err = imapClient.StartTLS(tlsConfig)
+		if err != nil {
+			imapClient.Terminate()
+			return nil, err
+		}
+		return imapClient, nil
+	case TransportPlain:
+		return client.Dial(addr)
+	default:
+		return nil, fmt.Errorf("unknown transport mode %s", t.Mode)
+	}
+}
+
+// TLSConfig builds the tls.Config for a connection to addr
+func (t TransportConfig) TLSConfig(addr string) (*tls.Config, error) {
+	serverName := t.ServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		serverName = host
+	}
+
+	minVersion, err := parseTLSVersion(t.MinTLSVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		MinVersion:         minVersion,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+
+	if t.CAFile != "" {
+		caBundle, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca file: %w", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("no certificates found in ca file %s", t.CAFile)
+		}
+	}
+
+	if t.ClientCertFile != "" || t.ClientKeyFile != "" {
+		clientCert, err := tls.LoadX509KeyPair(t.ClientCertFile, t.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	if len(t.PinnedCertificates) > 0 {
+		pins := make(map[string]bool, len(t.PinnedCertificates))
+		for _, pin := range t.PinnedCertificates {
+			pins[normalizeFingerprint(pin)] = true
+		}
+
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, cert := range state.PeerCertificates {
+				if pins[CertificateFingerprint(cert)] {
+					return nil
+				}
+			}
+			return errors.New("server certificate does not match any pinned certificate")
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// CertificateFingerprint returns the SHA-256 fingerprint of the certificate in hex
+func CertificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", ""))
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "":
+		return tls.VersionTLS12, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unknown tls version %s", version)
+	}
+}
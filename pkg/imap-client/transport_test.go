@@ -0,0 +1,127 @@
+package imap_client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/stretchr/testify/assert"
+)
+
+// startTestServer starts an in-memory IMAP server with the user
+// username/password. If implicitTLS is false and tlsConfig is set the server
+// offers STARTTLS.
+func startTestServer(t *testing.T, tlsConfig *tls.Config, implicitTLS bool) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	if implicitTLS {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	imapServer := server.New(memory.New())
+	imapServer.AllowInsecureAuth = true
+	imapServer.TLSConfig = tlsConfig
+	go imapServer.Serve(listener)
+	t.Cleanup(func() { imapServer.Close() })
+
+	return listener.Addr().String()
+}
+
+// newTestCertificate creates a self-signed certificate for 127.0.0.1 and
+// writes it to a PEM file
+func newTestCertificate(t *testing.T) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "imap-mirror test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	caFile := path.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, caFile
+}
+
+func openTestConnection(addr string, transport TransportConfig) error {
+	conn := NewConnection(ConnectionParams{
+		ImapAddr:     addr,
+		ImapUsername: "username",
+		ImapPassword: "password",
+		Transport:    transport,
+	})
+	defer conn.Close()
+
+	return conn.Open()
+}
+
+func TestTransportTLS(t *testing.T) {
+	cert, caFile := newTestCertificate(t)
+	addr := startTestServer(t, &tls.Config{Certificates: []tls.Certificate{cert}}, true)
+
+	// self-signed certificate is not trusted by the system roots
+	assert.Error(t, openTestConnection(addr, TransportConfig{}))
+	assert.NoError(t, openTestConnection(addr, TransportConfig{CAFile: caFile, MinTLSVersion: "1.3"}))
+}
+
+func TestTransportStartTLS(t *testing.T) {
+	cert, caFile := newTestCertificate(t)
+	addr := startTestServer(t, &tls.Config{Certificates: []tls.Certificate{cert}}, false)
+
+	assert.NoError(t, openTestConnection(addr, TransportConfig{Mode: TransportStartTLS, CAFile: caFile}))
+
+	plainAddr := startTestServer(t, nil, false)
+	assert.ErrorContains(t, openTestConnection(plainAddr, TransportConfig{Mode: TransportStartTLS, CAFile: caFile}), "STARTTLS")
+	assert.NoError(t, openTestConnection(plainAddr, TransportConfig{Mode: TransportPlain}))
+}
+
+func TestTransportPinnedCertificate(t *testing.T) {
+	cert, _ := newTestCertificate(t)
+	addr := startTestServer(t, &tls.Config{Certificates: []tls.Certificate{cert}}, true)
+
+	fingerprint := CertificateFingerprint(cert.Leaf)
+	assert.NoError(t, openTestConnection(addr, TransportConfig{
+		InsecureSkipVerify: true,
+		PinnedCertificates: []string{fingerprint},
+	}))
+
+	otherCert, _ := newTestCertificate(t)
+	assert.ErrorContains(t, openTestConnection(addr, TransportConfig{
+		InsecureSkipVerify: true,
+		PinnedCertificates: []string{CertificateFingerprint(otherCert.Leaf)},
+	}), "pinned")
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	version, err := parseTLSVersion("")
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), version)
+
+	_, err = parseTLSVersion("2.0")
+	assert.Error(t, err)
+}
@@ -0,0 +1,159 @@
+package imap_client
+
+import (
+	"context"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+	log "github.com/sirupsen/logrus"
+)
+
+const watchEventBufferSize = 256
+
+// watch starts watching the configured mailboxes and reports the name of
+// every changed mailbox to events. A single NOTIFY session is used if the
+// server supports it, otherwise one IDLE connection per mailbox. The watchers
+// stop when ctx is done.
+func (c *Client) watch(ctx context.Context, events chan<- string) {
+	if len(c.idleConnections) == 0 {
+		log.Error("no idle connection open. not watching any mailbox")
+		return
+	}
+
+	first := c.idleConnections[0]
+	if ok, err := first.Support(CapNotify); err == nil && ok {
+		log.WithField("mailboxes", c.watchMailboxes).Info("watching mailboxes with NOTIFY")
+		c.watchers.Add(1)
+		go c.notifyLoop(ctx, first, c.watchMailboxes, events)
+		return
+	}
+
+	for i, mailbox := range c.watchMailboxes {
+		conn := first
+		if i > 0 {
+			conn = NewConnection(c.idleParams)
+			c.idleConnections = append(c.idleConnections, conn)
+			if err := conn.Open(); err != nil {
+				log.WithError(err).WithField("mailbox", mailbox).Error("failed to open idle connection")
+			}
+		}
+
+		log.WithField("mailbox", mailbox).Info("watching mailbox with IDLE")
+		c.watchers.Add(1)
+		go c.idleLoop(ctx, conn, mailbox, events)
+	}
+}
+
+func (c *Client) idleLoop(ctx context.Context, conn *Connection, mailbox string, events chan<- string) {
+	defer c.watchers.Done()
+
+	failures := 0
+	for ctx.Err() == nil {
+		if !conn.IsOpen() {
+			failures++
+			c.reopen(ctx, conn, failures)
+			continue
+		}
+
+		err := c.waitForMailboxUpdate(ctx, conn, mailbox)
+		if ctx.Err() != nil {
+			return
+		} else if err != nil {
+			failures++
+			log.WithError(err).WithField("mailbox", mailbox).Error("failed to wait for mailbox update")
+			c.reopen(ctx, conn, failures)
+			continue
+		}
+
+		failures = 0
+		sendEvent(events, mailbox)
+	}
+}
+
+func (c *Client) notifyLoop(ctx context.Context, conn *Connection, mailboxes []string, events chan<- string) {
+	defer c.watchers.Done()
+
+	failures := 0
+	for ctx.Err() == nil {
+		if !conn.IsOpen() {
+			failures++
+			c.reopen(ctx, conn, failures)
+			continue
+		}
+
+		err := conn.Notify(ctx, mailboxes)
+		if err == nil {
+			failures = 0
+			err = conn.IdleNotify(ctx, func(mailbox string) {
+				log.WithField("mailbox", mailbox).Info("mailbox updated")
+				sendEvent(events, mailbox)
+			})
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		failures++
+		log.WithError(err).Error("failed to wait for notifications")
+		c.reopen(ctx, conn, failures)
+	}
+}
+
+// reopen waits with exponential backoff depending on the number of
+// consecutive failures and opens the connection again
+func (c *Client) reopen(ctx context.Context, conn *Connection, failures int) {
+	backoff := c.idleParams.Retry.Backoff(failures)
+	log.Infof("reopening idle connection in %s", backoff)
+	if sleepContext(ctx, backoff) != nil {
+		return
+	}
+	retryMetrics.Add("idleReconnects", 1)
+
+	conn.Close()
+	if err := conn.Open(); err != nil {
+		log.WithError(err).Error("failed to reopen idle connection")
+	}
+}
+
+func sendEvent(events chan<- string, mailbox string) {
+	select {
+	case events <- mailbox:
+	default:
+		log.WithField("mailbox", mailbox).Warn("too many pending mailbox updates. dropping update")
+	}
+}
+
+func (c *Client) waitForMailboxUpdate(ctx context.Context, conn *Connection, mailbox string) error {
+	const logoutTimeout = 1 * time.Minute
+
+	log.WithField("mailbox", mailbox).Info("waiting for mailbox update")
+	defer log.WithField("mailbox", mailbox).Info("mailbox updated")
+
+	_, err := conn.Select(ctx, mailbox, true)
+	if err != nil {
+		return err
+	}
+
+	updateChan := make(chan client.Update, 16)
+	conn.SetUpdates(updateChan)
+	defer func() {
+		conn.SetUpdates(nil)
+		close(updateChan)
+	}()
+
+	stopChan := make(chan struct{})
+	go func() {
+		defer close(stopChan)
+
+		for update := range updateChan {
+			switch update.(type) {
+			case *client.MailboxUpdate, *client.ExpungeUpdate, *client.MessageUpdate:
+				return
+			default:
+				continue
+			}
+		}
+	}()
+
+	return conn.Idle(ctx, stopChan, &client.IdleOptions{LogoutTimeout: logoutTimeout})
+}
@@ -1,7 +1,9 @@
 package imap_filter
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"slices"
 	"sync"
 
@@ -12,11 +14,14 @@ import (
 )
 
 type FilterClient struct {
-	filters    []Filter
-	client     *imap_client.Connection
-	closeChan  chan struct{}
-	closedWg   *sync.WaitGroup
-	applyTasks chan struct {
+	filters     []Filter
+	client      *imap_client.Connection
+	closed      bool
+	closedLock  sync.RWMutex
+	applyerDone chan struct{}
+	movesCtx    context.Context
+	cancelMoves context.CancelFunc
+	applyTasks  chan struct {
 		srcMailbox  string
 		msguid      uint32
 		destMailbox string
@@ -38,10 +43,12 @@ func NewFilterClient(filters ...Filter) *FilterClient {
 		filters = append(filters[:i], filters[i+1:]...)
 	}
 
+	movesCtx, cancelMoves := context.WithCancel(context.Background())
 	fc := &FilterClient{
-		filters:   filters,
-		closeChan: make(chan struct{}),
-		closedWg:  &sync.WaitGroup{},
+		filters:     filters,
+		applyerDone: make(chan struct{}),
+		movesCtx:    movesCtx,
+		cancelMoves: cancelMoves,
 		applyTasks: make(chan struct {
 			srcMailbox  string
 			msguid      uint32
@@ -49,41 +56,69 @@ func NewFilterClient(filters ...Filter) *FilterClient {
 		}, 1024),
 	}
 
-	fc.closedWg.Add(1)
 	go fc.filterApplyer()
 	return fc
 }
 
-func (f *FilterClient) Close() {
-	close(f.closeChan)
-	f.closedWg.Wait()
+func (f *FilterClient) Close() error {
+	return f.Shutdown(context.Background())
+}
+
+// Shutdown stops accepting messages and applies the queued moves until ctx
+// is done. Moves that are still queued then are dropped.
+func (f *FilterClient) Shutdown(ctx context.Context) error {
+	f.closedLock.Lock()
+	if !f.closed {
+		f.closed = true
+		close(f.applyTasks)
+	}
+	f.closedLock.Unlock()
+
+	if pending := len(f.applyTasks); pending > 0 {
+		log.Infof("applying %d pending moves", pending)
+	}
+
+	select {
+	case <-f.applyerDone:
+		return nil
+	case <-ctx.Done():
+		f.cancelMoves()
+		<-f.applyerDone
+		return fmt.Errorf("failed to apply pending moves: %w", ctx.Err())
+	}
 }
 
 func (f *FilterClient) filterApplyer() {
-	for {
-		select {
-		case <-f.closeChan:
-			f.closedWg.Done()
-			return
-		case task := <-f.applyTasks:
-			mb := f.client.Mailbox()
-			if mb.Name != task.srcMailbox {
-				_, err := f.client.Select(task.srcMailbox, false)
-				if err != nil {
-					log.WithError(err).Errorf("failed to select mailbox %s", task.srcMailbox)
-					continue
-				}
-			}
+	defer close(f.applyerDone)
+
+	dropped := 0
+	for task := range f.applyTasks {
+		if f.movesCtx.Err() != nil || f.client == nil {
+			dropped++
+			continue
+		}
 
-			msgSeq := new(imap.SeqSet)
-			msgSeq.AddNum(task.msguid)
-			log.Infof("moving message %d from %s to %s", task.msguid, task.srcMailbox, task.destMailbox)
-			err := f.client.UidMove(msgSeq, task.destMailbox)
+		mb := f.client.Mailbox()
+		if mb == nil || mb.Name != task.srcMailbox {
+			_, err := f.client.Select(f.movesCtx, task.srcMailbox, false)
 			if err != nil {
-				log.WithError(err).Error("failed to move message")
+				log.WithError(err).Errorf("failed to select mailbox %s", task.srcMailbox)
 				continue
 			}
 		}
+
+		msgSeq := new(imap.SeqSet)
+		msgSeq.AddNum(task.msguid)
+		log.Infof("moving message %d from %s to %s", task.msguid, task.srcMailbox, task.destMailbox)
+		err := f.client.UidMove(f.movesCtx, msgSeq, task.destMailbox)
+		if err != nil {
+			log.WithError(err).Error("failed to move message")
+			continue
+		}
+	}
+
+	if dropped > 0 {
+		log.Warnf("dropped %d pending moves", dropped)
 	}
 }
 
@@ -103,8 +138,10 @@ func (f *FilterClient) SelectMailboxes() []string {
 func (f *FilterClient) HandleMessage(mailbox string, message *imap.Message) {
 	result := f.FilterImap(mailbox, message)
 	if result != FilterResultAccept {
-
-		f.applyResultToMessage(result, mailbox, message.Uid)
+		err := f.applyResultToMessage(result, mailbox, message.Uid)
+		if err != nil {
+			log.WithError(err).Errorf("failed to apply filter result to message %d", message.Uid)
+		}
 	}
 }
 
@@ -120,6 +157,12 @@ func (f *FilterClient) applyResultToMessage(filterResult FilterResult, mailbox s
 	msgSeq := new(imap.SeqSet)
 	msgSeq.AddNum(message)
 
+	f.closedLock.RLock()
+	defer f.closedLock.RUnlock()
+	if f.closed {
+		return errors.New("filter client is closed")
+	}
+
 	if filterResult.Kind == FilterResultKindDelete {
 		f.applyTasks <- struct {
 			srcMailbox  string
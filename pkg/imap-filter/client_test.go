@@ -0,0 +1,23 @@
+package imap_filter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterClientShutdownDrainsMoves(t *testing.T) {
+	client := NewFilterClient()
+
+	// without a connection the queued moves are dropped, but not lost silently
+	assert.NoError(t, client.applyResultToMessage(FilterResult{Kind: FilterResultKindMove, Target: "Archive"}, "INBOX", 1))
+	assert.NoError(t, client.Shutdown(context.Background()))
+	assert.Equal(t, 0, len(client.applyTasks))
+
+	err := client.applyResultToMessage(FilterResult{Kind: FilterResultKindMove, Target: "Archive"}, "INBOX", 2)
+	assert.Error(t, err)
+
+	// shutting down twice is fine
+	assert.NoError(t, client.Close())
+}
@@ -7,6 +7,7 @@ import (
 	"slices"
 	"time"
 
+	imap_client "github.com/Schidstorm/imap-mirror/pkg/imap-client"
 	log "github.com/sirupsen/logrus"
 	lua "github.com/yuin/gopher-lua"
 )
@@ -160,6 +161,8 @@ func (f *LuaFilter) SelectMailboxes() []string {
 	for _, l := range f.luaStates {
 		err := checkFuncExistance(l, selectMailboxesFunctionName)
 		if err != nil {
+			// scripts without SelectMailboxes filter every mailbox
+			resultMap[imap_client.SelectAllMailboxes] = struct{}{}
 			continue
 		}
 
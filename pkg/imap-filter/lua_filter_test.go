@@ -131,3 +131,42 @@ func TestFilterFilterReal(t *testing.T) {
 
 	filter.Close()
 }
+
+func TestFilterSelectMailboxes(t *testing.T) {
+	scripts := map[string]string{
+		"scripts/a.lua": `
+		function SelectMailboxes()
+			return { "INBOX", "INBOX.Rechnungen" }
+		end
+
+		function Filter(mail, mailbox)
+			return true
+		end
+		`,
+	}
+
+	filter := NewLuaFilter(LuaFilterConfig{ScriptsDir: "scripts"}, func(d string) ([]string, error) {
+		return []string{"scripts/a.lua"}, nil
+	}, func(file string) (string, error) {
+		return scripts[file], nil
+	})
+
+	assert.NoError(t, filter.Init())
+	assert.ElementsMatch(t, []string{"INBOX", "INBOX.Rechnungen"}, filter.SelectMailboxes())
+	filter.Close()
+
+	scripts["scripts/a.lua"] = `
+		function Filter(mail, mailbox)
+			return true
+		end
+		`
+	filter = NewLuaFilter(LuaFilterConfig{ScriptsDir: "scripts"}, func(d string) ([]string, error) {
+		return []string{"scripts/a.lua"}, nil
+	}, func(file string) (string, error) {
+		return scripts[file], nil
+	})
+
+	assert.NoError(t, filter.Init())
+	assert.Equal(t, []string{"*"}, filter.SelectMailboxes())
+	filter.Close()
+}
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"context"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+func init() {
+	Register("file", openLocal)
+}
+
+// LocalFS is a directory of the local file system
+type LocalFS struct {
+	root string
+}
+
+// NewLocalFS returns the file system below root
+func NewLocalFS(root string) *LocalFS {
+	return &LocalFS{root: root}
+}
+
+// openLocal opens file:///abs/dir and file://./rel/dir
+func openLocal(_ context.Context, u *url.URL, _ Config) (FS, error) {
+	root := path.Join(u.Host, u.Path)
+	if root == "" {
+		root = "."
+	}
+	return NewLocalFS(filepath.FromSlash(root)), nil
+}
+
+func (l *LocalFS) path(name string) string {
+	return filepath.Join(l.root, filepath.FromSlash(name))
+}
+
+func (l *LocalFS) Open(name string) (fs.File, error) {
+	return os.Open(l.path(name))
+}
+
+func (l *LocalFS) OpenFile(name string, flag int, perm os.FileMode) (fs.File, error) {
+	return os.OpenFile(l.path(name), flag, perm)
+}
+
+func (l *LocalFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return os.WriteFile(l.path(name), data, perm)
+}
+
+func (l *LocalFS) MkdirAll(name string, perm os.FileMode) error {
+	return os.MkdirAll(l.path(name), perm)
+}
+
+func (l *LocalFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return os.Chtimes(l.path(name), atime, mtime)
+}
+
+func (l *LocalFS) Rename(oldpath, newpath string) error {
+	return os.Rename(l.path(oldpath), l.path(newpath))
+}
+
+func (l *LocalFS) Remove(name string) error {
+	return os.Remove(l.path(name))
+}
+
+func (l *LocalFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(l.path(name))
+}
+
+func (l *LocalFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(l.path(name))
+}
+
+func (l *LocalFS) Close() error {
+	return nil
+}
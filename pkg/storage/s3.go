@@ -0,0 +1,630 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hack-pad/hackpadfs"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const (
+	defaultS3Endpoint = "s3.amazonaws.com"
+	// mtimeMetadata keeps the modification time, which S3 does not let
+	// clients set. minio-go returns it canonicalized.
+	mtimeMetadata          = "mtime"
+	mtimeMetadataCanonical = "Mtime"
+	noSuchKey              = "NoSuchKey"
+)
+
+func init() {
+	Register("s3", openS3)
+}
+
+// S3Config configures s3:// URLs
+type S3Config struct {
+	// Endpoint is host:port of the S3 API, s3.amazonaws.com by default
+	Endpoint string `json:"endpoint" yaml:"endpoint"`
+	Region   string `json:"region" yaml:"region"`
+	// AccessKeyID and SecretAccessKey default to the user and password of the
+	// URL
+	AccessKeyID     string `json:"accessKeyId" yaml:"accessKeyId"`
+	SecretAccessKey string `json:"secretAccessKey" yaml:"secretAccessKey"`
+	// Insecure talks plain HTTP, for example to a local MinIO
+	Insecure bool `json:"insecure" yaml:"insecure"`
+	// PathStyle addresses buckets by path instead of by host name
+	PathStyle bool `json:"pathStyle" yaml:"pathStyle"`
+}
+
+// S3FS is a prefix of an S3 bucket. Directories are implicit in the keys,
+// MkdirAll stores empty "dir/" markers so that empty directories exist.
+// Modification times are kept in the metadata of the objects. Files opened for
+// writing are buffered in a temporary file and uploaded on Sync and Close.
+//
+// Objects cannot be appended to. Opening a file with O_APPEND downloads the
+// whole object and Close uploads it again, so appending to a file costs its
+// full size in both directions. The backup appends one short line per message
+// to the metadata and CAS manifest of a mailbox, each of these appends uploads
+// the whole file, which grows with the number of messages in the mailbox. The
+// mbox format, which appends every message to one large file, is refused, see
+// AppendsInPlace.
+type S3FS struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3FS returns the keys below prefix in bucket
+func NewS3FS(client *minio.Client, bucket string, prefix string) *S3FS {
+	return &S3FS{client: client, bucket: bucket, prefix: strings.Trim(path.Clean("/"+prefix), "/")}
+}
+
+// openS3 opens s3://accessKey:secretKey@bucket/prefix
+func openS3(_ context.Context, u *url.URL, cfg Config) (FS, error) {
+	bucket := u.Hostname()
+	if bucket == "" {
+		return nil, fmt.Errorf("s3 url %s has no bucket", u.Redacted())
+	}
+
+	accessKey, secretKey := cfg.S3.AccessKeyID, cfg.S3.SecretAccessKey
+	if accessKey == "" {
+		accessKey = username(u)
+	}
+	if secretKey == "" {
+		secretKey = password(u, cfg)
+	}
+
+	endpoint := cfg.S3.Endpoint
+	if endpoint == "" {
+		endpoint = defaultS3Endpoint
+	}
+
+	bucketLookup := minio.BucketLookupAuto
+	if cfg.S3.PathStyle {
+		bucketLookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure:       !cfg.S3.Insecure,
+		Region:       cfg.S3.Region,
+		BucketLookup: bucketLookup,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewS3FS(client, bucket, u.Path), nil
+}
+
+// key returns the object key of name, "" for the root
+func (s *S3FS) key(name string) string {
+	key := path.Join(s.prefix, name)
+	if key == "." {
+		return ""
+	}
+	return strings.Trim(key, "/")
+}
+
+// dirPrefix returns the prefix of the keys in the directory with key
+func dirPrefix(key string) string {
+	if key == "" {
+		return ""
+	}
+	return key + "/"
+}
+
+func (s *S3FS) Open(name string) (fs.File, error) {
+	return s.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (s *S3FS) OpenFile(name string, flag int, perm os.FileMode) (fs.File, error) {
+	info, err := s.Stat(name)
+	exists := err == nil
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		if !exists {
+			return nil, err
+		}
+		if info.IsDir() {
+			return &s3Dir{fs: s, name: name, info: info}, nil
+		}
+
+		object, err := s.client.GetObject(context.Background(), s.bucket, s.key(name), minio.GetObjectOptions{})
+		if err != nil {
+			return nil, s3Error("open", name, err)
+		}
+		return &s3Reader{Object: object, info: info}, nil
+	}
+
+	switch {
+	case !exists && flag&os.O_CREATE == 0:
+		return nil, err
+	case exists && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case exists && info.IsDir():
+		return nil, &fs.PathError{Op: "open", Path: name, Err: hackpadfs.ErrIsDir}
+	}
+
+	tmp, err := os.CreateTemp("", "s3-upload-*")
+	if err != nil {
+		return nil, err
+	}
+
+	file := &s3Writer{fs: s, name: name, tmp: tmp, append: flag&os.O_APPEND != 0, dirty: !exists || flag&os.O_TRUNC != 0}
+	if !file.dirty {
+		err = file.download()
+		if err != nil {
+			file.discard()
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+func (s *S3FS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return s.put(name, bytes.NewReader(data), int64(len(data)))
+}
+
+// put uploads the content of name with the current time as modification time
+func (s *S3FS) put(name string, r io.Reader, size int64) error {
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.key(name), r, size, minio.PutObjectOptions{
+		UserMetadata: map[string]string{mtimeMetadata: time.Now().UTC().Format(time.RFC3339Nano)},
+	})
+	return s3Error("write", name, err)
+}
+
+func (s *S3FS) MkdirAll(name string, perm os.FileMode) error {
+	info, err := s.Stat(name)
+	switch {
+	case err == nil && info.IsDir():
+		return nil
+	case err == nil:
+		return &fs.PathError{Op: "mkdir", Path: name, Err: hackpadfs.ErrNotDir}
+	case !errors.Is(err, fs.ErrNotExist):
+		return err
+	}
+
+	_, err = s.client.PutObject(context.Background(), s.bucket, dirPrefix(s.key(name)), bytes.NewReader(nil), 0, minio.PutObjectOptions{})
+	return s3Error("mkdir", name, err)
+}
+
+// Chtimes sets the modification time of a file by copying the object onto
+// itself with new metadata. Directories have no modification time.
+func (s *S3FS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	info, err := s.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+
+	key := s.key(name)
+	_, err = s.client.CopyObject(context.Background(), minio.CopyDestOptions{
+		Bucket:          s.bucket,
+		Object:          key,
+		ReplaceMetadata: true,
+		UserMetadata:    map[string]string{mtimeMetadata: mtime.UTC().Format(time.RFC3339Nano)},
+	}, minio.CopySrcOptions{Bucket: s.bucket, Object: key})
+	return s3Error("chtimes", name, err)
+}
+
+// Rename copies the objects of oldpath to newpath and removes them. It
+// replaces newpath if it is a file but is not atomic.
+func (s *S3FS) Rename(oldpath, newpath string) error {
+	info, err := s.Stat(oldpath)
+	if err != nil {
+		return err
+	}
+
+	oldKey, newKey := s.key(oldpath), s.key(newpath)
+	if !info.IsDir() {
+		return s3Error("rename", oldpath, s.move(oldKey, newKey))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for object := range s.list(ctx, dirPrefix(oldKey), true) {
+		if object.Err != nil {
+			return s3Error("rename", oldpath, object.Err)
+		}
+		err := s.move(object.Key, dirPrefix(newKey)+strings.TrimPrefix(object.Key, dirPrefix(oldKey)))
+		if err != nil {
+			return s3Error("rename", oldpath, err)
+		}
+	}
+	return nil
+}
+
+func (s *S3FS) move(oldKey, newKey string) error {
+	ctx := context.Background()
+	_, err := s.client.CopyObject(ctx, minio.CopyDestOptions{Bucket: s.bucket, Object: newKey}, minio.CopySrcOptions{Bucket: s.bucket, Object: oldKey})
+	if err != nil {
+		return err
+	}
+	return s.client.RemoveObject(ctx, s.bucket, oldKey, minio.RemoveObjectOptions{})
+}
+
+// Remove removes a file or an empty directory. S3 does not report missing
+// keys, Remove stats them first.
+func (s *S3FS) Remove(name string) error {
+	info, err := s.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	key := s.key(name)
+	if info.IsDir() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		for object := range s.list(ctx, dirPrefix(key), true) {
+			if object.Err != nil {
+				return s3Error("remove", name, object.Err)
+			}
+			if object.Key != dirPrefix(key) {
+				return &fs.PathError{Op: "remove", Path: name, Err: hackpadfs.ErrNotEmpty}
+			}
+		}
+		key = dirPrefix(key)
+	}
+
+	err = s.client.RemoveObject(context.Background(), s.bucket, key, minio.RemoveObjectOptions{})
+	return s3Error("remove", name, err)
+}
+
+func (s *S3FS) Stat(name string) (fs.FileInfo, error) {
+	key := s.key(name)
+	if key == "" {
+		return &s3FileInfo{name: ".", dir: true}, nil
+	}
+
+	object, err := s.client.StatObject(context.Background(), s.bucket, key, minio.StatObjectOptions{})
+	if err == nil {
+		return objectInfo(path.Base(key), object), nil
+	}
+	if minio.ToErrorResponse(err).Code != noSuchKey {
+		return nil, s3Error("stat", name, err)
+	}
+
+	// directories exist as long as there are keys below them
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for object := range s.list(ctx, dirPrefix(key), true) {
+		if object.Err != nil {
+			return nil, s3Error("stat", name, object.Err)
+		}
+		return &s3FileInfo{name: path.Base(key), dir: true}, nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (s *S3FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: hackpadfs.ErrNotDir}
+	}
+
+	prefix := dirPrefix(s.key(name))
+	var entries []fs.DirEntry
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for object := range s.list(ctx, prefix, false) {
+		if object.Err != nil {
+			return nil, s3Error("readdir", name, object.Err)
+		}
+		if object.Key == prefix {
+			// the marker of the directory itself
+			continue
+		}
+
+		base := strings.TrimPrefix(object.Key, prefix)
+		dir := strings.HasSuffix(base, "/")
+		base = strings.TrimSuffix(base, "/")
+		entries = append(entries, &s3DirEntry{fs: s, name: path.Join(name, base), base: base, dir: dir})
+	}
+
+	// S3 lists keys sorted, but "a/" sorts after "a.b" while fs.ReadDirFS
+	// sorts by name
+	sortDirEntries(entries)
+	return entries, nil
+}
+
+// list lists the keys below prefix, recursive lists the keys of
+// subdirectories instead of their prefixes. Callers that stop reading early
+// cancel ctx to end the listing.
+func (s *S3FS) list(ctx context.Context, prefix string, recursive bool) <-chan minio.ObjectInfo {
+	return s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: recursive})
+}
+
+func (s *S3FS) Close() error {
+	return nil
+}
+
+// s3Error turns missing keys into fs.ErrNotExist
+func s3Error(op string, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if minio.ToErrorResponse(err).Code == noSuchKey {
+		err = fs.ErrNotExist
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+func objectInfo(name string, object minio.ObjectInfo) *s3FileInfo {
+	modTime := object.LastModified
+	if mtime, err := time.Parse(time.RFC3339Nano, object.UserMetadata[mtimeMetadataCanonical]); err == nil {
+		modTime = mtime
+	}
+	return &s3FileInfo{name: name, size: object.Size, modTime: modTime}
+}
+
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i *s3FileInfo) Name() string       { return i.name }
+func (i *s3FileInfo) Size() int64        { return i.size }
+func (i *s3FileInfo) ModTime() time.Time { return i.modTime }
+func (i *s3FileInfo) IsDir() bool        { return i.dir }
+func (i *s3FileInfo) Sys() any           { return nil }
+
+func (i *s3FileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o755
+	}
+	return 0o644
+}
+
+// s3DirEntry stats files only when asked for their info, listings do not
+// return the metadata with the modification time
+type s3DirEntry struct {
+	fs   *S3FS
+	name string
+	base string
+	dir  bool
+}
+
+func (e *s3DirEntry) Name() string { return e.base }
+func (e *s3DirEntry) IsDir() bool  { return e.dir }
+
+func (e *s3DirEntry) Type() fs.FileMode {
+	if e.dir {
+		return fs.ModeDir
+	}
+	return 0
+}
+
+func (e *s3DirEntry) Info() (fs.FileInfo, error) {
+	if e.dir {
+		return &s3FileInfo{name: e.base, dir: true}, nil
+	}
+	return e.fs.Stat(e.name)
+}
+
+// s3Reader is a file opened for reading, the object is downloaded while it is
+// read
+type s3Reader struct {
+	*minio.Object
+	info fs.FileInfo
+}
+
+func (r *s3Reader) Stat() (fs.FileInfo, error) {
+	return r.info, nil
+}
+
+func (r *s3Reader) Read(b []byte) (int, error) {
+	n, err := r.Object.Read(b)
+	if err != nil && err != io.EOF {
+		return n, s3Error("read", r.info.Name(), err)
+	}
+	return n, err
+}
+
+// s3Dir is a directory opened with Open
+type s3Dir struct {
+	fs      *S3FS
+	name    string
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *s3Dir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *s3Dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: hackpadfs.ErrIsDir}
+}
+
+func (d *s3Dir) Close() error {
+	return nil
+}
+
+func (d *s3Dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.fs.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.read = entries, true
+	}
+
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+// s3Writer is a file opened for writing. Its content is kept in a temporary
+// file and uploaded as a whole by Sync and Close.
+type s3Writer struct {
+	fs     *S3FS
+	name   string
+	append bool
+
+	lock   sync.Mutex
+	tmp    *os.File
+	dirty  bool
+	closed bool
+}
+
+// download copies the object into the temporary file
+func (w *s3Writer) download() error {
+	object, err := w.fs.client.GetObject(context.Background(), w.fs.bucket, w.fs.key(w.name), minio.GetObjectOptions{})
+	if err != nil {
+		return s3Error("open", w.name, err)
+	}
+	defer object.Close()
+
+	_, err = io.Copy(w.tmp, object)
+	if err != nil {
+		return s3Error("open", w.name, err)
+	}
+	_, err = w.tmp.Seek(0, io.SeekStart)
+	return err
+}
+
+// upload stores the temporary file as the object. The caller holds the lock.
+func (w *s3Writer) upload() error {
+	info, err := w.tmp.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = w.fs.put(w.name, io.NewSectionReader(w.tmp, 0, info.Size()), info.Size())
+	if err != nil {
+		return err
+	}
+	w.dirty = false
+	return nil
+}
+
+func (w *s3Writer) discard() {
+	w.tmp.Close()
+	os.Remove(w.tmp.Name())
+}
+
+func (w *s3Writer) Read(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed {
+		return 0, fs.ErrClosed
+	}
+	return w.tmp.Read(b)
+}
+
+func (w *s3Writer) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed {
+		return 0, fs.ErrClosed
+	}
+	if w.append {
+		_, err := w.tmp.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	w.dirty = true
+	return w.tmp.Write(b)
+}
+
+func (w *s3Writer) Seek(offset int64, whence int) (int64, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed {
+		return 0, fs.ErrClosed
+	}
+	return w.tmp.Seek(offset, whence)
+}
+
+func (w *s3Writer) Truncate(size int64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed {
+		return fs.ErrClosed
+	}
+
+	w.dirty = true
+	return w.tmp.Truncate(size)
+}
+
+func (w *s3Writer) Stat() (fs.FileInfo, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed {
+		return nil, fs.ErrClosed
+	}
+
+	info, err := w.tmp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &s3FileInfo{name: path.Base(w.name), size: info.Size(), modTime: info.ModTime()}, nil
+}
+
+func (w *s3Writer) Sync() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed {
+		return fs.ErrClosed
+	}
+	if !w.dirty {
+		return nil
+	}
+	return w.upload()
+}
+
+func (w *s3Writer) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed {
+		return fs.ErrClosed
+	}
+	w.closed = true
+	defer w.discard()
+
+	if !w.dirty {
+		return nil
+	}
+	return w.upload()
+}
@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/stretchr/testify/require"
+)
+
+const testBucket = "backup"
+
+// fakeS3 serves the part of the S3 API the backend uses from memory. It
+// stands in for MinIO in tests without a server.
+type fakeS3 struct {
+	lock    sync.Mutex
+	objects map[string]fakeObject
+}
+
+type fakeObject struct {
+	data     []byte
+	metadata http.Header
+	modTime  time.Time
+}
+
+func (o fakeObject) etag() string {
+	sum := md5.Sum(o.data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+type listBucketResult struct {
+	XMLName        xml.Name `xml:"ListBucketResult"`
+	Name           string
+	Prefix         string
+	KeyCount       int
+	MaxKeys        int
+	IsTruncated    bool
+	Contents       []listedObject
+	CommonPrefixes []commonPrefix
+}
+
+type listedObject struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+}
+
+type commonPrefix struct {
+	Prefix string
+}
+
+type copyObjectResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	LastModified string
+	ETag         string
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != testBucket {
+		s.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, r)
+	case r.Method == http.MethodHead, r.Method == http.MethodGet:
+		object, ok := s.objects[key]
+		if !ok {
+			s.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		for name, values := range object.metadata {
+			w.Header()[name] = values
+		}
+		w.Header().Set("ETag", object.etag())
+		http.ServeContent(w, r, "", object.modTime, bytes.NewReader(object.data))
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		s.copy(w, r, key)
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			s.error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		object := fakeObject{data: data, metadata: userMetadata(r.Header), modTime: time.Now()}
+		s.objects[key] = object
+		w.Header().Set("ETag", object.etag())
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+
+	result := listBucketResult{Name: testBucket, Prefix: prefix, MaxKeys: 1000}
+	prefixes := map[string]bool{}
+	var keys []string
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				common := key[:len(prefix)+i+len(delimiter)]
+				if !prefixes[common] {
+					prefixes[common] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: common})
+				}
+				continue
+			}
+		}
+
+		object := s.objects[key]
+		result.Contents = append(result.Contents, listedObject{
+			Key:          key,
+			LastModified: object.modTime.UTC().Format(time.RFC3339),
+			ETag:         object.etag(),
+			Size:         int64(len(object.data)),
+		})
+	}
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+
+	s.writeXML(w, result)
+}
+
+func (s *fakeS3) copy(w http.ResponseWriter, r *http.Request, key string) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		s.error(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	_, sourceKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+
+	object, ok := s.objects[sourceKey]
+	if !ok {
+		s.error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+
+	copied := fakeObject{data: object.data, metadata: object.metadata, modTime: time.Now()}
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		copied.metadata = userMetadata(r.Header)
+	}
+	s.objects[key] = copied
+
+	s.writeXML(w, copyObjectResult{LastModified: copied.modTime.UTC().Format(time.RFC3339), ETag: copied.etag()})
+}
+
+func (s *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (s *fakeS3) writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+func userMetadata(header http.Header) http.Header {
+	metadata := http.Header{}
+	for name, values := range header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") {
+			metadata[name] = values
+		}
+	}
+	return metadata
+}
+
+// newFakeS3FS returns a file system on a fresh fake S3 server
+func newFakeS3FS(t *testing.T) FS {
+	server := httptest.NewTLSServer(&fakeS3{objects: map[string]fakeObject{}})
+	t.Cleanup(server.Close)
+
+	client, err := minio.New(strings.TrimPrefix(server.URL, "https://"), &minio.Options{
+		Creds:        credentials.NewStaticV4("access", "secret", ""),
+		Secure:       true,
+		Region:       "us-east-1",
+		BucketLookup: minio.BucketLookupPath,
+		Transport:    server.Client().Transport,
+	})
+	require.NoError(t, err)
+	return NewS3FS(client, testBucket, "/prefix/")
+}
+
+func TestS3FSContract(t *testing.T) {
+	runContract(t, newFakeS3FS)
+}
+
+func TestS3FSKeys(t *testing.T) {
+	fsys := newFakeS3FS(t).(*S3FS)
+
+	require.Equal(t, "prefix/INBOX/1.eml", fsys.key("INBOX/1.eml"))
+	require.Equal(t, "prefix", fsys.key("."))
+	require.Equal(t, "", NewS3FS(nil, testBucket, "").key("."))
+}
+
+// TestS3URLContract runs against the MinIO or S3 bucket in S3_TEST_URL, e.g.
+// s3://minioadmin:minioadmin@backup/test with S3_TEST_ENDPOINT=localhost:9000
+// for a local MinIO over plain HTTP
+func TestS3URLContract(t *testing.T) {
+	rawURL := os.Getenv("S3_TEST_URL")
+	if rawURL == "" {
+		t.Skip("S3_TEST_URL is not set")
+	}
+
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	runContract(t, func(t *testing.T) FS {
+		return openTestDir(t, Config{
+			URL: rawURL,
+			S3: S3Config{
+				Endpoint:  endpoint,
+				Region:    os.Getenv("S3_TEST_REGION"),
+				Insecure:  endpoint != "",
+				PathStyle: endpoint != "",
+			},
+		})
+	})
+}
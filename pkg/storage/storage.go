@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/Schidstorm/imap-mirror/pkg/cifs"
+	"github.com/hack-pad/hackpadfs"
+)
+
+// FS is the file system of a storage backend. It satisfies imap_client.FS
+// and imap_backup.FS, Close releases the connection of the backend.
+type FS interface {
+	hackpadfs.FS
+	hackpadfs.OpenFileFS
+	hackpadfs.WriteFileFS
+	hackpadfs.MkdirAllFS
+	hackpadfs.ChtimesFS
+	hackpadfs.RenameFS
+	hackpadfs.RemoveFS
+	hackpadfs.StatFS
+	hackpadfs.ReadDirFS
+	io.Closer
+}
+
+// Config selects the storage backend by the scheme of URL:
+//
+//	file:///srv/backup
+//	smb://user@nas.example.com:445/share/dir
+//	sftp://user@host.example.com:22/srv/backup
+//	s3://bucket/prefix
+//
+// The path of the URL is the root of the file system. Passwords may be part
+// of the URL or set in Password.
+type Config struct {
+	URL      string `json:"url" yaml:"url"`
+	Password string `json:"password" yaml:"password"`
+
+	Cifs CifsConfig `json:"cifs" yaml:"cifs"`
+	SFTP SFTPConfig `json:"sftp" yaml:"sftp"`
+	S3   S3Config   `json:"s3" yaml:"s3"`
+}
+
+// Backend opens the file system of u
+type Backend func(ctx context.Context, u *url.URL, cfg Config) (FS, error)
+
+var (
+	backendsLock sync.RWMutex
+	backends     = map[string]Backend{}
+)
+
+// Register makes backend available for URLs with scheme. Registering a scheme
+// twice replaces its backend.
+func Register(scheme string, backend Backend) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+
+	backends[scheme] = backend
+}
+
+// Schemes returns the registered schemes sorted by name
+func Schemes() []string {
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+
+	schemes := make([]string, 0, len(backends))
+	for scheme := range backends {
+		schemes = append(schemes, scheme)
+	}
+	slices.Sort(schemes)
+	return schemes
+}
+
+// Open opens the file system of cfg.URL with the backend of its scheme
+func Open(ctx context.Context, cfg Config) (FS, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage url: %w", err)
+	}
+
+	backendsLock.RLock()
+	backend, ok := backends[u.Scheme]
+	backendsLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown storage scheme %q, known are %v", u.Scheme, Schemes())
+	}
+
+	return backend(ctx, u, cfg)
+}
+
+// OpenOrCifs opens the file system of cfg.URL. Configs without a URL use the
+// SMB share of cifsConfig, which is how the storage was configured before
+// URLs were introduced.
+func OpenOrCifs(ctx context.Context, cfg Config, cifsConfig cifs.Config) (FS, error) {
+	if cfg.URL == "" {
+		return cifs.OpenCifsShare(ctx, cifsConfig)
+	}
+	return Open(ctx, cfg)
+}
+
+// AllowsColons reports whether file names on the storage that OpenOrCifs
+// opens for cfg may contain colons. SMB uses them to name alternate data
+// streams.
+func AllowsColons(cfg Config) bool {
+	if cfg.URL == "" {
+		return false
+	}
+
+	u, err := url.Parse(cfg.URL)
+	return err != nil || u.Scheme != "smb"
+}
+
+// AppendsInPlace reports whether the storage that OpenOrCifs opens for cfg
+// appends to files without rewriting them. S3 objects cannot be appended to,
+// every append downloads and uploads the whole object.
+func AppendsInPlace(cfg Config) bool {
+	u, err := url.Parse(cfg.URL)
+	return cfg.URL == "" || err != nil || u.Scheme != "s3"
+}
+
+// password returns the password of the URL or the one of the config
+func password(u *url.URL, cfg Config) string {
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			return password
+		}
+	}
+	return cfg.Password
+}
+
+// username returns the user of the URL
+func username(u *url.URL) string {
+	if u.User == nil {
+		return ""
+	}
+	return u.User.Username()
+}
+
+// sortDirEntries sorts entries by name as fs.ReadDirFS requires
+func sortDirEntries(entries []fs.DirEntry) {
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+}
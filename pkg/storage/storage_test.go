@@ -0,0 +1,264 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	imap_backup "github.com/Schidstorm/imap-mirror/pkg/imap-backup"
+	imapclient "github.com/Schidstorm/imap-mirror/pkg/imap-client"
+	"github.com/Schidstorm/imap-mirror/pkg/imap-client/fstest"
+	"github.com/emersion/go-imap"
+	"github.com/hack-pad/hackpadfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	_ imapclient.FS  = FS(nil)
+	_ imap_backup.FS = FS(nil)
+)
+
+// runContract runs the contract of imap_client.FS and the parts of the
+// backup contract that are specific to storage backends
+func runContract(t *testing.T, newFS func(t *testing.T) FS) {
+	fstest.Run(t, func(t *testing.T) (imapclient.FS, string) {
+		return newFS(t), ""
+	})
+
+	tests := []struct {
+		name string
+		test func(t *testing.T, fsys FS)
+	}{
+		{"ChtimesSetsModTime", testChtimesSetsModTime},
+		{"ReadDirLists", testReadDirLists},
+		{"MkdirAllCreatesEmptyDir", testMkdirAllCreatesEmptyDir},
+		{"RemoveFileAndEmptyDir", testRemoveFileAndEmptyDir},
+		{"AppendKeepsContent", testAppendKeepsContent},
+		{"MaildirStoreWithoutColons", testMaildirStoreWithoutColons},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, newFS(t))
+		})
+	}
+}
+
+func testChtimesSetsModTime(t *testing.T, fsys FS) {
+	require.NoError(t, fsys.WriteFile("message.eml", []byte("body"), 0644))
+
+	mtime := time.Date(2020, 5, 17, 10, 30, 0, 0, time.UTC)
+	require.NoError(t, fsys.Chtimes("message.eml", mtime, mtime))
+
+	info, err := fsys.Stat("message.eml")
+	require.NoError(t, err)
+	assert.True(t, mtime.Equal(info.ModTime()), "mtime is %s", info.ModTime())
+	assert.Equal(t, int64(4), info.Size())
+
+	entries, err := fsys.ReadDir(".")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	info, err = entries[0].Info()
+	require.NoError(t, err)
+	assert.True(t, mtime.Equal(info.ModTime()), "listed mtime is %s", info.ModTime())
+}
+
+func testReadDirLists(t *testing.T, fsys FS) {
+	require.NoError(t, fsys.MkdirAll("INBOX/sub", 0755))
+	require.NoError(t, fsys.WriteFile("INBOX/b.eml", []byte("b"), 0644))
+	require.NoError(t, fsys.WriteFile("INBOX/a.eml", []byte("a"), 0644))
+	require.NoError(t, fsys.WriteFile("INBOX/sub/c.eml", []byte("c"), 0644))
+	require.NoError(t, fsys.WriteFile("INBOX.eml", []byte("x"), 0644))
+
+	entries, err := fsys.ReadDir("INBOX")
+	require.NoError(t, err)
+
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"a.eml", "b.eml", "sub"}, names)
+	assert.True(t, entries[2].IsDir())
+
+	var files []string
+	err = hackpadfs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			files = append(files, name)
+		}
+		return err
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"INBOX/a.eml", "INBOX/b.eml", "INBOX/sub/c.eml", "INBOX.eml"}, files)
+
+	_, err = fsys.ReadDir("missing")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func testMkdirAllCreatesEmptyDir(t *testing.T, fsys FS) {
+	require.NoError(t, fsys.MkdirAll("a/b", 0755))
+
+	info, err := fsys.Stat("a/b")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+
+	entries, err := fsys.ReadDir("a/b")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func testRemoveFileAndEmptyDir(t *testing.T, fsys FS) {
+	require.NoError(t, fsys.MkdirAll("dir", 0755))
+	require.NoError(t, fsys.WriteFile("dir/file", []byte("x"), 0644))
+
+	assert.Error(t, fsys.Remove("dir"))
+	require.NoError(t, fsys.Remove("dir/file"))
+	require.NoError(t, fsys.Remove("dir"))
+
+	_, err := fsys.Stat("dir")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.ErrorIs(t, fsys.Remove("dir"), fs.ErrNotExist)
+}
+
+func testAppendKeepsContent(t *testing.T, fsys FS) {
+	require.NoError(t, fsys.WriteFile("audit.jsonl", []byte("one\n"), 0644))
+
+	file, err := fsys.OpenFile("audit.jsonl", os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	require.NoError(t, err)
+	_, err = file.(io.Writer).Write([]byte("two\n"))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	content, err := hackpadfs.ReadFile(fsys, "audit.jsonl")
+	require.NoError(t, err)
+	assert.Equal(t, "one\ntwo\n", string(content))
+}
+
+// testMaildirStoreWithoutColons writes a Maildir backup with the names used
+// on storages without colons and reads it back
+func testMaildirStoreWithoutColons(t *testing.T, fsys FS) {
+	cfg, err := imap_backup.Config{BackupDir: "backup", Format: imap_backup.FormatMaildir}.WithoutColons()
+	require.NoError(t, err)
+	backup, err := imap_backup.NewImapBackup(fsys, cfg)
+	require.NoError(t, err)
+	backup.HandleUidValidity("INBOX", 1)
+
+	message := &imap.Message{
+		Uid:      1,
+		Flags:    []string{imap.SeenFlag},
+		Envelope: &imap.Envelope{Subject: "hello", MessageId: "<1@example.com>", Date: time.Now()},
+		Body: map[*imap.BodySectionName]imap.Literal{
+			&imap_backup.FetchBodySection: strings.NewReader("Subject: hello\r\n\r\nbody\r\n"),
+		},
+	}
+	require.NoError(t, backup.SaveMessage("INBOX", message, fsys, "backup"))
+	message.Flags = []string{imap.SeenFlag, imap.FlaggedFlag}
+	backup.HandleFlags("INBOX", message)
+
+	entries, err := fsys.ReadDir("backup/INBOX/cur")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.True(t, strings.HasSuffix(entries[0].Name(), "!2,FS"), "name is %s", entries[0].Name())
+
+	var bodies []string
+	err = imap_backup.WalkBackup(fsys, "backup", func(message imap_backup.BackupMessage, body io.Reader) error {
+		content, err := io.ReadAll(body)
+		bodies = append(bodies, string(content))
+		assert.ElementsMatch(t, []string{imap.SeenFlag, imap.FlaggedFlag}, message.Flags)
+		return err
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Subject: hello\r\n\r\nbody\r\n"}, bodies)
+}
+
+// smbNamesFS refuses the file names that SMB shares do not allow, so that
+// the contract shows which names would fail on a share
+type smbNamesFS struct {
+	FS
+}
+
+func (f smbNamesFS) check(op string, name string) error {
+	if strings.ContainsAny(name, `\:*?"<>|`) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return nil
+}
+
+func (f smbNamesFS) OpenFile(name string, flag int, perm os.FileMode) (fs.File, error) {
+	if err := f.check("open", name); err != nil {
+		return nil, err
+	}
+	return f.FS.OpenFile(name, flag, perm)
+}
+
+func (f smbNamesFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	if err := f.check("write", name); err != nil {
+		return err
+	}
+	return f.FS.WriteFile(name, data, perm)
+}
+
+func (f smbNamesFS) MkdirAll(name string, perm os.FileMode) error {
+	if err := f.check("mkdir", name); err != nil {
+		return err
+	}
+	return f.FS.MkdirAll(name, perm)
+}
+
+func (f smbNamesFS) Rename(oldpath, newpath string) error {
+	if err := f.check("rename", newpath); err != nil {
+		return err
+	}
+	return f.FS.Rename(oldpath, newpath)
+}
+
+func TestSMBNamesContract(t *testing.T) {
+	runContract(t, func(t *testing.T) FS {
+		return smbNamesFS{NewLocalFS(t.TempDir())}
+	})
+}
+
+func TestAllowsColons(t *testing.T) {
+	assert.False(t, AllowsColons(Config{}))
+	assert.False(t, AllowsColons(Config{URL: "smb://nas/share"}))
+	assert.True(t, AllowsColons(Config{URL: "file:///srv/backup"}))
+	assert.True(t, AllowsColons(Config{URL: "s3://bucket/prefix"}))
+}
+
+func TestAppendsInPlace(t *testing.T) {
+	assert.True(t, AppendsInPlace(Config{}))
+	assert.True(t, AppendsInPlace(Config{URL: "sftp://host/srv/backup"}))
+	assert.False(t, AppendsInPlace(Config{URL: "s3://bucket/prefix"}))
+}
+
+func TestLocalFSContract(t *testing.T) {
+	runContract(t, func(t *testing.T) FS {
+		return NewLocalFS(t.TempDir())
+	})
+}
+
+func TestOpenFileURL(t *testing.T) {
+	dir := t.TempDir()
+
+	fsys, err := Open(context.Background(), Config{URL: "file://" + filepath.ToSlash(dir)})
+	require.NoError(t, err)
+	defer fsys.Close()
+
+	require.NoError(t, fsys.MkdirAll("email/INBOX", 0755))
+	require.NoError(t, fsys.WriteFile("email/INBOX/1.eml", []byte("body"), 0644))
+
+	content, err := os.ReadFile(filepath.Join(dir, "email", "INBOX", "1.eml"))
+	require.NoError(t, err)
+	assert.Equal(t, "body", string(content))
+}
+
+func TestOpenUnknownScheme(t *testing.T) {
+	_, err := Open(context.Background(), Config{URL: "ftp://host/dir"})
+	assert.ErrorContains(t, err, `unknown storage scheme "ftp"`)
+
+	assert.Equal(t, []string{"file", "s3", "sftp", "smb"}, Schemes())
+}
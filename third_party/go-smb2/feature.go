@@ -0,0 +1,25 @@
+package smb2
+
+import (
+	. "github.com/hirochachacha/go-smb2/internal/smb2"
+)
+
+// client
+
+const (
+	clientCapabilities = SMB2_GLOBAL_CAP_LARGE_MTU | SMB2_GLOBAL_CAP_ENCRYPTION
+)
+
+var (
+	clientHashAlgorithms = []uint16{SHA512}
+	clientCiphers        = []uint16{AES128GCM, AES128CCM}
+	clientDialects       = []uint16{SMB311, SMB302, SMB300, SMB210, SMB202}
+)
+
+const (
+	clientMaxCreditBalance = 128
+)
+
+const (
+	clientMaxSymlinkDepth = 8
+)
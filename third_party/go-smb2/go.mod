@@ -0,0 +1,8 @@
+module github.com/hirochachacha/go-smb2
+
+go 1.12
+
+require (
+	github.com/geoffgarside/ber v1.1.0
+	golang.org/x/crypto v0.0.0-20200728195943-123391ffb6de
+)